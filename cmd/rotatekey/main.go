@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"SecureSignIn/db"
+	"SecureSignIn/utils"
+)
+
+func main() {
+	// Define command-line flags
+	var (
+		dbPath     = flag.String("db", "", "Path to SQLite database file (default: data/securesignin.db)")
+		keyPath    = flag.String("key", "", "Path to the current encryption key (default: "+db.DefaultEncryptionKeyPath+")")
+		newKeyPath = flag.String("new-key", "", "Path to a new 32-byte key to rotate to (default: generate a random key)")
+		skipBackup = flag.Bool("no-backup", false, "Skip the database backup before rotating")
+		verbose    = flag.Bool("verbose", false, "Enable verbose output")
+	)
+
+	// Parse flags
+	flag.Parse()
+
+	// Set default paths if not provided
+	if *dbPath == "" {
+		*dbPath = filepath.Join("data", "securesignin.db")
+	}
+	if *keyPath == "" {
+		*keyPath = db.EncryptionKeyPath()
+	}
+
+	// Check that the database and current key exist
+	if _, err := os.Stat(*dbPath); os.IsNotExist(err) {
+		log.Fatalf("Database file not found at %s", *dbPath)
+	}
+	if _, err := db.ReadEncryptionKey(*keyPath); err != nil {
+		log.Fatalf("Failed to read current encryption key: %v", err)
+	}
+
+	// Load or generate the new key
+	var newKey []byte
+	var err error
+	if *newKeyPath != "" {
+		newKey, err = db.ReadEncryptionKey(*newKeyPath)
+		if err != nil {
+			log.Fatalf("Failed to read new encryption key: %v", err)
+		}
+	} else {
+		newKey, err = db.NewEncryptionKey()
+		if err != nil {
+			log.Fatalf("Failed to generate new encryption key: %v", err)
+		}
+		if *verbose {
+			log.Printf("Generated new encryption key")
+		}
+	}
+
+	// Back up the database before rewriting any rows
+	if !*skipBackup {
+		backupPath, err := utils.BackupDatabase(*dbPath)
+		if err != nil {
+			log.Fatalf("Backup failed: %v", err)
+		}
+		fmt.Printf("✅ Database backup created at %s\n", backupPath)
+	}
+
+	// Open the database with the current key
+	os.Setenv("SQLITE_DB_PATH", *dbPath)
+	os.Setenv("ENCRYPTION_KEY_PATH", *keyPath)
+	if err := db.InitializeDB(); err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.DB.Close()
+
+	// Re-encrypt every row and replace the key file before committing. The
+	// old key is put back if the commit fails, as the rows are still under it.
+	oldKeyBackup := *keyPath + ".old"
+	restoreOldKey := func() error {
+		return os.Rename(oldKeyBackup, *keyPath)
+	}
+	count, err := db.RotateEncryptionKey(newKey, func() error {
+		if err := os.Rename(*keyPath, oldKeyBackup); err != nil {
+			return err
+		}
+		if err := os.WriteFile(*keyPath, newKey, 0600); err != nil {
+			// Put the old key back so it still matches the database
+			restoreOldKey()
+			return err
+		}
+		return nil
+	}, restoreOldKey)
+	if err != nil {
+		log.Fatalf("Key rotation failed: %v", err)
+	}
+
+	fmt.Printf("✅ Re-encrypted %d rows under the new key\n", count)
+	fmt.Printf("The new key is at %s and the previous key was kept at %s.\n", *keyPath, oldKeyBackup)
+	fmt.Println("\nKey rotation complete. Remove the previous key once you have verified the application starts correctly.")
+}
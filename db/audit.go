@@ -0,0 +1,323 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Entity types recorded in the audit log
+const (
+	AuditUser      = "user"
+	AuditRole      = "role"
+	AuditVehicle   = "vehicle"
+	AuditTrip      = "trip"
+	AuditBooking   = "booking"
+	AuditPolicy    = "policy"
+	AuditFare      = "fare"
+	AuditPayment   = "payment"
+	AuditSchedule  = "schedule"
+	AuditStation   = "station"
+	AuditRoute     = "route"
+	AuditWaitlist  = "waitlist"
+	AuditPassenger = "passenger"
+)
+
+// Actions recorded for the changes the app makes by itself, the same as
+// handlers records for users
+const (
+	auditActionCreate = "create"
+	auditActionUpdate = "update"
+)
+
+// auditSystemActor is recorded as the actor of changes made by background jobs
+const auditSystemActor = "system"
+
+// auditEntities maps each entity type that can be snapshotted to its table and
+// the columns recorded in the audit log. Secrets and encrypted personal data
+// are deliberately left out.
+var auditEntities = map[string]struct {
+	table   string
+	columns []string
+}{
+	AuditUser:      {"users", []string{"id", "username", "email", "role", "created_at", "locked_until", "totp_enabled", "must_change_password", "password_changed_at"}},
+	AuditRole:      {"roles", []string{"id", "name", "description", "dashboard", "built_in"}},
+	AuditVehicle:   {"vehicles", []string{"id", "vehicle_number", "type", "capacity", "status", "last_maintenance_date", "next_maintenance_date", "notes", "seat_columns", "aisle_after", "seat_letters"}},
+	AuditTrip:      {"trips", []string{"id", "origin", "destination", "vehicle_id", "departure_time", "arrival_time", "schedule_id", "route_id"}},
+	AuditSchedule:  {"schedules", []string{"id", "origin", "destination", "departure_time", "duration_minutes", "days_of_week", "valid_from", "valid_to", "vehicle_id", "active", "route_id"}},
+	AuditStation:   {"stations", []string{"id", "code", "name", "city", "latitude", "longitude", "timezone"}},
+	AuditBooking:   {"bookings", []string{"id", "trip_id", "passenger", "passenger_id", "phone_number", "booking_date", "status", "seat_number", "fare_id", "fare_category", "price_cents", "cancelled_at", "refund_percent", "refund_cents", "refund_overridden", "cancellation_reason", "reference", "boarded_at", "boarded_by", "boarding_stop", "alighting_stop"}},
+	AuditFare:      {"fares", []string{"id", "origin", "destination", "base_fare_cents", "valid_from", "valid_to"}},
+	AuditPayment:   {"payments", []string{"id", "booking_id", "amount_cents", "method", "cashier_username", "reference", "created_at"}},
+	AuditPassenger: {"passengers", []string{"id", "name", "phone_number", "created_at", "updated_at"}},
+	AuditWaitlist:  {"waitlist", []string{"id", "trip_id", "passenger", "phone_number", "boarding_stop", "alighting_stop", "priority", "status", "created_at", "created_by", "offered_at", "hold_expires_at", "booking_id"}},
+}
+
+// AuditEntry is one recorded data-changing action.
+type AuditEntry struct {
+	ID            int64           `json:"id"`
+	CreatedAt     time.Time       `json:"created_at"`
+	ActorID       int64           `json:"actor_id"`
+	ActorUsername string          `json:"actor_username"`
+	Action        string          `json:"action"`
+	EntityType    string          `json:"entity_type"`
+	EntityID      int64           `json:"entity_id"`
+	Before        json.RawMessage `json:"before"`
+	After         json.RawMessage `json:"after"`
+	IPAddress     string          `json:"ip_address"`
+	RequestID     string          `json:"request_id"`
+}
+
+// AuditFilter narrows down audit log queries. Empty fields match everything.
+type AuditFilter struct {
+	Actor      string
+	Action     string
+	EntityType string
+	EntityID   int64
+	From       string // YYYY-MM-DD, inclusive
+	To         string // YYYY-MM-DD, inclusive
+}
+
+// Snapshot returns the audited columns of an entity as they are now, for use
+// as the before or after state of an audit entry. It returns nil if the
+// entity does not exist or its type is not snapshotted.
+func Snapshot(entityType string, id int64) (map[string]interface{}, error) {
+	return snapshot(DB, entityType, id)
+}
+
+// snapshot is Snapshot read through q, so it can be taken inside a transaction
+func snapshot(q queryer, entityType string, id int64) (map[string]interface{}, error) {
+	entity, ok := auditEntities[entityType]
+	if !ok {
+		return nil, nil
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", strings.Join(entity.columns, ", "), entity.table)
+	values := make([]interface{}, len(entity.columns))
+	pointers := make([]interface{}, len(entity.columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	if err := q.QueryRow(query, id).Scan(pointers...); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading %s %d for audit: %w", entityType, id, err)
+	}
+
+	snapshot := make(map[string]interface{}, len(entity.columns))
+	for i, col := range entity.columns {
+		if b, ok := values[i].([]byte); ok {
+			snapshot[col] = string(b)
+		} else {
+			snapshot[col] = values[i]
+		}
+	}
+
+	// A role is mostly its permissions, which live in their own table
+	if entityType == AuditRole {
+		perms, err := rolePermissionNames(q, id)
+		if err != nil {
+			return nil, err
+		}
+		snapshot["permissions"] = perms
+	}
+	return snapshot, nil
+}
+
+// rolePermissionNames returns the sorted permissions granted to a role
+func rolePermissionNames(q queryer, roleID int64) ([]string, error) {
+	rows, err := q.Query("SELECT permission FROM role_permissions WHERE role_id = ? ORDER BY permission", roleID)
+	if err != nil {
+		return nil, fmt.Errorf("error reading permissions of role %d for audit: %w", roleID, err)
+	}
+	defer rows.Close()
+
+	perms := []string{}
+	for rows.Next() {
+		var perm string
+		if err := rows.Scan(&perm); err != nil {
+			return nil, fmt.Errorf("error reading role permission: %w", err)
+		}
+		perms = append(perms, perm)
+	}
+	return perms, rows.Err()
+}
+
+// RecordAudit writes an entry to the audit log. Before and After are
+// marshalled to JSON; nil means the entity did not exist on that side.
+func RecordAudit(entry AuditEntry, before, after interface{}) error {
+	beforeJSON, err := auditJSON(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := auditJSON(after)
+	if err != nil {
+		return err
+	}
+
+	var actorID sql.NullInt64
+	if entry.ActorID > 0 {
+		actorID = sql.NullInt64{Int64: entry.ActorID, Valid: true}
+	}
+	var entityID sql.NullInt64
+	if entry.EntityID > 0 {
+		entityID = sql.NullInt64{Int64: entry.EntityID, Valid: true}
+	}
+
+	_, err = DB.Exec(`
+		INSERT INTO audit_log (created_at, actor_id, actor_username, action, entity_type, entity_id,
+			before_json, after_json, ip_address, request_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, sqlTime(time.Now()), actorID, entry.ActorUsername, entry.Action, entry.EntityType, entityID,
+		beforeJSON, afterJSON, entry.IPAddress, entry.RequestID)
+	if err != nil {
+		return fmt.Errorf("error recording audit entry %s %s: %w", entry.Action, entry.EntityType, err)
+	}
+	return nil
+}
+
+// systemChange is a change made by a background job rather than a user,
+// recorded in the audit log once the job's transaction has committed
+type systemChange struct {
+	action     string
+	entityType string
+	entityID   int64
+	before     map[string]interface{}
+}
+
+// updateChange takes the state of an entity before a background job updates
+// it within tx
+func updateChange(tx *sql.Tx, entityType string, id int64) (systemChange, error) {
+	before, err := snapshot(tx, entityType, id)
+	return systemChange{action: auditActionUpdate, entityType: entityType, entityID: id, before: before}, err
+}
+
+// createChange is an entity a background job has created
+func createChange(entityType string, id int64) systemChange {
+	return systemChange{action: auditActionCreate, entityType: entityType, entityID: id}
+}
+
+// offerChanges are the bookings made and waitlist entries updated by waitlist offers
+func offerChanges(offers []WaitlistOffer) []systemChange {
+	var changes []systemChange
+	for _, o := range offers {
+		changes = append(changes, createChange(AuditBooking, o.BookingID), systemChange{action: auditActionUpdate, entityType: AuditWaitlist, entityID: o.EntryID})
+	}
+	return changes
+}
+
+// auditSystemChanges records the changes of a background job in the audit
+// log, made by the system user (actor ID 0), with each entity as it is now as
+// the after state. Failing to write an entry is logged, since the changes
+// have already been made.
+func auditSystemChanges(changes []systemChange) {
+	for _, ch := range changes {
+		after, err := Snapshot(ch.entityType, ch.entityID)
+		if err != nil {
+			log.Printf("Error taking audit snapshot: %v", err)
+		}
+		entry := AuditEntry{ActorUsername: auditSystemActor, Action: ch.action, EntityType: ch.entityType, EntityID: ch.entityID}
+		if err := RecordAudit(entry, ch.before, after); err != nil {
+			log.Printf("Error writing audit entry for %s %s %d: %v", ch.action, ch.entityType, ch.entityID, err)
+		}
+	}
+}
+
+// auditJSON marshals one side of an audit entry, keeping nil as SQL NULL
+func auditJSON(v interface{}) (sql.NullString, error) {
+	if v == nil {
+		return sql.NullString{}, nil
+	}
+	if m, ok := v.(map[string]interface{}); ok && m == nil {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("error encoding audit state: %w", err)
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+// auditWhere builds the WHERE clause and arguments for an audit filter
+func auditWhere(f AuditFilter) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	if f.Actor != "" {
+		conds = append(conds, "actor_username LIKE ?")
+		args = append(args, "%"+f.Actor+"%")
+	}
+	if f.Action != "" {
+		conds = append(conds, "action = ?")
+		args = append(args, f.Action)
+	}
+	if f.EntityType != "" {
+		conds = append(conds, "entity_type = ?")
+		args = append(args, f.EntityType)
+	}
+	if f.EntityID > 0 {
+		conds = append(conds, "entity_id = ?")
+		args = append(args, f.EntityID)
+	}
+	if f.From != "" {
+		conds = append(conds, "DATE(created_at) >= DATE(?)")
+		args = append(args, f.From)
+	}
+	if f.To != "" {
+		conds = append(conds, "DATE(created_at) <= DATE(?)")
+		args = append(args, f.To)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// GetAuditLog returns the audit entries matching a filter, newest first, along
+// with the total number of matches. A limit of 0 returns every match.
+func GetAuditLog(f AuditFilter, limit, offset int) ([]AuditEntry, int, error) {
+	where, args := auditWhere(f)
+
+	var total int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM audit_log"+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("error counting audit entries: %w", err)
+	}
+
+	query := `
+		SELECT id, created_at, COALESCE(actor_id, 0), COALESCE(actor_username, ''), action, entity_type,
+			COALESCE(entity_id, 0), before_json, after_json, COALESCE(ip_address, ''), COALESCE(request_id, '')
+		FROM audit_log` + where + " ORDER BY id DESC"
+	if limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, offset)
+	}
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error retrieving audit entries: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var before, after sql.NullString
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.ActorID, &e.ActorUsername, &e.Action, &e.EntityType,
+			&e.EntityID, &before, &after, &e.IPAddress, &e.RequestID); err != nil {
+			return nil, 0, fmt.Errorf("error reading audit entry: %w", err)
+		}
+		if before.Valid {
+			e.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			e.After = json.RawMessage(after.String)
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error reading audit entries: %w", err)
+	}
+	return entries, total, nil
+}
@@ -0,0 +1,261 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"SecureSignIn/utils"
+)
+
+// BoardingPolicy sets when passengers can board a trip. Boarding opens
+// OpensBefore the trip leaves the passenger's boarding stop and closes
+// ClosesAfter it, when confirmed bookings that have not boarded become no-shows.
+type BoardingPolicy struct {
+	OpensBefore time.Duration
+	ClosesAfter time.Duration
+}
+
+// Boarding is the active boarding policy, configurable through the environment.
+var Boarding = LoadBoardingPolicy()
+
+// LoadBoardingPolicy reads the boarding window from the environment.
+func LoadBoardingPolicy() BoardingPolicy {
+	return BoardingPolicy{
+		OpensBefore: utils.GetEnvDuration("BOARDING_OPENS_BEFORE", 2*time.Hour),
+		ClosesAfter: utils.GetEnvDuration("BOARDING_CLOSES_AFTER", 15*time.Minute),
+	}
+}
+
+var (
+	// ErrWrongTrip is returned when a ticket is scanned for a different trip than the one boarding
+	ErrWrongTrip = errors.New("ticket is for another trip")
+	// ErrTicketOutdated is returned when a ticket no longer matches its booking, e.g. after a seat change
+	ErrTicketOutdated = errors.New("ticket has been replaced by a newer print")
+	// ErrBoardingNotOpen is returned when scanning a ticket before boarding opens
+	ErrBoardingNotOpen = errors.New("boarding has not opened for this trip")
+	// ErrBoardingClosed is returned when scanning a ticket after boarding has closed
+	ErrBoardingClosed = errors.New("boarding has closed for this trip")
+	// ErrAlreadyBoarded is returned when a ticket is scanned a second time
+	ErrAlreadyBoarded = errors.New("passenger has already boarded")
+	// ErrNotBoardable is returned for bookings that are not confirmed
+	ErrNotBoardable = errors.New("booking is not confirmed")
+)
+
+// BoardingPass is the booking a scanned ticket belongs to, as shown to the
+// operator at the door. Origin and Destination are where the passenger boards
+// and alights, and DepartureTime is when the trip leaves the boarding stop.
+type BoardingPass struct {
+	BookingID     int64     `json:"booking_id"`
+	Reference     string    `json:"reference"`
+	Passenger     string    `json:"passenger"`
+	TripID        int64     `json:"trip_id"`
+	Origin        string    `json:"origin"`
+	Destination   string    `json:"destination"`
+	DepartureTime string    `json:"departure_time"`
+	SeatNumber    string    `json:"seat_number"`
+	Status        string    `json:"status"`
+	BoardedAt     time.Time `json:"boarded_at"`
+	BoardedBy     string    `json:"boarded_by"`
+}
+
+// BoardTicket verifies a scanned ticket payload and marks its booking Boarded
+// by the given operator. If tripID is not 0 the ticket must be for that trip.
+// Boarding is only possible within the boarding window and once per booking;
+// for a duplicate scan the returned pass says when and by whom the passenger
+// boarded, along with ErrAlreadyBoarded.
+func BoardTicket(payload string, tripID, operatorID int64, operatorUsername string) (*BoardingPass, error) {
+	claims, err := VerifyTicket(payload)
+	if err != nil {
+		return nil, err
+	}
+	if tripID != 0 && claims.TripID != tripID {
+		return nil, ErrWrongTrip
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	pass := &BoardingPass{BookingID: claims.BookingID}
+	var reference sql.NullString
+	var boardedAt sql.NullTime
+	var boardedBy sql.NullString
+	err = tx.QueryRow(`
+		SELECT b.reference, b.passenger, b.trip_id, `+boardingStationSQL+`, `+alightingStationSQL+`, `+boardingTimeSQL+`,
+			COALESCE(b.seat_number, ''), b.status, b.boarded_at, b.boarded_by
+		FROM bookings b
+		JOIN trips t ON b.trip_id = t.id
+		WHERE b.id = ?
+	`, claims.BookingID).Scan(&reference, &pass.Passenger, &pass.TripID, &pass.Origin, &pass.Destination, &pass.DepartureTime,
+		&pass.SeatNumber, &pass.Status, &boardedAt, &boardedBy)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidTicket
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving booking %d: %w", claims.BookingID, err)
+	}
+	pass.Reference = reference.String
+	if pass.Reference != claims.Reference {
+		return nil, ErrInvalidTicket
+	}
+	if pass.TripID != claims.TripID || pass.SeatNumber != claims.SeatNumber || pass.DepartureTime != claims.DepartureTime {
+		return pass, ErrTicketOutdated
+	}
+
+	switch pass.Status {
+	case BookingBoarded:
+		pass.BoardedAt = boardedAt.Time
+		pass.BoardedBy = boardedBy.String
+		return pass, ErrAlreadyBoarded
+	case BookingConfirmed:
+	default:
+		return pass, ErrNotBoardable
+	}
+
+	loc, err := tripLocation(tx, pass.TripID)
+	if err != nil {
+		return nil, err
+	}
+	departure, err := parseDeparture(pass.DepartureTime, loc)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if now.Before(departure.Add(-Boarding.OpensBefore)) {
+		return pass, ErrBoardingNotOpen
+	}
+	if now.After(departure.Add(Boarding.ClosesAfter)) {
+		return pass, ErrBoardingClosed
+	}
+
+	if _, err := setBookingStatus(tx, pass.BookingID, BookingBoarded, operatorID, operatorUsername, "Ticket scanned", now); err != nil {
+		return nil, err
+	}
+	operator := sql.NullInt64{Int64: operatorID, Valid: operatorID != 0}
+	_, err = tx.Exec("UPDATE bookings SET boarded_at = ?, boarded_by_id = ?, boarded_by = ? WHERE id = ?",
+		sqlTime(now), operator, operatorUsername, pass.BookingID)
+	if err != nil {
+		return nil, fmt.Errorf("error boarding booking %d: %w", pass.BookingID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error boarding booking %d: %w", pass.BookingID, err)
+	}
+	pass.Status = BookingBoarded
+	pass.BoardedAt = now
+	pass.BoardedBy = operatorUsername
+	return pass, nil
+}
+
+// GetTripBoardingCounts returns how many passengers of a trip have boarded,
+// are confirmed but not yet boarded, and did not show up
+func GetTripBoardingCounts(tripID int64) (boarded, awaiting, noShow int, err error) {
+	err = DB.QueryRow(`
+		SELECT COALESCE(SUM(CASE WHEN status = 'Boarded' THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN status = 'Confirmed' THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN status = 'NoShow' THEN 1 ELSE 0 END), 0)
+		FROM bookings
+		WHERE trip_id = ?
+	`, tripID).Scan(&boarded, &awaiting, &noShow)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("error getting trip boarding counts: %w", err)
+	}
+	return boarded, awaiting, noShow, nil
+}
+
+// MarkNoShows flips confirmed bookings whose boarding has closed at their
+// boarding stop to NoShow, recording the change in their status history and
+// the audit log, and returns how many were changed
+func MarkNoShows() (int64, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	cutoffSQL, cutoff, err := stationNowSQL(tx, "t.origin", now.Add(-Boarding.ClosesAfter))
+	if err != nil {
+		return 0, err
+	}
+	closed := `b.status = 'Confirmed'
+		  AND EXISTS (SELECT 1 FROM trips t WHERE t.id = b.trip_id AND ` + boardingTimeSQL + ` <= ` + cutoffSQL + `)`
+	rows, err := tx.Query("SELECT b.id FROM bookings b WHERE "+closed, cutoff...)
+	if err != nil {
+		return 0, fmt.Errorf("error retrieving no-shows: %w", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error scanning no-show: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	changes := make([]systemChange, 0, len(ids))
+	for _, id := range ids {
+		change, err := updateChange(tx, AuditBooking, id)
+		if err != nil {
+			return 0, err
+		}
+		changes = append(changes, change)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO booking_status_history (booking_id, from_status, to_status, actor_username, reason, created_at)
+		SELECT b.id, b.status, ?, ?, 'Did not board before boarding closed', ?
+		FROM bookings b
+		WHERE `+closed, append([]interface{}{BookingNoShow, auditSystemActor, sqlTime(now)}, cutoff...)...)
+	if err != nil {
+		return 0, fmt.Errorf("error recording no-shows: %w", err)
+	}
+	res, err := tx.Exec(`
+		UPDATE bookings AS b SET status = ?
+		WHERE `+closed, append([]interface{}{BookingNoShow}, cutoff...)...)
+	if err != nil {
+		return 0, fmt.Errorf("error marking no-shows: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error marking no-shows: %w", err)
+	}
+	auditSystemChanges(changes)
+	return n, nil
+}
+
+// ScheduleNoShowCheck runs MarkNoShows now and then at the given interval
+func ScheduleNoShowCheck(interval time.Duration) {
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+
+	check := func() {
+		if n, err := MarkNoShows(); err != nil {
+			log.Printf("Warning: Failed to mark no-shows: %v", err)
+		} else if n > 0 {
+			log.Printf("Marked %d bookings as no-shows", n)
+		}
+	}
+	check()
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			check()
+		}
+	}()
+
+	log.Printf("No-show check scheduled every %s", interval)
+}
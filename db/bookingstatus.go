@@ -0,0 +1,276 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Booking statuses. A booking starts Confirmed, or Held with an expiry when it
+// is a seat hold or waitlist offer, and moves between them
+// only as bookingTransitions allows.
+const (
+	BookingHeld      = "Held"
+	BookingConfirmed = "Confirmed"
+	BookingCancelled = "Cancelled"
+	BookingBoarded   = "Boarded"
+	BookingNoShow    = "NoShow"
+	BookingRefunded  = "Refunded"
+)
+
+// BookingStatuses lists every booking status, in the order a booking usually
+// passes through them
+var BookingStatuses = []string{BookingHeld, BookingConfirmed, BookingBoarded, BookingNoShow, BookingCancelled, BookingRefunded}
+
+// bookingTransitions lists the statuses each status may change to. Cancelled
+// bookings can be reinstated until the trip leaves; boarded and refunded
+// bookings are final.
+var bookingTransitions = map[string][]string{
+	BookingHeld:      {BookingConfirmed, BookingCancelled},
+	BookingConfirmed: {BookingBoarded, BookingNoShow, BookingCancelled},
+	BookingBoarded:   {},
+	BookingNoShow:    {BookingRefunded},
+	BookingCancelled: {BookingConfirmed, BookingRefunded},
+	BookingRefunded:  {},
+}
+
+// releasedStatusesSQL are the statuses of bookings that no longer hold a
+// seat, for use as "status NOT IN " + releasedStatusesSQL
+const releasedStatusesSQL = "('Cancelled', 'Refunded')"
+
+// ErrInvalidStatus is returned for a booking status not in BookingStatuses
+var ErrInvalidStatus = errors.New("unknown booking status")
+
+// BookingTransitionError is returned when a booking cannot change from one
+// status to another. Its message is safe to show to the user.
+type BookingTransitionError struct {
+	From   string
+	To     string
+	Reason string
+}
+
+func (e *BookingTransitionError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("A %s booking cannot become %s: %s", e.From, e.To, e.Reason)
+	}
+	return fmt.Sprintf("A %s booking cannot become %s", e.From, e.To)
+}
+
+// IsValidBookingStatus reports whether status is a booking status
+func IsValidBookingStatus(status string) bool {
+	_, ok := bookingTransitions[status]
+	return ok
+}
+
+// CanChangeBookingStatus reports whether the transition table allows a
+// booking to change from one status to another
+func CanChangeBookingStatus(from, to string) bool {
+	for _, s := range bookingTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// isReleased reports whether a booking with the given status has given up its seat
+func isReleased(status string) bool {
+	return status == BookingCancelled || status == BookingRefunded
+}
+
+// BookingStatusChange is one recorded change of a booking's status. From is
+// empty for the status the booking was made with.
+type BookingStatusChange struct {
+	ID            int64     `json:"id"`
+	BookingID     int64     `json:"booking_id"`
+	From          string    `json:"from_status"`
+	To            string    `json:"to_status"`
+	ActorID       int64     `json:"actor_id"`
+	ActorUsername string    `json:"actor_username"`
+	Reason        string    `json:"reason"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// recordStatusChange adds a status change of a booking to its history
+func recordStatusChange(q queryer, bookingID int64, from, to string, actorID int64, actorUsername, reason string, now time.Time) error {
+	_, err := q.Exec(`
+		INSERT INTO booking_status_history (booking_id, from_status, to_status, actor_id, actor_username, reason, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, bookingID, sql.NullString{String: from, Valid: from != ""}, to, sql.NullInt64{Int64: actorID, Valid: actorID != 0},
+		actorUsername, sql.NullString{String: reason, Valid: reason != ""}, sqlTime(now))
+	if err != nil {
+		return fmt.Errorf("error recording status of booking %d: %w", bookingID, err)
+	}
+	return nil
+}
+
+// setBookingStatus moves a booking to a new status within a write transaction
+// and records the change in its history, returning the status it had. It is
+// the one place booking statuses change. It returns ErrInvalidStatus for an
+// unknown status, sql.ErrNoRows if the booking does not exist, and a
+// *BookingTransitionError if the transition table does not allow the change,
+// the trip has left for a booking being confirmed, or money paid for a
+// booking being marked refunded has not all been paid back. Seats, refunds
+// and the other effects of the change are left to the caller.
+func setBookingStatus(tx *sql.Tx, bookingID int64, to string, actorID int64, actorUsername, reason string, now time.Time) (string, error) {
+	if !IsValidBookingStatus(to) {
+		return "", ErrInvalidStatus
+	}
+
+	var from, origin, departure string
+	var paid int64
+	err := tx.QueryRow(`
+		SELECT b.status, t.origin, `+boardingTimeSQL+`, COALESCE((SELECT SUM(p.amount_cents) FROM payments p WHERE p.booking_id = b.id), 0)
+		FROM bookings b
+		JOIN trips t ON b.trip_id = t.id
+		WHERE b.id = ?
+	`, bookingID).Scan(&from, &origin, &departure, &paid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", err
+		}
+		return "", fmt.Errorf("error retrieving booking %d: %w", bookingID, err)
+	}
+
+	if !CanChangeBookingStatus(from, to) {
+		return from, &BookingTransitionError{From: from, To: to}
+	}
+	switch to {
+	case BookingHeld, BookingConfirmed:
+		loc, err := stationLocation(tx, origin)
+		if err != nil {
+			return from, err
+		}
+		leaves, err := parseDeparture(departure, loc)
+		if err != nil {
+			return from, err
+		}
+		if !now.Before(leaves) {
+			return from, &BookingTransitionError{From: from, To: to, Reason: "the trip has already left"}
+		}
+	case BookingRefunded:
+		if paid != 0 {
+			return from, &BookingTransitionError{From: from, To: to, Reason: "not everything paid for it has been refunded"}
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE bookings SET status = ? WHERE id = ?", to, bookingID); err != nil {
+		return from, fmt.Errorf("error updating booking status: %w", err)
+	}
+	return from, recordStatusChange(tx, bookingID, from, to, actorID, actorUsername, reason, now)
+}
+
+// GetBookingStatusHistory returns the status changes of a booking, oldest
+// first. Bookings made before history was kept start with their first change.
+func GetBookingStatusHistory(bookingID int64) ([]BookingStatusChange, error) {
+	rows, err := DB.Query(`
+		SELECT id, booking_id, COALESCE(from_status, ''), to_status, COALESCE(actor_id, 0), COALESCE(actor_username, ''),
+			COALESCE(reason, ''), created_at
+		FROM booking_status_history
+		WHERE booking_id = ?
+		ORDER BY id
+	`, bookingID)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving status history of booking %d: %w", bookingID, err)
+	}
+	defer rows.Close()
+
+	history := []BookingStatusChange{}
+	for rows.Next() {
+		var c BookingStatusChange
+		if err := rows.Scan(&c.ID, &c.BookingID, &c.From, &c.To, &c.ActorID, &c.ActorUsername, &c.Reason, &c.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning booking status change: %w", err)
+		}
+		history = append(history, c)
+	}
+	return history, rows.Err()
+}
+
+// migrateBookingStatuses moves bookings off the statuses the state machine
+// does not know. Pending bookings of trips yet to leave become seat holds that
+// staff have SeatHold to confirm before they are released; those of trips
+// that have left, and bookings with any other status, which clients could
+// once set freely, are cancelled with a full refund of anything paid. The
+// bookings changed are logged.
+func migrateBookingStatuses() error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	nowSQL, args, err := stationNowSQL(tx, "t.origin", now)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(`
+		SELECT b.id, b.status, `+boardingTimeSQL+` <= `+nowSQL+`
+		FROM bookings b
+		JOIN trips t ON b.trip_id = t.id
+		WHERE b.status NOT IN (?, ?, ?, ?, ?, ?)
+	`, append(args, BookingHeld, BookingConfirmed, BookingCancelled, BookingBoarded, BookingNoShow, BookingRefunded)...)
+	if err != nil {
+		return fmt.Errorf("error retrieving bookings to migrate: %w", err)
+	}
+	type oldBooking struct {
+		id       int64
+		status   string
+		departed bool
+	}
+	var bookings []oldBooking
+	for rows.Next() {
+		var b oldBooking
+		if err := rows.Scan(&b.id, &b.status, &b.departed); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning booking: %w", err)
+		}
+		bookings = append(bookings, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var held, cancelled []int64
+	expires := now.Add(SeatHold)
+	full := 100
+	for _, b := range bookings {
+		// Held is where every old status can leave from
+		keep := b.status == "Pending" && !b.departed
+		holdExpires := sql.NullString{String: sqlTime(expires), Valid: keep}
+		_, err := tx.Exec("UPDATE bookings SET status = ?, hold_expires_at = ? WHERE id = ?", BookingHeld, holdExpires, b.id)
+		if err != nil {
+			return fmt.Errorf("error migrating booking %d: %w", b.id, err)
+		}
+		if err := recordStatusChange(tx, b.id, b.status, BookingHeld, 0, "system", "Status "+b.status+" retired", now); err != nil {
+			return err
+		}
+		if keep {
+			held = append(held, b.id)
+			continue
+		}
+		_, err = cancelBooking(tx, CancelRequest{
+			BookingID:       b.id,
+			OverridePercent: &full,
+			Reason:          "Status " + b.status + " retired",
+			CashierUsername: "system",
+		}, now)
+		if err != nil {
+			return fmt.Errorf("error cancelling booking %d: %w", b.id, err)
+		}
+		cancelled = append(cancelled, b.id)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error migrating booking statuses: %w", err)
+	}
+	if len(held) > 0 {
+		log.Printf("Put %d Pending bookings on hold until %s for staff to confirm: %v", len(held), expires.Format(departureLayouts[0]), held)
+	}
+	if len(cancelled) > 0 {
+		log.Printf("Cancelled %d bookings with a retired status or whose trip has left: %v", len(cancelled), cancelled)
+	}
+	return nil
+}
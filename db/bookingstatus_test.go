@@ -0,0 +1,279 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+// addTestBooking makes a confirmed booking on a trip and returns its ID
+func addTestBooking(t *testing.T, tripID int64, n int) int64 {
+	t.Helper()
+	booking, err := AddBooking(testBooking(tripID, n))
+	if err != nil {
+		t.Fatalf("AddBooking: %v", err)
+	}
+	return booking.ID
+}
+
+// moveTrip moves a trip so that it leaves its origin at the given time,
+// written in the time zone of its origin station
+func moveTrip(t *testing.T, tripID int64, departure time.Time) {
+	t.Helper()
+	loc, err := tripLocation(DB, tripID)
+	if err != nil {
+		t.Fatalf("tripLocation: %v", err)
+	}
+	dep := departure.In(loc).Format(departureLayouts[0])
+	arr := departure.Add(10 * time.Hour).In(loc).Format(departureLayouts[0])
+	if _, err := DB.Exec("UPDATE trips SET departure_time = ?, arrival_time = ? WHERE id = ?", dep, arr, tripID); err != nil {
+		t.Fatalf("moving trip: %v", err)
+	}
+	if _, err := DB.Exec("UPDATE trip_stops SET departure_time = ? WHERE trip_id = ? AND position = 0", dep, tripID); err != nil {
+		t.Fatalf("moving trip stops: %v", err)
+	}
+}
+
+// forceStatus moves a booking to a status through the state machine
+func forceStatus(t *testing.T, bookingID int64, to string) {
+	t.Helper()
+	tx, err := DB.Begin()
+	if err != nil {
+		t.Fatalf("Begin: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := setBookingStatus(tx, bookingID, to, 0, "test", "", time.Now()); err != nil {
+		t.Fatalf("setBookingStatus %s: %v", to, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+}
+
+func bookingStatus(t *testing.T, bookingID int64) string {
+	t.Helper()
+	var status string
+	if err := DB.QueryRow("SELECT status FROM bookings WHERE id = ?", bookingID).Scan(&status); err != nil {
+		t.Fatalf("reading booking status: %v", err)
+	}
+	return status
+}
+
+func historyCount(t *testing.T, bookingID int64) int {
+	t.Helper()
+	var n int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM booking_status_history WHERE booking_id = ?", bookingID).Scan(&n); err != nil {
+		t.Fatalf("counting status history: %v", err)
+	}
+	return n
+}
+
+func cancelTestBooking(t *testing.T, bookingID int64, percent int) *Cancellation {
+	t.Helper()
+	c, _, err := CancelBooking(CancelRequest{BookingID: bookingID, OverridePercent: &percent, Reason: "test", CashierUsername: "test"})
+	if err != nil {
+		t.Fatalf("CancelBooking: %v", err)
+	}
+	return c
+}
+
+func TestCanChangeBookingStatus(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     bool
+	}{
+		{BookingHeld, BookingConfirmed, true},
+		{BookingHeld, BookingBoarded, false},
+		{BookingConfirmed, BookingBoarded, true},
+		{BookingConfirmed, BookingRefunded, false},
+		{BookingBoarded, BookingConfirmed, false},
+		{BookingBoarded, BookingCancelled, false},
+		{BookingNoShow, BookingRefunded, true},
+		{BookingNoShow, BookingConfirmed, false},
+		{BookingCancelled, BookingConfirmed, true},
+		{BookingCancelled, BookingHeld, false},
+		{BookingRefunded, BookingConfirmed, false},
+		{"Banana", BookingConfirmed, false},
+		{BookingConfirmed, "Banana", false},
+	}
+	for _, tt := range tests {
+		if got := CanChangeBookingStatus(tt.from, tt.to); got != tt.want {
+			t.Errorf("CanChangeBookingStatus(%s, %s) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateBookingStatus(t *testing.T) {
+	openTestDB(t)
+	tripID := addTestTrip(t, 10)
+
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, bookingID int64)
+		to      string
+		wantErr func(error) bool
+		want    string
+	}{
+		{
+			name:    "unknown status",
+			to:      "Banana",
+			wantErr: func(err error) bool { return errors.Is(err, ErrInvalidStatus) },
+			want:    BookingConfirmed,
+		},
+		{
+			name:    "boarded is final",
+			setup:   func(t *testing.T, id int64) { forceStatus(t, id, BookingBoarded) },
+			to:      BookingConfirmed,
+			wantErr: isTransitionError,
+			want:    BookingBoarded,
+		},
+		{
+			name:    "boarding is only by ticket",
+			to:      BookingBoarded,
+			wantErr: isTransitionError,
+			want:    BookingConfirmed,
+		},
+		{
+			name:    "held is confirmed through its hold",
+			setup:   func(t *testing.T, id int64) { forceHeld(t, id) },
+			to:      BookingConfirmed,
+			wantErr: isTransitionError,
+			want:    BookingHeld,
+		},
+		{
+			name: "reinstate a cancelled booking",
+			setup: func(t *testing.T, id int64) {
+				cancelTestBooking(t, id, 0)
+			},
+			to:   BookingConfirmed,
+			want: BookingConfirmed,
+		},
+		{
+			name: "refunded while money is still paid",
+			setup: func(t *testing.T, id int64) {
+				if _, err := RecordPayment(id, 5000, PaymentCash, 0, "test", ""); err != nil {
+					t.Fatalf("RecordPayment: %v", err)
+				}
+				cancelTestBooking(t, id, 50)
+			},
+			to:      BookingRefunded,
+			wantErr: isTransitionError,
+			want:    BookingCancelled,
+		},
+		{
+			name:  "refunded once nothing is paid",
+			setup: func(t *testing.T, id int64) { forceStatus(t, id, BookingNoShow) },
+			to:    BookingRefunded,
+			want:  BookingRefunded,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := addTestBooking(t, tripID, i)
+			if tt.setup != nil {
+				tt.setup(t, id)
+			}
+			before := historyCount(t, id)
+
+			err := UpdateBookingStatus(id, tt.to, 0, "test", "test change")
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("UpdateBookingStatus: %v", err)
+			case tt.wantErr != nil && !tt.wantErr(err):
+				t.Fatalf("UpdateBookingStatus error = %v, want it refused", err)
+			}
+			if got := bookingStatus(t, id); got != tt.want {
+				t.Errorf("status = %s, want %s", got, tt.want)
+			}
+			wantHistory := before
+			if err == nil {
+				wantHistory++
+			}
+			if got := historyCount(t, id); got != wantHistory {
+				t.Errorf("%d status history rows, want %d", got, wantHistory)
+			}
+		})
+	}
+}
+
+func isTransitionError(err error) bool {
+	var transitionErr *BookingTransitionError
+	return errors.As(err, &transitionErr)
+}
+
+// forceHeld turns a booking into a seat hold that has not run out
+func forceHeld(t *testing.T, bookingID int64) {
+	t.Helper()
+	_, err := DB.Exec("UPDATE bookings SET status = ?, hold_expires_at = ? WHERE id = ?", BookingHeld, sqlTime(time.Now().Add(time.Hour)), bookingID)
+	if err != nil {
+		t.Fatalf("holding booking: %v", err)
+	}
+}
+
+func TestReinstateAfterDepartureIsRefused(t *testing.T) {
+	openTestDB(t)
+	tripID := addTestTrip(t, 10)
+	id := addTestBooking(t, tripID, 1)
+	cancelTestBooking(t, id, 0)
+	moveTrip(t, tripID, time.Now().Add(-time.Hour))
+
+	err := UpdateBookingStatus(id, BookingConfirmed, 0, "test", "")
+	var transitionErr *BookingTransitionError
+	if !errors.As(err, &transitionErr) || transitionErr.Reason == "" {
+		t.Fatalf("reinstating after departure: error = %v, want a refusal because the trip has left", err)
+	}
+	if got := bookingStatus(t, id); got != BookingCancelled {
+		t.Errorf("status = %s, want Cancelled", got)
+	}
+}
+
+// TestStatusChangesAreRecorded follows a booking through its life and checks
+// that each change is written to its history, with who made it and why
+func TestStatusChangesAreRecorded(t *testing.T) {
+	openTestDB(t)
+	tripID := addTestTrip(t, 10)
+	id := addTestBooking(t, tripID, 1)
+
+	if _, err := RecordPayment(id, 2000, PaymentCard, 0, "cashier", ""); err != nil {
+		t.Fatalf("RecordPayment: %v", err)
+	}
+	cancelTestBooking(t, id, 0)
+	if err := UpdateBookingStatus(id, BookingConfirmed, 7, "manager", "Passenger changed their mind"); err != nil {
+		t.Fatalf("reinstating: %v", err)
+	}
+	forceStatus(t, id, BookingNoShow)
+	if _, err := RecordRefund(id, 2000, PaymentCard, 0, "cashier", "No-show refund"); err != nil {
+		t.Fatalf("RecordRefund: %v", err)
+	}
+
+	history, err := GetBookingStatusHistory(id)
+	if err != nil {
+		t.Fatalf("GetBookingStatusHistory: %v", err)
+	}
+	want := []struct{ from, to string }{
+		{"", BookingConfirmed},
+		{BookingConfirmed, BookingCancelled},
+		{BookingCancelled, BookingConfirmed},
+		{BookingConfirmed, BookingNoShow},
+		{BookingNoShow, BookingRefunded},
+	}
+	if len(history) != len(want) {
+		t.Fatalf("%d status changes recorded, want %d: %+v", len(history), len(want), history)
+	}
+	for i, w := range want {
+		if history[i].From != w.from || history[i].To != w.to {
+			t.Errorf("change %d = %s -> %s, want %s -> %s", i, history[i].From, history[i].To, w.from, w.to)
+		}
+	}
+	if reinstated := history[2]; reinstated.ActorID != 7 || reinstated.ActorUsername != "manager" || reinstated.Reason != "Passenger changed their mind" {
+		t.Errorf("reinstatement recorded as %+v", reinstated)
+	}
+}
+
+func TestUpdateBookingStatusUnknownBooking(t *testing.T) {
+	openTestDB(t)
+	if err := UpdateBookingStatus(999, BookingConfirmed, 0, "test", ""); err != sql.ErrNoRows {
+		t.Errorf("error = %v, want sql.ErrNoRows", err)
+	}
+}
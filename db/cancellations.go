@@ -0,0 +1,297 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// departureLayouts are the ways a trip's departure time may be written
+var departureLayouts = []string{"2006-01-02T15:04", "2006-01-02T15:04:05", "2006-01-02 15:04", timestampLayout}
+
+var (
+	// ErrAlreadyCancelled is returned when cancelling a booking that is already cancelled
+	ErrAlreadyCancelled = errors.New("booking is already cancelled")
+	// ErrOverrideReasonRequired is returned when a refund override has no reason
+	ErrOverrideReasonRequired = errors.New("a reason is required to override the refund")
+)
+
+// CancellationRule refunds RefundPercent of what was paid for a booking when
+// it is cancelled at least MinHoursBefore hours before departure.
+type CancellationRule struct {
+	MinHoursBefore int `json:"min_hours_before"`
+	RefundPercent  int `json:"refund_percent"`
+}
+
+// defaultCancellationRules are seeded on first start: a full refund up to 24
+// hours before departure and half after that. Once the trip has departed
+// nothing is refunded, whatever the rules say.
+var defaultCancellationRules = []CancellationRule{
+	{24, 100},
+	{0, 50},
+}
+
+// Cancellation is the refund due, or given, for cancelling a booking and how
+// it was worked out. DepartureTime is when the trip leaves the passenger's
+// boarding stop. Amounts are in cents.
+type Cancellation struct {
+	BookingID       int64   `json:"booking_id"`
+	DepartureTime   string  `json:"departure_time"`
+	HoursBefore     float64 `json:"hours_before"`
+	RefundPercent   int     `json:"refund_percent"`
+	PaidCents       int64   `json:"paid_cents"`
+	RefundCents     int64   `json:"refund_cents"`
+	Overridden      bool    `json:"overridden"`
+	Reason          string  `json:"reason,omitempty"`
+	RefundPaymentID int64   `json:"refund_payment_id,omitempty"`
+}
+
+// CancelRequest describes a cancellation. OverridePercent replaces the
+// percentage the rules give and must come with a Reason.
+type CancelRequest struct {
+	BookingID       int64
+	OverridePercent *int
+	Reason          string
+	CashierID       int64
+	CashierUsername string
+}
+
+// seedCancellationRules stores the default cancellation rules if none are set
+func seedCancellationRules() error {
+	var count int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM cancellation_rules").Scan(&count); err != nil {
+		return fmt.Errorf("error checking cancellation rules: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	for _, r := range defaultCancellationRules {
+		_, err := DB.Exec("INSERT INTO cancellation_rules (min_hours_before, refund_percent) VALUES (?, ?)", r.MinHoursBefore, r.RefundPercent)
+		if err != nil {
+			return fmt.Errorf("error seeding cancellation rules: %w", err)
+		}
+	}
+	return nil
+}
+
+// GetCancellationRules returns the cancellation rules, longest notice first
+func GetCancellationRules() ([]CancellationRule, error) {
+	return cancellationRules(DB)
+}
+
+func cancellationRules(q queryer) ([]CancellationRule, error) {
+	rows, err := q.Query("SELECT min_hours_before, refund_percent FROM cancellation_rules ORDER BY min_hours_before DESC")
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving cancellation rules: %w", err)
+	}
+	defer rows.Close()
+
+	rules := []CancellationRule{}
+	for rows.Next() {
+		var r CancellationRule
+		if err := rows.Scan(&r.MinHoursBefore, &r.RefundPercent); err != nil {
+			return nil, fmt.Errorf("error scanning cancellation rule: %w", err)
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+// SetCancellationRules replaces the cancellation rules. With no rules nothing
+// is refunded on cancellation.
+func SetCancellationRules(rules []CancellationRule) error {
+	seen := map[int]bool{}
+	for _, r := range rules {
+		if r.MinHoursBefore < 0 {
+			return fmt.Errorf("hours before departure cannot be negative")
+		}
+		if r.RefundPercent < 0 || r.RefundPercent > 100 {
+			return fmt.Errorf("refund must be between 0 and 100 percent")
+		}
+		if seen[r.MinHoursBefore] {
+			return fmt.Errorf("there is more than one rule for %d hours before departure", r.MinHoursBefore)
+		}
+		seen[r.MinHoursBefore] = true
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM cancellation_rules"); err != nil {
+		return fmt.Errorf("error clearing cancellation rules: %w", err)
+	}
+	for _, r := range rules {
+		_, err := tx.Exec("INSERT INTO cancellation_rules (min_hours_before, refund_percent) VALUES (?, ?)", r.MinHoursBefore, r.RefundPercent)
+		if err != nil {
+			return fmt.Errorf("error saving cancellation rule: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error saving cancellation rules: %w", err)
+	}
+	return nil
+}
+
+// refundPercent picks the rule with the longest notice that hoursBefore
+// satisfies. Nothing is refunded after departure. rules is left as it is.
+func refundPercent(rules []CancellationRule, hoursBefore float64) int {
+	if hoursBefore < 0 {
+		return 0
+	}
+	sorted := append([]CancellationRule(nil), rules...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].MinHoursBefore > sorted[j].MinHoursBefore })
+	for _, r := range sorted {
+		if hoursBefore >= float64(r.MinHoursBefore) {
+			return r.RefundPercent
+		}
+	}
+	return 0
+}
+
+// parseDeparture reads a trip's departure time in the time zone of the trip's
+// origin station (see tripLocation)
+func parseDeparture(departure string, loc *time.Location) (time.Time, error) {
+	for _, layout := range departureLayouts {
+		if t, err := time.ParseInLocation(layout, departure, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid departure time %q", departure)
+}
+
+// quoteCancellation works out the refund for cancelling a booking at now under
+// the cancellation rules. It returns sql.ErrNoRows if the booking does not exist.
+func quoteCancellation(q queryer, bookingID int64, now time.Time) (*Cancellation, error) {
+	var status, origin string
+	c := &Cancellation{BookingID: bookingID}
+	err := q.QueryRow(`
+		SELECT b.status, t.origin, `+boardingTimeSQL+`, COALESCE((SELECT SUM(p.amount_cents) FROM payments p WHERE p.booking_id = b.id), 0)
+		FROM bookings b
+		JOIN trips t ON b.trip_id = t.id
+		WHERE b.id = ?
+	`, bookingID).Scan(&status, &origin, &c.DepartureTime, &c.PaidCents)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error retrieving booking %d: %w", bookingID, err)
+	}
+	if isReleased(status) {
+		return nil, ErrAlreadyCancelled
+	}
+
+	loc, err := stationLocation(q, origin)
+	if err != nil {
+		return nil, err
+	}
+	departure, err := parseDeparture(c.DepartureTime, loc)
+	if err != nil {
+		return nil, err
+	}
+	c.HoursBefore = departure.Sub(now).Hours()
+
+	rules, err := cancellationRules(q)
+	if err != nil {
+		return nil, err
+	}
+	c.RefundPercent = refundPercent(rules, c.HoursBefore)
+	c.RefundCents = c.PaidCents * int64(c.RefundPercent) / 100
+	return c, nil
+}
+
+// QuoteCancellation returns the refund a booking would get if it were
+// cancelled now, without cancelling it
+func QuoteCancellation(bookingID int64) (*Cancellation, error) {
+	return quoteCancellation(DB, bookingID, time.Now())
+}
+
+// CancelBooking cancels a booking, refunding the share of what was paid that
+// the cancellation rules (or the override) allow. The refund is paid out by
+// the method last used to pay for the booking and recorded in the ledger, and
+// the outcome is kept on the booking. A booking paid back in full becomes
+// Refunded. The freed seat is offered to the trip's waitlist in the same
+// transaction, so no other booking can take it first, and the offers made are
+// returned. It returns sql.ErrNoRows if the booking does not exist,
+// ErrAlreadyCancelled if it is cancelled or refunded, and a
+// *BookingTransitionError if it has boarded or not shown up.
+func CancelBooking(req CancelRequest) (*Cancellation, []WaitlistOffer, error) {
+	if req.OverridePercent != nil {
+		if *req.OverridePercent < 0 || *req.OverridePercent > 100 {
+			return nil, nil, fmt.Errorf("refund must be between 0 and 100 percent")
+		}
+		if req.Reason == "" {
+			return nil, nil, ErrOverrideReasonRequired
+		}
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	c, err := cancelBooking(tx, req, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	var tripID int64
+	if err := tx.QueryRow("SELECT trip_id FROM bookings WHERE id = ?", req.BookingID).Scan(&tripID); err != nil {
+		return nil, nil, fmt.Errorf("error retrieving booking %d: %w", req.BookingID, err)
+	}
+	offers, err := promoteWaitlist(tx, tripID, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("error cancelling booking: %w", err)
+	}
+	return c, offers, nil
+}
+
+// cancelBooking cancels a booking and pays out its refund within a write
+// transaction, as CancelBooking describes
+func cancelBooking(tx *sql.Tx, req CancelRequest, now time.Time) (*Cancellation, error) {
+	c, err := quoteCancellation(tx, req.BookingID, now)
+	if err != nil {
+		return nil, err
+	}
+	if req.OverridePercent != nil {
+		c.Overridden = true
+		c.Reason = req.Reason
+		c.RefundPercent = *req.OverridePercent
+		c.RefundCents = c.PaidCents * int64(c.RefundPercent) / 100
+	}
+
+	if _, err := setBookingStatus(tx, req.BookingID, BookingCancelled, req.CashierID, req.CashierUsername, req.Reason, now); err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`
+		UPDATE bookings SET cancelled_at = ?, cancelled_by = ?, refund_percent = ?, refund_cents = ?,
+			refund_overridden = ?, cancellation_reason = ?
+		WHERE id = ?
+	`, sqlTime(now), req.CashierUsername, c.RefundPercent, c.RefundCents, c.Overridden, sql.NullString{String: c.Reason, Valid: c.Reason != ""}, req.BookingID)
+	if err != nil {
+		return nil, fmt.Errorf("error cancelling booking: %w", err)
+	}
+
+	// Pay out the refund; paying back everything marks the booking Refunded
+	if c.RefundCents > 0 {
+		method := PaymentCash
+		err := tx.QueryRow("SELECT method FROM payments WHERE booking_id = ? AND amount_cents > 0 ORDER BY id DESC LIMIT 1", req.BookingID).Scan(&method)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("error retrieving payment method: %w", err)
+		}
+		reference := fmt.Sprintf("Cancellation refund (%d%%)", c.RefundPercent)
+		c.RefundPaymentID, err = insertLedgerEntry(tx, req.BookingID, -c.RefundCents, method, req.CashierID, req.CashierUsername, reference)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRefundPercent(t *testing.T) {
+	rules := []CancellationRule{{0, 50}, {72, 100}, {24, 80}}
+	tests := []struct {
+		name        string
+		rules       []CancellationRule
+		hoursBefore float64
+		want        int
+	}{
+		{"well ahead", rules, 100, 100},
+		{"exactly 72 hours", rules, 72, 100},
+		{"just under 72 hours", rules, 71.99, 80},
+		{"exactly 24 hours", rules, 24, 80},
+		{"just under 24 hours", rules, 23.99, 50},
+		{"at departure", rules, 0, 50},
+		{"after departure", rules, -0.01, 0},
+		{"no rules", nil, 100, 0},
+		{"no rule for short notice", []CancellationRule{{24, 100}}, 12, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := refundPercent(tt.rules, tt.hoursBefore); got != tt.want {
+				t.Errorf("refundPercent(%v) = %d, want %d", tt.hoursBefore, got, tt.want)
+			}
+		})
+	}
+	if want := []CancellationRule{{0, 50}, {72, 100}, {24, 80}}; !reflect.DeepEqual(rules, want) {
+		t.Errorf("refundPercent reordered the rules it was given: %v", rules)
+	}
+}
+
+// TestQuoteCancellationEdges quotes a booking on a trip leaving in two days
+// under the default rules: a full refund from 24 hours before, half after
+// that, and nothing once the trip has left
+func TestQuoteCancellationEdges(t *testing.T) {
+	openTestDB(t)
+	tripID := addTestTrip(t, 10)
+	id := addTestBooking(t, tripID, 1)
+	if _, err := RecordPayment(id, 4000, PaymentCash, 0, "test", ""); err != nil {
+		t.Fatalf("RecordPayment: %v", err)
+	}
+	departure := time.Now().Truncate(time.Minute).Add(48 * time.Hour)
+	moveTrip(t, tripID, departure)
+
+	tests := []struct {
+		name        string
+		at          time.Time
+		wantPercent int
+		wantRefund  int64
+	}{
+		{"exactly 24 hours before", departure.Add(-24 * time.Hour), 100, 4000},
+		{"a minute under 24 hours before", departure.Add(-24*time.Hour + time.Minute), 50, 2000},
+		{"at departure", departure, 50, 2000},
+		{"after departure", departure.Add(time.Minute), 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := quoteCancellation(DB, id, tt.at)
+			if err != nil {
+				t.Fatalf("quoteCancellation: %v", err)
+			}
+			if c.RefundPercent != tt.wantPercent || c.RefundCents != tt.wantRefund {
+				t.Errorf("refund = %d%% (%d cents), want %d%% (%d cents)", c.RefundPercent, c.RefundCents, tt.wantPercent, tt.wantRefund)
+			}
+			if c.PaidCents != 4000 {
+				t.Errorf("paid = %d cents, want 4000", c.PaidCents)
+			}
+		})
+	}
+
+	if err := SetCancellationRules(nil); err != nil {
+		t.Fatalf("SetCancellationRules: %v", err)
+	}
+	c, err := quoteCancellation(DB, id, departure.Add(-72*time.Hour))
+	if err != nil {
+		t.Fatalf("quoteCancellation: %v", err)
+	}
+	if c.RefundPercent != 0 || c.RefundCents != 0 {
+		t.Errorf("with no rules the refund is %d%% (%d cents), want nothing", c.RefundPercent, c.RefundCents)
+	}
+}
+
+func TestCancelBookingOverrideNeedsReason(t *testing.T) {
+	openTestDB(t)
+	tripID := addTestTrip(t, 10)
+	id := addTestBooking(t, tripID, 1)
+
+	full := 100
+	_, _, err := CancelBooking(CancelRequest{BookingID: id, OverridePercent: &full, CashierUsername: "test"})
+	if !errors.Is(err, ErrOverrideReasonRequired) {
+		t.Fatalf("override without a reason: error = %v, want ErrOverrideReasonRequired", err)
+	}
+	if got := bookingStatus(t, id); got != BookingConfirmed {
+		t.Errorf("status = %s, want the booking left Confirmed", got)
+	}
+}
+
+func TestCancelBookingRefunds(t *testing.T) {
+	openTestDB(t)
+	tripID := addTestTrip(t, 10)
+	moveTrip(t, tripID, time.Now().Add(48*time.Hour))
+
+	tests := []struct {
+		name       string
+		override   *int
+		wantStatus string
+		wantRefund int64
+	}{
+		{"full refund under the rules", nil, BookingRefunded, 3000},
+		{"partial refund by override", intPtr(40), BookingCancelled, 1200},
+		{"no refund by override", intPtr(0), BookingCancelled, 0},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := addTestBooking(t, tripID, i)
+			if _, err := RecordPayment(id, 3000, PaymentCard, 0, "test", ""); err != nil {
+				t.Fatalf("RecordPayment: %v", err)
+			}
+			c, _, err := CancelBooking(CancelRequest{BookingID: id, OverridePercent: tt.override, Reason: "test", CashierUsername: "test"})
+			if err != nil {
+				t.Fatalf("CancelBooking: %v", err)
+			}
+			if c.RefundCents != tt.wantRefund {
+				t.Errorf("refund = %d cents, want %d", c.RefundCents, tt.wantRefund)
+			}
+			if got := bookingStatus(t, id); got != tt.wantStatus {
+				t.Errorf("status = %s, want %s", got, tt.wantStatus)
+			}
+			balance, err := GetBookingBalance(id)
+			if err != nil {
+				t.Fatalf("GetBookingBalance: %v", err)
+			}
+			if balance.PaidCents != 3000-tt.wantRefund {
+				t.Errorf("paid after cancelling = %d cents, want %d", balance.PaidCents, 3000-tt.wantRefund)
+			}
+			if _, _, err := CancelBooking(CancelRequest{BookingID: id}); !errors.Is(err, ErrAlreadyCancelled) {
+				t.Errorf("cancelling again: error = %v, want ErrAlreadyCancelled", err)
+			}
+		})
+	}
+}
+
+func intPtr(v int) *int {
+	return &v
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"log"
+	"time"
+)
+
+// PurgeExpiredRecords removes expired sessions and used or expired password
+// reset tokens.
+func PurgeExpiredRecords() {
+	if n, err := PurgeExpiredSessions(); err != nil {
+		log.Printf("Warning: Failed to purge expired sessions: %v", err)
+	} else if n > 0 {
+		log.Printf("Purged %d expired sessions", n)
+	}
+	if n, err := PurgeExpiredResetTokens(); err != nil {
+		log.Printf("Warning: Failed to purge expired reset tokens: %v", err)
+	} else if n > 0 {
+		log.Printf("Purged %d used or expired reset tokens", n)
+	}
+}
+
+// ScheduleCleanup runs PurgeExpiredRecords now and then at the given interval
+func ScheduleCleanup(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	PurgeExpiredRecords()
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			PurgeExpiredRecords()
+		}
+	}()
+
+	log.Printf("Expired record cleanup scheduled every %s", interval)
+}
@@ -33,8 +33,10 @@ func InitializeDB() error {
 	}
 
 	log.Printf("Opening SQLite database at: %s", dbPath)
-	// SQLite connection string with WAL journal mode for better concurrency and performance
-	connStr := fmt.Sprintf("%s?_journal=WAL&_timeout=5000&_fk=true", dbPath)
+	// SQLite connection string with WAL journal mode for better concurrency and performance.
+	// Transactions take the write lock when they begin, so what a transaction
+	// has checked (such as a free seat) still holds when it commits.
+	connStr := fmt.Sprintf("%s?_journal=WAL&_timeout=5000&_fk=true&_txlock=immediate", dbPath)
 	DB, err = sql.Open("sqlite3", connStr)
 	if err != nil {
 		return fmt.Errorf("failed to open SQLite database: %w", err)
@@ -107,6 +109,16 @@ func InitializeDB() error {
 		}
 	}
 
+	// Load the key used to encrypt sensitive columns before touching any rows
+	if err := LoadEncryptionKey(EncryptionKeyPath()); err != nil {
+		DB.Close()
+		return err
+	}
+	if err := LoadTicketKey(TicketKeyPath()); err != nil {
+		DB.Close()
+		return err
+	}
+
 	log.Println("Database connection successful. Initializing schema...")
 	err = initializeSchema()
 	if err != nil {
@@ -120,6 +132,18 @@ func InitializeDB() error {
 		// Continue anyway, as the application might still work with the existing schema
 	}
 
+	// Register the permissions the code checks before roles are seeded
+	if err = syncPermissions(); err != nil {
+		DB.Close()
+		return fmt.Errorf("failed to register permissions: %w", err)
+	}
+
+	// Apply one-shot data migrations
+	if err = runDataMigrations(); err != nil {
+		DB.Close()
+		return fmt.Errorf("failed to apply data migrations: %w", err)
+	}
+
 	// Verify that all expected tables and indexes exist
 	if err := utils.VerifyTableConsistency(DB); err != nil {
 		log.Printf("Warning: Table consistency check failed: %v", err)
@@ -142,7 +166,16 @@ func initializeSchema() error {
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		date_of_birth TEXT,
 		social_security TEXT,
-		role TEXT DEFAULT 'Operator'
+		role TEXT DEFAULT 'Operator',
+		failed_login_count INTEGER DEFAULT 0,
+		last_failed_login TIMESTAMP,
+		lockout_count INTEGER DEFAULT 0,
+		locked_until TIMESTAMP,
+		totp_secret TEXT,
+		totp_enabled INTEGER DEFAULT 0,
+		totp_last_step INTEGER,
+		password_changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		must_change_password INTEGER DEFAULT 0
 	);
 	`
 	_, err := DB.Exec(usersTableSQL)
@@ -161,7 +194,10 @@ func initializeSchema() error {
 		last_maintenance_date TEXT,
 		next_maintenance_date TEXT,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		notes TEXT
+		notes TEXT,
+		seat_columns INTEGER DEFAULT 4,
+		aisle_after INTEGER DEFAULT 2,
+		seat_letters TEXT
 	);
 	`
 	_, err = DB.Exec(vehiclesTableSQL)
@@ -185,21 +221,25 @@ func initializeSchema() error {
 		return fmt.Errorf("failed to create login_history table: %w", err)
 	}
 
-	// Create reset_codes table
-	resetCodesTableSQL := `
-	CREATE TABLE IF NOT EXISTS reset_codes (
+	// Create reset_tokens table. Only hashes of reset codes and link tokens are stored.
+	resetTokensTableSQL := `
+	CREATE TABLE IF NOT EXISTS reset_tokens (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		user_id INTEGER NOT NULL,
-		code TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		token_hash TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		expires_at TIMESTAMP NOT NULL,
-		used INTEGER DEFAULT 0,
+		used_at TIMESTAMP,
 		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
 	);
+	CREATE INDEX IF NOT EXISTS idx_reset_tokens_user ON reset_tokens(user_id);
+	CREATE INDEX IF NOT EXISTS idx_reset_tokens_hash ON reset_tokens(token_hash);
 	`
-	_, err = DB.Exec(resetCodesTableSQL)
+	_, err = DB.Exec(resetTokensTableSQL)
 	if err != nil {
-		return fmt.Errorf("failed to create reset_codes table: %w", err)
+		return fmt.Errorf("failed to create reset_tokens table: %w", err)
 	}
 
 	// Create security_questions table
@@ -241,6 +281,8 @@ func initializeSchema() error {
 		departure_time TEXT NOT NULL,
 		arrival_time TEXT NOT NULL,
 		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		schedule_id INTEGER REFERENCES schedules(id) ON DELETE SET NULL,
+		route_id INTEGER REFERENCES routes(id),
 		FOREIGN KEY(vehicle_id) REFERENCES vehicles(id) ON DELETE SET NULL
 	);
 	`
@@ -260,6 +302,29 @@ func initializeSchema() error {
 		date_of_birth TEXT NOT NULL,
 		booking_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 		status TEXT NOT NULL,
+		seat_number TEXT,
+		fare_id INTEGER,
+		fare_category TEXT,
+		base_fare_cents INTEGER,
+		fare_multiplier REAL,
+		discount_percent INTEGER,
+		price_cents INTEGER,
+		cancelled_at TIMESTAMP,
+		cancelled_by TEXT,
+		refund_percent INTEGER,
+		refund_cents INTEGER,
+		refund_overridden INTEGER NOT NULL DEFAULT 0,
+		cancellation_reason TEXT,
+		reference TEXT,
+		ticket_issued_at TIMESTAMP,
+		ticket_prints INTEGER NOT NULL DEFAULT 0,
+		boarded_at TIMESTAMP,
+		boarded_by_id INTEGER,
+		boarded_by TEXT,
+		boarding_stop INTEGER NOT NULL DEFAULT 0,
+		alighting_stop INTEGER,
+		hold_expires_at TIMESTAMP,
+		passenger_id INTEGER REFERENCES passengers(id),
 		FOREIGN KEY(trip_id) REFERENCES trips(id) ON DELETE CASCADE
 	);
 	`
@@ -268,6 +333,538 @@ func initializeSchema() error {
 		return fmt.Errorf("failed to create bookings table: %w", err)
 	}
 
+	// Create sessions table (server-side login sessions)
+	sessionsTableSQL := `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token TEXT UNIQUE NOT NULL,
+		user_id INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		ip_address TEXT,
+		user_agent TEXT,
+		expires_at TIMESTAMP NOT NULL,
+		pending_2fa INTEGER DEFAULT 0,
+		csrf_token TEXT,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	`
+	_, err = DB.Exec(sessionsTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create sessions table: %w", err)
+	}
+
+	sessionsUserIndexSQL := `CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);`
+	_, err = DB.Exec(sessionsUserIndexSQL)
+	if err != nil {
+		log.Printf("Warning: Could not ensure sessions user index: %v", err)
+	}
+
+	// Create recovery_codes table (single-use two-factor backup codes)
+	recoveryCodesTableSQL := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		code_hash TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		used_at TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	`
+	_, err = DB.Exec(recoveryCodesTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create recovery_codes table: %w", err)
+	}
+
+	// Create two_factor_policy table (which roles must use two-factor authentication)
+	twoFactorPolicyTableSQL := `
+	CREATE TABLE IF NOT EXISTS two_factor_policy (
+		role TEXT PRIMARY KEY,
+		required INTEGER NOT NULL DEFAULT 0
+	);
+	`
+	_, err = DB.Exec(twoFactorPolicyTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create two_factor_policy table: %w", err)
+	}
+
+	// Create password_history table (hashes of recent passwords, to prevent reuse)
+	passwordHistoryTableSQL := `
+	CREATE TABLE IF NOT EXISTS password_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		password_hash TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_password_history_user ON password_history(user_id);
+	`
+	_, err = DB.Exec(passwordHistoryTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create password_history table: %w", err)
+	}
+
+	// Create roles, permissions and role_permissions tables (what each role may do)
+	rolesTableSQL := `
+	CREATE TABLE IF NOT EXISTS roles (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT UNIQUE NOT NULL COLLATE NOCASE,
+		description TEXT NOT NULL DEFAULT '',
+		dashboard TEXT NOT NULL DEFAULT 'operator',
+		built_in INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS permissions (
+		name TEXT PRIMARY KEY,
+		description TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS role_permissions (
+		role_id INTEGER NOT NULL,
+		permission TEXT NOT NULL,
+		PRIMARY KEY (role_id, permission),
+		FOREIGN KEY (role_id) REFERENCES roles(id) ON DELETE CASCADE,
+		FOREIGN KEY (permission) REFERENCES permissions(name) ON DELETE CASCADE
+	);
+	`
+	_, err = DB.Exec(rolesTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create roles tables: %w", err)
+	}
+
+	// Create audit_log table (who changed what, with the state before and after)
+	auditLogTableSQL := `
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		actor_id INTEGER,
+		actor_username TEXT,
+		action TEXT NOT NULL,
+		entity_type TEXT NOT NULL,
+		entity_id INTEGER,
+		before_json TEXT,
+		after_json TEXT,
+		ip_address TEXT,
+		request_id TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_entity ON audit_log(entity_type, entity_id);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_created_at ON audit_log(created_at);
+	`
+	_, err = DB.Exec(auditLogTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create audit_log table: %w", err)
+	}
+
+	// Create fares, vehicle_type_multipliers and fare_discounts tables (what a ticket costs)
+	faresTableSQL := `
+	CREATE TABLE IF NOT EXISTS fares (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		origin TEXT NOT NULL,
+		destination TEXT NOT NULL,
+		base_fare_cents INTEGER NOT NULL,
+		valid_from TEXT NOT NULL,
+		valid_to TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_fares_route ON fares(origin, destination, valid_from);
+	CREATE TABLE IF NOT EXISTS vehicle_type_multipliers (
+		vehicle_type TEXT PRIMARY KEY COLLATE NOCASE,
+		multiplier REAL NOT NULL DEFAULT 1
+	);
+	CREATE TABLE IF NOT EXISTS fare_discounts (
+		category TEXT PRIMARY KEY,
+		min_age INTEGER NOT NULL,
+		max_age INTEGER NOT NULL DEFAULT 0,
+		percent INTEGER NOT NULL
+	);
+	`
+	_, err = DB.Exec(faresTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create fares tables: %w", err)
+	}
+
+	// Create payments table (ledger of money taken for bookings; refunds are negative)
+	paymentsTableSQL := `
+	CREATE TABLE IF NOT EXISTS payments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		booking_id INTEGER NOT NULL,
+		amount_cents INTEGER NOT NULL,
+		method TEXT NOT NULL,
+		cashier_id INTEGER,
+		cashier_username TEXT,
+		reference TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (booking_id) REFERENCES bookings(id) ON DELETE RESTRICT,
+		FOREIGN KEY (cashier_id) REFERENCES users(id) ON DELETE SET NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_payments_booking ON payments(booking_id);
+	CREATE INDEX IF NOT EXISTS idx_payments_created_at ON payments(created_at);
+	`
+	_, err = DB.Exec(paymentsTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create payments table: %w", err)
+	}
+
+	// Create cancellation_rules table (share of the fare refunded by notice given)
+	cancellationRulesTableSQL := `
+	CREATE TABLE IF NOT EXISTS cancellation_rules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		min_hours_before INTEGER NOT NULL UNIQUE,
+		refund_percent INTEGER NOT NULL
+	);
+	`
+	_, err = DB.Exec(cancellationRulesTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create cancellation_rules table: %w", err)
+	}
+
+	// Create schedules table (recurring timetable that trips are generated from)
+	schedulesTableSQL := `
+	CREATE TABLE IF NOT EXISTS schedules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		origin TEXT NOT NULL,
+		destination TEXT NOT NULL,
+		departure_time TEXT NOT NULL,
+		duration_minutes INTEGER NOT NULL,
+		days_of_week TEXT NOT NULL,
+		valid_from TEXT NOT NULL,
+		valid_to TEXT,
+		vehicle_id INTEGER,
+		active INTEGER NOT NULL DEFAULT 1,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		route_id INTEGER REFERENCES routes(id),
+		FOREIGN KEY(vehicle_id) REFERENCES vehicles(id) ON DELETE SET NULL
+	);
+	`
+	_, err = DB.Exec(schedulesTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create schedules table: %w", err)
+	}
+
+	// Create schedule_conflicts table (departures a schedule could not generate)
+	scheduleConflictsTableSQL := `
+	CREATE TABLE IF NOT EXISTS schedule_conflicts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		schedule_id INTEGER NOT NULL,
+		departure_time TEXT NOT NULL,
+		reason TEXT NOT NULL,
+		detected_at TIMESTAMP NOT NULL,
+		UNIQUE(schedule_id, departure_time),
+		FOREIGN KEY(schedule_id) REFERENCES schedules(id) ON DELETE CASCADE
+	);
+	`
+	_, err = DB.Exec(scheduleConflictsTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create schedule_conflicts table: %w", err)
+	}
+
+	// Create stations table (terminals that trips, fares and timetables run between)
+	stationsTableSQL := `
+	CREATE TABLE IF NOT EXISTS stations (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		code TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		city TEXT NOT NULL,
+		latitude REAL,
+		longitude REAL,
+		timezone TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	_, err = DB.Exec(stationsTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create stations table: %w", err)
+	}
+
+	// Create routes table (a service pattern between stations; stops are in route_stops)
+	routesTableSQL := `
+	CREATE TABLE IF NOT EXISTS routes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		distance_km REAL,
+		duration_minutes INTEGER NOT NULL,
+		active INTEGER NOT NULL DEFAULT 1,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	_, err = DB.Exec(routesTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create routes table: %w", err)
+	}
+
+	// Create route_stops table (ordered stations of each route, origin first)
+	routeStopsTableSQL := `
+	CREATE TABLE IF NOT EXISTS route_stops (
+		route_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		station_id INTEGER NOT NULL,
+		PRIMARY KEY(route_id, position),
+		FOREIGN KEY(route_id) REFERENCES routes(id) ON DELETE CASCADE,
+		FOREIGN KEY(station_id) REFERENCES stations(id)
+	);
+	`
+	_, err = DB.Exec(routeStopsTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create route_stops table: %w", err)
+	}
+
+	// Create trip_stops table (the stations each trip calls at and when, origin first)
+	tripStopsTableSQL := `
+	CREATE TABLE IF NOT EXISTS trip_stops (
+		trip_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		station_id INTEGER NOT NULL,
+		arrival_time TEXT,
+		departure_time TEXT,
+		PRIMARY KEY(trip_id, position),
+		FOREIGN KEY(trip_id) REFERENCES trips(id) ON DELETE CASCADE,
+		FOREIGN KEY(station_id) REFERENCES stations(id)
+	);
+	`
+	_, err = DB.Exec(tripStopsTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create trip_stops table: %w", err)
+	}
+
+	// Create waitlist table (passengers waiting for a seat on a full trip; booking_id is the seat offered to them)
+	waitlistTableSQL := `
+	CREATE TABLE IF NOT EXISTS waitlist (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		trip_id INTEGER NOT NULL,
+		passenger TEXT NOT NULL,
+		social_id TEXT NOT NULL,
+		phone_number TEXT NOT NULL,
+		date_of_birth TEXT NOT NULL,
+		boarding_stop INTEGER NOT NULL DEFAULT 0,
+		alighting_stop INTEGER,
+		priority INTEGER NOT NULL DEFAULT 0,
+		status TEXT NOT NULL DEFAULT 'Waiting',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		created_by TEXT,
+		offered_at TIMESTAMP,
+		hold_expires_at TIMESTAMP,
+		booking_id INTEGER,
+		FOREIGN KEY(trip_id) REFERENCES trips(id) ON DELETE CASCADE,
+		FOREIGN KEY(booking_id) REFERENCES bookings(id) ON DELETE SET NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_waitlist_trip ON waitlist(trip_id, status);
+	`
+	_, err = DB.Exec(waitlistTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create waitlist table: %w", err)
+	}
+
+	// Create booking_status_history table (every change of a booking's status, with who made it and why)
+	bookingStatusHistoryTableSQL := `
+	CREATE TABLE IF NOT EXISTS booking_status_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		booking_id INTEGER NOT NULL,
+		from_status TEXT,
+		to_status TEXT NOT NULL,
+		actor_id INTEGER,
+		actor_username TEXT,
+		reason TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY(booking_id) REFERENCES bookings(id) ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS idx_booking_status_history_booking ON booking_status_history(booking_id);
+	`
+	_, err = DB.Exec(bookingStatusHistoryTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create booking_status_history table: %w", err)
+	}
+
+	// Create passengers table (one record per national ID; social_id_hash is its blind index)
+	passengersTableSQL := `
+	CREATE TABLE IF NOT EXISTS passengers (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		social_id_hash TEXT NOT NULL UNIQUE,
+		social_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		phone_number TEXT NOT NULL,
+		date_of_birth TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_passengers_phone ON passengers(phone_number);
+	`
+	_, err = DB.Exec(passengersTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create passengers table: %w", err)
+	}
+
+	// Create schema_migrations table (records one-shot data migrations)
+	schemaMigrationsTableSQL := `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		name TEXT PRIMARY KEY,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	`
+	_, err = DB.Exec(schemaMigrationsTableSQL)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	return nil
+}
+
+// dataMigrations are run once, in order, and recorded in schema_migrations
+var dataMigrations = []struct {
+	name string
+	run  func() error
+}{
+	{"encrypt_pii_v1", func() error {
+		count, err := EncryptExistingRecords()
+		if err != nil {
+			return err
+		}
+		log.Printf("Encrypted sensitive fields in %d existing rows", count)
+		return nil
+	}},
+	{"drop_plaintext_reset_codes", func() error {
+		// Superseded by reset_tokens, which only stores hashes
+		_, err := DB.Exec("DROP TABLE IF EXISTS reset_codes")
+		return err
+	}},
+	{"password_changed_at_v1", func() error {
+		// Start the password age of existing accounts from when they were created
+		_, err := DB.Exec("UPDATE users SET password_changed_at = COALESCE(created_at, CURRENT_TIMESTAMP) WHERE password_changed_at IS NULL")
+		return err
+	}},
+	{"seed_builtin_roles_v1", func() error {
+		// Reproduce the Operator, Manager, Accountant and Admin roles as permission sets
+		if err := seedBuiltinRoles(); err != nil {
+			return err
+		}
+		return syncPermissions()
+	}},
+	{"assign_seat_numbers_v1", func() error {
+		// Seat existing bookings, then allow each seat to be held by one active booking per trip
+		if err := assignMissingSeats(); err != nil {
+			return err
+		}
+		_, err := DB.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_bookings_trip_seat ON bookings(trip_id, seat_number)
+			WHERE status != 'Cancelled' AND seat_number IS NOT NULL`)
+		return err
+	}},
+	{"seed_fares_v1", func() error {
+		// Default child and senior discounts, and who may see and set fares
+		if err := seedFareDiscounts(); err != nil {
+			return err
+		}
+		return grantPermissions(map[string][]string{
+			"Operator":   {PermFaresView},
+			"Manager":    {PermFaresView, PermFaresManage},
+			"Accountant": {PermFaresView},
+		})
+	}},
+	{"grant_payment_permissions_v1", func() error {
+		// Cashiers take payments; accountants and managers also pay out refunds
+		return grantPermissions(map[string][]string{
+			"Operator":   {PermPaymentsView, PermPaymentsRecord},
+			"Manager":    {PermPaymentsView, PermPaymentsRecord, PermPaymentsRefund},
+			"Accountant": {PermPaymentsView, PermPaymentsRecord, PermPaymentsRefund},
+		})
+	}},
+	{"seed_cancellation_rules_v1", func() error {
+		// Default refund rules; only managers may override what they give
+		if err := seedCancellationRules(); err != nil {
+			return err
+		}
+		return grantPermissions(map[string][]string{
+			"Manager": {PermBookingsOverrideRefund},
+		})
+	}},
+	{"assign_booking_references_v1", func() error {
+		// Give existing bookings a reference, then keep references unique
+		if err := assignMissingReferences(); err != nil {
+			return err
+		}
+		if _, err := DB.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_bookings_reference ON bookings(reference)"); err != nil {
+			return err
+		}
+		return grantPermissions(map[string][]string{
+			"Operator": {PermTicketsPrint},
+			"Manager":  {PermTicketsPrint},
+		})
+	}},
+	{"grant_boarding_permissions_v1", func() error {
+		// Operators at the door and managers board passengers
+		return grantPermissions(map[string][]string{
+			"Operator": {PermBoardingScan},
+			"Manager":  {PermBoardingScan},
+		})
+	}},
+	{"add_schedules_v1", func() error {
+		// A schedule generates at most one trip per departure
+		if _, err := DB.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_trips_schedule_departure ON trips(schedule_id, departure_time) WHERE schedule_id IS NOT NULL"); err != nil {
+			return err
+		}
+		return grantPermissions(map[string][]string{
+			"Operator": {PermSchedulesManage},
+			"Manager":  {PermSchedulesManage},
+		})
+	}},
+	{"add_stations_and_routes_v1", func() error {
+		if err := migrateToStations(); err != nil {
+			return err
+		}
+		return grantPermissions(map[string][]string{
+			"Manager": {PermRoutesManage},
+		})
+	}},
+	{"add_trip_stops_v1", func() error {
+		// Seats are now sold per segment, so a seat may be held by several
+		// bookings that do not overlap; pickSeat checks this instead
+		if _, err := DB.Exec("DROP INDEX IF EXISTS idx_bookings_trip_seat"); err != nil {
+			return err
+		}
+		return migrateTripStops()
+	}},
+	{"booking_state_machine_v1", migrateBookingStatuses},
+	{"add_passengers_v1", func() error {
+		if _, err := DB.Exec("CREATE INDEX IF NOT EXISTS idx_bookings_passenger ON bookings(passenger_id)"); err != nil {
+			return err
+		}
+		if err := migratePassengers(); err != nil {
+			return err
+		}
+		return grantPermissions(map[string][]string{
+			"Manager": {PermPassengersMerge},
+		})
+	}},
+	{"waitlist_booking_holds_v1", func() error {
+		// Waitlist offers expire from their booking, like seat holds
+		_, err := DB.Exec(`
+			UPDATE bookings SET hold_expires_at = (
+				SELECT w.hold_expires_at FROM waitlist w WHERE w.booking_id = bookings.id AND w.status = ?
+			)
+			WHERE hold_expires_at IS NULL AND status = ?
+			  AND id IN (SELECT booking_id FROM waitlist WHERE status = ? AND hold_expires_at IS NOT NULL)
+		`, WaitlistOffered, BookingHeld, WaitlistOffered)
+		return err
+	}},
+}
+
+// runDataMigrations applies any data migration that has not been recorded yet
+func runDataMigrations() error {
+	for _, m := range dataMigrations {
+		var applied int
+		err := DB.QueryRow("SELECT COUNT(*) FROM schema_migrations WHERE name = ?", m.name).Scan(&applied)
+		if err != nil {
+			return fmt.Errorf("failed to check migration %s: %w", m.name, err)
+		}
+		if applied > 0 {
+			continue
+		}
+
+		log.Printf("Applying data migration %s...", m.name)
+		if err := m.run(); err != nil {
+			return fmt.Errorf("migration %s failed: %w", m.name, err)
+		}
+		if _, err := DB.Exec("INSERT INTO schema_migrations (name) VALUES (?)", m.name); err != nil {
+			return fmt.Errorf("failed to record migration %s: %w", m.name, err)
+		}
+	}
 	return nil
 }
 
@@ -314,7 +911,10 @@ func migrateSchema() error {
 			last_maintenance_date TEXT,
 			next_maintenance_date TEXT,
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			notes TEXT
+			notes TEXT,
+			seat_columns INTEGER DEFAULT 4,
+			aisle_after INTEGER DEFAULT 2,
+			seat_letters TEXT
 		);
 		`
 		_, err := DB.Exec(vehiclesTableSQL)
@@ -371,6 +971,82 @@ func migrateSchema() error {
 		log.Println("Added 'role' column to users table")
 	}
 
+	// Add columns introduced after the original tables were created
+	addedColumns := []struct{ table, name, definition string }{
+		// Account lockout
+		{"users", "failed_login_count", "INTEGER DEFAULT 0"},
+		{"users", "last_failed_login", "TIMESTAMP"},
+		{"users", "lockout_count", "INTEGER DEFAULT 0"},
+		{"users", "locked_until", "TIMESTAMP"},
+		// Two-factor authentication
+		{"users", "totp_secret", "TEXT"},
+		{"users", "totp_enabled", "INTEGER DEFAULT 0"},
+		{"users", "totp_last_step", "INTEGER"},
+		{"sessions", "pending_2fa", "INTEGER DEFAULT 0"},
+		// Password policy
+		{"users", "password_changed_at", "TIMESTAMP"},
+		{"users", "must_change_password", "INTEGER DEFAULT 0"},
+		// CSRF protection
+		{"sessions", "csrf_token", "TEXT"},
+		// Seat maps
+		{"vehicles", "seat_columns", "INTEGER DEFAULT 4"},
+		{"vehicles", "aisle_after", "INTEGER DEFAULT 2"},
+		{"vehicles", "seat_letters", "TEXT"},
+		{"bookings", "seat_number", "TEXT"},
+		// Fares
+		{"bookings", "fare_id", "INTEGER"},
+		{"bookings", "fare_category", "TEXT"},
+		{"bookings", "base_fare_cents", "INTEGER"},
+		{"bookings", "fare_multiplier", "REAL"},
+		{"bookings", "discount_percent", "INTEGER"},
+		{"bookings", "price_cents", "INTEGER"},
+		// Cancellations
+		{"bookings", "cancelled_at", "TIMESTAMP"},
+		{"bookings", "cancelled_by", "TEXT"},
+		{"bookings", "refund_percent", "INTEGER"},
+		{"bookings", "refund_cents", "INTEGER"},
+		{"bookings", "refund_overridden", "INTEGER NOT NULL DEFAULT 0"},
+		{"bookings", "cancellation_reason", "TEXT"},
+		// Tickets
+		{"bookings", "reference", "TEXT"},
+		{"bookings", "ticket_issued_at", "TIMESTAMP"},
+		{"bookings", "ticket_prints", "INTEGER NOT NULL DEFAULT 0"},
+		// Boarding
+		{"bookings", "boarded_at", "TIMESTAMP"},
+		{"bookings", "boarded_by_id", "INTEGER"},
+		{"bookings", "boarded_by", "TEXT"},
+		// Timetables
+		{"trips", "schedule_id", "INTEGER REFERENCES schedules(id) ON DELETE SET NULL"},
+		// Stations and routes
+		{"trips", "route_id", "INTEGER REFERENCES routes(id)"},
+		{"schedules", "route_id", "INTEGER REFERENCES routes(id)"},
+		// Multi-stop trips
+		{"bookings", "boarding_stop", "INTEGER NOT NULL DEFAULT 0"},
+		{"bookings", "alighting_stop", "INTEGER"},
+		// Seat holds
+		{"bookings", "hold_expires_at", "TIMESTAMP"},
+		// Passenger registry
+		{"bookings", "passenger_id", "INTEGER REFERENCES passengers(id)"},
+	}
+	for _, col := range addedColumns {
+		var exists int
+		err = DB.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", col.table, col.name).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("failed to check if %s.%s column exists: %w", col.table, col.name, err)
+		}
+		if exists == 0 {
+			var tableExists int
+			if err := DB.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name = ?", col.table).Scan(&tableExists); err != nil || tableExists == 0 {
+				// Table is created with the column later in initializeSchema
+				continue
+			}
+			log.Printf("Adding '%s' column to %s table...", col.name, col.table)
+			if _, err := DB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", col.table, col.name, col.definition)); err != nil {
+				return fmt.Errorf("failed to add %s.%s column: %w", col.table, col.name, err)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -386,18 +1062,27 @@ func AddUser(username, passwordHash, dob, ssn string, email string, role string)
 		role = "Operator"
 	}
 
-	// Prepare the SQL statement for inserting a new user
-	stmt, err := DB.Prepare(`
-		INSERT INTO users (username, password, date_of_birth, social_security, email, role)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`)
+	// Encrypt sensitive fields before they reach the database
+	encDOB, err := EncryptField(dob)
 	if err != nil {
-		return 0, fmt.Errorf("failed to prepare statement: %w", err)
+		return 0, fmt.Errorf("failed to encrypt date of birth: %w", err)
+	}
+	encSSN, err := EncryptField(ssn)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encrypt social security number: %w", err)
 	}
-	defer stmt.Close()
 
-	// Execute the statement with the provided values
-	result, err := stmt.Exec(username, passwordHash, dob, ssn, email, role)
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Insert the user, starting the password age now
+	result, err := tx.Exec(`
+		INSERT INTO users (username, password, date_of_birth, social_security, email, role, password_changed_at)
+		VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`, username, passwordHash, encDOB, encSSN, email, role)
 	if err != nil {
 		return 0, fmt.Errorf("failed to insert user: %w", err)
 	}
@@ -408,6 +1093,13 @@ func AddUser(username, passwordHash, dob, ssn string, email string, role string)
 		return 0, fmt.Errorf("failed to get last insert ID: %w", err)
 	}
 
+	if err := recordPasswordHistory(tx, userID, passwordHash); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit new user: %w", err)
+	}
+
 	return userID, nil
 }
 
@@ -466,16 +1158,6 @@ func GetUserByID(userID int) (*sql.Row, error) {
 	return row, nil // Error checking deferred to Scan
 }
 
-// UpdateUserPassword updates a user's password hash (SQLite).
-func UpdateUserPassword(userID int, newPasswordHash string) error {
-	query := "UPDATE users SET password = ? WHERE id = ?"
-	_, err := DB.Exec(query, newPasswordHash, userID)
-	if err != nil {
-		return fmt.Errorf("error updating password for user ID %d: %w", userID, err)
-	}
-	return nil
-}
-
 // UpdateUsername updates a user's username in the database.
 func UpdateUsername(userID int64, newUsername string) error {
 	// Check if username already exists
@@ -516,7 +1198,13 @@ func LogLoginAttempt(userID int64, ipAddress string, success bool) error {
 
 // GetAllUsers retrieves all users (SQLite).
 func GetAllUsers() (*sql.Rows, error) {
-	rows, err := DB.Query("SELECT id, username, email, password, created_at, date_of_birth, social_security, role FROM users ORDER BY username")
+	query := `
+		SELECT id, username, email, password, created_at, date_of_birth, social_security, role,
+			CASE WHEN locked_until > ? THEN locked_until END AS locked_until
+		FROM users
+		ORDER BY username
+	`
+	rows, err := DB.Query(query, sqlTime(time.Now()))
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving all users: %w", err)
 	}
@@ -539,47 +1227,6 @@ func GetLoginHistory() (*sql.Rows, error) {
 	return rows, nil
 }
 
-// StoreResetCode stores a new reset code for a user
-func StoreResetCode(userID int64, code string, expiresAt time.Time) error {
-	query := "INSERT INTO reset_codes (user_id, code, expires_at) VALUES (?, ?, ?)"
-	_, err := DB.Exec(query, userID, code, expiresAt)
-	if err != nil {
-		return fmt.Errorf("error storing reset code: %w", err)
-	}
-	return nil
-}
-
-// ValidateResetCode checks if a reset code is valid and not expired
-func ValidateResetCode(code string) (int64, error) {
-	query := `
-		SELECT user_id 
-		FROM reset_codes 
-		WHERE code = ? 
-		AND used = 0 
-		AND expires_at > CURRENT_TIMESTAMP
-		LIMIT 1
-	`
-	var userID int64
-	err := DB.QueryRow(query, code).Scan(&userID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return 0, fmt.Errorf("invalid or expired reset code")
-		}
-		return 0, fmt.Errorf("error validating reset code: %w", err)
-	}
-	return userID, nil
-}
-
-// MarkResetCodeUsed marks a reset code as used
-func MarkResetCodeUsed(code string) error {
-	query := "UPDATE reset_codes SET used = 1 WHERE code = ?"
-	_, err := DB.Exec(query, code)
-	if err != nil {
-		return fmt.Errorf("error marking reset code as used: %w", err)
-	}
-	return nil
-}
-
 // CheckEmailExists checks if an email address already exists in the database
 func CheckEmailExists(email string) (bool, error) {
 	// Check if email column exists
@@ -684,10 +1331,15 @@ func EnsureAdminUser() error {
 		}
 		
 		// Insert the admin user
-		_, err = AddUser("admin", string(hashedPassword), "", "", "admin@example.com", "Admin")
+		adminID, err := AddUser("admin", string(hashedPassword), "", "", "admin@example.com", "Admin")
 		if err != nil {
 			return fmt.Errorf("error creating default admin user: %w", err)
 		}
+
+		// The default password is public, so it has to be changed at first login
+		if err := RequirePasswordChange(adminID); err != nil {
+			return fmt.Errorf("error flagging default admin password for change: %w", err)
+		}
 		
 		log.Println("Default admin user created successfully. Username: admin, Password: admin")
 	}
@@ -695,6 +1347,16 @@ func EnsureAdminUser() error {
 	return nil
 }
 
+// GetUserRole returns the role of a user. It returns sql.ErrNoRows if the user does not exist.
+func GetUserRole(userID int64) (string, error) {
+	var role string
+	err := DB.QueryRow("SELECT role FROM users WHERE id = ?", userID).Scan(&role)
+	if err != nil {
+		return "", err
+	}
+	return role, nil
+}
+
 // UpdateUserRole updates a user's role in the database.
 func UpdateUserRole(userID int64, newRole string) error {
 	query := "UPDATE users SET role = ? WHERE id = ?"
@@ -717,8 +1379,9 @@ func DeleteUser(userID int64) error {
 
 // --- Vehicle Functions ---
 
-// AddVehicle adds a new vehicle to the database
-func AddVehicle(vehicleNumber, vehicleType string, capacity int, status, lastMaintenance, nextMaintenance, notes string) (int64, error) {
+// AddVehicle adds a new vehicle to the database. Its capacity is the number of
+// seats in its layout.
+func AddVehicle(vehicleNumber, vehicleType string, layout SeatLayout, status, lastMaintenance, nextMaintenance, notes string) (int64, error) {
 	// Validate inputs (basic check)
 	if vehicleNumber == "" || vehicleType == "" || status == "" {
 		return 0, fmt.Errorf("vehicle number, type, and status are required")
@@ -726,8 +1389,9 @@ func AddVehicle(vehicleNumber, vehicleType string, capacity int, status, lastMai
 
 	// Prepare the SQL statement for inserting a new vehicle
 	stmt, err := DB.Prepare(`
-		INSERT INTO vehicles (vehicle_number, type, capacity, status, last_maintenance_date, next_maintenance_date, notes)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO vehicles (vehicle_number, type, capacity, status, last_maintenance_date, next_maintenance_date, notes,
+			seat_columns, aisle_after, seat_letters)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`)
 	if err != nil {
 		return 0, fmt.Errorf("failed to prepare statement: %w", err)
@@ -735,7 +1399,8 @@ func AddVehicle(vehicleNumber, vehicleType string, capacity int, status, lastMai
 	defer stmt.Close()
 
 	// Execute the statement with the provided values
-	result, err := stmt.Exec(vehicleNumber, vehicleType, capacity, status, lastMaintenance, nextMaintenance, notes)
+	result, err := stmt.Exec(vehicleNumber, vehicleType, layout.Capacity, status, lastMaintenance, nextMaintenance, notes,
+		layout.Columns, layout.AisleAfter, layout.Letters)
 	if err != nil {
 		return 0, fmt.Errorf("failed to insert vehicle: %w", err)
 	}
@@ -753,7 +1418,8 @@ func AddVehicle(vehicleNumber, vehicleType string, capacity int, status, lastMai
 func GetAllVehicles() (*sql.Rows, error) {
 	rows, err := DB.Query(`
 		SELECT id, vehicle_number, type, capacity, status, 
-			   last_maintenance_date, next_maintenance_date, created_at, notes 
+			   last_maintenance_date, next_maintenance_date, created_at, notes,
+			   seat_columns, aisle_after, seat_letters
 		FROM vehicles 
 		ORDER BY vehicle_number
 	`)
@@ -767,7 +1433,8 @@ func GetAllVehicles() (*sql.Rows, error) {
 func GetAvailableVehicles(departureTime, arrivalTime string) (*sql.Rows, error) {
 	query := `
 		SELECT id, vehicle_number, type, capacity, status,
-		       last_maintenance_date, next_maintenance_date, created_at, notes
+		       last_maintenance_date, next_maintenance_date, created_at, notes,
+		       seat_columns, aisle_after, seat_letters
 		FROM vehicles
 		WHERE status != 'Under repair'
 		  AND (next_maintenance_date IS NULL OR next_maintenance_date < ? OR next_maintenance_date > ?)
@@ -789,7 +1456,8 @@ func GetAvailableVehicles(departureTime, arrivalTime string) (*sql.Rows, error)
 func GetVehicleByID(vehicleID int64) (*sql.Row, error) {
 	query := `
 		SELECT id, vehicle_number, type, capacity, status, 
-			   last_maintenance_date, next_maintenance_date, created_at, notes 
+			   last_maintenance_date, next_maintenance_date, created_at, notes,
+			   seat_columns, aisle_after, seat_letters
 		FROM vehicles 
 		WHERE id = ?
 	`
@@ -797,8 +1465,8 @@ func GetVehicleByID(vehicleID int64) (*sql.Row, error) {
 	return row, nil
 }
 
-// UpdateVehicle updates a vehicle's information in the database
-func UpdateVehicle(vehicleID int64, vehicleNumber, vehicleType string, capacity int, 
+// UpdateVehicle updates a vehicle's information and seat layout in the database
+func UpdateVehicle(vehicleID int64, vehicleNumber, vehicleType string, layout SeatLayout, 
 				  status, lastMaintenance, nextMaintenance, notes string) error {
 	// Validate inputs
 	if vehicleNumber == "" || vehicleType == "" || status == "" {
@@ -825,11 +1493,14 @@ func UpdateVehicle(vehicleID int64, vehicleNumber, vehicleType string, capacity
 			status = ?, 
 			last_maintenance_date = ?, 
 			next_maintenance_date = ?, 
-			notes = ? 
+			notes = ?,
+			seat_columns = ?,
+			aisle_after = ?,
+			seat_letters = ?
 		WHERE id = ?
 	`
-	_, err = DB.Exec(query, vehicleNumber, vehicleType, capacity, status, 
-					lastMaintenance, nextMaintenance, notes, vehicleID)
+	_, err = DB.Exec(query, vehicleNumber, vehicleType, layout.Capacity, status, 
+					lastMaintenance, nextMaintenance, notes, layout.Columns, layout.AisleAfter, layout.Letters, vehicleID)
 	if err != nil {
 		return fmt.Errorf("error updating vehicle with ID %d: %w", vehicleID, err)
 	}
@@ -848,28 +1519,30 @@ func DeleteVehicle(vehicleID int64) error {
 
 // --- Trip Functions ---
 
-// AddTrip adds a new trip to the database
-func AddTrip(origin, destination string, vehicleID int64, departureTime, arrivalTime string) (int64, error) {
+// AddTrip adds a new trip on a route to the database. Its origin and
+// destination are the ends of the route, and it calls at every stop of the
+// route, at times spaced evenly between its departure and arrival.
+func AddTrip(routeID, vehicleID int64, departureTime, arrivalTime string) (int64, error) {
 	// Validate departure before arrival
 	if departureTime >= arrivalTime {
 		return 0, fmt.Errorf("departure time must be before arrival time")
 	}
-	
-	// Validate origin and destination are different
-	if origin == destination {
-		return 0, fmt.Errorf("origin and destination cannot be the same city")
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	
-	stmt, err := DB.Prepare(`
-		INSERT INTO trips (origin, destination, vehicle_id, departure_time, arrival_time)
-		VALUES (?, ?, ?, ?, ?)
-	`)
+	defer tx.Rollback()
+
+	route, err := resolveRoute(tx, routeID, "", "")
 	if err != nil {
-		return 0, fmt.Errorf("failed to prepare trip insert: %w", err)
+		return 0, err
 	}
-	defer stmt.Close()
 
-	res, err := stmt.Exec(origin, destination, vehicleID, departureTime, arrivalTime)
+	res, err := tx.Exec(`
+		INSERT INTO trips (origin, destination, vehicle_id, departure_time, arrival_time, route_id)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, route.Origin, route.Destination, vehicleID, departureTime, arrivalTime, route.ID)
 	if err != nil {
 		return 0, fmt.Errorf("failed to insert trip: %w", err)
 	}
@@ -878,15 +1551,23 @@ func AddTrip(origin, destination string, vehicleID int64, departureTime, arrival
 	if err != nil {
 		return 0, fmt.Errorf("failed to retrieve trip id: %w", err)
 	}
+	if err := writeTripStops(tx, id, route, departureTime, arrivalTime); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit trip: %w", err)
+	}
 	return id, nil
 }
 
 // GetAllTrips retrieves all trips
 func GetAllTrips() (*sql.Rows, error) {
 	rows, err := DB.Query(`
-		SELECT t.id, t.origin, t.destination, t.vehicle_id, t.departure_time, t.arrival_time, t.created_at, v.vehicle_number
+		SELECT t.id, t.origin, t.destination, t.vehicle_id, t.departure_time, t.arrival_time, t.created_at, v.vehicle_number,
+			COALESCE(t.route_id, 0), COALESCE(r.name, '')
 		FROM trips t
 		LEFT JOIN vehicles v ON t.vehicle_id = v.id
+		LEFT JOIN routes r ON t.route_id = r.id
 		ORDER BY t.departure_time DESC
 	`)
 	if err != nil {
@@ -895,68 +1576,247 @@ func GetAllTrips() (*sql.Rows, error) {
 	return rows, nil
 }
 
-// UpdateTrip updates trip details
-func UpdateTrip(id int64, origin, destination string, vehicleID int64, departureTime, arrivalTime string) error {
+// UpdateTrip updates trip details. Its origin and destination are the ends
+// of the route. A trip moved to another route calls at that route's stops,
+// unless passengers board or alight at intermediate stops (ErrStopsBooked);
+// a trip that keeps its route keeps its stops, moved in proportion to its new
+// departure and arrival.
+func UpdateTrip(id, routeID, vehicleID int64, departureTime, arrivalTime string) error {
 	// Validate departure before arrival
 	if departureTime >= arrivalTime {
 		return fmt.Errorf("departure time must be before arrival time")
 	}
-	
-	// Validate origin and destination are different
-	if origin == destination {
-		return fmt.Errorf("origin and destination cannot be the same city")
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	
-	stmt, err := DB.Prepare(`
-		UPDATE trips SET origin=?, destination=?, vehicle_id=?, departure_time=?, arrival_time=? WHERE id=?
-	`)
+	defer tx.Rollback()
+
+	route, err := resolveRoute(tx, routeID, "", "")
 	if err != nil {
-		return fmt.Errorf("failed to prepare trip update: %w", err)
+		return err
+	}
+
+	var currentRoute sql.NullInt64
+	var currentDeparture, currentArrival string
+	err = tx.QueryRow("SELECT route_id, departure_time, arrival_time FROM trips WHERE id = ?", id).Scan(&currentRoute, &currentDeparture, &currentArrival)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return err
+		}
+		return fmt.Errorf("failed to retrieve trip: %w", err)
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(origin, destination, vehicleID, departureTime, arrivalTime, id)
+	_, err = tx.Exec(`
+		UPDATE trips SET origin=?, destination=?, vehicle_id=?, departure_time=?, arrival_time=?, route_id=? WHERE id=?
+	`, route.Origin, route.Destination, vehicleID, departureTime, arrivalTime, route.ID, id)
 	if err != nil {
 		return fmt.Errorf("failed to update trip: %w", err)
 	}
+
+	if currentRoute.Int64 != route.ID {
+		if booked, err := stopsBooked(tx, id); err != nil {
+			return err
+		} else if booked {
+			return ErrStopsBooked
+		}
+		err = writeTripStops(tx, id, route, departureTime, arrivalTime)
+	} else if currentDeparture != departureTime || currentArrival != arrivalTime {
+		err = retimeTripStops(tx, id, currentDeparture, currentArrival, departureTime, arrivalTime)
+	}
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit trip update: %w", err)
+	}
 	return nil
 }
 
-// DeleteTrip deletes a trip by ID
+// DeleteTrip deletes a trip by ID along with its bookings. A trip with a
+// booking that has payments cannot be deleted (ErrTripHasPayments), since the
+// ledger must keep them; cancel its bookings instead.
 func DeleteTrip(id int64) error {
-	_, err := DB.Exec("DELETE FROM trips WHERE id=?", id)
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var payments int
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM payments p
+		JOIN bookings b ON p.booking_id = b.id
+		WHERE b.trip_id = ?
+	`, id).Scan(&payments)
 	if err != nil {
+		return fmt.Errorf("error checking trip payments: %w", err)
+	}
+	if payments > 0 {
+		return ErrTripHasPayments
+	}
+	if _, err := tx.Exec("DELETE FROM trips WHERE id=?", id); err != nil {
+		return fmt.Errorf("failed to delete trip: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("failed to delete trip: %w", err)
 	}
 	return nil
 }
 
-// AddBooking adds a new booking to the database
-func AddBooking(tripID int64, passenger, socialID, phoneNumber, dateOfBirth, status string) (int64, error) {
+// NewBooking is what AddBooking returns about the booking it made. Fare is nil
+// if the booking is unpriced.
+type NewBooking struct {
+	ID            int64      `json:"booking_id"`
+	Reference     string     `json:"reference"`
+	SeatNumber    string     `json:"seat_number"`
+	Fare          *FareQuote `json:"fare"`
+	HoldExpiresAt *time.Time `json:"hold_expires_at,omitempty"`
+}
+
+// BookingRequest is a booking to be made by AddBooking, whose Status must be
+// Confirmed, or a seat hold to be made by HoldSeat. Boarding and Alighting are
+// station names or codes; empty means the trip's ends. An empty SeatNumber lets AddBooking choose the seat. The
+// staff member making the booking is recorded in its status history.
+type BookingRequest struct {
+	TripID        int64  `json:"trip_id"`
+	Passenger     string `json:"passenger"`
+	SocialID      string `json:"social_id"`
+	PhoneNumber   string `json:"phone_number"`
+	DateOfBirth   string `json:"date_of_birth"`
+	Status        string `json:"status"`
+	SeatNumber    string `json:"seat_number"`
+	Boarding      string `json:"boarding"`
+	Alighting     string `json:"alighting"`
+	ActorID       int64  `json:"-"`
+	ActorUsername string `json:"-"`
+}
+
+// AddBooking adds a new booking to the database with a random booking
+// reference, and returns its ID, reference, seat and price. It is the one way
+// bookings are made: the trip's free seats are checked and the booking
+// inserted in a single write transaction, so two bookings made at once cannot
+// both take the last seat. The passenger travels from the boarding to the
+// alighting station; ErrNotAStop and ErrInvalidSegment report stops that do
+// not fit the trip. An active booking gets the requested seat, or a seat that
+// is free between the two stops if none was requested; ErrSeatTaken,
+// ErrInvalidSeat and ErrTripFull report why it could not be seated. The price
+// is quoted from the fare between the two stops in effect on the day the
+// passenger boards and stored with the booking; it is nil if there is no fare
+// that day.
+func AddBooking(b BookingRequest) (*NewBooking, error) {
 	// Validate inputs
-	if tripID == 0 || passenger == "" || status == "" {
-		return 0, fmt.Errorf("trip ID, passenger name, and status are required")
+	if b.TripID == 0 || b.Passenger == "" || b.Status == "" {
+		return nil, fmt.Errorf("trip ID, passenger name, and status are required")
 	}
-	
-	// Prepare insert
-	stmt, err := DB.Prepare("INSERT INTO bookings (trip_id, passenger, social_id, phone_number, date_of_birth, status) VALUES (?, ?, ?, ?, ?, ?)")
+	if !IsValidBookingStatus(b.Status) {
+		return nil, ErrInvalidStatus
+	}
+	// Held bookings are made only by HoldSeat and promoteWaitlist, which set
+	// when the hold runs out
+	if b.Status != BookingConfirmed {
+		return nil, &BookingTransitionError{From: "new", To: b.Status}
+	}
+
+	tx, err := DB.Begin()
 	if err != nil {
-		return 0, fmt.Errorf("failed to prepare booking insert: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	seg, stops, err := tripSegment(tx, b.TripID, b.Boarding, b.Alighting)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("trip not found")
+		}
+		return nil, err
+	}
+
+	booking, err := insertBooking(tx, b, seg, stops)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit booking: %w", err)
+	}
+	return booking, nil
+}
+
+// insertBooking seats, prices and inserts a booking of the given segment of
+// its trip within a write transaction. Boarding and Alighting of the request
+// are ignored in favour of seg.
+func insertBooking(tx *sql.Tx, b BookingRequest, seg Segment, stops []TripStop) (*NewBooking, error) {
+	// Encrypt sensitive passenger fields
+	encSocialID, err := EncryptField(b.SocialID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt social ID: %w", err)
+	}
+	encDOB, err := EncryptField(b.DateOfBirth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt date of birth: %w", err)
+	}
+
+	// Keep the passenger in the registry
+	passengerID, err := savePassenger(tx, b, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	// Seat the passenger
+	picked, err := reserveSeat(tx, b.TripID, seg, NormalizeSeatLabel(b.SeatNumber))
+	if err != nil {
+		return nil, err
+	}
+	seat := sql.NullString{String: picked, Valid: true}
+
+	reference, err := uniqueReference(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Price the ticket; routes without a fare are booked unpriced
+	quote, err := quoteFare(tx, b.TripID, stops[seg.From], stops[seg.last(stops)], b.DateOfBirth)
+	if err == ErrNoFare {
+		log.Printf("Warning: No fare for trip %d, booking for %s is unpriced", b.TripID, b.Passenger)
+		quote = nil
+	} else if err != nil {
+		return nil, err
+	}
+	var fareID, baseFare, discount, price sql.NullInt64
+	var category sql.NullString
+	var multiplier sql.NullFloat64
+	if quote != nil {
+		fareID = sql.NullInt64{Int64: quote.FareID, Valid: true}
+		category = sql.NullString{String: quote.Category, Valid: true}
+		baseFare = sql.NullInt64{Int64: quote.BaseFareCents, Valid: true}
+		multiplier = sql.NullFloat64{Float64: quote.Multiplier, Valid: true}
+		discount = sql.NullInt64{Int64: int64(quote.DiscountPercent), Valid: true}
+		price = sql.NullInt64{Int64: quote.PriceCents, Valid: true}
 	}
-	defer stmt.Close()
 
 	// Execute insert
-	res, err := stmt.Exec(tripID, passenger, socialID, phoneNumber, dateOfBirth, status)
+	res, err := tx.Exec(`
+		INSERT INTO bookings (trip_id, passenger, social_id, phone_number, date_of_birth, status, seat_number,
+			fare_id, fare_category, base_fare_cents, fare_multiplier, discount_percent, price_cents, reference,
+			boarding_stop, alighting_stop, passenger_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, b.TripID, b.Passenger, encSocialID, b.PhoneNumber, encDOB, b.Status, seat,
+		fareID, category, baseFare, multiplier, discount, price, reference,
+		seg.From, seg.alightingStop(), sql.NullInt64{Int64: passengerID, Valid: passengerID != 0})
 	if err != nil {
-		return 0, fmt.Errorf("failed to insert booking: %w", err)
+		return nil, fmt.Errorf("failed to insert booking: %w", err)
 	}
 
 	// Get new ID
 	id, err := res.LastInsertId()
 	if err != nil {
-		return 0, fmt.Errorf("failed to retrieve booking id: %w", err)
+		return nil, fmt.Errorf("failed to retrieve booking id: %w", err)
 	}
-	return id, nil
+	if err := recordStatusChange(tx, id, "", b.Status, b.ActorID, b.ActorUsername, "", time.Now()); err != nil {
+		return nil, err
+	}
+	return &NewBooking{ID: id, Reference: reference, SeatNumber: seat.String, Fare: quote}, nil
 }
 
 // GetAllBookings retrieves all bookings
@@ -964,28 +1824,137 @@ func GetAllBookings() (*sql.Rows, error) {
 	return GetFilteredBookings(nil, "", "")
 }
 
-// UpdateBookingStatus updates the status of a booking
-func UpdateBookingStatus(bookingID int64, status string) error {
-	_, err := DB.Exec("UPDATE bookings SET status = ? WHERE id = ?", status, bookingID)
+// UpdateBookingStatus changes the status of a booking as the given staff
+// member, recording the reason in its status history. The change must be one
+// the booking state machine allows (see setBookingStatus). A cancelled booking
+// that is reinstated gets its old seat back if it is still free for its
+// segment, or else another free seat; ErrTripFull if there is none. Its
+// cancellation details are cleared, though any refund stays in the ledger.
+// Bookings are cancelled with CancelBooking so the refund rules apply,
+// boarded by scanning their ticket, and Held bookings are confirmed with
+// ConfirmHold or ConfirmWaitlistOffer so expired holds cannot be.
+func UpdateBookingStatus(bookingID int64, status string, actorID int64, actorUsername, reason string) error {
+	if status == BookingCancelled {
+		return fmt.Errorf("bookings must be cancelled with CancelBooking")
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var tripID int64
+	var current string
+	var seat sql.NullString
+	var boarding int
+	var alighting sql.NullInt64
+	err = tx.QueryRow("SELECT trip_id, status, seat_number, boarding_stop, alighting_stop FROM bookings WHERE id = ?", bookingID).
+		Scan(&tripID, &current, &seat, &boarding, &alighting)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return err
+		}
+		return fmt.Errorf("error retrieving booking: %w", err)
+	}
+	if status == BookingBoarded {
+		return &BookingTransitionError{From: current, To: status, Reason: "passengers are boarded by scanning their ticket"}
+	}
+	// Holds are confirmed through ConfirmHold or ConfirmWaitlistOffer, which
+	// check that they have not run out
+	if current == BookingHeld {
+		return &BookingTransitionError{From: current, To: status, Reason: "confirm or release it as a seat hold or waitlist offer"}
+	}
+
+	// Seat a reinstated booking while it still counts as cancelled
+	reinstating := current == BookingCancelled && !isReleased(status) && CanChangeBookingStatus(current, status)
+	if reinstating {
+		seg := bookingSegment(boarding, alighting)
+		picked, err := reserveSeat(tx, tripID, seg, seat.String)
+		if err == ErrSeatTaken || err == ErrInvalidSeat {
+			picked, err = reserveSeat(tx, tripID, seg, "")
+		}
+		if err != nil {
+			return err
+		}
+		seat = sql.NullString{String: picked, Valid: true}
+	}
+
+	if _, err := setBookingStatus(tx, bookingID, status, actorID, actorUsername, reason, time.Now()); err != nil {
+		return err
+	}
+
+	if reinstating {
+		_, err = tx.Exec(`
+			UPDATE bookings SET seat_number = ?, cancelled_at = NULL, cancelled_by = NULL, refund_percent = NULL,
+				refund_cents = NULL, refund_overridden = 0, cancellation_reason = NULL
+			WHERE id = ?
+		`, seat, bookingID)
+		if err != nil {
+			return fmt.Errorf("error clearing cancellation: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("error updating booking status: %w", err)
 	}
 	return nil
 }
 
-// DeleteBooking deletes a booking
-func DeleteBooking(bookingID int64) error {
-	_, err := DB.Exec("DELETE FROM bookings WHERE id = ?", bookingID)
+// DeleteBooking deletes a booking. Bookings with payments in the ledger
+// cannot be deleted (ErrBookingHasPayments); cancel them instead. A seat the
+// booking held is offered to the trip's waitlist in the same transaction, and
+// the offers made are returned. It returns sql.ErrNoRows if the booking does
+// not exist.
+func DeleteBooking(bookingID int64) ([]WaitlistOffer, error) {
+	tx, err := DB.Begin()
 	if err != nil {
-		return fmt.Errorf("error deleting booking: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
-	return nil
+	defer tx.Rollback()
+
+	var tripID int64
+	var status string
+	if err := tx.QueryRow("SELECT trip_id, status FROM bookings WHERE id = ?", bookingID).Scan(&tripID, &status); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error retrieving booking: %w", err)
+	}
+	var payments int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM payments WHERE booking_id = ?", bookingID).Scan(&payments); err != nil {
+		return nil, fmt.Errorf("error checking booking payments: %w", err)
+	}
+	if payments > 0 {
+		return nil, ErrBookingHasPayments
+	}
+	if err := settleWaitlistOffer(tx, bookingID, WaitlistExpired); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM bookings WHERE id = ?", bookingID); err != nil {
+		return nil, fmt.Errorf("error deleting booking: %w", err)
+	}
+
+	var offers []WaitlistOffer
+	if !isReleased(status) {
+		if offers, err = promoteWaitlist(tx, tripID, time.Now()); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error deleting booking: %w", err)
+	}
+	return offers, nil
 }
 
-// FindTripByRoute finds a trip by origin and destination
+// FindTripByRoute finds a trip by origin and destination, given as station names or codes
 func FindTripByRoute(origin, destination string) (int64, error) {
+	origin, destination, err := canonicalEndpoints(DB, origin, destination)
+	if err != nil {
+		return 0, err
+	}
 	var tripID int64
-	err := DB.QueryRow("SELECT id FROM trips WHERE origin = ? AND destination = ? ORDER BY departure_time LIMIT 1", origin, destination).Scan(&tripID)
+	err = DB.QueryRow("SELECT id FROM trips WHERE origin = ? AND destination = ? ORDER BY departure_time LIMIT 1", origin, destination).Scan(&tripID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return 0, fmt.Errorf("no trip found for route %s to %s", origin, destination)
@@ -997,7 +1966,10 @@ func FindTripByRoute(origin, destination string) (int64, error) {
 
 // GetFilteredBookings retrieves bookings with optional filtering and ordering
 func GetFilteredBookings(filter map[string]string, orderBy string, orderDir string) (*sql.Rows, error) {
-	query := `SELECT b.id, b.trip_id, b.passenger, b.social_id, b.phone_number, b.date_of_birth, b.booking_date, b.status, t.origin, t.destination, t.departure_time
+	query := `SELECT b.id, b.trip_id, b.passenger, b.social_id, b.phone_number, b.date_of_birth, b.booking_date, b.status, t.origin, t.destination, t.departure_time, COALESCE(b.seat_number, ''),
+		b.price_cents, COALESCE(b.fare_category, ''),
+		COALESCE((SELECT SUM(p.amount_cents) FROM payments p WHERE p.booking_id = b.id), 0), COALESCE(b.reference, ''),
+		`+boardingStationSQL+`, `+alightingStationSQL+`, b.hold_expires_at, b.passenger_id
 	FROM bookings b
 	JOIN trips t ON b.trip_id = t.id
 	WHERE 1=1`
@@ -1010,6 +1982,10 @@ func GetFilteredBookings(filter map[string]string, orderBy string, orderDir stri
 			query += " AND b.passenger LIKE ?"
 			args = append(args, "%"+v+"%")
 		}
+		if v, ok := filter["reference"]; ok && v != "" {
+			query += " AND b.reference = ?"
+			args = append(args, NormalizeReference(v))
+		}
 		if v, ok := filter["origin"]; ok && v != "" {
 			query += " AND t.origin = ?"
 			args = append(args, v)
@@ -1114,7 +2090,7 @@ func GetTripBookingsCount(tripID int64) (int, error) {
 	err := DB.QueryRow(`
 		SELECT COUNT(*) 
 		FROM bookings 
-		WHERE trip_id = ? AND status != 'Cancelled'
+		WHERE trip_id = ? AND status NOT IN `+releasedStatusesSQL+`
 	`, tripID).Scan(&count)
 	
 	if err != nil {
@@ -1131,7 +2107,7 @@ func GetVehicleBookingsCount(vehicleID int64) (int, error) {
 		SELECT COUNT(*)
 		FROM bookings b
 		JOIN trips t ON b.trip_id = t.id
-		WHERE t.vehicle_id = ? AND b.status != 'Cancelled'
+		WHERE t.vehicle_id = ? AND b.status NOT IN `+releasedStatusesSQL+`
 	`, vehicleID).Scan(&count)
 	if err != nil {
 		return 0, fmt.Errorf("error getting vehicle bookings count: %w", err)
@@ -1139,19 +2115,18 @@ func GetVehicleBookingsCount(vehicleID int64) (int, error) {
 	return count, nil
 }
 
-// CheckTripAvailability verifies if a trip has available seats
-func CheckTripAvailability(tripID int64) (bool, error) {
-	capacity, err := GetTripVehicleCapacity(tripID)
-	if err != nil {
-		return false, err
-	}
-	
-	bookingsCount, err := GetTripBookingsCount(tripID)
+// CheckTripAvailability verifies if a trip has a seat free between a boarding
+// and an alighting station, given by name or code; empty stations mean the
+// trip's ends
+func CheckTripAvailability(tripID int64, boarding, alighting string) (bool, error) {
+	capacity, err := GetTripCapacity(tripID, boarding, alighting)
 	if err != nil {
+		if err == sql.ErrNoRows {
+			return false, fmt.Errorf("trip not found")
+		}
 		return false, err
 	}
-	
-	return bookingsCount < capacity, nil
+	return capacity.Available > 0, nil
 }
 
 // GetBookingSummary returns the count of bookings per day within a date range
@@ -1187,9 +2162,9 @@ func GetCancellationSummary(from, to string) ([]map[string]interface{}, error) {
 	query := `
 	SELECT DATE(booking_date) AS date,
 		   COUNT(*) AS bookings,
-		   SUM(CASE WHEN status = 'Cancelled' THEN 1 ELSE 0 END) AS cancellations,
+		   SUM(CASE WHEN status IN ('Cancelled', 'Refunded') THEN 1 ELSE 0 END) AS cancellations,
 		   ROUND(
-			 SUM(CASE WHEN status = 'Cancelled' THEN 1 ELSE 0 END) * 100.0 / COUNT(*),
+			 SUM(CASE WHEN status IN ('Cancelled', 'Refunded') THEN 1 ELSE 0 END) * 100.0 / COUNT(*),
 			 2
 		   ) AS cancellation_rate
 	  FROM bookings
@@ -1223,14 +2198,15 @@ func GetCancellationSummary(from, to string) ([]map[string]interface{}, error) {
 	return results, nil
 }
 
-// GetRoutePerformance returns booking counts per origin-destination within a date range
+// GetRoutePerformance returns booking counts per route within a date range
 func GetRoutePerformance(from, to string) ([]map[string]interface{}, error) {
 	query := `
-	SELECT t.origin, t.destination, COUNT(b.id) AS bookings
+	SELECT COALESCE(r.name, t.origin || ' - ' || t.destination), t.origin, t.destination, COUNT(b.id) AS bookings
 	FROM bookings b
 	JOIN trips t ON b.trip_id = t.id
+	LEFT JOIN routes r ON t.route_id = r.id
 	WHERE DATE(b.booking_date) >= ? AND DATE(b.booking_date) <= ?
-	GROUP BY t.origin, t.destination
+	GROUP BY t.route_id, t.origin, t.destination
 	ORDER BY bookings DESC
 	`
 	rows, err := DB.Query(query, from, to)
@@ -1241,13 +2217,13 @@ func GetRoutePerformance(from, to string) ([]map[string]interface{}, error) {
 
 	var results []map[string]interface{}
 	for rows.Next() {
-		var origin, destination string
+		var route, origin, destination string
 		var count int
-		if err := rows.Scan(&origin, &destination, &count); err != nil {
+		if err := rows.Scan(&route, &origin, &destination, &count); err != nil {
 			log.Printf("Error scanning route performance row: %v", err)
 			continue
 		}
-		results = append(results, map[string]interface{}{"origin": origin, "destination": destination, "bookings": count})
+		results = append(results, map[string]interface{}{"route": route, "origin": origin, "destination": destination, "bookings": count})
 	}
 	return results, nil
 }
@@ -0,0 +1,390 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultEncryptionKeyPath is used when ENCRYPTION_KEY_PATH is not set
+const DefaultEncryptionKeyPath = "keys/encryption.key"
+
+// EncryptionKeySize is the length in bytes of the AES-256 field key
+const EncryptionKeySize = 32
+
+// encryptedPrefix marks a column value as AES-GCM ciphertext so plain text
+// written before encryption was introduced can still be recognised.
+const encryptedPrefix = "enc:v1:"
+
+// fieldCipher encrypts the personal data columns (SSN, social ID, date of birth)
+// and two-factor secrets
+var fieldCipher cipher.AEAD
+
+// lookupKey keys the blind indexes that let an encrypted value be found by
+// exact match without decrypting every row. It is derived from the field key.
+var lookupKey []byte
+
+// encryptedColumns lists every column that is stored encrypted at rest
+var encryptedColumns = map[string][]string{
+	"users":      {"social_security", "date_of_birth", "totp_secret"},
+	"bookings":   {"social_id", "date_of_birth"},
+	"waitlist":   {"social_id", "date_of_birth"},
+	"passengers": {"social_id", "date_of_birth"},
+}
+
+// EncryptionKeyPath returns the configured path of the field encryption key
+func EncryptionKeyPath() string {
+	if path := os.Getenv("ENCRYPTION_KEY_PATH"); path != "" {
+		return path
+	}
+	return DefaultEncryptionKeyPath
+}
+
+// ReadEncryptionKey reads a raw AES-256 key from disk.
+func ReadEncryptionKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != EncryptionKeySize {
+		return nil, fmt.Errorf("encryption key at %s must be exactly %d bytes, found %d", path, EncryptionKeySize, len(key))
+	}
+	return key, nil
+}
+
+// NewEncryptionKey returns a new random AES-256 key
+func NewEncryptionKey() ([]byte, error) {
+	key := make([]byte, EncryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate encryption key: %w", err)
+	}
+	return key, nil
+}
+
+// GenerateEncryptionKey creates a new random key and writes it to path with
+// owner-only permissions.
+func GenerateEncryptionKey(path string) ([]byte, error) {
+	key, err := NewEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create key directory: %w", err)
+	}
+	if err := os.WriteFile(path, key, 0600); err != nil {
+		return nil, fmt.Errorf("failed to write encryption key: %w", err)
+	}
+	return key, nil
+}
+
+// LoadEncryptionKey loads the field encryption key from path, generating a
+// new one if the file does not exist yet. A new key is only generated for a
+// database that holds no encrypted values: if it does, the key has been lost
+// or misplaced and a new one would leave them unreadable.
+func LoadEncryptionKey(path string) error {
+	key, err := ReadEncryptionKey(path)
+	if os.IsNotExist(err) {
+		encrypted, countErr := countEncryptedValues()
+		if countErr != nil {
+			return fmt.Errorf("failed to check for encrypted data: %w", countErr)
+		}
+		if encrypted > 0 {
+			return fmt.Errorf("no encryption key found at %s, but the database holds %d encrypted values: restore the key or set ENCRYPTION_KEY_PATH to where it is", path, encrypted)
+		}
+		log.Printf("No encryption key found at %s, generating a new one", path)
+		key, err = GenerateEncryptionKey(path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load encryption key: %w", err)
+	}
+
+	aead, err := newFieldCipher(key)
+	if err != nil {
+		return err
+	}
+	fieldCipher = aead
+	lookupKey = deriveLookupKey(key)
+	log.Printf("Loaded field encryption key from %s", path)
+	return nil
+}
+
+// countEncryptedValues counts the values stored encrypted in the database.
+// Tables and columns that do not exist yet hold none.
+func countEncryptedValues() (int, error) {
+	total := 0
+	for table, columns := range encryptedColumns {
+		for _, column := range columns {
+			var exists int
+			err := DB.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", table, column).Scan(&exists)
+			if err != nil {
+				return 0, fmt.Errorf("failed to check if %s.%s column exists: %w", table, column, err)
+			}
+			if exists == 0 {
+				continue
+			}
+			var count int
+			query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s LIKE ?", table, column)
+			if err := DB.QueryRow(query, encryptedPrefix+"%").Scan(&count); err != nil {
+				return 0, fmt.Errorf("failed to count encrypted values in %s.%s: %w", table, column, err)
+			}
+			total += count
+		}
+	}
+	return total, nil
+}
+
+// newFieldCipher builds an AES-GCM cipher from a raw key
+func newFieldCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise AES-GCM: %w", err)
+	}
+	return aead, nil
+}
+
+// deriveLookupKey derives the blind index key from a field key
+func deriveLookupKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("blind-index"))
+	return mac.Sum(nil)
+}
+
+// lookupHashWith returns the blind index of a value under the given key
+func lookupHashWith(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// LookupHash returns the blind index of a sensitive value, which is the same
+// each time the value is hashed under the current key
+func LookupHash(value string) (string, error) {
+	if lookupKey == nil {
+		return "", fmt.Errorf("encryption key not loaded")
+	}
+	return lookupHashWith(lookupKey, value), nil
+}
+
+// IsEncrypted reports whether a stored column value is already ciphertext
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// EncryptField encrypts a sensitive column value. Empty values are stored as is.
+func EncryptField(plaintext string) (string, error) {
+	return encryptWith(fieldCipher, plaintext)
+}
+
+// DecryptField decrypts a sensitive column value. Values that were written
+// before encryption was enabled are returned unchanged.
+func DecryptField(value string) (string, error) {
+	return decryptWith(fieldCipher, value)
+}
+
+// DecryptFields decrypts each of the given scanned values in place
+func DecryptFields(values ...*string) error {
+	for _, v := range values {
+		plaintext, err := DecryptField(*v)
+		if err != nil {
+			return err
+		}
+		*v = plaintext
+	}
+	return nil
+}
+
+func encryptWith(aead cipher.AEAD, plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	if aead == nil {
+		return "", fmt.Errorf("encryption key not loaded")
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptWith(aead cipher.AEAD, value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	if aead == nil {
+		return "", fmt.Errorf("encryption key not loaded")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %w", err)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted value: too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// reencryptColumns rewrites every encrypted column using the given transform.
+// It returns the number of rows that changed.
+func reencryptColumns(tx *sql.Tx, transform func(string) (string, bool, error)) (int, error) {
+	changed := 0
+	for table, columns := range encryptedColumns {
+		query := fmt.Sprintf("SELECT id, %s FROM %s", strings.Join(columns, ", "), table)
+		rows, err := tx.Query(query)
+		if err != nil {
+			return changed, fmt.Errorf("error reading %s: %w", table, err)
+		}
+
+		type pending struct {
+			id     int64
+			values []interface{}
+		}
+		var updates []pending
+		for rows.Next() {
+			var id int64
+			raw := make([]sql.NullString, len(columns))
+			dest := []interface{}{&id}
+			for i := range raw {
+				dest = append(dest, &raw[i])
+			}
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return changed, fmt.Errorf("error scanning %s row: %w", table, err)
+			}
+
+			values := make([]interface{}, len(columns))
+			rowChanged := false
+			for i, v := range raw {
+				if !v.Valid {
+					values[i] = nil
+					continue
+				}
+				newValue, didChange, err := transform(v.String)
+				if err != nil {
+					rows.Close()
+					return changed, fmt.Errorf("%s row %d, column %s: %w", table, id, columns[i], err)
+				}
+				values[i] = newValue
+				rowChanged = rowChanged || didChange
+			}
+			if rowChanged {
+				updates = append(updates, pending{id: id, values: values})
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return changed, fmt.Errorf("error iterating %s: %w", table, err)
+		}
+
+		setClause := strings.Join(columns, " = ?, ") + " = ?"
+		update := fmt.Sprintf("UPDATE %s SET %s WHERE id = ?", table, setClause)
+		for _, u := range updates {
+			if _, err := tx.Exec(update, append(u.values, u.id)...); err != nil {
+				return changed, fmt.Errorf("error updating %s row %d: %w", table, u.id, err)
+			}
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+// EncryptExistingRecords encrypts any sensitive values still stored in plain text
+func EncryptExistingRecords() (int, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	changed, err := reencryptColumns(tx, func(value string) (string, bool, error) {
+		if value == "" || IsEncrypted(value) {
+			return value, false, nil
+		}
+		encrypted, err := EncryptField(value)
+		return encrypted, true, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit encryption migration: %w", err)
+	}
+	return changed, nil
+}
+
+// RotateEncryptionKey re-encrypts every sensitive value under newKey inside a
+// single transaction, and rebuilds the blind indexes under its lookup key.
+// persistKey is called after all rows are rewritten but before the commit, so
+// if the new key cannot be saved the database is left encrypted under the old
+// key. If the commit then fails, restoreKey is called to put the old key back,
+// since the database is still encrypted under it.
+func RotateEncryptionKey(newKey []byte, persistKey, restoreKey func() error) (int, error) {
+	newCipher, err := newFieldCipher(newKey)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Rehash while the values can still be read under the old key
+	newLookupKey := deriveLookupKey(newKey)
+	if err := rehashPassengers(tx, newLookupKey); err != nil {
+		return 0, err
+	}
+
+	changed, err := reencryptColumns(tx, func(value string) (string, bool, error) {
+		if value == "" {
+			return value, false, nil
+		}
+		plaintext, err := DecryptField(value)
+		if err != nil {
+			return "", false, err
+		}
+		encrypted, err := encryptWith(newCipher, plaintext)
+		return encrypted, true, err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if persistKey != nil {
+		if err := persistKey(); err != nil {
+			return 0, fmt.Errorf("failed to persist new key: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		if persistKey != nil && restoreKey != nil {
+			if restoreErr := restoreKey(); restoreErr != nil {
+				return 0, fmt.Errorf("failed to commit key rotation: %w (and failed to restore the old key: %v)", err, restoreErr)
+			}
+		}
+		return 0, fmt.Errorf("failed to commit key rotation: %w", err)
+	}
+	fieldCipher = newCipher
+	lookupKey = newLookupKey
+	return changed, nil
+}
@@ -0,0 +1,402 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// dateLayout is how fare validity dates, dates of birth and the date part of
+// departure times are written
+const dateLayout = "2006-01-02"
+
+// Fare categories a passenger falls into by age on the day of travel
+const (
+	FareAdult  = "adult"
+	FareChild  = "child"
+	FareSenior = "senior"
+)
+
+var (
+	// ErrFareOverlap is returned when a fare's dates overlap another fare for the same route
+	ErrFareOverlap = errors.New("another fare for this route is in effect during these dates")
+	// ErrNoFare is returned when no fare is in effect for a trip's route on its departure date
+	ErrNoFare = errors.New("no fare is in effect for this route on the departure date")
+)
+
+// Fare is the base price of travelling from Origin to Destination between
+// ValidFrom and ValidTo (inclusive; empty for open-ended). Amounts are in cents.
+type Fare struct {
+	ID            int64  `json:"id"`
+	Origin        string `json:"origin"`
+	Destination   string `json:"destination"`
+	BaseFareCents int64  `json:"base_fare_cents"`
+	ValidFrom     string `json:"valid_from"`
+	ValidTo       string `json:"valid_to"`
+}
+
+// FareDiscount is the percentage taken off the fare of passengers aged between
+// MinAge and MaxAge (inclusive; 0 for no upper bound) on the day of travel.
+type FareDiscount struct {
+	Category string `json:"category"`
+	MinAge   int    `json:"min_age"`
+	MaxAge   int    `json:"max_age"`
+	Percent  int    `json:"percent"`
+}
+
+// FareQuote is the price of one ticket and how it was worked out. It is
+// copied onto the booking when the booking is made, so later fare changes do
+// not alter what the passenger paid.
+type FareQuote struct {
+	FareID          int64   `json:"fare_id"`
+	Category        string  `json:"category"`
+	BaseFareCents   int64   `json:"base_fare_cents"`
+	Multiplier      float64 `json:"multiplier"`
+	DiscountPercent int     `json:"discount_percent"`
+	PriceCents      int64   `json:"price_cents"`
+}
+
+// defaultFareDiscounts are seeded on first start: children under 12 travel at
+// half price and passengers 65 and over get 30% off
+var defaultFareDiscounts = []FareDiscount{
+	{FareChild, 0, 11, 50},
+	{FareSenior, 65, 0, 30},
+}
+
+// seedFareDiscounts stores the default child and senior discounts
+func seedFareDiscounts() error {
+	for _, d := range defaultFareDiscounts {
+		_, err := DB.Exec("INSERT OR IGNORE INTO fare_discounts (category, min_age, max_age, percent) VALUES (?, ?, ?, ?)",
+			d.Category, d.MinAge, d.MaxAge, d.Percent)
+		if err != nil {
+			return fmt.Errorf("error seeding %s discount: %w", d.Category, err)
+		}
+	}
+	return nil
+}
+
+// validateFare checks a fare's route, amount and dates
+func validateFare(f Fare) error {
+	if f.Origin == "" || f.Destination == "" {
+		return fmt.Errorf("origin and destination are required")
+	}
+	if f.Origin == f.Destination {
+		return fmt.Errorf("origin and destination cannot be the same city")
+	}
+	if f.BaseFareCents <= 0 {
+		return fmt.Errorf("base fare must be greater than zero")
+	}
+	if _, err := time.Parse(dateLayout, f.ValidFrom); err != nil {
+		return fmt.Errorf("valid from must be a date (YYYY-MM-DD)")
+	}
+	if f.ValidTo != "" {
+		if _, err := time.Parse(dateLayout, f.ValidTo); err != nil {
+			return fmt.Errorf("valid to must be a date (YYYY-MM-DD)")
+		}
+		if f.ValidTo < f.ValidFrom {
+			return fmt.Errorf("valid to must not be before valid from")
+		}
+	}
+	return nil
+}
+
+// checkFareOverlap returns ErrFareOverlap if a fare other than excludeID for
+// the same route is in effect on any day that f is
+func checkFareOverlap(tx *sql.Tx, f Fare, excludeID int64) error {
+	var count int
+	err := tx.QueryRow(`
+		SELECT COUNT(*) FROM fares
+		WHERE origin = ? AND destination = ? AND id != ?
+		  AND (valid_to IS NULL OR valid_to >= ?)
+		  AND (? = '' OR valid_from <= ?)
+	`, f.Origin, f.Destination, excludeID, f.ValidFrom, f.ValidTo, f.ValidTo).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("error checking for overlapping fares: %w", err)
+	}
+	if count > 0 {
+		return ErrFareOverlap
+	}
+	return nil
+}
+
+// nullableDate stores an empty date as NULL
+func nullableDate(date string) sql.NullString {
+	return sql.NullString{String: date, Valid: date != ""}
+}
+
+// AddFare adds a fare for a route. Its dates must not overlap another fare for the same route.
+func AddFare(f Fare) (int64, error) {
+	if err := validateFare(f); err != nil {
+		return 0, err
+	}
+	var err error
+	if f.Origin, f.Destination, err = canonicalEndpoints(DB, f.Origin, f.Destination); err != nil {
+		return 0, err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkFareOverlap(tx, f, 0); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("INSERT INTO fares (origin, destination, base_fare_cents, valid_from, valid_to) VALUES (?, ?, ?, ?, ?)",
+		f.Origin, f.Destination, f.BaseFareCents, f.ValidFrom, nullableDate(f.ValidTo))
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert fare: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve fare id: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit fare: %w", err)
+	}
+	return id, nil
+}
+
+// UpdateFare changes a fare. Bookings already made keep the price they were
+// sold at. It returns sql.ErrNoRows if the fare does not exist.
+func UpdateFare(f Fare) error {
+	if err := validateFare(f); err != nil {
+		return err
+	}
+	var err error
+	if f.Origin, f.Destination, err = canonicalEndpoints(DB, f.Origin, f.Destination); err != nil {
+		return err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := checkFareOverlap(tx, f, f.ID); err != nil {
+		return err
+	}
+	res, err := tx.Exec("UPDATE fares SET origin = ?, destination = ?, base_fare_cents = ?, valid_from = ?, valid_to = ? WHERE id = ?",
+		f.Origin, f.Destination, f.BaseFareCents, f.ValidFrom, nullableDate(f.ValidTo), f.ID)
+	if err != nil {
+		return fmt.Errorf("error updating fare ID %d: %w", f.ID, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit fare update: %w", err)
+	}
+	return nil
+}
+
+// DeleteFare deletes a fare. Bookings sold at it keep their price.
+func DeleteFare(id int64) error {
+	if _, err := DB.Exec("DELETE FROM fares WHERE id = ?", id); err != nil {
+		return fmt.Errorf("error deleting fare ID %d: %w", id, err)
+	}
+	return nil
+}
+
+// GetFares returns every fare, by route and then by start date
+func GetFares() ([]Fare, error) {
+	rows, err := DB.Query(`
+		SELECT id, origin, destination, base_fare_cents, valid_from, COALESCE(valid_to, '')
+		FROM fares
+		ORDER BY origin, destination, valid_from
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving fares: %w", err)
+	}
+	defer rows.Close()
+
+	fares := []Fare{}
+	for rows.Next() {
+		var f Fare
+		if err := rows.Scan(&f.ID, &f.Origin, &f.Destination, &f.BaseFareCents, &f.ValidFrom, &f.ValidTo); err != nil {
+			return nil, fmt.Errorf("error scanning fare: %w", err)
+		}
+		fares = append(fares, f)
+	}
+	return fares, rows.Err()
+}
+
+// GetVehicleTypeMultipliers returns the fare multiplier of each vehicle type
+// that has one. Types without a multiplier are charged the base fare.
+func GetVehicleTypeMultipliers() (map[string]float64, error) {
+	rows, err := DB.Query("SELECT vehicle_type, multiplier FROM vehicle_type_multipliers ORDER BY vehicle_type")
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving vehicle type multipliers: %w", err)
+	}
+	defer rows.Close()
+
+	multipliers := make(map[string]float64)
+	for rows.Next() {
+		var vehicleType string
+		var multiplier float64
+		if err := rows.Scan(&vehicleType, &multiplier); err != nil {
+			return nil, fmt.Errorf("error scanning vehicle type multiplier: %w", err)
+		}
+		multipliers[vehicleType] = multiplier
+	}
+	return multipliers, rows.Err()
+}
+
+// SetVehicleTypeMultiplier sets the fare multiplier of a vehicle type
+func SetVehicleTypeMultiplier(vehicleType string, multiplier float64) error {
+	if vehicleType == "" {
+		return fmt.Errorf("vehicle type is required")
+	}
+	if multiplier <= 0 || multiplier > 10 {
+		return fmt.Errorf("multiplier must be greater than 0 and at most 10")
+	}
+	_, err := DB.Exec(`
+		INSERT INTO vehicle_type_multipliers (vehicle_type, multiplier) VALUES (?, ?)
+		ON CONFLICT(vehicle_type) DO UPDATE SET multiplier = excluded.multiplier
+	`, vehicleType, multiplier)
+	if err != nil {
+		return fmt.Errorf("error updating multiplier for vehicle type %s: %w", vehicleType, err)
+	}
+	return nil
+}
+
+// GetFareDiscounts returns the child and senior discounts
+func GetFareDiscounts() ([]FareDiscount, error) {
+	return fareDiscounts(DB)
+}
+
+func fareDiscounts(q queryer) ([]FareDiscount, error) {
+	rows, err := q.Query("SELECT category, min_age, max_age, percent FROM fare_discounts ORDER BY min_age")
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving fare discounts: %w", err)
+	}
+	defer rows.Close()
+
+	discounts := []FareDiscount{}
+	for rows.Next() {
+		var d FareDiscount
+		if err := rows.Scan(&d.Category, &d.MinAge, &d.MaxAge, &d.Percent); err != nil {
+			return nil, fmt.Errorf("error scanning fare discount: %w", err)
+		}
+		discounts = append(discounts, d)
+	}
+	return discounts, rows.Err()
+}
+
+// UpdateFareDiscount changes the age range and percentage of the child or
+// senior discount
+func UpdateFareDiscount(d FareDiscount) error {
+	if d.Category != FareChild && d.Category != FareSenior {
+		return fmt.Errorf("unknown fare category %q", d.Category)
+	}
+	if d.MinAge < 0 || d.MaxAge < 0 || (d.MaxAge != 0 && d.MaxAge < d.MinAge) {
+		return fmt.Errorf("invalid age range")
+	}
+	if d.Percent < 0 || d.Percent > 100 {
+		return fmt.Errorf("discount must be between 0 and 100 percent")
+	}
+	_, err := DB.Exec(`
+		INSERT INTO fare_discounts (category, min_age, max_age, percent) VALUES (?, ?, ?, ?)
+		ON CONFLICT(category) DO UPDATE SET min_age = excluded.min_age, max_age = excluded.max_age, percent = excluded.percent
+	`, d.Category, d.MinAge, d.MaxAge, d.Percent)
+	if err != nil {
+		return fmt.Errorf("error updating %s discount: %w", d.Category, err)
+	}
+	return nil
+}
+
+// ageOn returns how old someone born on dob is on the given day
+func ageOn(dob, day time.Time) int {
+	age := day.Year() - dob.Year()
+	if day.Month() < dob.Month() || (day.Month() == dob.Month() && day.Day() < dob.Day()) {
+		age--
+	}
+	return age
+}
+
+// fareCategory picks the discount a passenger born on dateOfBirth is entitled
+// to on the travel date. Passengers without a valid date of birth pay the adult fare.
+func fareCategory(discounts []FareDiscount, dateOfBirth string, travel time.Time) (string, int) {
+	dob, err := time.Parse(dateLayout, dateOfBirth)
+	if err != nil || dob.After(travel) {
+		return FareAdult, 0
+	}
+	age := ageOn(dob, travel)
+	for _, d := range discounts {
+		if age >= d.MinAge && (d.MaxAge == 0 || age <= d.MaxAge) {
+			return d.Category, d.Percent
+		}
+	}
+	return FareAdult, 0
+}
+
+// QuoteFare prices a ticket on a trip between a boarding and an alighting
+// station, given by name or code (empty for the trip's ends), for a passenger
+// born on dateOfBirth. It uses the fare between the two stations in effect on
+// the day the passenger boards, and returns ErrNoFare if there is none, or
+// sql.ErrNoRows if the trip does not exist.
+func QuoteFare(tripID int64, boarding, alighting, dateOfBirth string) (*FareQuote, error) {
+	seg, stops, err := tripSegment(DB, tripID, boarding, alighting)
+	if err != nil {
+		return nil, err
+	}
+	return quoteFare(DB, tripID, stops[seg.From], stops[seg.last(stops)], dateOfBirth)
+}
+
+func quoteFare(q queryer, tripID int64, from, to TripStop, dateOfBirth string) (*FareQuote, error) {
+	var vehicleType string
+	err := q.QueryRow(`
+		SELECT COALESCE(v.type, '')
+		FROM trips t
+		LEFT JOIN vehicles v ON t.vehicle_id = v.id
+		WHERE t.id = ?
+	`, tripID).Scan(&vehicleType)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error retrieving trip for fare: %w", err)
+	}
+	origin, destination, departure := from.Name, to.Name, from.DepartureTime
+	if len(departure) < len(dateLayout) {
+		return nil, fmt.Errorf("trip %d has an invalid departure time", tripID)
+	}
+	travelDate := departure[:len(dateLayout)]
+	travel, err := time.Parse(dateLayout, travelDate)
+	if err != nil {
+		return nil, fmt.Errorf("trip %d has an invalid departure time", tripID)
+	}
+
+	quote := &FareQuote{Multiplier: 1}
+	err = q.QueryRow(`
+		SELECT id, base_fare_cents FROM fares
+		WHERE origin = ? AND destination = ? AND valid_from <= ? AND (valid_to IS NULL OR valid_to >= ?)
+		ORDER BY valid_from DESC LIMIT 1
+	`, origin, destination, travelDate, travelDate).Scan(&quote.FareID, &quote.BaseFareCents)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrNoFare
+		}
+		return nil, fmt.Errorf("error retrieving fare: %w", err)
+	}
+
+	err = q.QueryRow("SELECT multiplier FROM vehicle_type_multipliers WHERE vehicle_type = ? COLLATE NOCASE", strings.TrimSpace(vehicleType)).Scan(&quote.Multiplier)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("error retrieving vehicle type multiplier: %w", err)
+	}
+
+	discounts, err := fareDiscounts(q)
+	if err != nil {
+		return nil, err
+	}
+	quote.Category, quote.DiscountPercent = fareCategory(discounts, dateOfBirth, travel)
+
+	// Round to the nearest cent once, after applying the multiplier and discount
+	price := float64(quote.BaseFareCents) * quote.Multiplier * float64(100-quote.DiscountPercent) / 100
+	quote.PriceCents = int64(price + 0.5)
+	return quote, nil
+}
@@ -0,0 +1,156 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func mustDate(t *testing.T, s string) time.Time {
+	t.Helper()
+	d, err := time.Parse(dateLayout, s)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", s, err)
+	}
+	return d
+}
+
+func TestAgeOn(t *testing.T) {
+	tests := []struct {
+		dob, day string
+		want     int
+	}{
+		{"1990-06-15", "2020-06-14", 29},
+		{"1990-06-15", "2020-06-15", 30},
+		{"1990-06-15", "2020-06-16", 30},
+		{"1990-12-31", "2021-01-01", 30},
+		{"2020-03-01", "2020-03-01", 0},
+		// Born on 29 February: a year older on 1 March in other years
+		{"2000-02-29", "2001-02-28", 0},
+		{"2000-02-29", "2001-03-01", 1},
+		{"2000-02-29", "2004-02-28", 3},
+		{"2000-02-29", "2004-02-29", 4},
+	}
+	for _, tt := range tests {
+		if got := ageOn(mustDate(t, tt.dob), mustDate(t, tt.day)); got != tt.want {
+			t.Errorf("ageOn(%s, %s) = %d, want %d", tt.dob, tt.day, got, tt.want)
+		}
+	}
+}
+
+func TestFareCategory(t *testing.T) {
+	travel := mustDate(t, "2030-06-15")
+	tests := []struct {
+		name, dob    string
+		wantCategory string
+		wantPercent  int
+	}{
+		{"infant", "2030-01-01", FareChild, 50},
+		{"last day as a child", "2018-06-16", FareChild, 50},
+		{"twelfth birthday", "2018-06-15", FareAdult, 0},
+		{"adult", "1990-01-01", FareAdult, 0},
+		{"day before turning 65", "1965-06-16", FareAdult, 0},
+		{"65th birthday", "1965-06-15", FareSenior, 30},
+		{"very old", "1920-01-01", FareSenior, 30},
+		{"born after travel", "2030-06-16", FareAdult, 0},
+		{"no date of birth", "", FareAdult, 0},
+		{"invalid date of birth", "15/06/1990", FareAdult, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			category, percent := fareCategory(defaultFareDiscounts, tt.dob, travel)
+			if category != tt.wantCategory || percent != tt.wantPercent {
+				t.Errorf("fareCategory(%s) = %s, %d%%; want %s, %d%%", tt.dob, category, percent, tt.wantCategory, tt.wantPercent)
+			}
+		})
+	}
+}
+
+func TestFareDatesMayNotOverlap(t *testing.T) {
+	openTestDB(t)
+	if _, err := AddFare(Fare{Origin: "Tehran", Destination: "Isfahan", BaseFareCents: 1000, ValidFrom: "2030-01-01", ValidTo: "2030-06-30"}); err != nil {
+		t.Fatalf("AddFare: %v", err)
+	}
+	open, err := AddFare(Fare{Origin: "Tehran", Destination: "Isfahan", BaseFareCents: 1200, ValidFrom: "2030-09-01"})
+	if err != nil {
+		t.Fatalf("AddFare: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		from, to string
+		wantErr  error
+	}{
+		{"ends on the first day of another", "2029-12-01", "2030-01-01", ErrFareOverlap},
+		{"starts on the last day of another", "2030-06-30", "2030-08-31", ErrFareOverlap},
+		{"inside another", "2030-02-01", "2030-02-28", ErrFareOverlap},
+		{"around another", "2029-01-01", "2030-12-31", ErrFareOverlap},
+		{"runs into an open-ended fare", "2030-07-01", "2031-01-01", ErrFareOverlap},
+		{"open-ended over another", "2030-07-01", "", ErrFareOverlap},
+		{"fills the gap exactly", "2030-07-01", "2030-08-31", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := AddFare(Fare{Origin: "Tehran", Destination: "Isfahan", BaseFareCents: 1100, ValidFrom: tt.from, ValidTo: tt.to})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("AddFare(%s to %s) error = %v, want %v", tt.from, tt.to, err, tt.wantErr)
+			}
+		})
+	}
+
+	// Another route and the fare's own dates do not count
+	if _, err := AddFare(Fare{Origin: "Isfahan", Destination: "Tehran", BaseFareCents: 1000, ValidFrom: "2030-01-01"}); err != nil {
+		t.Errorf("AddFare for the return route: %v", err)
+	}
+	if err := UpdateFare(Fare{ID: open, Origin: "Tehran", Destination: "Isfahan", BaseFareCents: 1300, ValidFrom: "2030-09-01"}); err != nil {
+		t.Errorf("UpdateFare keeping its dates: %v", err)
+	}
+	if err := UpdateFare(Fare{ID: open, Origin: "Tehran", Destination: "Isfahan", BaseFareCents: 1300, ValidFrom: "2030-08-01"}); !errors.Is(err, ErrFareOverlap) {
+		t.Errorf("UpdateFare onto another fare: error = %v, want ErrFareOverlap", err)
+	}
+}
+
+func TestQuoteFare(t *testing.T) {
+	openTestDB(t)
+	tripID := addTestTrip(t, 10)
+	fares := []Fare{
+		{Origin: "Tehran", Destination: "Isfahan", BaseFareCents: 1001, ValidFrom: "2030-01-01", ValidTo: "2030-06-15"},
+		{Origin: "Tehran", Destination: "Isfahan", BaseFareCents: 2000, ValidFrom: "2030-06-16"},
+	}
+	for _, f := range fares {
+		if _, err := AddFare(f); err != nil {
+			t.Fatalf("AddFare: %v", err)
+		}
+	}
+	if err := SetVehicleTypeMultiplier("Bus", 1.5); err != nil {
+		t.Fatalf("SetVehicleTypeMultiplier: %v", err)
+	}
+
+	tests := []struct {
+		name, departs, dob string
+		wantBase, wantCost int64
+		wantCategory       string
+	}{
+		// 1001 * 1.5 = 1501.5, rounded once at the end
+		{"adult on the last day of a fare", "2030-06-15", "1990-01-01", 1001, 1502, FareAdult},
+		{"child", "2030-06-15", "2020-01-01", 1001, 751, FareChild},
+		{"senior on the first day of the next fare", "2030-06-16", "1960-01-01", 2000, 2100, FareSenior},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			moveTrip(t, tripID, mustDate(t, tt.departs).Add(9*time.Hour))
+			quote, err := QuoteFare(tripID, "", "", tt.dob)
+			if err != nil {
+				t.Fatalf("QuoteFare: %v", err)
+			}
+			if quote.BaseFareCents != tt.wantBase || quote.Multiplier != 1.5 || quote.Category != tt.wantCategory || quote.PriceCents != tt.wantCost {
+				t.Errorf("quote = %+v, want base %d, multiplier 1.5, %s, price %d", quote, tt.wantBase, tt.wantCategory, tt.wantCost)
+			}
+		})
+	}
+
+	moveTrip(t, tripID, mustDate(t, "2029-12-31").Add(9*time.Hour))
+	if _, err := QuoteFare(tripID, "", "", ""); !errors.Is(err, ErrNoFare) {
+		t.Errorf("QuoteFare before any fare: error = %v, want ErrNoFare", err)
+	}
+}
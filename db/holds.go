@@ -0,0 +1,315 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"SecureSignIn/utils"
+)
+
+// SeatHold is how long a seat held at the counter is kept when no other time
+// is asked for, and SeatHoldMax the longest it may be kept
+var (
+	SeatHold    = utils.GetEnvDuration("SEAT_HOLD", 15*time.Minute)
+	SeatHoldMax = utils.GetEnvDuration("SEAT_HOLD_MAX", 2*time.Hour)
+)
+
+var (
+	// ErrNotHeld is returned when confirming or releasing a booking that is not a seat hold
+	ErrNotHeld = errors.New("booking is not a seat hold")
+	// ErrHoldTooLong is returned when a seat is to be held for longer than SeatHoldMax
+	ErrHoldTooLong = errors.New("seat hold is longer than allowed")
+)
+
+// ReleasedHold is a seat hold or waitlist offer given up because it ran out
+// or was released
+type ReleasedHold struct {
+	BookingID       int64     `json:"booking_id"`
+	TripID          int64     `json:"trip_id"`
+	Reference       string    `json:"reference"`
+	SeatNumber      string    `json:"seat_number"`
+	HoldExpiresAt   time.Time `json:"hold_expires_at"`
+	RefundPaymentID int64     `json:"refund_payment_id,omitempty"`
+}
+
+// HoldSeat makes a Held booking that keeps a seat for the passenger until it
+// is confirmed, released or the hold runs out. The seat counts against the
+// trip's capacity like any other booking. hold is how long to keep it, or
+// SeatHold if zero; ErrHoldTooLong if it is longer than SeatHoldMax. The
+// booking is made as AddBooking makes it, with the same errors.
+func HoldSeat(b BookingRequest, hold time.Duration) (*NewBooking, error) {
+	if hold == 0 {
+		hold = SeatHold
+	}
+	if hold < 0 || hold > SeatHoldMax {
+		return nil, ErrHoldTooLong
+	}
+	if b.TripID == 0 || b.Passenger == "" {
+		return nil, fmt.Errorf("trip ID and passenger name are required")
+	}
+	b.Status = BookingHeld
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	seg, stops, err := tripSegment(tx, b.TripID, b.Boarding, b.Alighting)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("trip not found")
+		}
+		return nil, err
+	}
+
+	booking, err := insertBooking(tx, b, seg, stops)
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(hold)
+	if _, err := tx.Exec("UPDATE bookings SET hold_expires_at = ? WHERE id = ?", sqlTime(expires), booking.ID); err != nil {
+		return nil, fmt.Errorf("error setting seat hold: %w", err)
+	}
+	booking.HoldExpiresAt = &expires
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit seat hold: %w", err)
+	}
+	return booking, nil
+}
+
+// getSeatHold reads a seat hold within a transaction. It returns
+// sql.ErrNoRows if there is no such booking, ErrHoldExpired if it was a hold
+// that has since been released, and ErrNotHeld if it is not a hold or has
+// already been confirmed.
+func getSeatHold(tx *sql.Tx, bookingID int64) (*ReleasedHold, error) {
+	h := &ReleasedHold{BookingID: bookingID}
+	var status string
+	var expires sql.NullTime
+	err := tx.QueryRow(`
+		SELECT trip_id, status, COALESCE(reference, ''), COALESCE(seat_number, ''), hold_expires_at
+		FROM bookings
+		WHERE id = ?
+	`, bookingID).Scan(&h.TripID, &status, &h.Reference, &h.SeatNumber, &expires)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error retrieving booking %d: %w", bookingID, err)
+	}
+	switch {
+	case !expires.Valid:
+		return nil, ErrNotHeld
+	case isReleased(status):
+		return nil, ErrHoldExpired
+	case status != BookingHeld:
+		return nil, ErrNotHeld
+	}
+	h.HoldExpiresAt = expires.Time
+	return h, nil
+}
+
+// release cancels a seat hold with a full refund of anything paid for it.
+// If the hold was offered to a waitlisted passenger their entry expires.
+func (h *ReleasedHold) release(tx *sql.Tx, reason string, actorID int64, actorUsername string, now time.Time) error {
+	full := 100
+	cancellation, err := cancelBooking(tx, CancelRequest{
+		BookingID:       h.BookingID,
+		OverridePercent: &full,
+		Reason:          reason,
+		CashierID:       actorID,
+		CashierUsername: actorUsername,
+	}, now)
+	if err != nil {
+		return err
+	}
+	h.RefundPaymentID = cancellation.RefundPaymentID
+	return settleWaitlistOffer(tx, h.BookingID, WaitlistExpired)
+}
+
+// settleWaitlistOffer gives the waitlist entry a booking was offered to, if
+// any, the given status
+func settleWaitlistOffer(tx *sql.Tx, bookingID int64, status string) error {
+	_, err := tx.Exec("UPDATE waitlist SET status = ? WHERE booking_id = ? AND status = ?", status, bookingID, WaitlistOffered)
+	if err != nil {
+		return fmt.Errorf("error updating waitlist offer of booking %d: %w", bookingID, err)
+	}
+	return nil
+}
+
+// ConfirmHold confirms a seat hold before it runs out. It returns
+// sql.ErrNoRows if there is no such booking, ErrHoldExpired if the hold has
+// run out or been released, and ErrNotHeld if the booking is not a hold or
+// has already been confirmed.
+func ConfirmHold(bookingID, actorID int64, actorUsername string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	h, err := getSeatHold(tx, bookingID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if !now.Before(h.HoldExpiresAt) {
+		return ErrHoldExpired
+	}
+	if _, err := setBookingStatus(tx, bookingID, BookingConfirmed, actorID, actorUsername, "Seat hold confirmed", now); err != nil {
+		return err
+	}
+	if err := settleWaitlistOffer(tx, bookingID, WaitlistBooked); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error confirming seat hold: %w", err)
+	}
+	return nil
+}
+
+// ReleaseHold gives up a seat hold before it runs out, cancelling the booking
+// with a full refund of anything paid, and offers the seat to the trip's
+// waitlist. It returns the same errors as ConfirmHold.
+func ReleaseHold(bookingID, actorID int64, actorUsername string) ([]WaitlistOffer, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	h, err := getSeatHold(tx, bookingID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if err := h.release(tx, "Seat hold released", actorID, actorUsername, now); err != nil {
+		return nil, err
+	}
+	offers, err := promoteWaitlist(tx, h.TripID, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error releasing seat hold: %w", err)
+	}
+	return offers, nil
+}
+
+// ExpireHolds releases the seat holds and waitlist offers that have run out
+// and offers the seats to the waitlists of their trips, recording the changes
+// in the audit log as made by the system. It returns the holds released and
+// the waitlist offers made.
+func ExpireHolds() (released []ReleasedHold, offers []WaitlistOffer, err error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	rows, err := tx.Query(`
+		SELECT id FROM bookings
+		WHERE status = ? AND hold_expires_at IS NOT NULL AND hold_expires_at <= ?
+	`, BookingHeld, sqlTime(now))
+	if err != nil {
+		return nil, nil, fmt.Errorf("error retrieving expired seat holds: %w", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, nil, fmt.Errorf("error scanning seat hold: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var changes []systemChange
+	freed := map[int64]bool{}
+	for _, id := range ids {
+		h, err := getSeatHold(tx, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		change, err := updateChange(tx, AuditBooking, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		changes = append(changes, change)
+		var entryID int64
+		err = tx.QueryRow("SELECT id FROM waitlist WHERE booking_id = ? AND status = ?", id, WaitlistOffered).Scan(&entryID)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, nil, fmt.Errorf("error retrieving waitlist offer of booking %d: %w", id, err)
+		}
+		if entryID != 0 {
+			if change, err = updateChange(tx, AuditWaitlist, entryID); err != nil {
+				return nil, nil, err
+			}
+			changes = append(changes, change)
+		}
+
+		if err := h.release(tx, "Hold expired", 0, auditSystemActor, now); err != nil {
+			return nil, nil, err
+		}
+		if h.RefundPaymentID != 0 {
+			changes = append(changes, createChange(AuditPayment, h.RefundPaymentID))
+		}
+		released = append(released, *h)
+		freed[h.TripID] = true
+	}
+	for tripID := range freed {
+		promoted, err := promoteWaitlist(tx, tripID, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		offers = append(offers, promoted...)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("error releasing expired seat holds: %w", err)
+	}
+	auditSystemChanges(append(changes, offerChanges(offers)...))
+	return released, offers, nil
+}
+
+// ScheduleHoldCheck runs ExpireHolds now and then at the given interval,
+// logging each hold it releases
+func ScheduleHoldCheck(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	check := func() {
+		released, offers, err := ExpireHolds()
+		if err != nil {
+			log.Printf("Warning: Failed to release expired seat holds: %v", err)
+			return
+		}
+		for _, h := range released {
+			log.Printf("Released seat %s on trip %d (booking %d, %s): hold expired at %s",
+				h.SeatNumber, h.TripID, h.BookingID, h.Reference, h.HoldExpiresAt.Format(departureLayouts[0]))
+		}
+		for _, o := range offers {
+			log.Printf("Offered seat %s on trip %d to waitlisted passenger %s (booking %d, hold until %s)",
+				o.SeatNumber, o.TripID, o.Passenger, o.BookingID, o.HoldExpiresAt.Format(departureLayouts[0]))
+		}
+	}
+	check()
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			check()
+		}
+	}()
+
+	log.Printf("Seat hold check scheduled every %s", interval)
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"SecureSignIn/utils"
+)
+
+// LockoutPolicy controls when repeated failed logins lock an account.
+type LockoutPolicy struct {
+	MaxFailures int           // failed attempts allowed within Window before locking
+	Window      time.Duration // failures older than this no longer count
+	BaseLockout time.Duration // length of the first lockout, doubled for each consecutive one
+	MaxLockout  time.Duration // upper bound on a single lockout
+}
+
+// Lockout is the active lockout policy, configurable through the environment.
+var Lockout = LoadLockoutPolicy()
+
+// LoadLockoutPolicy reads the lockout thresholds from the environment.
+func LoadLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		MaxFailures: utils.GetEnvInt("LOGIN_MAX_FAILURES", 5),
+		Window:      utils.GetEnvDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		BaseLockout: utils.GetEnvDuration("LOGIN_LOCKOUT_BASE", time.Minute),
+		MaxLockout:  utils.GetEnvDuration("LOGIN_LOCKOUT_MAX", 24*time.Hour),
+	}
+}
+
+// lockoutDuration returns how long the n-th consecutive lockout lasts.
+func (p LockoutPolicy) lockoutDuration(n int) time.Duration {
+	d := p.BaseLockout
+	for i := 1; i < n && d < p.MaxLockout; i++ {
+		d *= 2
+	}
+	if d > p.MaxLockout {
+		d = p.MaxLockout
+	}
+	return d
+}
+
+// GetLockedUntil returns the time an account's lockout ends, or the zero time
+// if the account is not currently locked.
+func GetLockedUntil(userID int64) (time.Time, error) {
+	var lockedUntil sql.NullTime
+	err := DB.QueryRow(
+		"SELECT locked_until FROM users WHERE id = ? AND locked_until > ?",
+		userID, sqlTime(time.Now()),
+	).Scan(&lockedUntil)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error checking lockout for user ID %d: %w", userID, err)
+	}
+	return lockedUntil.Time, nil
+}
+
+// RecordFailedLogin logs a failed login and locks the account once it reaches
+// the policy's failure threshold. It returns the lockout end if the account
+// was locked by this attempt, or the zero time otherwise.
+func RecordFailedLogin(userID int64, ipAddress string) (time.Time, error) {
+	if err := LogLoginAttempt(userID, ipAddress, false); err != nil {
+		return time.Time{}, err
+	}
+	if Lockout.MaxFailures == 0 {
+		return time.Time{}, nil
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var failures, lockouts int
+	var lastFailed sql.NullTime
+	err = tx.QueryRow(
+		"SELECT failed_login_count, lockout_count, last_failed_login FROM users WHERE id = ?", userID,
+	).Scan(&failures, &lockouts, &lastFailed)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error reading login failures for user ID %d: %w", userID, err)
+	}
+
+	now := time.Now()
+	if !lastFailed.Valid || now.Sub(lastFailed.Time) > Lockout.Window {
+		failures = 0
+	}
+	failures++
+
+	var lockedUntil time.Time
+	var lockedUntilValue interface{}
+	if failures >= Lockout.MaxFailures {
+		lockouts++
+		lockedUntil = now.Add(Lockout.lockoutDuration(lockouts))
+		lockedUntilValue = sqlTime(lockedUntil)
+		failures = 0
+	}
+
+	_, err = tx.Exec(`
+		UPDATE users
+		SET failed_login_count = ?, last_failed_login = ?, lockout_count = ?,
+			locked_until = COALESCE(?, locked_until)
+		WHERE id = ?
+	`, failures, sqlTime(now), lockouts, lockedUntilValue, userID)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error recording login failure for user ID %d: %w", userID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return time.Time{}, fmt.Errorf("failed to commit login failure: %w", err)
+	}
+	return lockedUntil, nil
+}
+
+// ResetLoginFailures clears the failure counters after a successful login.
+func ResetLoginFailures(userID int64) error {
+	_, err := UnlockUser(userID)
+	return err
+}
+
+// UnlockUser lifts an account lockout. It returns false if the user does not exist.
+func UnlockUser(userID int64) (bool, error) {
+	result, err := DB.Exec(`
+		UPDATE users
+		SET failed_login_count = 0, last_failed_login = NULL, lockout_count = 0, locked_until = NULL
+		WHERE id = ?
+	`, userID)
+	if err != nil {
+		return false, fmt.Errorf("error unlocking user ID %d: %w", userID, err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("error unlocking user ID %d: %w", userID, err)
+	}
+	return n > 0, nil
+}
@@ -0,0 +1,339 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// ErrSamePassenger is returned when merging a passenger record into itself
+var ErrSamePassenger = errors.New("a passenger cannot be merged into itself")
+
+// passengerSearchLimit is the most passengers SearchPassengers returns
+const passengerSearchLimit = 10
+
+// Passenger is a person who travels, kept once per national ID. Bookings
+// still hold the details they were made with, unless they were moved here by
+// a merge; the registry holds the latest.
+type Passenger struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	SocialID    string    `json:"social_id"`
+	PhoneNumber string    `json:"phone_number"`
+	DateOfBirth string    `json:"date_of_birth"`
+	Bookings    int       `json:"bookings"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// PassengerTrip is one booking of a passenger. DepartureTime and ArrivalTime
+// are when the trip leaves the boarding stop and reaches the alighting stop.
+type PassengerTrip struct {
+	BookingID     int64  `json:"booking_id"`
+	Reference     string `json:"reference"`
+	TripID        int64  `json:"trip_id"`
+	Boarding      string `json:"boarding"`
+	Alighting     string `json:"alighting"`
+	DepartureTime string `json:"departure_time"`
+	ArrivalTime   string `json:"arrival_time"`
+	SeatNumber    string `json:"seat_number"`
+	Status        string `json:"status"`
+}
+
+// PassengerDetail is a passenger with their trips still to come, soonest
+// first, and the trips that have left, most recent first
+type PassengerDetail struct {
+	Passenger
+	Upcoming []PassengerTrip `json:"upcoming"`
+	Past     []PassengerTrip `json:"past"`
+}
+
+// savePassenger records the passenger of a booking in the registry and
+// returns their ID. A passenger already known by the national ID has their
+// name, phone and date of birth updated to those given. Bookings without a
+// national ID are not registered and get 0.
+func savePassenger(q queryer, b BookingRequest, now time.Time) (int64, error) {
+	socialID := strings.TrimSpace(b.SocialID)
+	if socialID == "" {
+		return 0, nil
+	}
+	hash, err := LookupHash(socialID)
+	if err != nil {
+		return 0, err
+	}
+	encSocialID, err := EncryptField(socialID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encrypt social ID: %w", err)
+	}
+	encDOB, err := EncryptField(b.DateOfBirth)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encrypt date of birth: %w", err)
+	}
+
+	var id int64
+	err = q.QueryRow("SELECT id FROM passengers WHERE social_id_hash = ?", hash).Scan(&id)
+	switch {
+	case err == sql.ErrNoRows:
+		res, err := q.Exec(`
+			INSERT INTO passengers (social_id_hash, social_id, name, phone_number, date_of_birth, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, hash, encSocialID, b.Passenger, b.PhoneNumber, encDOB, sqlTime(now), sqlTime(now))
+		if err != nil {
+			return 0, fmt.Errorf("error adding passenger: %w", err)
+		}
+		return res.LastInsertId()
+	case err != nil:
+		return 0, fmt.Errorf("error looking up passenger: %w", err)
+	}
+
+	_, err = q.Exec(`
+		UPDATE passengers SET name = ?, phone_number = ?, date_of_birth = ?, updated_at = ?
+		WHERE id = ?
+	`, b.Passenger, b.PhoneNumber, encDOB, sqlTime(now), id)
+	if err != nil {
+		return 0, fmt.Errorf("error updating passenger %d: %w", id, err)
+	}
+	return id, nil
+}
+
+// passengerSQL selects the columns scanned by scanPassenger
+const passengerSQL = `
+	SELECT p.id, p.name, p.social_id, p.phone_number, p.date_of_birth, p.created_at, p.updated_at,
+		(SELECT COUNT(*) FROM bookings b WHERE b.passenger_id = p.id)
+	FROM passengers p`
+
+// scanPassenger reads a row selected with passengerSQL
+func scanPassenger(row interface{ Scan(...interface{}) error }) (*Passenger, error) {
+	var p Passenger
+	if err := row.Scan(&p.ID, &p.Name, &p.SocialID, &p.PhoneNumber, &p.DateOfBirth, &p.CreatedAt, &p.UpdatedAt, &p.Bookings); err != nil {
+		return nil, err
+	}
+	if err := DecryptFields(&p.SocialID, &p.DateOfBirth); err != nil {
+		return nil, fmt.Errorf("error decrypting passenger %d: %w", p.ID, err)
+	}
+	return &p, nil
+}
+
+// SearchPassengers finds passengers for autocomplete: the one whose national
+// ID is exactly query, then those whose phone number starts with it
+func SearchPassengers(query string) ([]Passenger, error) {
+	query = strings.TrimSpace(query)
+	passengers := []Passenger{}
+	if query == "" {
+		return passengers, nil
+	}
+	hash, err := LookupHash(query)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := DB.Query(passengerSQL+`
+		WHERE p.social_id_hash = ? OR p.phone_number LIKE ? ESCAPE '\'
+		ORDER BY p.social_id_hash = ? DESC, p.name
+		LIMIT ?
+	`, hash, escapeLike(query)+"%", hash, passengerSearchLimit)
+	if err != nil {
+		return nil, fmt.Errorf("error searching passengers: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanPassenger(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning passenger: %w", err)
+		}
+		passengers = append(passengers, *p)
+	}
+	return passengers, rows.Err()
+}
+
+// escapeLike escapes the LIKE wildcards in s, for use with ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// GetPassenger returns a passenger with all their trips, or sql.ErrNoRows if
+// there is no such passenger. A trip is upcoming until it leaves the
+// passenger's boarding stop.
+func GetPassenger(id int64) (*PassengerDetail, error) {
+	p, err := scanPassenger(DB.QueryRow(passengerSQL+" WHERE p.id = ?", id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error retrieving passenger %d: %w", id, err)
+	}
+
+	nowSQL, args, err := stationNowSQL(DB, "t.origin", time.Now())
+	if err != nil {
+		return nil, err
+	}
+	rows, err := DB.Query(`
+		SELECT b.id, COALESCE(b.reference, ''), b.trip_id, `+boardingStationSQL+`, `+alightingStationSQL+`,
+			`+boardingTimeSQL+` AS departure, `+alightingTimeSQL+`, COALESCE(b.seat_number, ''), b.status,
+			`+boardingTimeSQL+` > `+nowSQL+`
+		FROM bookings b
+		JOIN trips t ON b.trip_id = t.id
+		WHERE b.passenger_id = ?
+		ORDER BY departure
+	`, append(args, id)...)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving trips of passenger %d: %w", id, err)
+	}
+	defer rows.Close()
+
+	detail := &PassengerDetail{Passenger: *p, Upcoming: []PassengerTrip{}, Past: []PassengerTrip{}}
+	for rows.Next() {
+		var t PassengerTrip
+		var upcoming bool
+		if err := rows.Scan(&t.BookingID, &t.Reference, &t.TripID, &t.Boarding, &t.Alighting,
+			&t.DepartureTime, &t.ArrivalTime, &t.SeatNumber, &t.Status, &upcoming); err != nil {
+			return nil, fmt.Errorf("error scanning passenger trip: %w", err)
+		}
+		if upcoming {
+			detail.Upcoming = append(detail.Upcoming, t)
+		} else {
+			detail.Past = append([]PassengerTrip{t}, detail.Past...)
+		}
+	}
+	return detail, rows.Err()
+}
+
+// MergePassengers folds a duplicate passenger record into the one to keep:
+// the duplicate's bookings move to the kept record, taking its name, national
+// ID and phone number, and the duplicate is deleted. It returns the number of bookings moved, sql.ErrNoRows if either
+// passenger does not exist and ErrSamePassenger if they are the same.
+func MergePassengers(keepID, duplicateID int64) (int64, error) {
+	if keepID == duplicateID {
+		return 0, ErrSamePassenger
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var found int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM passengers WHERE id IN (?, ?)", keepID, duplicateID).Scan(&found); err != nil {
+		return 0, fmt.Errorf("error retrieving passengers: %w", err)
+	}
+	if found != 2 {
+		return 0, sql.ErrNoRows
+	}
+
+	res, err := tx.Exec(`
+		UPDATE bookings SET passenger_id = p.id, passenger = p.name, social_id = p.social_id, phone_number = p.phone_number
+		FROM passengers p
+		WHERE p.id = ? AND bookings.passenger_id = ?
+	`, keepID, duplicateID)
+	if err != nil {
+		return 0, fmt.Errorf("error moving bookings: %w", err)
+	}
+	moved, _ := res.RowsAffected()
+	if _, err := tx.Exec("DELETE FROM passengers WHERE id = ?", duplicateID); err != nil {
+		return 0, fmt.Errorf("error deleting passenger %d: %w", duplicateID, err)
+	}
+	if _, err := tx.Exec("UPDATE passengers SET updated_at = ? WHERE id = ?", sqlTime(time.Now()), keepID); err != nil {
+		return 0, fmt.Errorf("error updating passenger %d: %w", keepID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error merging passengers: %w", err)
+	}
+	return moved, nil
+}
+
+// rehashPassengers rebuilds the national ID index of the registry under a new
+// lookup key, reading the IDs under the current field key
+func rehashPassengers(tx *sql.Tx, key []byte) error {
+	rows, err := tx.Query("SELECT id, social_id FROM passengers")
+	if err != nil {
+		return fmt.Errorf("error reading passengers: %w", err)
+	}
+	hashes := map[int64]string{}
+	for rows.Next() {
+		var id int64
+		var socialID string
+		if err := rows.Scan(&id, &socialID); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning passenger: %w", err)
+		}
+		if socialID, err = DecryptField(socialID); err != nil {
+			rows.Close()
+			return fmt.Errorf("passenger %d: %w", id, err)
+		}
+		hashes[id] = lookupHashWith(key, socialID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, hash := range hashes {
+		if _, err := tx.Exec("UPDATE passengers SET social_id_hash = ? WHERE id = ?", hash, id); err != nil {
+			return fmt.Errorf("error rehashing passenger %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// migratePassengers registers the passengers of existing bookings, oldest
+// booking first so each passenger ends up with their latest details, and
+// links the bookings to them. Bookings without a national ID stay unlinked.
+func migratePassengers() error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, passenger, social_id, phone_number, date_of_birth FROM bookings WHERE passenger_id IS NULL ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("error reading bookings: %w", err)
+	}
+	type pending struct {
+		id int64
+		b  BookingRequest
+	}
+	var bookings []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.b.Passenger, &p.b.SocialID, &p.b.PhoneNumber, &p.b.DateOfBirth); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning booking: %w", err)
+		}
+		if err := DecryptFields(&p.b.SocialID, &p.b.DateOfBirth); err != nil {
+			rows.Close()
+			return fmt.Errorf("booking %d: %w", p.id, err)
+		}
+		bookings = append(bookings, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	linked := 0
+	for _, p := range bookings {
+		passengerID, err := savePassenger(tx, p.b, now)
+		if err != nil {
+			return err
+		}
+		if passengerID == 0 {
+			continue
+		}
+		if _, err := tx.Exec("UPDATE bookings SET passenger_id = ? WHERE id = ?", passengerID, p.id); err != nil {
+			return fmt.Errorf("error linking booking %d: %w", p.id, err)
+		}
+		linked++
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error registering passengers: %w", err)
+	}
+	log.Printf("Linked %d existing bookings to the passenger registry", linked)
+	return nil
+}
@@ -0,0 +1,145 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+)
+
+// findPassenger looks a passenger up by national ID
+func findPassenger(t *testing.T, socialID string) *Passenger {
+	t.Helper()
+	found, err := SearchPassengers(socialID)
+	if err != nil {
+		t.Fatalf("SearchPassengers: %v", err)
+	}
+	if len(found) == 0 || found[0].SocialID != socialID {
+		t.Fatalf("SearchPassengers(%s) = %+v, want that passenger first", socialID, found)
+	}
+	return &found[0]
+}
+
+func TestSearchPassengers(t *testing.T) {
+	openTestDB(t)
+	tripID := addTestTrip(t, 10)
+	for i, phone := range []string{"09121111111", "09122222222", "09351111111"} {
+		b := testBooking(tripID, i+1)
+		b.PhoneNumber = phone
+		if _, err := AddBooking(b); err != nil {
+			t.Fatalf("AddBooking: %v", err)
+		}
+	}
+	// Booking again updates the registry rather than adding to it
+	again := testBooking(tripID, 1)
+	again.Passenger = "Renamed Passenger"
+	again.PhoneNumber = "09121111111"
+	if _, err := AddBooking(again); err != nil {
+		t.Fatalf("AddBooking: %v", err)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"0000000002", []string{"0000000002"}},
+		{"0912", []string{"0000000001", "0000000002"}},
+		{"0935", []string{"0000000003"}},
+		{"%", nil},
+		{"0912_", nil},
+		{"0000000009", nil},
+		{"  ", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			found, err := SearchPassengers(tt.query)
+			if err != nil {
+				t.Fatalf("SearchPassengers: %v", err)
+			}
+			if len(found) != len(tt.want) {
+				t.Fatalf("found %+v, want %v", found, tt.want)
+			}
+			for i, want := range tt.want {
+				if found[i].SocialID != want {
+					t.Errorf("result %d = %s, want %s", i, found[i].SocialID, want)
+				}
+			}
+		})
+	}
+
+	p := findPassenger(t, "0000000001")
+	if p.Name != "Renamed Passenger" || p.Bookings != 2 || p.DateOfBirth != "1990-01-01" {
+		t.Errorf("passenger = %+v, want the latest name, two bookings and the date of birth", p)
+	}
+}
+
+func TestMergePassengers(t *testing.T) {
+	openTestDB(t)
+	tripID := addTestTrip(t, 10)
+	keepBooking := testBooking(tripID, 1)
+	keepBooking.Passenger = "Sara Ahmadi"
+	keepBooking.PhoneNumber = "09121111111"
+	if _, err := AddBooking(keepBooking); err != nil {
+		t.Fatalf("AddBooking: %v", err)
+	}
+	// The same passenger booked twice with a mistyped national ID
+	for i := 0; i < 2; i++ {
+		dup := testBooking(tripID, 10)
+		dup.Passenger = "Sara Ahmady"
+		dup.PhoneNumber = "09129999999"
+		if _, err := AddBooking(dup); err != nil {
+			t.Fatalf("AddBooking: %v", err)
+		}
+	}
+	keep := findPassenger(t, "0000000001")
+	duplicate := findPassenger(t, "0000000010")
+
+	if _, err := MergePassengers(keep.ID, keep.ID); !errors.Is(err, ErrSamePassenger) {
+		t.Errorf("merging into itself: error = %v, want ErrSamePassenger", err)
+	}
+	if _, err := MergePassengers(keep.ID, 999); err != sql.ErrNoRows {
+		t.Errorf("merging an unknown passenger: error = %v, want sql.ErrNoRows", err)
+	}
+
+	moved, err := MergePassengers(keep.ID, duplicate.ID)
+	if err != nil {
+		t.Fatalf("MergePassengers: %v", err)
+	}
+	if moved != 2 {
+		t.Errorf("moved %d bookings, want 2", moved)
+	}
+	if _, err := GetPassenger(duplicate.ID); err != sql.ErrNoRows {
+		t.Errorf("GetPassenger(duplicate) error = %v, want sql.ErrNoRows", err)
+	}
+	if found, _ := SearchPassengers("0000000010"); len(found) != 0 {
+		t.Errorf("the duplicate's national ID still finds %+v", found)
+	}
+
+	detail, err := GetPassenger(keep.ID)
+	if err != nil {
+		t.Fatalf("GetPassenger: %v", err)
+	}
+	if detail.Bookings != 3 || len(detail.Upcoming) != 3 || len(detail.Past) != 0 {
+		t.Errorf("kept passenger has %d bookings, %d upcoming and %d past trips; want 3, 3 and 0", detail.Bookings, len(detail.Upcoming), len(detail.Past))
+	}
+
+	rows, err := DB.Query("SELECT passenger, social_id, phone_number FROM bookings WHERE passenger_id = ?", keep.ID)
+	if err != nil {
+		t.Fatalf("reading bookings: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, socialID, phone string
+		if err := rows.Scan(&name, &socialID, &phone); err != nil {
+			t.Fatalf("scanning booking: %v", err)
+		}
+		if err := DecryptFields(&socialID); err != nil {
+			t.Fatalf("DecryptFields: %v", err)
+		}
+		if name != "Sara Ahmadi" || socialID != "0000000001" || phone != "09121111111" {
+			t.Errorf("booking holds %s, %s, %s; want the kept passenger's details", name, socialID, phone)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("reading bookings: %v", err)
+	}
+}
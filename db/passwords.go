@@ -0,0 +1,150 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"SecureSignIn/utils"
+)
+
+// PasswordPolicyError is returned when a new password is rejected by the
+// password policy. Its message is safe to show to the user.
+type PasswordPolicyError struct {
+	Message string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return e.Message
+}
+
+// CheckNewPassword validates a new password for an existing user against the
+// password policy and their recent passwords. It returns a *PasswordPolicyError
+// if the password is not acceptable.
+func CheckNewPassword(userID int64, password string) error {
+	var username string
+	if err := DB.QueryRow("SELECT username FROM users WHERE id = ?", userID).Scan(&username); err != nil {
+		return fmt.Errorf("error retrieving user ID %d: %w", userID, err)
+	}
+	if ok, msg := utils.PasswordRules.Validate(password, username); !ok {
+		return &PasswordPolicyError{Message: msg}
+	}
+
+	reused, err := isRecentPassword(userID, password)
+	if err != nil {
+		return err
+	}
+	if reused {
+		return &PasswordPolicyError{Message: fmt.Sprintf(
+			"You have used this password recently. Please choose one you haven't used in your last %d passwords.",
+			utils.PasswordRules.History)}
+	}
+	return nil
+}
+
+// isRecentPassword reports whether a password matches the user's current
+// password or one of the previous passwords covered by the policy.
+func isRecentPassword(userID int64, password string) (bool, error) {
+	if utils.PasswordRules.History == 0 {
+		return false, nil
+	}
+
+	rows, err := DB.Query(`
+		SELECT password FROM users WHERE id = ?
+		UNION ALL
+		SELECT password_hash FROM (
+			SELECT password_hash FROM password_history WHERE user_id = ? ORDER BY id DESC LIMIT ?
+		)
+	`, userID, userID, utils.PasswordRules.History)
+	if err != nil {
+		return false, fmt.Errorf("error retrieving password history for user ID %d: %w", userID, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return false, fmt.Errorf("error reading password history for user ID %d: %w", userID, err)
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// SetUserPassword checks a new password against the policy and, if it is
+// acceptable, stores it for the user. It returns a *PasswordPolicyError if the
+// password is rejected. Every code path that changes a password goes through here.
+func SetUserPassword(userID int64, password string) error {
+	if err := CheckNewPassword(userID, password); err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("error hashing password: %w", err)
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE users SET password = ?, password_changed_at = ?, must_change_password = 0
+		WHERE id = ?
+	`, string(hash), sqlTime(time.Now()), userID)
+	if err != nil {
+		return fmt.Errorf("error updating password for user ID %d: %w", userID, err)
+	}
+	if err := recordPasswordHistory(tx, userID, string(hash)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit password change: %w", err)
+	}
+	return nil
+}
+
+// recordPasswordHistory remembers a password hash and forgets any beyond the
+// number the policy checks for reuse.
+func recordPasswordHistory(tx *sql.Tx, userID int64, passwordHash string) error {
+	if _, err := tx.Exec(
+		"INSERT INTO password_history (user_id, password_hash) VALUES (?, ?)", userID, passwordHash,
+	); err != nil {
+		return fmt.Errorf("error recording password history for user ID %d: %w", userID, err)
+	}
+	_, err := tx.Exec(`
+		DELETE FROM password_history
+		WHERE user_id = ? AND id NOT IN (
+			SELECT id FROM password_history WHERE user_id = ? ORDER BY id DESC LIMIT ?
+		)
+	`, userID, userID, utils.PasswordRules.History)
+	if err != nil {
+		return fmt.Errorf("error trimming password history for user ID %d: %w", userID, err)
+	}
+	return nil
+}
+
+// RequirePasswordChange makes a user choose a new password at their next login.
+func RequirePasswordChange(userID int64) error {
+	_, err := DB.Exec("UPDATE users SET must_change_password = 1 WHERE id = ?", userID)
+	if err != nil {
+		return fmt.Errorf("error flagging password change for user ID %d: %w", userID, err)
+	}
+	return nil
+}
+
+// passwordChangeDue reports whether a user has to change their password,
+// either because it was flagged or because it is older than the policy allows.
+func passwordChangeDue(mustChange bool, changedAt sql.NullTime) bool {
+	if mustChange {
+		return true
+	}
+	maxAge := utils.PasswordRules.MaxAge
+	return maxAge > 0 && changedAt.Valid && time.Since(changedAt.Time) > maxAge
+}
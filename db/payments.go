@@ -0,0 +1,389 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Ways a payment can be taken or a refund paid out
+const (
+	PaymentCash     = "cash"
+	PaymentCard     = "card"
+	PaymentTransfer = "transfer"
+)
+
+// PaymentMethods lists the accepted payment methods
+var PaymentMethods = []string{PaymentCash, PaymentCard, PaymentTransfer}
+
+var (
+	// ErrInvalidPaymentMethod is returned for a method not in PaymentMethods
+	ErrInvalidPaymentMethod = errors.New("payment method must be cash, card or transfer")
+	// ErrOverpayment is returned when a payment is more than the booking still owes
+	ErrOverpayment = errors.New("payment is more than the outstanding balance")
+	// ErrRefundTooLarge is returned when a refund is more than was paid for the booking
+	ErrRefundTooLarge = errors.New("refund is more than was paid for this booking")
+	// ErrBookingHasPayments is returned when deleting a booking that has ledger entries
+	ErrBookingHasPayments = errors.New("booking has payments and cannot be deleted")
+	// ErrTripHasPayments is returned when deleting a trip with a booking that has ledger entries
+	ErrTripHasPayments = errors.New("trip has bookings with payments and cannot be deleted")
+	// ErrBookingReleased is returned when paying for a booking that has been cancelled or refunded
+	ErrBookingReleased = errors.New("booking is cancelled or refunded and cannot be paid for")
+)
+
+// Payment is one entry in the payments ledger. Refunds are entries with a
+// negative amount. Amounts are in cents.
+type Payment struct {
+	ID              int64     `json:"id"`
+	BookingID       int64     `json:"booking_id"`
+	AmountCents     int64     `json:"amount_cents"`
+	Method          string    `json:"method"`
+	CashierID       int64     `json:"cashier_id"`
+	CashierUsername string    `json:"cashier_username"`
+	Reference       string    `json:"reference"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// BookingBalance is what a booking costs, what has been paid for it net of
+// refunds, and what is still owed. PriceCents is nil for unpriced bookings.
+type BookingBalance struct {
+	BookingID        int64  `json:"booking_id"`
+	PriceCents       *int64 `json:"price_cents"`
+	PaidCents        int64  `json:"paid_cents"`
+	OutstandingCents int64  `json:"outstanding_cents"`
+}
+
+// IsValidPaymentMethod reports whether method is an accepted payment method
+func IsValidPaymentMethod(method string) bool {
+	for _, m := range PaymentMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// bookingBalance works out the balance of a booking. It returns sql.ErrNoRows
+// if the booking does not exist.
+func bookingBalance(q queryer, bookingID int64) (*BookingBalance, error) {
+	var price sql.NullInt64
+	var paid int64
+	err := q.QueryRow(`
+		SELECT b.price_cents, COALESCE((SELECT SUM(p.amount_cents) FROM payments p WHERE p.booking_id = b.id), 0)
+		FROM bookings b
+		WHERE b.id = ?
+	`, bookingID).Scan(&price, &paid)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error retrieving balance of booking %d: %w", bookingID, err)
+	}
+
+	balance := &BookingBalance{BookingID: bookingID, PaidCents: paid}
+	if price.Valid {
+		balance.PriceCents = &price.Int64
+		balance.OutstandingCents = price.Int64 - paid
+	}
+	return balance, nil
+}
+
+// GetBookingBalance returns what a booking costs, what has been paid and what
+// is outstanding. It returns sql.ErrNoRows if the booking does not exist.
+func GetBookingBalance(bookingID int64) (*BookingBalance, error) {
+	return bookingBalance(DB, bookingID)
+}
+
+// RecordPayment adds a payment for a booking to the ledger. The payment may
+// not be more than the booking's outstanding balance; unpriced bookings
+// accept any amount. Cancelled and refunded bookings cannot be paid for
+// (ErrBookingReleased). It returns sql.ErrNoRows if the booking does not exist.
+func RecordPayment(bookingID, amountCents int64, method string, cashierID int64, cashierUsername, reference string) (int64, error) {
+	if amountCents <= 0 {
+		return 0, fmt.Errorf("amount must be greater than zero")
+	}
+	return addLedgerEntry(bookingID, amountCents, method, cashierID, cashierUsername, reference)
+}
+
+// RecordRefund adds a refund for a booking to the ledger as a negative entry.
+// The refund may not be more than has been paid for the booking. It returns
+// sql.ErrNoRows if the booking does not exist.
+func RecordRefund(bookingID, amountCents int64, method string, cashierID int64, cashierUsername, reference string) (int64, error) {
+	if amountCents <= 0 {
+		return 0, fmt.Errorf("amount must be greater than zero")
+	}
+	return addLedgerEntry(bookingID, -amountCents, method, cashierID, cashierUsername, reference)
+}
+
+// addLedgerEntry checks a payment (positive) or refund (negative) against the
+// booking's balance and records it
+func addLedgerEntry(bookingID, amountCents int64, method string, cashierID int64, cashierUsername, reference string) (int64, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	id, err := insertLedgerEntry(tx, bookingID, amountCents, method, cashierID, cashierUsername, reference)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit payment: %w", err)
+	}
+	return id, nil
+}
+
+// insertLedgerEntry records a ledger entry inside tx, so it can be part of a
+// larger change such as cancelling a booking
+func insertLedgerEntry(tx *sql.Tx, bookingID, amountCents int64, method string, cashierID int64, cashierUsername, reference string) (int64, error) {
+	if !IsValidPaymentMethod(method) {
+		return 0, ErrInvalidPaymentMethod
+	}
+
+	balance, err := bookingBalance(tx, bookingID)
+	if err != nil {
+		return 0, err
+	}
+	var status string
+	if err := tx.QueryRow("SELECT status FROM bookings WHERE id = ?", bookingID).Scan(&status); err != nil {
+		return 0, fmt.Errorf("error retrieving booking %d: %w", bookingID, err)
+	}
+	if amountCents > 0 && isReleased(status) {
+		return 0, ErrBookingReleased
+	}
+	if amountCents > 0 && balance.PriceCents != nil && amountCents > balance.OutstandingCents {
+		return 0, ErrOverpayment
+	}
+	if amountCents < 0 && -amountCents > balance.PaidCents {
+		return 0, ErrRefundTooLarge
+	}
+
+	cashier := sql.NullInt64{Int64: cashierID, Valid: cashierID != 0}
+	res, err := tx.Exec(`
+		INSERT INTO payments (booking_id, amount_cents, method, cashier_id, cashier_username, reference, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, bookingID, amountCents, method, cashier, cashierUsername, reference, sqlTime(time.Now()))
+	if err != nil {
+		return 0, fmt.Errorf("failed to record payment for booking %d: %w", bookingID, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve payment id: %w", err)
+	}
+
+	// A cancelled or no-show booking that has been paid back in full is refunded
+	if amountCents < 0 && balance.PaidCents+amountCents == 0 {
+		if CanChangeBookingStatus(status, BookingRefunded) {
+			if _, err := setBookingStatus(tx, bookingID, BookingRefunded, cashierID, cashierUsername, reference, time.Now()); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return id, nil
+}
+
+// PaymentFilter narrows down ledger queries. Empty fields match everything.
+type PaymentFilter struct {
+	BookingID int64
+	Method    string
+	From      string // YYYY-MM-DD, inclusive
+	To        string // YYYY-MM-DD, inclusive
+}
+
+// GetPayments returns the ledger entries matching the filter, newest first
+func GetPayments(f PaymentFilter) ([]Payment, error) {
+	query := `SELECT id, booking_id, amount_cents, method, COALESCE(cashier_id, 0), COALESCE(cashier_username, ''),
+		COALESCE(reference, ''), created_at
+		FROM payments WHERE 1=1`
+	var args []interface{}
+	if f.BookingID != 0 {
+		query += " AND booking_id = ?"
+		args = append(args, f.BookingID)
+	}
+	if f.Method != "" {
+		query += " AND method = ?"
+		args = append(args, f.Method)
+	}
+	if f.From != "" {
+		query += " AND DATE(created_at) >= ?"
+		args = append(args, f.From)
+	}
+	if f.To != "" {
+		query += " AND DATE(created_at) <= ?"
+		args = append(args, f.To)
+	}
+	query += " ORDER BY created_at DESC, id DESC"
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving payments: %w", err)
+	}
+	defer rows.Close()
+
+	payments := []Payment{}
+	for rows.Next() {
+		var p Payment
+		if err := rows.Scan(&p.ID, &p.BookingID, &p.AmountCents, &p.Method, &p.CashierID, &p.CashierUsername, &p.Reference, &p.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning payment: %w", err)
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+// centsToAmount turns cents into a currency amount for reports
+func centsToAmount(cents int64) float64 {
+	return float64(cents) / 100
+}
+
+// GetDailyRevenue returns payments, refunds and net revenue per day within a date range
+func GetDailyRevenue(from, to string) ([]map[string]interface{}, error) {
+	query := `
+	SELECT DATE(created_at) AS date,
+		   COALESCE(SUM(CASE WHEN amount_cents > 0 THEN amount_cents END), 0) AS payments,
+		   COALESCE(-SUM(CASE WHEN amount_cents < 0 THEN amount_cents END), 0) AS refunds,
+		   SUM(amount_cents) AS net
+	  FROM payments
+	 WHERE DATE(created_at) >= ? AND DATE(created_at) <= ?
+	 GROUP BY DATE(created_at)
+	 ORDER BY DATE(created_at)
+	`
+	rows, err := DB.Query(query, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error getting daily revenue: %w", err)
+	}
+	defer rows.Close()
+
+	var results []map[string]interface{}
+	for rows.Next() {
+		var date string
+		var payments, refunds, net int64
+		if err := rows.Scan(&date, &payments, &refunds, &net); err != nil {
+			log.Printf("Error scanning daily revenue row: %v", err)
+			continue
+		}
+		results = append(results, map[string]interface{}{
+			"date":     date,
+			"payments": centsToAmount(payments),
+			"refunds":  centsToAmount(refunds),
+			"net":      centsToAmount(net),
+		})
+	}
+	return results, nil
+}
+
+// GetRevenueByRoute returns net revenue per origin-destination within a date range
+func GetRevenueByRoute(from, to string) ([]map[string]interface{}, error) {
+	query := `
+	SELECT t.origin, t.destination, COUNT(DISTINCT p.booking_id) AS bookings, SUM(p.amount_cents) AS net
+	  FROM payments p
+	  JOIN bookings b ON p.booking_id = b.id
+	  JOIN trips t ON b.trip_id = t.id
+	 WHERE DATE(p.created_at) >= ? AND DATE(p.created_at) <= ?
+	 GROUP BY t.origin, t.destination
+	 ORDER BY net DESC
+	`
+	rows, err := DB.Query(query, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error getting revenue by route: %w", err)
+	}
+	defer rows.Close()
+
+	var results []map[string]interface{}
+	for rows.Next() {
+		var origin, destination string
+		var bookings int
+		var net int64
+		if err := rows.Scan(&origin, &destination, &bookings, &net); err != nil {
+			log.Printf("Error scanning revenue by route row: %v", err)
+			continue
+		}
+		results = append(results, map[string]interface{}{
+			"origin":      origin,
+			"destination": destination,
+			"bookings":    bookings,
+			"net":         centsToAmount(net),
+		})
+	}
+	return results, nil
+}
+
+// GetRevenueByPaymentMethod returns payments, refunds and net revenue per payment method within a date range
+func GetRevenueByPaymentMethod(from, to string) ([]map[string]interface{}, error) {
+	query := `
+	SELECT method,
+		   COALESCE(SUM(CASE WHEN amount_cents > 0 THEN amount_cents END), 0) AS payments,
+		   COALESCE(-SUM(CASE WHEN amount_cents < 0 THEN amount_cents END), 0) AS refunds,
+		   SUM(amount_cents) AS net
+	  FROM payments
+	 WHERE DATE(created_at) >= ? AND DATE(created_at) <= ?
+	 GROUP BY method
+	 ORDER BY net DESC
+	`
+	rows, err := DB.Query(query, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error getting revenue by payment method: %w", err)
+	}
+	defer rows.Close()
+
+	var results []map[string]interface{}
+	for rows.Next() {
+		var method string
+		var payments, refunds, net int64
+		if err := rows.Scan(&method, &payments, &refunds, &net); err != nil {
+			log.Printf("Error scanning revenue by payment method row: %v", err)
+			continue
+		}
+		results = append(results, map[string]interface{}{
+			"method":   method,
+			"payments": centsToAmount(payments),
+			"refunds":  centsToAmount(refunds),
+			"net":      centsToAmount(net),
+		})
+	}
+	return results, nil
+}
+
+// GetRefunds returns every refund within a date range
+func GetRefunds(from, to string) ([]map[string]interface{}, error) {
+	query := `
+	SELECT p.created_at, p.booking_id, b.passenger, t.origin, t.destination, -p.amount_cents, p.method,
+		   COALESCE(p.cashier_username, ''), COALESCE(p.reference, '')
+	  FROM payments p
+	  JOIN bookings b ON p.booking_id = b.id
+	  JOIN trips t ON b.trip_id = t.id
+	 WHERE p.amount_cents < 0 AND DATE(p.created_at) >= ? AND DATE(p.created_at) <= ?
+	 ORDER BY p.created_at
+	`
+	rows, err := DB.Query(query, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error getting refunds: %w", err)
+	}
+	defer rows.Close()
+
+	var results []map[string]interface{}
+	for rows.Next() {
+		var createdAt time.Time
+		var bookingID, amount int64
+		var passenger, origin, destination, method, cashier, reference string
+		if err := rows.Scan(&createdAt, &bookingID, &passenger, &origin, &destination, &amount, &method, &cashier, &reference); err != nil {
+			log.Printf("Error scanning refund row: %v", err)
+			continue
+		}
+		results = append(results, map[string]interface{}{
+			"time":        createdAt.Format(timestampLayout),
+			"booking_id":  bookingID,
+			"passenger":   passenger,
+			"origin":      origin,
+			"destination": destination,
+			"amount":      centsToAmount(amount),
+			"method":      method,
+			"cashier":     cashier,
+			"reference":   reference,
+		})
+	}
+	return results, nil
+}
@@ -0,0 +1,191 @@
+package db
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ResetTokenTTL is how long a password reset code or link stays valid.
+const ResetTokenTTL = 15 * time.Minute
+
+// MaxResetCodeAttempts is how many wrong guesses a reset code survives
+// before it is invalidated.
+const MaxResetCodeAttempts = 5
+
+// Kinds of password reset token. Codes are short and typed in by the user
+// alongside their email address; links carry a long random token in the URL.
+const (
+	ResetTokenCode = "code"
+	ResetTokenLink = "link"
+)
+
+// ErrInvalidResetToken is returned for unknown, expired, used or exhausted reset tokens.
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+// hashResetLink hashes a reset link token for storage and lookup. Link tokens
+// are 256-bit random values, so a fast hash is sufficient.
+func hashResetLink(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateResetCode creates a 6 hex digit reset code.
+func generateResetCode() (string, error) {
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// IssuePasswordReset invalidates a user's outstanding reset tokens and
+// issues a new reset code, plus a reset link token if withLink is set.
+// Only hashes are stored: codes are only 24 bits, so they get bcrypt, which
+// together with the attempt limit keeps a leaked database from revealing them.
+func IssuePasswordReset(userID int64, withLink bool) (code, link string, err error) {
+	code, err = generateResetCode()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate reset code: %w", err)
+	}
+	codeHash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to hash reset code: %w", err)
+	}
+	if withLink {
+		if link, err = generateSessionToken(); err != nil {
+			return "", "", fmt.Errorf("failed to generate reset link token: %w", err)
+		}
+	}
+
+	now := time.Now()
+	expiresAt := sqlTime(now.Add(ResetTokenTTL))
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"UPDATE reset_tokens SET used_at = ? WHERE user_id = ? AND used_at IS NULL", sqlTime(now), userID,
+	); err != nil {
+		return "", "", fmt.Errorf("error invalidating old reset tokens: %w", err)
+	}
+
+	insert := "INSERT INTO reset_tokens (user_id, kind, token_hash, expires_at) VALUES (?, ?, ?, ?)"
+	if _, err := tx.Exec(insert, userID, ResetTokenCode, string(codeHash), expiresAt); err != nil {
+		return "", "", fmt.Errorf("error storing reset code: %w", err)
+	}
+	if withLink {
+		if _, err := tx.Exec(insert, userID, ResetTokenLink, hashResetLink(link), expiresAt); err != nil {
+			return "", "", fmt.Errorf("error storing reset link: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", "", fmt.Errorf("failed to commit reset tokens: %w", err)
+	}
+	return code, link, nil
+}
+
+// VerifyResetCode checks a reset code against the user's outstanding code and
+// returns the token ID to pass to ConsumeResetToken. Each wrong guess counts
+// against the code, which is invalidated after MaxResetCodeAttempts.
+func VerifyResetCode(userID int64, code string) (int64, error) {
+	var tokenID int64
+	var codeHash string
+	err := DB.QueryRow(`
+		SELECT id, token_hash FROM reset_tokens
+		WHERE user_id = ? AND kind = ? AND used_at IS NULL AND expires_at > ? AND attempts < ?
+		ORDER BY id DESC LIMIT 1
+	`, userID, ResetTokenCode, sqlTime(time.Now()), MaxResetCodeAttempts).Scan(&tokenID, &codeHash)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidResetToken
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error looking up reset code: %w", err)
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(codeHash), []byte(code)) == nil {
+		return tokenID, nil
+	}
+
+	_, err = DB.Exec(`
+		UPDATE reset_tokens
+		SET attempts = attempts + 1,
+			used_at = CASE WHEN attempts + 1 >= ? THEN ? ELSE used_at END
+		WHERE id = ?
+	`, MaxResetCodeAttempts, sqlTime(time.Now()), tokenID)
+	if err != nil {
+		return 0, fmt.Errorf("error recording reset code attempt: %w", err)
+	}
+	return 0, ErrInvalidResetToken
+}
+
+// LookupResetLink returns the user and token ID for an outstanding reset link token.
+func LookupResetLink(token string) (userID, tokenID int64, err error) {
+	err = DB.QueryRow(`
+		SELECT user_id, id FROM reset_tokens
+		WHERE token_hash = ? AND kind = ? AND used_at IS NULL AND expires_at > ?
+	`, hashResetLink(token), ResetTokenLink, sqlTime(time.Now())).Scan(&userID, &tokenID)
+	if err == sql.ErrNoRows {
+		return 0, 0, ErrInvalidResetToken
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("error looking up reset link: %w", err)
+	}
+	return userID, tokenID, nil
+}
+
+// ConsumeResetToken marks a verified reset token as used, along with any other
+// outstanding tokens for the same user. It returns ErrInvalidResetToken if the
+// token was used in the meantime.
+func ConsumeResetToken(tokenID int64) error {
+	now := sqlTime(time.Now())
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		"UPDATE reset_tokens SET used_at = ? WHERE id = ? AND used_at IS NULL AND expires_at > ?", now, tokenID, now,
+	)
+	if err != nil {
+		return fmt.Errorf("error marking reset token as used: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidResetToken
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE reset_tokens SET used_at = ?
+		WHERE user_id = (SELECT user_id FROM reset_tokens WHERE id = ?) AND used_at IS NULL
+	`, now, tokenID); err != nil {
+		return fmt.Errorf("error invalidating other reset tokens: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit reset token: %w", err)
+	}
+	return nil
+}
+
+// PurgeExpiredResetTokens removes reset tokens that have expired or been used.
+func PurgeExpiredResetTokens() (int64, error) {
+	res, err := DB.Exec(
+		"DELETE FROM reset_tokens WHERE expires_at <= ? OR used_at IS NOT NULL", sqlTime(time.Now()),
+	)
+	if err != nil {
+		return 0, fmt.Errorf("error purging expired reset tokens: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+// addTestUser adds an operator and returns their ID
+func addTestUser(t *testing.T, username string) int64 {
+	t.Helper()
+	id, err := AddUser(username, "not-a-real-hash", "1990-01-01", "1234567890", username+"@example.com", "Operator")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	return id
+}
+
+// wrongCode is never a reset code, which is made of hex digits
+const wrongCode = "zzzzzz"
+
+func TestResetCodeAttemptLimit(t *testing.T) {
+	openTestDB(t)
+	userID := addTestUser(t, "alice")
+
+	code, _, err := IssuePasswordReset(userID, false)
+	if err != nil {
+		t.Fatalf("IssuePasswordReset: %v", err)
+	}
+	for i := 1; i < MaxResetCodeAttempts; i++ {
+		if _, err := VerifyResetCode(userID, wrongCode); !errors.Is(err, ErrInvalidResetToken) {
+			t.Fatalf("wrong guess %d: error = %v, want ErrInvalidResetToken", i, err)
+		}
+	}
+	if _, err := VerifyResetCode(userID, code); err != nil {
+		t.Errorf("code after %d wrong guesses: %v, want it still accepted", MaxResetCodeAttempts-1, err)
+	}
+
+	code, _, err = IssuePasswordReset(userID, false)
+	if err != nil {
+		t.Fatalf("IssuePasswordReset: %v", err)
+	}
+	for i := 0; i < MaxResetCodeAttempts; i++ {
+		VerifyResetCode(userID, wrongCode)
+	}
+	if _, err := VerifyResetCode(userID, code); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("code after %d wrong guesses: error = %v, want it locked", MaxResetCodeAttempts, err)
+	}
+}
+
+func TestNewResetCodeInvalidatesOlder(t *testing.T) {
+	openTestDB(t)
+	userID := addTestUser(t, "bob")
+
+	oldCode, oldLink, err := IssuePasswordReset(userID, true)
+	if err != nil {
+		t.Fatalf("IssuePasswordReset: %v", err)
+	}
+	code, link, err := IssuePasswordReset(userID, true)
+	if err != nil {
+		t.Fatalf("IssuePasswordReset: %v", err)
+	}
+
+	if _, _, err := LookupResetLink(oldLink); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("old link: error = %v, want ErrInvalidResetToken", err)
+	}
+	if oldCode != code {
+		if _, err := VerifyResetCode(userID, oldCode); !errors.Is(err, ErrInvalidResetToken) {
+			t.Errorf("old code: error = %v, want ErrInvalidResetToken", err)
+		}
+	}
+	if linkUser, _, err := LookupResetLink(link); err != nil || linkUser != userID {
+		t.Errorf("new link = user %d, %v; want user %d", linkUser, err, userID)
+	}
+	tokenID, err := VerifyResetCode(userID, code)
+	if err != nil {
+		t.Fatalf("new code: %v", err)
+	}
+
+	// Using the code uses up the link issued with it
+	if err := ConsumeResetToken(tokenID); err != nil {
+		t.Fatalf("ConsumeResetToken: %v", err)
+	}
+	if err := ConsumeResetToken(tokenID); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("consuming again: error = %v, want ErrInvalidResetToken", err)
+	}
+	if _, _, err := LookupResetLink(link); !errors.Is(err, ErrInvalidResetToken) {
+		t.Errorf("link after the code was used: error = %v, want ErrInvalidResetToken", err)
+	}
+}
@@ -0,0 +1,458 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"SecureSignIn/utils"
+)
+
+// timeOfDayLayout is how a schedule's departure time is written
+const timeOfDayLayout = "15:04"
+
+// Reasons a scheduled trip could not be generated
+const (
+	ConflictNoVehicle          = "no default vehicle"
+	ConflictNoRoute            = "no route"
+	ConflictVehicleUnavailable = "vehicle is under repair, in maintenance or on another trip"
+	ConflictInsertFailed       = "trip could not be saved"
+)
+
+// ScheduleDaysAhead is how many days ahead, starting today, trips are generated
+var ScheduleDaysAhead = utils.GetEnvInt("SCHEDULE_DAYS_AHEAD", 14)
+
+// Schedule is a recurring timetable entry: a trip on RouteID from Origin to
+// Destination leaving at DepartureTime (HH:MM) on each of DaysOfWeek
+// (1 = Monday to 7 = Sunday) between ValidFrom and ValidTo (inclusive; empty
+// for open-ended), run by VehicleID (0 if none has been picked yet).
+type Schedule struct {
+	ID              int64  `json:"id"`
+	RouteID         int64  `json:"route_id"`
+	Origin          string `json:"origin"`
+	Destination     string `json:"destination"`
+	DepartureTime   string `json:"departure_time"`
+	DurationMinutes int    `json:"duration_minutes"`
+	DaysOfWeek      []int  `json:"days_of_week"`
+	ValidFrom       string `json:"valid_from"`
+	ValidTo         string `json:"valid_to"`
+	VehicleID       int64  `json:"vehicle_id"`
+	VehicleNumber   string `json:"vehicle_number"`
+	Active          bool   `json:"active"`
+}
+
+// ScheduleConflict is a departure a schedule should have generated but could not
+type ScheduleConflict struct {
+	ID            int64     `json:"id"`
+	ScheduleID    int64     `json:"schedule_id"`
+	Origin        string    `json:"origin"`
+	Destination   string    `json:"destination"`
+	DepartureTime string    `json:"departure_time"`
+	VehicleID     int64     `json:"vehicle_id"`
+	Reason        string    `json:"reason"`
+	DetectedAt    time.Time `json:"detected_at"`
+}
+
+// GenerationReport sums up a run of the trip generator
+type GenerationReport struct {
+	CreatedTripIDs []int64            `json:"created_trip_ids"`
+	Conflicts      []ScheduleConflict `json:"conflicts"`
+}
+
+// useRoute puts a schedule on its route, found by RouteID or else by origin
+// and destination. A schedule without a duration takes the route's.
+func (s *Schedule) useRoute() error {
+	route, err := ResolveRoute(s.RouteID, s.Origin, s.Destination)
+	if err != nil {
+		return err
+	}
+	s.RouteID, s.Origin, s.Destination = route.ID, route.Origin, route.Destination
+	if s.DurationMinutes == 0 {
+		s.DurationMinutes = route.DurationMinutes
+	}
+	return nil
+}
+
+// validateSchedule checks a schedule's times, days and dates
+func validateSchedule(s Schedule) error {
+	if _, err := time.Parse(timeOfDayLayout, s.DepartureTime); err != nil {
+		return fmt.Errorf("departure time must be a time of day (HH:MM)")
+	}
+	if s.DurationMinutes <= 0 {
+		return fmt.Errorf("duration must be greater than zero")
+	}
+	if len(s.DaysOfWeek) == 0 {
+		return fmt.Errorf("pick at least one day of the week")
+	}
+	for _, d := range s.DaysOfWeek {
+		if d < 1 || d > 7 {
+			return fmt.Errorf("days of the week run from 1 (Monday) to 7 (Sunday)")
+		}
+	}
+	if _, err := time.Parse(dateLayout, s.ValidFrom); err != nil {
+		return fmt.Errorf("valid from must be a date (YYYY-MM-DD)")
+	}
+	if s.ValidTo != "" {
+		if _, err := time.Parse(dateLayout, s.ValidTo); err != nil {
+			return fmt.Errorf("valid to must be a date (YYYY-MM-DD)")
+		}
+		if s.ValidTo < s.ValidFrom {
+			return fmt.Errorf("valid to must not be before valid from")
+		}
+	}
+	return nil
+}
+
+// formatDays writes days of the week as stored, e.g. "1,2,3,4,5"
+func formatDays(days []int) string {
+	seen := map[int]bool{}
+	var unique []int
+	for _, d := range days {
+		if !seen[d] {
+			seen[d] = true
+			unique = append(unique, d)
+		}
+	}
+	sort.Ints(unique)
+	parts := make([]string, len(unique))
+	for i, d := range unique {
+		parts[i] = strconv.Itoa(d)
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseDays reads days of the week as stored
+func parseDays(days string) []int {
+	var parsed []int
+	for _, part := range strings.Split(days, ",") {
+		if d, err := strconv.Atoi(strings.TrimSpace(part)); err == nil {
+			parsed = append(parsed, d)
+		}
+	}
+	return parsed
+}
+
+// runsOn reports whether a schedule has a departure on date
+func (s Schedule) runsOn(date time.Time) bool {
+	day := date.Format(dateLayout)
+	if day < s.ValidFrom || (s.ValidTo != "" && day > s.ValidTo) {
+		return false
+	}
+	weekday := int(date.Weekday())
+	if weekday == 0 {
+		weekday = 7
+	}
+	for _, d := range s.DaysOfWeek {
+		if d == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// AddSchedule adds a timetable entry and returns its ID
+func AddSchedule(s Schedule) (int64, error) {
+	if err := s.useRoute(); err != nil {
+		return 0, err
+	}
+	if err := validateSchedule(s); err != nil {
+		return 0, err
+	}
+	res, err := DB.Exec(`
+		INSERT INTO schedules (origin, destination, departure_time, duration_minutes, days_of_week, valid_from, valid_to, vehicle_id, active, route_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, s.Origin, s.Destination, s.DepartureTime, s.DurationMinutes, formatDays(s.DaysOfWeek), s.ValidFrom,
+		nullableDate(s.ValidTo), sql.NullInt64{Int64: s.VehicleID, Valid: s.VehicleID != 0}, s.Active, s.RouteID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert schedule: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+// UpdateSchedule changes a timetable entry. Trips it has already generated
+// are left as they are. It returns sql.ErrNoRows if the schedule does not exist.
+func UpdateSchedule(s Schedule) error {
+	if err := s.useRoute(); err != nil {
+		return err
+	}
+	if err := validateSchedule(s); err != nil {
+		return err
+	}
+	res, err := DB.Exec(`
+		UPDATE schedules SET origin = ?, destination = ?, departure_time = ?, duration_minutes = ?, days_of_week = ?,
+			valid_from = ?, valid_to = ?, vehicle_id = ?, active = ?, route_id = ?
+		WHERE id = ?
+	`, s.Origin, s.Destination, s.DepartureTime, s.DurationMinutes, formatDays(s.DaysOfWeek), s.ValidFrom,
+		nullableDate(s.ValidTo), sql.NullInt64{Int64: s.VehicleID, Valid: s.VehicleID != 0}, s.Active, s.RouteID, s.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update schedule: %w", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return sql.ErrNoRows
+	}
+	// Departures that no longer match the schedule are no longer conflicts
+	if _, err := DB.Exec("DELETE FROM schedule_conflicts WHERE schedule_id = ?", s.ID); err != nil {
+		return fmt.Errorf("failed to clear schedule conflicts: %w", err)
+	}
+	return nil
+}
+
+// DeleteSchedule deletes a timetable entry. Trips it generated are kept.
+func DeleteSchedule(id int64) error {
+	_, err := DB.Exec("DELETE FROM schedules WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete schedule: %w", err)
+	}
+	return nil
+}
+
+// GetSchedules returns every timetable entry ordered by route and departure time
+func GetSchedules() ([]Schedule, error) {
+	return schedules(false)
+}
+
+func schedules(activeOnly bool) ([]Schedule, error) {
+	query := `
+		SELECT s.id, COALESCE(s.route_id, 0), s.origin, s.destination, s.departure_time, s.duration_minutes, s.days_of_week, s.valid_from,
+			COALESCE(s.valid_to, ''), COALESCE(s.vehicle_id, 0), COALESCE(v.vehicle_number, ''), s.active
+		FROM schedules s
+		LEFT JOIN vehicles v ON s.vehicle_id = v.id`
+	if activeOnly {
+		query += " WHERE s.active = 1"
+	}
+	query += " ORDER BY s.origin, s.destination, s.departure_time"
+
+	rows, err := DB.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving schedules: %w", err)
+	}
+	defer rows.Close()
+
+	list := []Schedule{}
+	for rows.Next() {
+		var s Schedule
+		var days string
+		if err := rows.Scan(&s.ID, &s.RouteID, &s.Origin, &s.Destination, &s.DepartureTime, &s.DurationMinutes, &days, &s.ValidFrom,
+			&s.ValidTo, &s.VehicleID, &s.VehicleNumber, &s.Active); err != nil {
+			return nil, fmt.Errorf("error scanning schedule: %w", err)
+		}
+		s.DaysOfWeek = parseDays(days)
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// GetScheduleConflicts returns the departures schedules could not generate,
+// soonest first. Departures that have passed are left out.
+func GetScheduleConflicts() ([]ScheduleConflict, error) {
+	nowSQL, args, err := stationNowSQL(DB, "s.origin", time.Now())
+	if err != nil {
+		return nil, err
+	}
+	rows, err := DB.Query(`
+		SELECT c.id, c.schedule_id, s.origin, s.destination, c.departure_time, COALESCE(s.vehicle_id, 0), c.reason, c.detected_at
+		FROM schedule_conflicts c
+		JOIN schedules s ON c.schedule_id = s.id
+		WHERE c.departure_time >= `+nowSQL+`
+		ORDER BY c.departure_time
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving schedule conflicts: %w", err)
+	}
+	defer rows.Close()
+
+	conflicts := []ScheduleConflict{}
+	for rows.Next() {
+		var c ScheduleConflict
+		if err := rows.Scan(&c.ID, &c.ScheduleID, &c.Origin, &c.Destination, &c.DepartureTime, &c.VehicleID, &c.Reason, &c.DetectedAt); err != nil {
+			return nil, fmt.Errorf("error scanning schedule conflict: %w", err)
+		}
+		conflicts = append(conflicts, c)
+	}
+	return conflicts, rows.Err()
+}
+
+// recordScheduleConflict stores why a departure could not be generated,
+// replacing what an earlier run found for the same departure
+func recordScheduleConflict(c ScheduleConflict) error {
+	_, err := DB.Exec(`
+		INSERT INTO schedule_conflicts (schedule_id, departure_time, reason, detected_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(schedule_id, departure_time) DO UPDATE SET reason = excluded.reason, detected_at = excluded.detected_at
+	`, c.ScheduleID, c.DepartureTime, c.Reason, sqlTime(c.DetectedAt))
+	if err != nil {
+		return fmt.Errorf("failed to record schedule conflict: %w", err)
+	}
+	return nil
+}
+
+// GenerateScheduledTrips creates the trips active schedules call for from now
+// until daysAhead days ahead. Departures that already have a trip are
+// skipped, so it is safe to run repeatedly. A departure whose vehicle is
+// missing or unavailable is not created but recorded as a conflict, and is
+// tried again on the next run.
+func GenerateScheduledTrips(daysAhead int) (*GenerationReport, error) {
+	list, err := schedules(true)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &GenerationReport{CreatedTripIDs: []int64{}, Conflicts: []ScheduleConflict{}}
+	now := time.Now()
+	for _, s := range list {
+		at, err := time.Parse(timeOfDayLayout, s.DepartureTime)
+		if err != nil {
+			log.Printf("Warning: Schedule %d has an invalid departure time %q", s.ID, s.DepartureTime)
+			continue
+		}
+		// Departures are at the time of day at the origin station
+		loc, err := stationLocation(DB, s.Origin)
+		if err != nil {
+			return report, err
+		}
+		local := now.In(loc)
+		today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+		for day := 0; day < daysAhead; day++ {
+			date := today.AddDate(0, 0, day)
+			if !s.runsOn(date) {
+				continue
+			}
+			departure := time.Date(date.Year(), date.Month(), date.Day(), at.Hour(), at.Minute(), 0, 0, loc)
+			if departure.Before(now) {
+				continue
+			}
+			tripID, conflict, err := generateTrip(s, departure)
+			if err != nil {
+				return report, err
+			}
+			if conflict != nil {
+				report.Conflicts = append(report.Conflicts, *conflict)
+			} else if tripID != 0 {
+				report.CreatedTripIDs = append(report.CreatedTripIDs, tripID)
+			}
+		}
+	}
+	return report, nil
+}
+
+// generateTrip creates the trip of one departure of a schedule. It returns
+// 0 and no conflict if the trip already exists.
+func generateTrip(s Schedule, departure time.Time) (int64, *ScheduleConflict, error) {
+	dep := departure.Format(departureLayouts[0])
+	arr := departure.Add(time.Duration(s.DurationMinutes) * time.Minute).Format(departureLayouts[0])
+
+	var exists int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM trips WHERE schedule_id = ? AND departure_time = ?", s.ID, dep).Scan(&exists); err != nil {
+		return 0, nil, fmt.Errorf("error checking for scheduled trip: %w", err)
+	}
+	if exists > 0 {
+		return 0, nil, nil
+	}
+
+	conflict := &ScheduleConflict{
+		ScheduleID:    s.ID,
+		Origin:        s.Origin,
+		Destination:   s.Destination,
+		DepartureTime: dep,
+		VehicleID:     s.VehicleID,
+		DetectedAt:    time.Now(),
+	}
+	if s.RouteID == 0 {
+		conflict.Reason = ConflictNoRoute
+		return 0, conflict, recordScheduleConflict(*conflict)
+	}
+	if s.VehicleID == 0 {
+		conflict.Reason = ConflictNoVehicle
+		return 0, conflict, recordScheduleConflict(*conflict)
+	}
+	available, err := IsVehicleAvailableForTripEdit(s.VehicleID, dep, arr, 0)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !available {
+		conflict.Reason = ConflictVehicleUnavailable
+		return 0, conflict, recordScheduleConflict(*conflict)
+	}
+
+	tripID, err := insertScheduledTrip(s, dep, arr)
+	if err != nil {
+		log.Printf("Error generating trip for schedule %d at %s: %v", s.ID, dep, err)
+		conflict.Reason = ConflictInsertFailed
+		return 0, conflict, recordScheduleConflict(*conflict)
+	}
+	if _, err := DB.Exec("DELETE FROM schedule_conflicts WHERE schedule_id = ? AND departure_time = ?", s.ID, dep); err != nil {
+		return tripID, nil, fmt.Errorf("failed to clear schedule conflict: %w", err)
+	}
+	return tripID, nil, nil
+}
+
+// insertScheduledTrip adds the trip of a schedule departing at dep, calling
+// at the stops of the schedule's route
+func insertScheduledTrip(s Schedule, dep, arr string) (int64, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	route, err := getRoute(tx, s.RouteID)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`
+		INSERT INTO trips (origin, destination, vehicle_id, departure_time, arrival_time, schedule_id, route_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, s.Origin, s.Destination, s.VehicleID, dep, arr, s.ID, s.RouteID)
+	if err != nil {
+		return 0, err
+	}
+	tripID, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve trip id: %w", err)
+	}
+	if err := writeTripStops(tx, tripID, route, dep, arr); err != nil {
+		return 0, err
+	}
+	return tripID, tx.Commit()
+}
+
+// ScheduleTripGeneration runs GenerateScheduledTrips for ScheduleDaysAhead
+// days now and then at the given interval, recording the trips it creates in
+// the audit log as made by the system
+func ScheduleTripGeneration(interval time.Duration) {
+	if interval <= 0 {
+		interval = 24 * time.Hour
+	}
+
+	generate := func() {
+		report, err := GenerateScheduledTrips(ScheduleDaysAhead)
+		if report != nil {
+			changes := make([]systemChange, 0, len(report.CreatedTripIDs))
+			for _, id := range report.CreatedTripIDs {
+				changes = append(changes, createChange(AuditTrip, id))
+			}
+			auditSystemChanges(changes)
+		}
+		if err != nil {
+			log.Printf("Warning: Failed to generate scheduled trips: %v", err)
+			return
+		}
+		if len(report.CreatedTripIDs) > 0 || len(report.Conflicts) > 0 {
+			log.Printf("Generated %d scheduled trips, %d departures could not be generated", len(report.CreatedTripIDs), len(report.Conflicts))
+		}
+	}
+	generate()
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			generate()
+		}
+	}()
+
+	log.Printf("Scheduled trip generation every %s, %d days ahead", interval, ScheduleDaysAhead)
+}
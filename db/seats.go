@@ -0,0 +1,388 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// DefaultSeatLetters labels the seats of a row from the left. I is skipped so
+// it is not mistaken for 1.
+const DefaultSeatLetters = "ABCDEFGHJK"
+
+// DefaultSeatColumns is the number of seats per row of vehicles that do not set their own
+const DefaultSeatColumns = 4
+
+var (
+	// ErrSeatTaken is returned when booking a seat another active booking holds
+	ErrSeatTaken = errors.New("seat is already taken")
+	// ErrInvalidSeat is returned when booking a seat the trip's vehicle does not have
+	ErrInvalidSeat = errors.New("seat does not exist on this vehicle")
+	// ErrTripFull is returned when a trip has no seat left that is free for the whole segment booked
+	ErrTripFull = errors.New("trip is fully booked")
+)
+
+// SeatLayout describes how a vehicle's seats are arranged: Columns seats per
+// row, an aisle after the AisleAfter-th seat (0 for none), and one letter per
+// column. The vehicle's capacity decides how many rows there are; the last row
+// may be partly filled.
+type SeatLayout struct {
+	Capacity   int    `json:"capacity"`
+	Rows       int    `json:"rows"`
+	Columns    int    `json:"columns"`
+	AisleAfter int    `json:"aisle_after"`
+	Letters    string `json:"letters"`
+}
+
+// Seat is one seat of a layout, numbered from row 1, column 1.
+type Seat struct {
+	Label  string `json:"label"`
+	Row    int    `json:"row"`
+	Column int    `json:"column"`
+}
+
+// NewSeatLayout validates a vehicle's seat layout and fills in the defaults:
+// a column count of 0 means DefaultSeatColumns (or fewer for small vehicles),
+// an aisleAfter below 0 means the middle of the row, and empty letters mean
+// DefaultSeatLetters.
+func NewSeatLayout(capacity, columns, aisleAfter int, letters string) (SeatLayout, error) {
+	if capacity < 1 {
+		return SeatLayout{}, fmt.Errorf("capacity must be at least 1")
+	}
+	if columns == 0 {
+		columns = DefaultSeatColumns
+		if capacity < columns {
+			columns = capacity
+		}
+	}
+	letters = strings.ToUpper(strings.TrimSpace(letters))
+	if letters == "" {
+		letters = DefaultSeatLetters
+	}
+	if columns < 1 || columns > len(letters) {
+		return SeatLayout{}, fmt.Errorf("seats per row must be between 1 and %d", len(letters))
+	}
+	letters = letters[:columns]
+	for i, r := range letters {
+		if r < 'A' || r > 'Z' || strings.IndexRune(letters, r) != i {
+			return SeatLayout{}, fmt.Errorf("seat letters must be distinct letters A-Z")
+		}
+	}
+	if aisleAfter < 0 {
+		aisleAfter = columns / 2
+	}
+	if aisleAfter >= columns {
+		return SeatLayout{}, fmt.Errorf("the aisle must come after one of the first %d seats of a row", columns-1)
+	}
+	return SeatLayout{
+		Capacity:   capacity,
+		Rows:       (capacity + columns - 1) / columns,
+		Columns:    columns,
+		AisleAfter: aisleAfter,
+		Letters:    letters,
+	}, nil
+}
+
+// SeatLayoutFromColumns builds a vehicle's layout from its stored columns.
+// Layouts that no longer validate (e.g. hand-edited rows) fall back to the defaults.
+func SeatLayoutFromColumns(capacity int, columns, aisleAfter sql.NullInt64, letters sql.NullString) SeatLayout {
+	aisle := -1
+	if aisleAfter.Valid {
+		aisle = int(aisleAfter.Int64)
+	}
+	layout, err := NewSeatLayout(capacity, int(columns.Int64), aisle, letters.String)
+	if err != nil {
+		layout, _ = NewSeatLayout(capacity, 0, -1, "")
+	}
+	return layout
+}
+
+// Seats lists the seats of the layout in booking order: row by row, from the left.
+func (l SeatLayout) Seats() []Seat {
+	seats := make([]Seat, 0, l.Capacity)
+	for i := 0; i < l.Capacity; i++ {
+		row, col := i/l.Columns+1, i%l.Columns+1
+		seats = append(seats, Seat{
+			Label:  strconv.Itoa(row) + string(l.Letters[col-1]),
+			Row:    row,
+			Column: col,
+		})
+	}
+	return seats
+}
+
+// HasSeat reports whether label is a seat of the layout
+func (l SeatLayout) HasSeat(label string) bool {
+	for _, seat := range l.Seats() {
+		if seat.Label == label {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeSeatLabel tidies a seat label typed by a user, e.g. " 3c" to "3C"
+func NormalizeSeatLabel(label string) string {
+	return strings.ToUpper(strings.TrimSpace(label))
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// GetVehicleSeatLayout returns the seat layout of a vehicle
+func GetVehicleSeatLayout(vehicleID int64) (SeatLayout, error) {
+	return vehicleSeatLayout(DB, "SELECT capacity, seat_columns, aisle_after, seat_letters FROM vehicles WHERE id = ?", vehicleID)
+}
+
+// GetTripSeatLayout returns the seat layout of the vehicle assigned to a trip
+func GetTripSeatLayout(tripID int64) (SeatLayout, error) {
+	return tripSeatLayout(DB, tripID)
+}
+
+func tripSeatLayout(q queryer, tripID int64) (SeatLayout, error) {
+	return vehicleSeatLayout(q, `
+		SELECT v.capacity, v.seat_columns, v.aisle_after, v.seat_letters
+		FROM trips t
+		JOIN vehicles v ON t.vehicle_id = v.id
+		WHERE t.id = ?
+	`, tripID)
+}
+
+func vehicleSeatLayout(q queryer, query string, id int64) (SeatLayout, error) {
+	var capacity int
+	var columns, aisleAfter sql.NullInt64
+	var letters sql.NullString
+	if err := q.QueryRow(query, id).Scan(&capacity, &columns, &aisleAfter, &letters); err != nil {
+		if err == sql.ErrNoRows {
+			return SeatLayout{}, err
+		}
+		return SeatLayout{}, fmt.Errorf("error getting seat layout: %w", err)
+	}
+	return SeatLayoutFromColumns(capacity, columns, aisleAfter, letters), nil
+}
+
+// occupiedSeats maps the seats held by active bookings of a trip on any leg
+// of a segment to the booking holding them
+func occupiedSeats(q queryer, tripID int64, seg Segment) (map[string]int64, error) {
+	rows, err := q.Query(`
+		SELECT id, seat_number FROM bookings
+		WHERE trip_id = ? AND status NOT IN `+releasedStatusesSQL+` AND seat_number IS NOT NULL
+		  AND boarding_stop < ? AND (alighting_stop IS NULL OR alighting_stop > ?)
+	`, tripID, seg.To, seg.From)
+	if err != nil {
+		return nil, fmt.Errorf("error getting occupied seats: %w", err)
+	}
+	defer rows.Close()
+
+	occupied := make(map[string]int64)
+	for rows.Next() {
+		var bookingID int64
+		var seat string
+		if err := rows.Scan(&bookingID, &seat); err != nil {
+			return nil, fmt.Errorf("error scanning occupied seat: %w", err)
+		}
+		occupied[seat] = bookingID
+	}
+	return occupied, rows.Err()
+}
+
+// pickSeat checks that the requested seat of a trip is free for a segment, or
+// picks a free seat if none was requested. Seats already sold for other legs
+// of the trip are picked first, so seats free for the whole trip are kept for
+// passengers travelling the whole way.
+func pickSeat(q queryer, tripID int64, seg Segment, requested string) (string, error) {
+	layout, err := tripSeatLayout(q, tripID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("trip not found")
+		}
+		return "", err
+	}
+	occupied, err := occupiedSeats(q, tripID, seg)
+	if err != nil {
+		return "", err
+	}
+
+	if requested != "" {
+		if !layout.HasSeat(requested) {
+			return "", ErrInvalidSeat
+		}
+		if _, taken := occupied[requested]; taken {
+			return "", ErrSeatTaken
+		}
+		return requested, nil
+	}
+
+	sold, err := occupiedSeats(q, tripID, wholeTrip)
+	if err != nil {
+		return "", err
+	}
+	free := ""
+	for _, seat := range layout.Seats() {
+		if _, taken := occupied[seat.Label]; taken {
+			continue
+		}
+		if _, elsewhere := sold[seat.Label]; elsewhere {
+			return seat.Label, nil
+		}
+		if free == "" {
+			free = seat.Label
+		}
+	}
+	if free == "" {
+		return "", ErrTripFull
+	}
+	return free, nil
+}
+
+// reserveSeat gives a booking of a trip a seat for a segment, as pickSeat
+// does, after checking that no leg of the segment already carries as many
+// active bookings as the vehicle has seats. Bookings left without a seat
+// count too. Every booking that takes a seat goes through it, inside the
+// booking's write transaction.
+func reserveSeat(q queryer, tripID int64, seg Segment, requested string) (string, error) {
+	var capacity int
+	err := q.QueryRow("SELECT v.capacity FROM trips t JOIN vehicles v ON t.vehicle_id = v.id WHERE t.id = ?", tripID).Scan(&capacity)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf("trip not found")
+		}
+		return "", fmt.Errorf("error getting trip vehicle capacity: %w", err)
+	}
+	stops, err := getTripStops(q, tripID)
+	if err != nil {
+		return "", err
+	}
+	loads, err := legLoads(q, tripID, len(stops)-1)
+	if err != nil {
+		return "", err
+	}
+	for leg := seg.From; leg < len(loads) && leg < seg.To; leg++ {
+		if loads[leg] >= capacity {
+			return "", ErrTripFull
+		}
+	}
+	return pickSeat(q, tripID, seg, requested)
+}
+
+// SeatStatus is one seat of a trip's seat map
+type SeatStatus struct {
+	Seat
+	Occupied  bool  `json:"occupied"`
+	BookingID int64 `json:"booking_id,omitempty"`
+}
+
+// SeatMap is the occupancy of every seat on a trip between two stops. A seat
+// is occupied if it is held on any leg between them.
+type SeatMap struct {
+	TripID    int64        `json:"trip_id"`
+	Boarding  string       `json:"boarding"`
+	Alighting string       `json:"alighting"`
+	Layout    SeatLayout   `json:"layout"`
+	Seats     []SeatStatus `json:"seats"`
+	Booked    int          `json:"booked"`
+	Available int          `json:"available"`
+}
+
+// GetTripSeatMap returns the seat map of a trip between a boarding and an
+// alighting station, given by name or code; empty stations mean the trip's
+// ends. It returns sql.ErrNoRows if the trip does not exist.
+func GetTripSeatMap(tripID int64, boarding, alighting string) (*SeatMap, error) {
+	layout, err := GetTripSeatLayout(tripID)
+	if err != nil {
+		return nil, err
+	}
+	seg, stops, err := tripSegment(DB, tripID, boarding, alighting)
+	if err != nil {
+		return nil, err
+	}
+	occupied, err := occupiedSeats(DB, tripID, seg)
+	if err != nil {
+		return nil, err
+	}
+
+	seatMap := &SeatMap{TripID: tripID, Boarding: stops[seg.From].Name, Alighting: stops[seg.last(stops)].Name, Layout: layout}
+	for _, seat := range layout.Seats() {
+		status := SeatStatus{Seat: seat}
+		if bookingID, ok := occupied[seat.Label]; ok {
+			status.Occupied = true
+			status.BookingID = bookingID
+			seatMap.Booked++
+		}
+		seatMap.Seats = append(seatMap.Seats, status)
+	}
+	seatMap.Available = layout.Capacity - seatMap.Booked
+	return seatMap, nil
+}
+
+// MissingSeatsOnVehicle lists the seats held by active bookings of a trip that
+// the given vehicle does not have, i.e. the bookings that would lose their
+// seat if the trip moved to that vehicle
+func MissingSeatsOnVehicle(tripID, vehicleID int64) ([]string, error) {
+	layout, err := GetVehicleSeatLayout(vehicleID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("vehicle not found")
+		}
+		return nil, err
+	}
+	occupied, err := occupiedSeats(DB, tripID, wholeTrip)
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, seat := range layout.Seats() {
+		delete(occupied, seat.Label)
+	}
+	for label := range occupied {
+		missing = append(missing, label)
+	}
+	return missing, nil
+}
+
+// assignMissingSeats gives every active booking without a seat a free seat of
+// its trip, in booking order. Bookings beyond the vehicle's capacity
+// are left without a seat and logged.
+func assignMissingSeats() error {
+	rows, err := DB.Query(`
+		SELECT id, trip_id FROM bookings
+		WHERE status NOT IN `+releasedStatusesSQL+` AND seat_number IS NULL
+		ORDER BY trip_id, booking_date, id
+	`)
+	if err != nil {
+		return fmt.Errorf("error getting bookings without seats: %w", err)
+	}
+	var bookings [][2]int64
+	for rows.Next() {
+		var id, tripID int64
+		if err := rows.Scan(&id, &tripID); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning booking: %w", err)
+		}
+		bookings = append(bookings, [2]int64{id, tripID})
+	}
+	rows.Close()
+
+	assigned := 0
+	for _, b := range bookings {
+		seat, err := pickSeat(DB, b[1], wholeTrip, "")
+		if err != nil {
+			log.Printf("Warning: Could not assign a seat to booking %d on trip %d: %v", b[0], b[1], err)
+			continue
+		}
+		if _, err := DB.Exec("UPDATE bookings SET seat_number = ? WHERE id = ?", seat, b[0]); err != nil {
+			return fmt.Errorf("error assigning seat to booking %d: %w", b[0], err)
+		}
+		assigned++
+	}
+	log.Printf("Assigned seats to %d existing bookings", assigned)
+	return nil
+}
@@ -0,0 +1,173 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openTestDB opens a fresh database in a temporary directory through
+// InitializeDB, with its own encryption and ticket keys
+func openTestDB(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("SQLITE_DB_PATH", filepath.Join(dir, "test.db"))
+	t.Setenv("ENCRYPTION_KEY_PATH", filepath.Join(dir, "encryption.key"))
+	t.Setenv("TICKET_KEY_PATH", filepath.Join(dir, "ticket.key"))
+	if err := InitializeDB(); err != nil {
+		t.Fatalf("InitializeDB: %v", err)
+	}
+	t.Cleanup(func() { DB.Close() })
+}
+
+// addTestTrip adds a trip between two seeded stations on a vehicle with the
+// given number of seats, departing tomorrow
+func addTestTrip(t *testing.T, capacity int) int64 {
+	t.Helper()
+	return addTestTripVia(t, capacity, "THR", "IFN")
+}
+
+// addTestTripVia adds a trip calling at the given seeded stations, in order,
+// on a new vehicle with the given number of seats, departing tomorrow
+func addTestTripVia(t *testing.T, capacity int, codes ...string) int64 {
+	t.Helper()
+	var stationIDs []int64
+	for _, code := range codes {
+		station, err := FindStation(code)
+		if err != nil {
+			t.Fatalf("FindStation %s: %v", code, err)
+		}
+		stationIDs = append(stationIDs, station.ID)
+	}
+	routeID, err := AddRoute(Route{DurationMinutes: 600, Active: true}, stationIDs)
+	if err != nil {
+		t.Fatalf("AddRoute: %v", err)
+	}
+	layout, err := NewSeatLayout(capacity, 0, -1, "")
+	if err != nil {
+		t.Fatalf("NewSeatLayout: %v", err)
+	}
+	testVehicles++
+	vehicleID, err := AddVehicle(fmt.Sprintf("TEST-%d", testVehicles), "Bus", layout, "Active", "", "", "")
+	if err != nil {
+		t.Fatalf("AddVehicle: %v", err)
+	}
+	departure := time.Now().Add(24 * time.Hour)
+	tripID, err := AddTrip(routeID, vehicleID, departure.Format(departureLayouts[0]), departure.Add(10*time.Hour).Format(departureLayouts[0]))
+	if err != nil {
+		t.Fatalf("AddTrip: %v", err)
+	}
+	return tripID
+}
+
+// testVehicles numbers the vehicles added by addTestTripVia
+var testVehicles int
+
+func testBooking(tripID int64, n int) BookingRequest {
+	return BookingRequest{
+		TripID:      tripID,
+		Passenger:   "Test Passenger",
+		SocialID:    fmt.Sprintf("%010d", n),
+		PhoneNumber: "09120000000",
+		DateOfBirth: "1990-01-01",
+		Status:      BookingConfirmed,
+	}
+}
+
+// TestParallelBookingsNeverOverbook fires many bookings at once at a trip with
+// one seat left: exactly one gets it and the rest are told the trip is full
+func TestParallelBookingsNeverOverbook(t *testing.T) {
+	openTestDB(t)
+	const capacity = 5
+	const parallel = 25
+	tripID := addTestTrip(t, capacity)
+
+	for i := 0; i < capacity-1; i++ {
+		if _, err := AddBooking(testBooking(tripID, i)); err != nil {
+			t.Fatalf("AddBooking %d: %v", i, err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, parallel)
+	start := make(chan struct{})
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			<-start
+			_, err := AddBooking(testBooking(tripID, capacity+n))
+			errs <- err
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case errors.Is(err, ErrTripFull):
+		default:
+			t.Errorf("unexpected booking error: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d parallel bookings succeeded, want exactly 1", succeeded)
+	}
+
+	var vehicleCapacity int
+	if err := DB.QueryRow("SELECT v.capacity FROM trips t JOIN vehicles v ON t.vehicle_id = v.id WHERE t.id = ?", tripID).Scan(&vehicleCapacity); err != nil {
+		t.Fatalf("reading capacity: %v", err)
+	}
+	stops, err := GetTripStops(tripID)
+	if err != nil {
+		t.Fatalf("GetTripStops: %v", err)
+	}
+	loads, err := legLoads(DB, tripID, len(stops)-1)
+	if err != nil {
+		t.Fatalf("legLoads: %v", err)
+	}
+	for leg, load := range loads {
+		if load > vehicleCapacity {
+			t.Errorf("leg %d has %d bookings, more than the capacity of %d", leg, load, vehicleCapacity)
+		}
+		if load != capacity {
+			t.Errorf("leg %d has %d bookings, want %d", leg, load, capacity)
+		}
+	}
+}
+
+// TestAssignMissingSeatsSkipsReleasedBookings seats bookings left without a
+// seat, leaving cancelled and refunded ones unseated so they take no seat
+func TestAssignMissingSeatsSkipsReleasedBookings(t *testing.T) {
+	openTestDB(t)
+	tripID := addTestTrip(t, 2)
+	statuses := []string{BookingRefunded, BookingCancelled, BookingConfirmed, BookingNoShow}
+	ids := make([]int64, len(statuses))
+	for i, status := range statuses {
+		ids[i] = addTestBooking(t, tripID, i)
+		if _, err := DB.Exec("UPDATE bookings SET status = ?, seat_number = NULL WHERE id = ?", status, ids[i]); err != nil {
+			t.Fatalf("clearing seat: %v", err)
+		}
+	}
+
+	if err := assignMissingSeats(); err != nil {
+		t.Fatalf("assignMissingSeats: %v", err)
+	}
+	for i, status := range statuses {
+		var seat sql.NullString
+		if err := DB.QueryRow("SELECT seat_number FROM bookings WHERE id = ?", ids[i]).Scan(&seat); err != nil {
+			t.Fatalf("reading seat: %v", err)
+		}
+		if want := !isReleased(status); seat.Valid != want {
+			t.Errorf("%s booking seated = %v (%q), want %v", status, seat.Valid, seat.String, want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package db
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// SessionTTL is how long a login session stays valid after it is created.
+const SessionTTL = 24 * time.Hour
+
+// timestampLayout matches SQLite's CURRENT_TIMESTAMP format so stored times
+// can be compared against it directly in queries.
+const timestampLayout = "2006-01-02 15:04:05"
+
+// sqlTime formats a time in UTC using the same layout as CURRENT_TIMESTAMP.
+func sqlTime(t time.Time) string {
+	return t.UTC().Format(timestampLayout)
+}
+
+// Session is a server-side login session together with the user it belongs to.
+type Session struct {
+	ID         int64
+	Token      string
+	UserID     int64
+	Username   string
+	Role       string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	IPAddress  string
+	UserAgent  string
+	ExpiresAt  time.Time
+	// CSRFToken must accompany every state-changing request made with this session
+	CSRFToken string
+	// TwoFactorEnabled reports whether the user has enrolled an authenticator app
+	TwoFactorEnabled bool
+	// PasswordChangeDue reports whether the user must choose a new password
+	// before doing anything else
+	PasswordChangeDue bool
+}
+
+// generateSessionToken creates an opaque random session identifier.
+func generateSessionToken() (string, error) {
+	b := make([]byte, 32) // 256 bits
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CreateSession starts a new session for a user and returns its token.
+func CreateSession(userID int64, ipAddress, userAgent string) (string, error) {
+	return createSession(userID, ipAddress, userAgent, SessionTTL, false)
+}
+
+// CreatePendingSession starts a short-lived session for a user who has
+// entered their password but still has to pass the two-factor check. A
+// pending session does not authenticate any other request.
+func CreatePendingSession(userID int64, ipAddress, userAgent string) (string, error) {
+	return createSession(userID, ipAddress, userAgent, PendingTwoFactorTTL, true)
+}
+
+func createSession(userID int64, ipAddress, userAgent string, ttl time.Duration, pending bool) (string, error) {
+	token, err := generateSessionToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate session token: %w", err)
+	}
+	csrfToken, err := generateSessionToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate CSRF token: %w", err)
+	}
+
+	pendingInt := 0
+	if pending {
+		pendingInt = 1
+	}
+
+	query := `
+		INSERT INTO sessions (token, user_id, ip_address, user_agent, expires_at, pending_2fa, csrf_token)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err = DB.Exec(query, token, userID, ipAddress, userAgent, sqlTime(time.Now().Add(ttl)), pendingInt, csrfToken)
+	if err != nil {
+		return "", fmt.Errorf("error creating session for user ID %d: %w", userID, err)
+	}
+	return token, nil
+}
+
+// GetSession looks up a live session by token, loading the user's current
+// username and role. It returns sql.ErrNoRows if the session does not exist
+// or has expired.
+func GetSession(token string) (*Session, error) {
+	return getSession(token, false)
+}
+
+// GetPendingSession looks up a session that is waiting for the two-factor
+// check. It returns sql.ErrNoRows if there is no such live session.
+func GetPendingSession(token string) (*Session, error) {
+	return getSession(token, true)
+}
+
+func getSession(token string, pending bool) (*Session, error) {
+	pendingInt := 0
+	if pending {
+		pendingInt = 1
+	}
+
+	query := `
+		SELECT s.id, s.token, s.user_id, u.username, COALESCE(u.role, 'Operator'),
+		       s.created_at, s.last_seen_at, COALESCE(s.ip_address, ''), COALESCE(s.user_agent, ''), s.expires_at,
+		       COALESCE(s.csrf_token, ''), COALESCE(u.totp_enabled, 0), COALESCE(u.must_change_password, 0), u.password_changed_at
+		FROM sessions s
+		JOIN users u ON s.user_id = u.id
+		WHERE s.token = ? AND s.expires_at > CURRENT_TIMESTAMP AND COALESCE(s.pending_2fa, 0) = ?
+	`
+	var s Session
+	var mustChangePassword bool
+	var passwordChangedAt sql.NullTime
+	err := DB.QueryRow(query, token, pendingInt).Scan(&s.ID, &s.Token, &s.UserID, &s.Username, &s.Role,
+		&s.CreatedAt, &s.LastSeenAt, &s.IPAddress, &s.UserAgent, &s.ExpiresAt, &s.CSRFToken, &s.TwoFactorEnabled,
+		&mustChangePassword, &passwordChangedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error retrieving session: %w", err)
+	}
+	s.PasswordChangeDue = passwordChangeDue(mustChangePassword, passwordChangedAt)
+	return &s, nil
+}
+
+// GetSessionCSRFToken returns the CSRF token of a live session, whether or not
+// it is still waiting for the two-factor check. Sessions created before CSRF
+// tokens existed are given one. It returns sql.ErrNoRows if there is no such
+// live session.
+func GetSessionCSRFToken(token string) (string, error) {
+	var id int64
+	var csrfToken string
+	err := DB.QueryRow(
+		"SELECT id, COALESCE(csrf_token, '') FROM sessions WHERE token = ? AND expires_at > CURRENT_TIMESTAMP", token,
+	).Scan(&id, &csrfToken)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", err
+		}
+		return "", fmt.Errorf("error retrieving session CSRF token: %w", err)
+	}
+	if csrfToken != "" {
+		return csrfToken, nil
+	}
+
+	csrfToken, err = generateSessionToken()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate CSRF token: %w", err)
+	}
+	if _, err := DB.Exec("UPDATE sessions SET csrf_token = ? WHERE id = ?", csrfToken, id); err != nil {
+		return "", fmt.Errorf("error storing CSRF token for session %d: %w", id, err)
+	}
+	return csrfToken, nil
+}
+
+// TouchSession records activity on a session.
+func TouchSession(sessionID int64) error {
+	query := "UPDATE sessions SET last_seen_at = CURRENT_TIMESTAMP WHERE id = ?"
+	_, err := DB.Exec(query, sessionID)
+	if err != nil {
+		return fmt.Errorf("error updating session ID %d: %w", sessionID, err)
+	}
+	return nil
+}
+
+// DeleteSession removes a session by token.
+func DeleteSession(token string) error {
+	_, err := DB.Exec("DELETE FROM sessions WHERE token = ?", token)
+	if err != nil {
+		return fmt.Errorf("error deleting session: %w", err)
+	}
+	return nil
+}
+
+// PurgeExpiredSessions removes all sessions past their expiry time.
+func PurgeExpiredSessions() (int64, error) {
+	res, err := DB.Exec("DELETE FROM sessions WHERE expires_at <= CURRENT_TIMESTAMP")
+	if err != nil {
+		return 0, fmt.Errorf("error purging expired sessions: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
+
+// GetUserSessions retrieves a user's live sessions, most recently active first.
+func GetUserSessions(userID int64) ([]Session, error) {
+	query := `
+		SELECT s.id, s.token, s.user_id, u.username, COALESCE(u.role, 'Operator'),
+		       s.created_at, s.last_seen_at, COALESCE(s.ip_address, ''), COALESCE(s.user_agent, ''), s.expires_at
+		FROM sessions s
+		JOIN users u ON s.user_id = u.id
+		WHERE s.user_id = ? AND s.expires_at > CURRENT_TIMESTAMP AND COALESCE(s.pending_2fa, 0) = 0
+		ORDER BY s.last_seen_at DESC
+	`
+	rows, err := DB.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving sessions for user ID %d: %w", userID, err)
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.Token, &s.UserID, &s.Username, &s.Role,
+			&s.CreatedAt, &s.LastSeenAt, &s.IPAddress, &s.UserAgent, &s.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("error scanning session row: %w", err)
+		}
+		sessions = append(sessions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating sessions for user ID %d: %w", userID, err)
+	}
+	return sessions, nil
+}
+
+// DeleteUserSession revokes a single session belonging to a user. It reports
+// whether a session was actually removed.
+func DeleteUserSession(userID, sessionID int64) (bool, error) {
+	res, err := DB.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", sessionID, userID)
+	if err != nil {
+		return false, fmt.Errorf("error revoking session ID %d: %w", sessionID, err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// DeleteUserSessions revokes every session belonging to a user.
+func DeleteUserSessions(userID int64) (int64, error) {
+	res, err := DB.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	if err != nil {
+		return 0, fmt.Errorf("error revoking sessions for user ID %d: %w", userID, err)
+	}
+	n, _ := res.RowsAffected()
+	return n, nil
+}
@@ -0,0 +1,820 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+	// Bundled so station time zones can be checked on hosts without a zoneinfo database
+	_ "time/tzdata"
+)
+
+// DefaultStationTimezone is used for stations added without a time zone
+const DefaultStationTimezone = "Asia/Tehran"
+
+// stationCodePattern is what a station code may look like, e.g. "THR"
+var stationCodePattern = regexp.MustCompile(`^[A-Z0-9]{2,10}$`)
+
+var (
+	// ErrUnknownStation is returned for an origin, destination or stop that is not a station
+	ErrUnknownStation = errors.New("unknown station")
+	// ErrSameStation is returned when an origin and destination are the same station
+	ErrSameStation = errors.New("origin and destination cannot be the same city")
+	// ErrNoRoute is returned when no active route runs between two stations
+	ErrNoRoute = errors.New("no route between these stations")
+	// ErrRouteInactive is returned when scheduling a trip on a route that has been retired
+	ErrRouteInactive = errors.New("route is not active")
+	// ErrStationInUse is returned when deleting a station that is a stop of a route
+	ErrStationInUse = errors.New("station is a stop of a route")
+	// ErrRouteInUse is returned when deleting a route that trips or timetables run on,
+	// or moving the ends of a route that trips run on
+	ErrRouteInUse = errors.New("route has trips or timetables")
+)
+
+// Station is a bus terminal or stop. Trips, fares and timetables refer to
+// stations by name.
+type Station struct {
+	ID        int64    `json:"id"`
+	Code      string   `json:"code"`
+	Name      string   `json:"name"`
+	City      string   `json:"city"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Timezone  string   `json:"timezone"`
+}
+
+// RouteStop is a station on a route, in the order the route calls at them
+type RouteStop struct {
+	StationID int64  `json:"station_id"`
+	Code      string `json:"code"`
+	Name      string `json:"name"`
+}
+
+// Route is the ordered list of stations a service calls at, from its origin
+// (the first stop) to its destination (the last). DistanceKm is 0 if not known.
+type Route struct {
+	ID              int64       `json:"id"`
+	Name            string      `json:"name"`
+	Origin          string      `json:"origin"`
+	Destination     string      `json:"destination"`
+	Stops           []RouteStop `json:"stops"`
+	DistanceKm      float64     `json:"distance_km"`
+	DurationMinutes int         `json:"duration_minutes"`
+	Active          bool        `json:"active"`
+}
+
+// defaultStations are the cities the dashboards offered before stations were
+// managed, seeded on first start
+var defaultStations = []Station{
+	{Code: "THR", Name: "Tehran", City: "Tehran", Latitude: coordinate(35.6892), Longitude: coordinate(51.3890)},
+	{Code: "MHD", Name: "Mashhad", City: "Mashhad", Latitude: coordinate(36.2605), Longitude: coordinate(59.6168)},
+	{Code: "IFN", Name: "Isfahan", City: "Isfahan", Latitude: coordinate(32.6546), Longitude: coordinate(51.6680)},
+	{Code: "KRJ", Name: "Karaj", City: "Karaj", Latitude: coordinate(35.8400), Longitude: coordinate(50.9391)},
+	{Code: "SYZ", Name: "Shiraz", City: "Shiraz", Latitude: coordinate(29.5918), Longitude: coordinate(52.5837)},
+	{Code: "TBZ", Name: "Tabriz", City: "Tabriz", Latitude: coordinate(38.0800), Longitude: coordinate(46.2919)},
+	{Code: "QOM", Name: "Qom", City: "Qom", Latitude: coordinate(34.6416), Longitude: coordinate(50.8746)},
+	{Code: "AWZ", Name: "Ahvaz", City: "Ahvaz", Latitude: coordinate(31.3183), Longitude: coordinate(48.6706)},
+	{Code: "KSH", Name: "Kermanshah", City: "Kermanshah", Latitude: coordinate(34.3142), Longitude: coordinate(47.0650)},
+	{Code: "OMH", Name: "Urmia", City: "Urmia", Latitude: coordinate(37.5527), Longitude: coordinate(45.0761)},
+}
+
+func coordinate(v float64) *float64 {
+	return &v
+}
+
+// normalizeStationName trims a station name and collapses runs of spaces
+func normalizeStationName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// validateStation checks a station's code, names, coordinates and time zone,
+// tidying them up in place
+func validateStation(s *Station) error {
+	s.Code = strings.ToUpper(strings.TrimSpace(s.Code))
+	s.Name = normalizeStationName(s.Name)
+	s.City = normalizeStationName(s.City)
+	s.Timezone = strings.TrimSpace(s.Timezone)
+	if !stationCodePattern.MatchString(s.Code) {
+		return fmt.Errorf("station code must be 2 to 10 letters or digits")
+	}
+	if s.Name == "" {
+		return fmt.Errorf("station name is required")
+	}
+	if s.City == "" {
+		s.City = s.Name
+	}
+	if (s.Latitude == nil) != (s.Longitude == nil) {
+		return fmt.Errorf("give both latitude and longitude, or neither")
+	}
+	if s.Latitude != nil && (*s.Latitude < -90 || *s.Latitude > 90 || *s.Longitude < -180 || *s.Longitude > 180) {
+		return fmt.Errorf("coordinates are out of range")
+	}
+	if s.Timezone == "" {
+		s.Timezone = DefaultStationTimezone
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("unknown time zone %q", s.Timezone)
+	}
+	return nil
+}
+
+// stationLocation is the time zone of the station with the given name. The
+// times of a trip or timetable are written in the time zone of its origin;
+// trips from places that are not stations use the server's.
+func stationLocation(q queryer, name string) (*time.Location, error) {
+	var timezone string
+	err := q.QueryRow("SELECT timezone FROM stations WHERE name = ?", name).Scan(&timezone)
+	if err == sql.ErrNoRows {
+		return time.Local, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving time zone of %s: %w", name, err)
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("station %s has an unknown time zone %q", name, timezone)
+	}
+	return loc, nil
+}
+
+// tripLocation is the time zone a trip's times are written in, that of its
+// origin station. It returns sql.ErrNoRows if the trip does not exist.
+func tripLocation(q queryer, tripID int64) (*time.Location, error) {
+	var origin string
+	if err := q.QueryRow("SELECT origin FROM trips WHERE id = ?", tripID).Scan(&origin); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error retrieving trip %d: %w", tripID, err)
+	}
+	return stationLocation(q, origin)
+}
+
+// stationNowSQL is an SQL expression for now as written in the time zone of
+// the station named by origin, an SQL expression such as t.origin, to compare
+// with the times of trips from there, and its arguments
+func stationNowSQL(q queryer, origin string, now time.Time) (string, []interface{}, error) {
+	rows, err := q.Query("SELECT DISTINCT timezone FROM stations")
+	if err != nil {
+		return "", nil, fmt.Errorf("error retrieving station time zones: %w", err)
+	}
+	defer rows.Close()
+
+	expr := "CASE (SELECT st.timezone FROM stations st WHERE st.name = " + origin + ")"
+	var args []interface{}
+	for rows.Next() {
+		var timezone string
+		if err := rows.Scan(&timezone); err != nil {
+			return "", nil, fmt.Errorf("error scanning station time zone: %w", err)
+		}
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return "", nil, fmt.Errorf("unknown station time zone %q", timezone)
+		}
+		expr += " WHEN ? THEN ?"
+		args = append(args, timezone, now.In(loc).Format(departureLayouts[0]))
+	}
+	if err := rows.Err(); err != nil {
+		return "", nil, err
+	}
+	local := now.In(time.Local).Format(departureLayouts[0])
+	if len(args) == 0 {
+		return "?", []interface{}{local}, nil
+	}
+	return "(" + expr + " ELSE ? END)", append(args, local), nil
+}
+
+// nullableFloat stores a missing coordinate as NULL
+func nullableFloat(v *float64) sql.NullFloat64 {
+	if v == nil {
+		return sql.NullFloat64{}
+	}
+	return sql.NullFloat64{Float64: *v, Valid: true}
+}
+
+// isUniqueViolation reports whether err is SQLite rejecting a duplicate value
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// AddStation adds a station and returns its ID
+func AddStation(s Station) (int64, error) {
+	if err := validateStation(&s); err != nil {
+		return 0, err
+	}
+	res, err := DB.Exec(`
+		INSERT INTO stations (code, name, city, latitude, longitude, timezone)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, s.Code, s.Name, s.City, nullableFloat(s.Latitude), nullableFloat(s.Longitude), s.Timezone)
+	if isUniqueViolation(err) {
+		return 0, fmt.Errorf("a station with this code or name already exists")
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert station: %w", err)
+	}
+	return res.LastInsertId()
+}
+
+// UpdateStation changes a station. Renaming a station renames it on the
+// trips, fares and timetables that refer to it. It returns sql.ErrNoRows if
+// the station does not exist.
+func UpdateStation(s Station) error {
+	if err := validateStation(&s); err != nil {
+		return err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var oldName string
+	if err := tx.QueryRow("SELECT name FROM stations WHERE id = ?", s.ID).Scan(&oldName); err != nil {
+		if err == sql.ErrNoRows {
+			return err
+		}
+		return fmt.Errorf("error retrieving station %d: %w", s.ID, err)
+	}
+	_, err = tx.Exec(`
+		UPDATE stations SET code = ?, name = ?, city = ?, latitude = ?, longitude = ?, timezone = ?
+		WHERE id = ?
+	`, s.Code, s.Name, s.City, nullableFloat(s.Latitude), nullableFloat(s.Longitude), s.Timezone, s.ID)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("a station with this code or name already exists")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update station: %w", err)
+	}
+	if oldName != s.Name {
+		if err := renameStation(tx, oldName, s.Name); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit station update: %w", err)
+	}
+	return nil
+}
+
+// renameStation replaces a station's name wherever it is stored as an origin or destination
+func renameStation(q queryer, from, to string) error {
+	for _, table := range []string{"trips", "fares", "schedules"} {
+		for _, column := range []string{"origin", "destination"} {
+			query := fmt.Sprintf("UPDATE %s SET %s = ? WHERE %s = ?", table, column, column)
+			if _, err := q.Exec(query, to, from); err != nil {
+				return fmt.Errorf("error renaming station on %s: %w", table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// DeleteStation deletes a station. Stations that are stops of a route cannot be deleted.
+func DeleteStation(id int64) error {
+	var stops int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM route_stops WHERE station_id = ?", id).Scan(&stops); err != nil {
+		return fmt.Errorf("error checking station use: %w", err)
+	}
+	if stops > 0 {
+		return ErrStationInUse
+	}
+	if _, err := DB.Exec("DELETE FROM stations WHERE id = ?", id); err != nil {
+		return fmt.Errorf("error deleting station %d: %w", id, err)
+	}
+	return nil
+}
+
+const stationColumns = "id, code, name, city, latitude, longitude, timezone"
+
+func scanStation(row interface{ Scan(...interface{}) error }) (*Station, error) {
+	var s Station
+	var lat, lon sql.NullFloat64
+	if err := row.Scan(&s.ID, &s.Code, &s.Name, &s.City, &lat, &lon, &s.Timezone); err != nil {
+		return nil, err
+	}
+	if lat.Valid && lon.Valid {
+		s.Latitude, s.Longitude = &lat.Float64, &lon.Float64
+	}
+	return &s, nil
+}
+
+// GetStations returns every station ordered by name
+func GetStations() ([]Station, error) {
+	rows, err := DB.Query("SELECT " + stationColumns + " FROM stations ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving stations: %w", err)
+	}
+	defer rows.Close()
+
+	stations := []Station{}
+	for rows.Next() {
+		s, err := scanStation(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning station: %w", err)
+		}
+		stations = append(stations, *s)
+	}
+	return stations, rows.Err()
+}
+
+// FindStation returns the station with a name or code, ignoring case and
+// extra spaces. It returns ErrUnknownStation if there is none.
+func FindStation(nameOrCode string) (*Station, error) {
+	return findStation(DB, nameOrCode)
+}
+
+func findStation(q queryer, nameOrCode string) (*Station, error) {
+	key := normalizeStationName(nameOrCode)
+	s, err := scanStation(q.QueryRow("SELECT "+stationColumns+" FROM stations WHERE name = ? OR code = ? ORDER BY name = ? DESC LIMIT 1", key, key, key))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownStation, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error finding station: %w", err)
+	}
+	return s, nil
+}
+
+// canonicalEndpoints returns the station names of an origin and destination
+// given by name or code
+func canonicalEndpoints(q queryer, origin, destination string) (string, string, error) {
+	from, err := findStation(q, origin)
+	if err != nil {
+		return "", "", err
+	}
+	to, err := findStation(q, destination)
+	if err != nil {
+		return "", "", err
+	}
+	if from.ID == to.ID {
+		return "", "", ErrSameStation
+	}
+	return from.Name, to.Name, nil
+}
+
+// validateRoute checks a route's stops, distance and duration
+func validateRoute(r Route, stationIDs []int64) error {
+	if len(stationIDs) < 2 {
+		return fmt.Errorf("a route needs at least an origin and a destination")
+	}
+	seen := map[int64]bool{}
+	for _, id := range stationIDs {
+		if seen[id] {
+			return fmt.Errorf("a route cannot call at the same station twice")
+		}
+		seen[id] = true
+	}
+	if r.DistanceKm < 0 {
+		return fmt.Errorf("distance cannot be negative")
+	}
+	if r.DurationMinutes <= 0 {
+		return fmt.Errorf("duration must be greater than zero")
+	}
+	return nil
+}
+
+// writeRouteStops replaces the stops of a route and returns them in order
+func writeRouteStops(tx *sql.Tx, routeID int64, stationIDs []int64) ([]RouteStop, error) {
+	if _, err := tx.Exec("DELETE FROM route_stops WHERE route_id = ?", routeID); err != nil {
+		return nil, fmt.Errorf("error clearing route stops: %w", err)
+	}
+	stops := make([]RouteStop, len(stationIDs))
+	for i, id := range stationIDs {
+		stops[i].StationID = id
+		err := tx.QueryRow("SELECT code, name FROM stations WHERE id = ?", id).Scan(&stops[i].Code, &stops[i].Name)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w: #%d", ErrUnknownStation, id)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error retrieving station %d: %w", id, err)
+		}
+		if _, err := tx.Exec("INSERT INTO route_stops (route_id, position, station_id) VALUES (?, ?, ?)", routeID, i, id); err != nil {
+			return nil, fmt.Errorf("error adding route stop: %w", err)
+		}
+	}
+	return stops, nil
+}
+
+// routeName is the name a route gets if none is given, e.g. "Tehran - Mashhad"
+func routeName(stops []RouteStop) string {
+	return stops[0].Name + " - " + stops[len(stops)-1].Name
+}
+
+// AddRoute adds a route calling at stationIDs in order and returns its ID.
+// A route without a name is named after its ends.
+func AddRoute(r Route, stationIDs []int64) (int64, error) {
+	if err := validateRoute(r, stationIDs); err != nil {
+		return 0, err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	id, err := insertRoute(tx, r, stationIDs)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit route: %w", err)
+	}
+	return id, nil
+}
+
+func insertRoute(tx *sql.Tx, r Route, stationIDs []int64) (int64, error) {
+	res, err := tx.Exec("INSERT INTO routes (name, distance_km, duration_minutes, active) VALUES (?, ?, ?, ?)",
+		strings.TrimSpace(r.Name), sql.NullFloat64{Float64: r.DistanceKm, Valid: r.DistanceKm > 0}, r.DurationMinutes, r.Active)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert route: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to retrieve route id: %w", err)
+	}
+	stops, err := writeRouteStops(tx, id, stationIDs)
+	if err != nil {
+		return 0, err
+	}
+	if strings.TrimSpace(r.Name) == "" {
+		if _, err := tx.Exec("UPDATE routes SET name = ? WHERE id = ?", routeName(stops), id); err != nil {
+			return 0, fmt.Errorf("failed to name route: %w", err)
+		}
+	}
+	return id, nil
+}
+
+// UpdateRoute changes a route. The origin and destination of a route that
+// trips or timetables run on cannot be moved; its intermediate stops,
+// distance and duration can. It returns sql.ErrNoRows if the route does not exist.
+func UpdateRoute(r Route, stationIDs []int64) error {
+	if err := validateRoute(r, stationIDs); err != nil {
+		return err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	current, err := getRoute(tx, r.ID)
+	if err != nil {
+		return err
+	}
+	first, last := current.Stops[0].StationID, current.Stops[len(current.Stops)-1].StationID
+	if first != stationIDs[0] || last != stationIDs[len(stationIDs)-1] {
+		if used, err := routeInUse(tx, r.ID); err != nil {
+			return err
+		} else if used {
+			return ErrRouteInUse
+		}
+	}
+
+	stops, err := writeRouteStops(tx, r.ID, stationIDs)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSpace(r.Name)
+	if name == "" {
+		name = routeName(stops)
+	}
+	_, err = tx.Exec("UPDATE routes SET name = ?, distance_km = ?, duration_minutes = ?, active = ? WHERE id = ?",
+		name, sql.NullFloat64{Float64: r.DistanceKm, Valid: r.DistanceKm > 0}, r.DurationMinutes, r.Active, r.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update route: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit route update: %w", err)
+	}
+	return nil
+}
+
+// routeInUse reports whether any trip or timetable runs on a route
+func routeInUse(q queryer, routeID int64) (bool, error) {
+	var count int
+	err := q.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM trips WHERE route_id = ?) + (SELECT COUNT(*) FROM schedules WHERE route_id = ?)
+	`, routeID, routeID).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("error checking route use: %w", err)
+	}
+	return count > 0, nil
+}
+
+// DeleteRoute deletes a route that no trip or timetable runs on. Routes in
+// use can be made inactive instead.
+func DeleteRoute(id int64) error {
+	used, err := routeInUse(DB, id)
+	if err != nil {
+		return err
+	}
+	if used {
+		return ErrRouteInUse
+	}
+	if _, err := DB.Exec("DELETE FROM routes WHERE id = ?", id); err != nil {
+		return fmt.Errorf("error deleting route %d: %w", id, err)
+	}
+	return nil
+}
+
+// GetRoute returns a route with its stops. It returns sql.ErrNoRows if the
+// route does not exist.
+func GetRoute(id int64) (*Route, error) {
+	return getRoute(DB, id)
+}
+
+func getRoute(q queryer, id int64) (*Route, error) {
+	r := Route{ID: id}
+	var distance sql.NullFloat64
+	err := q.QueryRow("SELECT name, distance_km, duration_minutes, active FROM routes WHERE id = ?", id).
+		Scan(&r.Name, &distance, &r.DurationMinutes, &r.Active)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error retrieving route %d: %w", id, err)
+	}
+	r.DistanceKm = distance.Float64
+	if err := loadRouteStops(q, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// loadRouteStops fills in the stops, origin and destination of a route
+func loadRouteStops(q queryer, r *Route) error {
+	rows, err := q.Query(`
+		SELECT rs.station_id, s.code, s.name
+		FROM route_stops rs
+		JOIN stations s ON rs.station_id = s.id
+		WHERE rs.route_id = ?
+		ORDER BY rs.position
+	`, r.ID)
+	if err != nil {
+		return fmt.Errorf("error retrieving route stops: %w", err)
+	}
+	defer rows.Close()
+
+	r.Stops = []RouteStop{}
+	for rows.Next() {
+		var stop RouteStop
+		if err := rows.Scan(&stop.StationID, &stop.Code, &stop.Name); err != nil {
+			return fmt.Errorf("error scanning route stop: %w", err)
+		}
+		r.Stops = append(r.Stops, stop)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(r.Stops) < 2 {
+		return fmt.Errorf("route %d has fewer than two stops", r.ID)
+	}
+	r.Origin, r.Destination = r.Stops[0].Name, r.Stops[len(r.Stops)-1].Name
+	return nil
+}
+
+// GetRoutes returns every route with its stops, ordered by name
+func GetRoutes() ([]Route, error) {
+	rows, err := DB.Query("SELECT id, name, distance_km, duration_minutes, active FROM routes ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving routes: %w", err)
+	}
+	routes := []Route{}
+	for rows.Next() {
+		var r Route
+		var distance sql.NullFloat64
+		if err := rows.Scan(&r.ID, &r.Name, &distance, &r.DurationMinutes, &r.Active); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning route: %w", err)
+		}
+		r.DistanceKm = distance.Float64
+		routes = append(routes, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range routes {
+		if err := loadRouteStops(DB, &routes[i]); err != nil {
+			return nil, err
+		}
+	}
+	return routes, nil
+}
+
+// ResolveRoute returns the route a trip or timetable runs on: the route with
+// routeID if it is not 0, and otherwise the active route between the origin
+// and destination stations (given by name or code) with the fewest stops.
+func ResolveRoute(routeID int64, origin, destination string) (*Route, error) {
+	return resolveRoute(DB, routeID, origin, destination)
+}
+
+func resolveRoute(q queryer, routeID int64, origin, destination string) (*Route, error) {
+	if routeID == 0 {
+		from, err := findStation(q, origin)
+		if err != nil {
+			return nil, err
+		}
+		to, err := findStation(q, destination)
+		if err != nil {
+			return nil, err
+		}
+		if from.ID == to.ID {
+			return nil, ErrSameStation
+		}
+		err = q.QueryRow(`
+			SELECT r.id FROM routes r
+			WHERE r.active = 1
+			  AND (SELECT station_id FROM route_stops WHERE route_id = r.id ORDER BY position LIMIT 1) = ?
+			  AND (SELECT station_id FROM route_stops WHERE route_id = r.id ORDER BY position DESC LIMIT 1) = ?
+			ORDER BY (SELECT COUNT(*) FROM route_stops WHERE route_id = r.id), r.id
+			LIMIT 1
+		`, from.ID, to.ID).Scan(&routeID)
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("%w from %s to %s", ErrNoRoute, from.Name, to.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error finding route: %w", err)
+		}
+	}
+
+	r, err := getRoute(q, routeID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: route #%d does not exist", ErrNoRoute, routeID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !r.Active {
+		return nil, ErrRouteInactive
+	}
+	return r, nil
+}
+
+// stationCode makes up an unused code for a station found in existing data,
+// from the first letters of its name
+func stationCode(q queryer, name string) (string, error) {
+	var letters []rune
+	for _, r := range strings.ToUpper(name) {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			letters = append(letters, r)
+		}
+		if len(letters) == 3 {
+			break
+		}
+	}
+	base := string(letters)
+	if len(base) < 2 {
+		base = "ST"
+	}
+	for n := 1; n < 1000; n++ {
+		code := base
+		if n > 1 {
+			code = fmt.Sprintf("%s%d", base, n)
+		}
+		var taken int
+		if err := q.QueryRow("SELECT COUNT(*) FROM stations WHERE code = ?", code).Scan(&taken); err != nil {
+			return "", fmt.Errorf("error checking station code: %w", err)
+		}
+		if taken == 0 {
+			return code, nil
+		}
+	}
+	return "", fmt.Errorf("could not find a free station code for %s", name)
+}
+
+// migrateToStations seeds the default stations, turns every origin and
+// destination typed into trips, fares and timetables into a station (so
+// "tehran " and "Tehran" become the same one), and puts existing trips and
+// timetables on a direct route between their ends
+func migrateToStations() error {
+	for _, s := range defaultStations {
+		s.Timezone = DefaultStationTimezone
+		_, err := DB.Exec("INSERT OR IGNORE INTO stations (code, name, city, latitude, longitude, timezone) VALUES (?, ?, ?, ?, ?, ?)",
+			s.Code, s.Name, s.City, nullableFloat(s.Latitude), nullableFloat(s.Longitude), s.Timezone)
+		if err != nil {
+			return fmt.Errorf("error seeding station %s: %w", s.Name, err)
+		}
+	}
+
+	rows, err := DB.Query(`
+		SELECT origin FROM trips UNION SELECT destination FROM trips
+		UNION SELECT origin FROM fares UNION SELECT destination FROM fares
+		UNION SELECT origin FROM schedules UNION SELECT destination FROM schedules
+	`)
+	if err != nil {
+		return fmt.Errorf("error retrieving places: %w", err)
+	}
+	var places []string
+	for rows.Next() {
+		var place string
+		if err := rows.Scan(&place); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning place: %w", err)
+		}
+		places = append(places, place)
+	}
+	rows.Close()
+
+	for _, place := range places {
+		station, err := findStation(DB, place)
+		if errors.Is(err, ErrUnknownStation) {
+			name := normalizeStationName(place)
+			if name == "" {
+				continue
+			}
+			var code string
+			if code, err = stationCode(DB, name); err != nil {
+				return err
+			}
+			log.Printf("Adding station %s (%s) found in existing trips", name, code)
+			if _, err := DB.Exec("INSERT INTO stations (code, name, city, timezone) VALUES (?, ?, ?, ?)", code, name, name, DefaultStationTimezone); err != nil {
+				return fmt.Errorf("error adding station %s: %w", name, err)
+			}
+			station, err = findStation(DB, name)
+		}
+		if err != nil {
+			return err
+		}
+		if place != station.Name {
+			if err := renameStation(DB, place, station.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Each route is created from the average journey time of its trips, or
+	// from a timetable's duration if no trip has run on it yet
+	rows, err = DB.Query(`
+		SELECT origin, destination, MAX(CAST(ROUND(AVG(minutes)) AS INTEGER), 1) FROM (
+			SELECT origin, destination, (julianday(arrival_time) - julianday(departure_time)) * 1440 AS minutes FROM trips
+			UNION ALL
+			SELECT origin, destination, duration_minutes FROM schedules
+			WHERE NOT EXISTS (SELECT 1 FROM trips t WHERE t.origin = schedules.origin AND t.destination = schedules.destination)
+		)
+		WHERE origin != destination
+		GROUP BY origin, destination
+	`)
+	if err != nil {
+		return fmt.Errorf("error retrieving routes in use: %w", err)
+	}
+	type pair struct {
+		origin, destination string
+		minutes             int
+	}
+	var pairs []pair
+	for rows.Next() {
+		var p pair
+		var minutes sql.NullInt64
+		if err := rows.Scan(&p.origin, &p.destination, &minutes); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning route: %w", err)
+		}
+		p.minutes = int(minutes.Int64)
+		if p.minutes <= 0 {
+			p.minutes = 60
+		}
+		pairs = append(pairs, p)
+	}
+	rows.Close()
+
+	for _, p := range pairs {
+		tx, err := DB.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		route, err := resolveRoute(tx, 0, p.origin, p.destination)
+		if errors.Is(err, ErrNoRoute) {
+			var from, to *Station
+			if from, err = findStation(tx, p.origin); err == nil {
+				if to, err = findStation(tx, p.destination); err == nil {
+					var id int64
+					if id, err = insertRoute(tx, Route{DurationMinutes: p.minutes, Active: true}, []int64{from.ID, to.ID}); err == nil {
+						route = &Route{ID: id}
+					}
+				}
+			}
+		}
+		if err == nil {
+			_, err = tx.Exec("UPDATE trips SET route_id = ? WHERE origin = ? AND destination = ? AND route_id IS NULL", route.ID, p.origin, p.destination)
+		}
+		if err == nil {
+			_, err = tx.Exec("UPDATE schedules SET route_id = ? WHERE origin = ? AND destination = ? AND route_id IS NULL", route.ID, p.origin, p.destination)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error creating route from %s to %s: %w", p.origin, p.destination, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package db
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultTicketKeyPath is used when TICKET_KEY_PATH is not set
+const DefaultTicketKeyPath = "keys/ticket.key"
+
+// ticketKeySize is the length in bytes of the HMAC-SHA256 ticket signing key
+const ticketKeySize = 32
+
+// referenceAlphabet leaves out letters and digits that are easily confused
+// when read out or typed (0/O, 1/I/L)
+const referenceAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// referenceLength is the number of characters in a booking reference
+const referenceLength = 6
+
+// ticketPayloadPrefix versions the signed payload encoded in a ticket's QR code
+const ticketPayloadPrefix = "T1"
+
+// ticketKey signs the payload in each ticket's QR code
+var ticketKey []byte
+
+var (
+	// ErrTicketCancelled is returned when printing a ticket for a cancelled booking
+	ErrTicketCancelled = errors.New("booking is cancelled")
+	// ErrInvalidTicket is returned for a ticket payload that is malformed or not signed by this system
+	ErrInvalidTicket = errors.New("ticket is not valid")
+)
+
+// Ticket is what is printed on a passenger's ticket. Payload is the signed
+// string encoded in its QR code. Prints counts how often it has been printed,
+// including this time. Origin and Destination are where the passenger boards
+// and alights, and the times are the trip's times at those stops.
+type Ticket struct {
+	BookingID     int64  `json:"booking_id"`
+	Reference     string `json:"reference"`
+	Passenger     string `json:"passenger"`
+	Origin        string `json:"origin"`
+	Destination   string `json:"destination"`
+	DepartureTime string `json:"departure_time"`
+	ArrivalTime   string `json:"arrival_time"`
+	VehicleNumber string `json:"vehicle_number"`
+	SeatNumber    string `json:"seat_number"`
+	FareCategory  string `json:"fare_category"`
+	PriceCents    *int64 `json:"price_cents"`
+	Status        string `json:"status"`
+	Prints        int    `json:"prints"`
+	Payload       string `json:"payload"`
+}
+
+// TicketClaims is the content of a ticket's signed payload
+type TicketClaims struct {
+	Reference     string `json:"ref"`
+	BookingID     int64  `json:"bid"`
+	TripID        int64  `json:"tid"`
+	SeatNumber    string `json:"seat"`
+	DepartureTime string `json:"dep"`
+}
+
+// TicketKeyPath returns the configured path of the ticket signing key
+func TicketKeyPath() string {
+	if path := os.Getenv("TICKET_KEY_PATH"); path != "" {
+		return path
+	}
+	return DefaultTicketKeyPath
+}
+
+// LoadTicketKey loads the ticket signing key from path, generating a new one
+// if the file does not exist yet. Tickets signed with a lost key no longer
+// verify, so the key should be backed up with the encryption key, and no new
+// key is generated once tickets have been issued.
+func LoadTicketKey(path string) error {
+	key, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		issued, countErr := countIssuedTickets()
+		if countErr != nil {
+			return fmt.Errorf("failed to check for issued tickets: %w", countErr)
+		}
+		if issued > 0 {
+			return fmt.Errorf("no ticket signing key found at %s, but %d tickets have been issued: restore the key or set TICKET_KEY_PATH to where it is", path, issued)
+		}
+		log.Printf("No ticket signing key found at %s, generating a new one", path)
+		key = make([]byte, ticketKeySize)
+		if _, err = rand.Read(key); err != nil {
+			return fmt.Errorf("failed to generate ticket signing key: %w", err)
+		}
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return fmt.Errorf("failed to create key directory: %w", err)
+		}
+		err = os.WriteFile(path, key, 0600)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load ticket signing key: %w", err)
+	}
+	if len(key) != ticketKeySize {
+		return fmt.Errorf("ticket signing key at %s must be exactly %d bytes, found %d", path, ticketKeySize, len(key))
+	}
+	ticketKey = key
+	log.Printf("Loaded ticket signing key from %s", path)
+	return nil
+}
+
+// countIssuedTickets counts the bookings whose ticket has been issued. A
+// database whose bookings table is older than tickets has none.
+func countIssuedTickets() (int, error) {
+	var exists int
+	err := DB.QueryRow("SELECT COUNT(*) FROM pragma_table_info('bookings') WHERE name = 'ticket_issued_at'").Scan(&exists)
+	if err != nil || exists == 0 {
+		return 0, err
+	}
+	var count int
+	err = DB.QueryRow("SELECT COUNT(*) FROM bookings WHERE ticket_issued_at IS NOT NULL OR ticket_prints > 0").Scan(&count)
+	return count, err
+}
+
+// newReference returns a random booking reference such as "K7QX2M"
+func newReference() (string, error) {
+	max := big.NewInt(int64(len(referenceAlphabet)))
+	ref := make([]byte, referenceLength)
+	for i := range ref {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate booking reference: %w", err)
+		}
+		ref[i] = referenceAlphabet[n.Int64()]
+	}
+	return string(ref), nil
+}
+
+// uniqueReference returns a booking reference no booking has yet
+func uniqueReference(q queryer) (string, error) {
+	for attempt := 0; attempt < 10; attempt++ {
+		ref, err := newReference()
+		if err != nil {
+			return "", err
+		}
+		var taken int
+		if err := q.QueryRow("SELECT COUNT(*) FROM bookings WHERE reference = ?", ref).Scan(&taken); err != nil {
+			return "", fmt.Errorf("error checking booking reference: %w", err)
+		}
+		if taken == 0 {
+			return ref, nil
+		}
+	}
+	return "", fmt.Errorf("could not find a free booking reference")
+}
+
+// assignMissingReferences gives every booking made before references were
+// introduced a reference of its own
+func assignMissingReferences() error {
+	rows, err := DB.Query("SELECT id FROM bookings WHERE reference IS NULL")
+	if err != nil {
+		return fmt.Errorf("error retrieving bookings without reference: %w", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning booking: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		ref, err := uniqueReference(DB)
+		if err != nil {
+			return err
+		}
+		if _, err := DB.Exec("UPDATE bookings SET reference = ? WHERE id = ?", ref, id); err != nil {
+			return fmt.Errorf("error assigning reference to booking %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// NormalizeReference upper-cases a booking reference and removes spaces
+func NormalizeReference(ref string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(ref), " ", ""))
+}
+
+// FindBookingByReference returns the ID of the booking with a reference. It
+// returns sql.ErrNoRows if there is none.
+func FindBookingByReference(ref string) (int64, error) {
+	var id int64
+	err := DB.QueryRow("SELECT id FROM bookings WHERE reference = ?", NormalizeReference(ref)).Scan(&id)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("error finding booking by reference: %w", err)
+	}
+	return id, err
+}
+
+// signTicket encodes claims as the payload of a ticket's QR code:
+// "T1.<base64url JSON>.<base64url HMAC-SHA256>"
+func signTicket(claims TicketClaims) (string, error) {
+	if ticketKey == nil {
+		return "", fmt.Errorf("ticket signing key is not loaded")
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode ticket: %w", err)
+	}
+	signed := ticketPayloadPrefix + "." + base64.RawURLEncoding.EncodeToString(body)
+	mac := hmac.New(sha256.New, ticketKey)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// VerifyTicket checks the signature of a ticket payload read from its QR code
+// and returns what it claims. It returns ErrInvalidTicket if the payload was
+// altered or not issued by this system.
+func VerifyTicket(payload string) (*TicketClaims, error) {
+	if ticketKey == nil {
+		return nil, fmt.Errorf("ticket signing key is not loaded")
+	}
+	parts := strings.Split(strings.TrimSpace(payload), ".")
+	if len(parts) != 3 || parts[0] != ticketPayloadPrefix {
+		return nil, ErrInvalidTicket
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidTicket
+	}
+	mac := hmac.New(sha256.New, ticketKey)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrInvalidTicket
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidTicket
+	}
+	var claims TicketClaims
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, ErrInvalidTicket
+	}
+	return &claims, nil
+}
+
+// IssueTicket returns the ticket of a booking and records that it was
+// printed. The same booking always gets the same reference and payload, so a
+// lost ticket can be printed again. It returns sql.ErrNoRows if the booking
+// does not exist and ErrTicketCancelled if it is cancelled.
+func IssueTicket(bookingID int64) (*Ticket, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	t := &Ticket{BookingID: bookingID}
+	var tripID int64
+	var reference sql.NullString
+	var price sql.NullInt64
+	err = tx.QueryRow(`
+		SELECT b.trip_id, b.reference, b.passenger, `+boardingStationSQL+`, `+alightingStationSQL+`,
+			`+boardingTimeSQL+`, `+alightingTimeSQL+`,
+			COALESCE(v.vehicle_number, ''), COALESCE(b.seat_number, ''), COALESCE(b.fare_category, ''), b.price_cents,
+			b.status, b.ticket_prints
+		FROM bookings b
+		JOIN trips t ON b.trip_id = t.id
+		LEFT JOIN vehicles v ON t.vehicle_id = v.id
+		WHERE b.id = ?
+	`, bookingID).Scan(&tripID, &reference, &t.Passenger, &t.Origin, &t.Destination, &t.DepartureTime, &t.ArrivalTime,
+		&t.VehicleNumber, &t.SeatNumber, &t.FareCategory, &price, &t.Status, &t.Prints)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error retrieving booking %d: %w", bookingID, err)
+	}
+	if isReleased(t.Status) {
+		return nil, ErrTicketCancelled
+	}
+	if price.Valid {
+		t.PriceCents = &price.Int64
+	}
+
+	t.Reference = reference.String
+	if !reference.Valid {
+		if t.Reference, err = uniqueReference(tx); err != nil {
+			return nil, err
+		}
+	}
+	t.Prints++
+	_, err = tx.Exec(`
+		UPDATE bookings SET reference = ?, ticket_prints = ?, ticket_issued_at = COALESCE(ticket_issued_at, ?)
+		WHERE id = ?
+	`, t.Reference, t.Prints, sqlTime(time.Now()), bookingID)
+	if err != nil {
+		return nil, fmt.Errorf("error recording ticket print: %w", err)
+	}
+
+	t.Payload, err = signTicket(TicketClaims{
+		Reference:     t.Reference,
+		BookingID:     bookingID,
+		TripID:        tripID,
+		SeatNumber:    t.SeatNumber,
+		DepartureTime: t.DepartureTime,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error recording ticket print: %w", err)
+	}
+	return t, nil
+}
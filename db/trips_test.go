@@ -0,0 +1,42 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDeleteTripWithPayments(t *testing.T) {
+	openTestDB(t)
+	tripID := addTestTrip(t, 10)
+	id := addTestBooking(t, tripID, 1)
+	if _, err := RecordPayment(id, 2000, PaymentCash, 0, "test", ""); err != nil {
+		t.Fatalf("RecordPayment: %v", err)
+	}
+	cancelTestBooking(t, id, 50)
+
+	if err := DeleteTrip(tripID); !errors.Is(err, ErrTripHasPayments) {
+		t.Fatalf("DeleteTrip error = %v, want ErrTripHasPayments", err)
+	}
+	if got := bookingStatus(t, id); got != BookingCancelled {
+		t.Errorf("booking is %s, want it kept Cancelled", got)
+	}
+}
+
+func TestDeleteTripRemovesUnpaidBookings(t *testing.T) {
+	openTestDB(t)
+	tripID := addTestTrip(t, 1)
+	id := addTestBooking(t, tripID, 1)
+	addTestWaitlist(t, tripID, 2, 0, "", "")
+	cancelTestBooking(t, id, 0)
+
+	if err := DeleteTrip(tripID); err != nil {
+		t.Fatalf("DeleteTrip: %v", err)
+	}
+	var bookings int
+	if err := DB.QueryRow("SELECT COUNT(*) FROM bookings WHERE trip_id = ?", tripID).Scan(&bookings); err != nil {
+		t.Fatalf("counting bookings: %v", err)
+	}
+	if bookings != 0 {
+		t.Errorf("%d bookings left on the deleted trip", bookings)
+	}
+}
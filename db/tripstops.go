@@ -0,0 +1,507 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// tripEnd is the To of a Segment that runs to the last stop of its trip.
+// Bookings to the end of a trip store no alighting stop, so they keep
+// alighting at the end if the trip's stops change.
+const tripEnd = math.MaxInt32
+
+var (
+	// ErrNotAStop is returned when boarding or alighting at a station the trip does not call at
+	ErrNotAStop = errors.New("station is not a stop of this trip")
+	// ErrInvalidSegment is returned when the alighting stop does not come after the boarding stop
+	ErrInvalidSegment = errors.New("alighting stop must come after the boarding stop")
+	// ErrStopsBooked is returned when changing the stops of a trip that
+	// passengers board or alight at part way
+	ErrStopsBooked = errors.New("passengers board or alight at intermediate stops of this trip")
+)
+
+// TripStop is a station a trip calls at, in order from position 0 (the
+// origin). The origin has no arrival time and the destination no departure time.
+type TripStop struct {
+	Position      int    `json:"position"`
+	StationID     int64  `json:"station_id"`
+	Code          string `json:"code"`
+	Name          string `json:"name"`
+	ArrivalTime   string `json:"arrival_time"`
+	DepartureTime string `json:"departure_time"`
+}
+
+// Segment is the part of a trip a passenger travels on: from the stop at
+// position From to the stop at position To, or to the end of the trip if To
+// is tripEnd. Seats are sold per segment, so two bookings may hold the same
+// seat if their segments do not overlap.
+type Segment struct {
+	From int
+	To   int
+}
+
+// Where a booking's passenger boards and alights, and when, for queries that
+// join bookings (or waitlist entries) as b and trips as t. Trips without stored stops board at
+// their origin and alight at their destination.
+const (
+	boardingStationSQL = `COALESCE((SELECT s.name FROM trip_stops ts JOIN stations s ON ts.station_id = s.id
+		WHERE ts.trip_id = b.trip_id AND ts.position = b.boarding_stop), t.origin)`
+	alightingStationSQL = `COALESCE((SELECT s.name FROM trip_stops ts JOIN stations s ON ts.station_id = s.id
+		WHERE ts.trip_id = b.trip_id AND ts.position = b.alighting_stop), t.destination)`
+	boardingTimeSQL = `COALESCE((SELECT ts.departure_time FROM trip_stops ts
+		WHERE ts.trip_id = b.trip_id AND ts.position = b.boarding_stop), t.departure_time)`
+	alightingTimeSQL = `COALESCE((SELECT ts.arrival_time FROM trip_stops ts
+		WHERE ts.trip_id = b.trip_id AND ts.position = b.alighting_stop), t.arrival_time)`
+)
+
+// wholeTrip is the segment from the origin to the end of a trip
+var wholeTrip = Segment{From: 0, To: tripEnd}
+
+// bookingSegment builds the segment of a booking from its stored stops
+func bookingSegment(boarding int, alighting sql.NullInt64) Segment {
+	if !alighting.Valid {
+		return Segment{From: boarding, To: tripEnd}
+	}
+	return Segment{From: boarding, To: int(alighting.Int64)}
+}
+
+// alightingStop is how the alighting stop of a segment is stored: NULL for the end of the trip
+func (s Segment) alightingStop() sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(s.To), Valid: s.To != tripEnd}
+}
+
+// last returns the position of the stop the segment ends at on a trip with the given stops
+func (s Segment) last(stops []TripStop) int {
+	if s.To == tripEnd || s.To >= len(stops) {
+		return len(stops) - 1
+	}
+	return s.To
+}
+
+// GetTripStops returns the stops of a trip in order, or sql.ErrNoRows if the
+// trip does not exist
+func GetTripStops(tripID int64) ([]TripStop, error) {
+	return getTripStops(DB, tripID)
+}
+
+// getTripStops loads the stops of a trip. Trips that are not on a route have
+// no stored stops and call only at their origin and destination.
+func getTripStops(q queryer, tripID int64) ([]TripStop, error) {
+	rows, err := q.Query(`
+		SELECT ts.position, ts.station_id, s.code, s.name, COALESCE(ts.arrival_time, ''), COALESCE(ts.departure_time, '')
+		FROM trip_stops ts
+		JOIN stations s ON ts.station_id = s.id
+		WHERE ts.trip_id = ?
+		ORDER BY ts.position
+	`, tripID)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving trip stops: %w", err)
+	}
+	defer rows.Close()
+
+	var stops []TripStop
+	for rows.Next() {
+		var stop TripStop
+		if err := rows.Scan(&stop.Position, &stop.StationID, &stop.Code, &stop.Name, &stop.ArrivalTime, &stop.DepartureTime); err != nil {
+			return nil, fmt.Errorf("error scanning trip stop: %w", err)
+		}
+		stops = append(stops, stop)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(stops) >= 2 {
+		return stops, nil
+	}
+
+	origin, destination := TripStop{Position: 0}, TripStop{Position: 1}
+	err = q.QueryRow("SELECT origin, departure_time, destination, arrival_time FROM trips WHERE id = ?", tripID).
+		Scan(&origin.Name, &origin.DepartureTime, &destination.Name, &destination.ArrivalTime)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error retrieving trip %d: %w", tripID, err)
+	}
+	return []TripStop{origin, destination}, nil
+}
+
+// writeTripStops replaces the stops of a trip with the stops of its route,
+// spacing the times of the intermediate stops evenly between the trip's
+// departure and arrival
+func writeTripStops(q queryer, tripID int64, route *Route, departureTime, arrivalTime string) error {
+	loc, err := stationLocation(q, route.Origin)
+	if err != nil {
+		return err
+	}
+	departure, err := parseDeparture(departureTime, loc)
+	if err != nil {
+		return err
+	}
+	arrival, err := parseDeparture(arrivalTime, loc)
+	if err != nil {
+		return fmt.Errorf("invalid arrival time %q", arrivalTime)
+	}
+
+	if _, err := q.Exec("DELETE FROM trip_stops WHERE trip_id = ?", tripID); err != nil {
+		return fmt.Errorf("error clearing trip stops: %w", err)
+	}
+	last := len(route.Stops) - 1
+	for i, stop := range route.Stops {
+		var arrive, depart sql.NullString
+		switch i {
+		case 0:
+			depart = sql.NullString{String: departureTime, Valid: true}
+		case last:
+			arrive = sql.NullString{String: arrivalTime, Valid: true}
+		default:
+			at := departure.Add(arrival.Sub(departure) * time.Duration(i) / time.Duration(last)).Round(time.Minute).Format(departureLayouts[0])
+			arrive = sql.NullString{String: at, Valid: true}
+			depart = arrive
+		}
+		_, err := q.Exec("INSERT INTO trip_stops (trip_id, position, station_id, arrival_time, departure_time) VALUES (?, ?, ?, ?, ?)",
+			tripID, i, stop.StationID, arrive, depart)
+		if err != nil {
+			return fmt.Errorf("error adding stop %s to trip: %w", stop.Name, err)
+		}
+	}
+	return nil
+}
+
+// retimeTripStops moves the stops of a trip to its new departure and
+// arrival, keeping each intermediate stop at the same share of the journey
+func retimeTripStops(q queryer, tripID int64, oldDeparture, oldArrival, departureTime, arrivalTime string) error {
+	stops, err := getTripStops(q, tripID)
+	if err != nil {
+		return err
+	}
+	if stops[0].StationID == 0 {
+		return nil
+	}
+	loc, err := tripLocation(q, tripID)
+	if err != nil {
+		return err
+	}
+	from, err := parseDeparture(oldDeparture, loc)
+	if err != nil {
+		return err
+	}
+	to, err := parseDeparture(oldArrival, loc)
+	if err != nil {
+		return err
+	}
+	departure, err := parseDeparture(departureTime, loc)
+	if err != nil {
+		return err
+	}
+	arrival, err := parseDeparture(arrivalTime, loc)
+	if err != nil {
+		return fmt.Errorf("invalid arrival time %q", arrivalTime)
+	}
+	scale := float64(arrival.Sub(departure)) / float64(to.Sub(from))
+	move := func(at string) (string, error) {
+		t, err := parseDeparture(at, loc)
+		if err != nil {
+			return "", err
+		}
+		return departure.Add(time.Duration(float64(t.Sub(from)) * scale)).Round(time.Minute).Format(departureLayouts[0]), nil
+	}
+
+	last := len(stops) - 1
+	for _, stop := range stops[1:last] {
+		arrive, err := move(stop.ArrivalTime)
+		if err != nil {
+			return err
+		}
+		depart, err := move(stop.DepartureTime)
+		if err != nil {
+			return err
+		}
+		if _, err := q.Exec("UPDATE trip_stops SET arrival_time = ?, departure_time = ? WHERE trip_id = ? AND position = ?",
+			arrive, depart, tripID, stop.Position); err != nil {
+			return fmt.Errorf("error moving trip stop: %w", err)
+		}
+	}
+	if _, err := q.Exec("UPDATE trip_stops SET departure_time = ? WHERE trip_id = ? AND position = 0", departureTime, tripID); err != nil {
+		return fmt.Errorf("error moving trip stop: %w", err)
+	}
+	if _, err := q.Exec("UPDATE trip_stops SET arrival_time = ? WHERE trip_id = ? AND position = ?", arrivalTime, tripID, last); err != nil {
+		return fmt.Errorf("error moving trip stop: %w", err)
+	}
+	return nil
+}
+
+// stopsBooked reports whether an active booking of a trip boards or alights part way
+func stopsBooked(q queryer, tripID int64) (bool, error) {
+	var count int
+	err := q.QueryRow(`
+		SELECT COUNT(*) FROM bookings
+		WHERE trip_id = ? AND status NOT IN `+releasedStatusesSQL+` AND (boarding_stop != 0 OR alighting_stop IS NOT NULL)
+	`, tripID).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("error checking booked stops: %w", err)
+	}
+	return count > 0, nil
+}
+
+// SetTripStopTimes sets the arrival and departure times of a trip's
+// intermediate stops. The times of the origin and destination are the trip's
+// own and are changed with UpdateTrip. Each stop must be reached no earlier
+// than the one before it is left, and left no earlier than it is reached.
+// It returns sql.ErrNoRows if the trip does not exist.
+func SetTripStopTimes(tripID int64, times []TripStop) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stops, err := getTripStops(tx, tripID)
+	if err != nil {
+		return err
+	}
+	last := len(stops) - 1
+	for _, t := range times {
+		if t.Position <= 0 || t.Position >= last {
+			return fmt.Errorf("stop %d is not an intermediate stop of this trip", t.Position)
+		}
+		stops[t.Position].ArrivalTime = strings.TrimSpace(t.ArrivalTime)
+		stops[t.Position].DepartureTime = strings.TrimSpace(t.DepartureTime)
+	}
+
+	loc, err := tripLocation(tx, tripID)
+	if err != nil {
+		return err
+	}
+	previous, err := parseDeparture(stops[0].DepartureTime, loc)
+	if err != nil {
+		return err
+	}
+	for _, stop := range stops[1:] {
+		arrival, err := parseDeparture(stop.ArrivalTime, loc)
+		if err != nil {
+			return fmt.Errorf("invalid arrival time at %s", stop.Name)
+		}
+		if arrival.Before(previous) {
+			return fmt.Errorf("%s is reached before the previous stop is left", stop.Name)
+		}
+		if stop.Position == last {
+			break
+		}
+		departure, err := parseDeparture(stop.DepartureTime, loc)
+		if err != nil {
+			return fmt.Errorf("invalid departure time at %s", stop.Name)
+		}
+		if departure.Before(arrival) {
+			return fmt.Errorf("%s is left before it is reached", stop.Name)
+		}
+		previous = departure
+	}
+
+	for _, stop := range stops[1:last] {
+		arrival, _ := parseDeparture(stop.ArrivalTime, loc)
+		departure, _ := parseDeparture(stop.DepartureTime, loc)
+		if _, err := tx.Exec("UPDATE trip_stops SET arrival_time = ?, departure_time = ? WHERE trip_id = ? AND position = ?",
+			arrival.Format(departureLayouts[0]), departure.Format(departureLayouts[0]), tripID, stop.Position); err != nil {
+			return fmt.Errorf("error updating trip stop: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit trip stops: %w", err)
+	}
+	return nil
+}
+
+// stopPosition finds the stop of a trip at a station given by name or code,
+// looking from position from onwards first
+func stopPosition(q queryer, stops []TripStop, nameOrCode string, from int) (int, error) {
+	station, err := findStation(q, nameOrCode)
+	if err != nil {
+		return 0, err
+	}
+	found := -1
+	for _, stop := range stops {
+		if stop.StationID == station.ID || (stop.StationID == 0 && strings.EqualFold(stop.Name, station.Name)) {
+			if stop.Position >= from {
+				return stop.Position, nil
+			}
+			if found < 0 {
+				found = stop.Position
+			}
+		}
+	}
+	if found < 0 {
+		return 0, fmt.Errorf("%w: %s", ErrNotAStop, station.Name)
+	}
+	return found, nil
+}
+
+// tripSegment finds the segment of a trip between a boarding and an
+// alighting station, given by name or code. An empty boarding station is the
+// trip's origin and an empty alighting station the end of the trip. The
+// trip's stops are returned with the segment.
+func tripSegment(q queryer, tripID int64, boarding, alighting string) (Segment, []TripStop, error) {
+	stops, err := getTripStops(q, tripID)
+	if err != nil {
+		return Segment{}, nil, err
+	}
+	last := len(stops) - 1
+
+	seg := wholeTrip
+	if boarding = strings.TrimSpace(boarding); boarding != "" {
+		if seg.From, err = stopPosition(q, stops, boarding, 0); err != nil {
+			return Segment{}, nil, err
+		}
+	}
+	if alighting = strings.TrimSpace(alighting); alighting != "" {
+		if seg.To, err = stopPosition(q, stops, alighting, seg.From+1); err != nil {
+			return Segment{}, nil, err
+		}
+		if seg.To == last {
+			seg.To = tripEnd
+		}
+	}
+	if seg.From >= last || seg.To <= seg.From {
+		return Segment{}, nil, ErrInvalidSegment
+	}
+	return seg, stops, nil
+}
+
+// legLoads counts the active bookings of a trip on each of its legs, leg i
+// running from stop i to stop i+1
+func legLoads(q queryer, tripID int64, legs int) ([]int, error) {
+	rows, err := q.Query("SELECT boarding_stop, alighting_stop FROM bookings WHERE trip_id = ? AND status NOT IN "+releasedStatusesSQL, tripID)
+	if err != nil {
+		return nil, fmt.Errorf("error getting trip bookings: %w", err)
+	}
+	defer rows.Close()
+
+	loads := make([]int, legs)
+	for rows.Next() {
+		var from int
+		var to sql.NullInt64
+		if err := rows.Scan(&from, &to); err != nil {
+			return nil, fmt.Errorf("error scanning booking: %w", err)
+		}
+		seg := bookingSegment(from, to)
+		for leg := seg.From; leg < legs && leg < seg.To; leg++ {
+			loads[leg]++
+		}
+	}
+	return loads, rows.Err()
+}
+
+// TripLeg is the stretch of a trip between two consecutive stops and how
+// many of its seats are booked
+type TripLeg struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Booked    int    `json:"booked"`
+	Available int    `json:"available"`
+}
+
+// TripCapacity is the seat availability of a trip for a segment. Booked is
+// the most seats booked on any leg of the segment and Available the number of
+// seats free for the whole segment. Legs covers the whole trip.
+type TripCapacity struct {
+	Capacity  int       `json:"capacity"`
+	Boarding  string    `json:"boarding"`
+	Alighting string    `json:"alighting"`
+	Booked    int       `json:"booked"`
+	Available int       `json:"available"`
+	Legs      []TripLeg `json:"legs"`
+}
+
+// GetTripCapacity returns the seat availability of a trip between a boarding
+// and an alighting station, given by name or code; empty stations mean the
+// trip's ends. It returns sql.ErrNoRows if the trip does not exist.
+func GetTripCapacity(tripID int64, boarding, alighting string) (*TripCapacity, error) {
+	layout, err := tripSeatLayout(DB, tripID)
+	if err != nil {
+		return nil, err
+	}
+	seg, stops, err := tripSegment(DB, tripID, boarding, alighting)
+	if err != nil {
+		return nil, err
+	}
+
+	loads, err := legLoads(DB, tripID, len(stops)-1)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &TripCapacity{
+		Capacity:  layout.Capacity,
+		Boarding:  stops[seg.From].Name,
+		Alighting: stops[seg.last(stops)].Name,
+		Legs:      []TripLeg{},
+	}
+	for i, load := range loads {
+		leg := TripLeg{From: stops[i].Name, To: stops[i+1].Name, Booked: load}
+		leg.Available = layout.Capacity - leg.Booked
+		if leg.Available < 0 {
+			leg.Available = 0
+		}
+		if i >= seg.From && i < seg.To && leg.Booked > tc.Booked {
+			tc.Booked = leg.Booked
+		}
+		tc.Legs = append(tc.Legs, leg)
+	}
+
+	occupied, err := occupiedSeats(DB, tripID, seg)
+	if err != nil {
+		return nil, err
+	}
+	for _, seat := range layout.Seats() {
+		if _, taken := occupied[seat.Label]; !taken {
+			tc.Available++
+		}
+	}
+	return tc, nil
+}
+
+// migrateTripStops gives every trip on a route the stops of its route
+func migrateTripStops() error {
+	rows, err := DB.Query(`
+		SELECT id, route_id, departure_time, arrival_time FROM trips
+		WHERE route_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM trip_stops ts WHERE ts.trip_id = trips.id)
+	`)
+	if err != nil {
+		return fmt.Errorf("error retrieving trips: %w", err)
+	}
+	type trip struct {
+		id, routeID        int64
+		departure, arrival string
+	}
+	var trips []trip
+	for rows.Next() {
+		var t trip
+		if err := rows.Scan(&t.id, &t.routeID, &t.departure, &t.arrival); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning trip: %w", err)
+		}
+		trips = append(trips, t)
+	}
+	rows.Close()
+
+	routes := make(map[int64]*Route)
+	for _, t := range trips {
+		route, ok := routes[t.routeID]
+		if !ok {
+			if route, err = getRoute(DB, t.routeID); err != nil {
+				return err
+			}
+			routes[t.routeID] = route
+		}
+		if err := writeTripStops(DB, t.id, route, t.departure, t.arrival); err != nil {
+			log.Printf("Warning: Could not add stops to trip %d: %v", t.id, err)
+		}
+	}
+	log.Printf("Added stops to %d existing trips", len(trips))
+	return nil
+}
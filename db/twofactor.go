@@ -0,0 +1,226 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PendingTwoFactorTTL is how long a user has to enter their two-factor code
+// after their password has been accepted.
+const PendingTwoFactorTTL = 5 * time.Minute
+
+// GetTwoFactorSecret returns a user's TOTP secret and whether enrollment has
+// been confirmed. The secret is empty if the user never started enrollment.
+func GetTwoFactorSecret(userID int64) (string, bool, error) {
+	var secret sql.NullString
+	var enabled int
+	err := DB.QueryRow(
+		"SELECT totp_secret, COALESCE(totp_enabled, 0) FROM users WHERE id = ?", userID,
+	).Scan(&secret, &enabled)
+	if err != nil {
+		return "", false, fmt.Errorf("error retrieving two-factor settings for user ID %d: %w", userID, err)
+	}
+	plaintext, err := DecryptField(secret.String)
+	if err != nil {
+		return "", false, fmt.Errorf("error decrypting two-factor secret for user ID %d: %w", userID, err)
+	}
+	return plaintext, enabled == 1, nil
+}
+
+// SetPendingTwoFactorSecret stores a new, not yet confirmed TOTP secret for a user.
+func SetPendingTwoFactorSecret(userID int64, secret string) error {
+	encrypted, err := EncryptField(secret)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt two-factor secret: %w", err)
+	}
+	_, err = DB.Exec("UPDATE users SET totp_secret = ?, totp_enabled = 0, totp_last_step = NULL WHERE id = ?", encrypted, userID)
+	if err != nil {
+		return fmt.Errorf("error saving two-factor secret for user ID %d: %w", userID, err)
+	}
+	return nil
+}
+
+// EnableTwoFactor confirms a user's pending TOTP secret and replaces their
+// recovery codes with the given ones.
+func EnableTwoFactor(userID int64, recoveryCodes []string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET totp_enabled = 1 WHERE id = ?", userID); err != nil {
+		return fmt.Errorf("error enabling two-factor for user ID %d: %w", userID, err)
+	}
+	if err := replaceRecoveryCodes(tx, userID, recoveryCodes); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit two-factor enrollment: %w", err)
+	}
+	return nil
+}
+
+// DisableTwoFactor removes a user's TOTP secret and recovery codes.
+func DisableTwoFactor(userID int64) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last_step = NULL WHERE id = ?", userID); err != nil {
+		return fmt.Errorf("error disabling two-factor for user ID %d: %w", userID, err)
+	}
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("error deleting recovery codes for user ID %d: %w", userID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit two-factor removal: %w", err)
+	}
+	return nil
+}
+
+// UseTOTPStep records that a user's authenticator code for the given time
+// step has been accepted. It reports false if a code for that step or a later
+// one has already been accepted, so that each code works only once.
+func UseTOTPStep(userID, step int64) (bool, error) {
+	res, err := DB.Exec(
+		"UPDATE users SET totp_last_step = ? WHERE id = ? AND COALESCE(totp_last_step, -1) < ?", step, userID, step,
+	)
+	if err != nil {
+		return false, fmt.Errorf("error recording two-factor code for user ID %d: %w", userID, err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// hashRecoveryCode normalises a recovery code and hashes it for storage.
+// Recovery codes are 64-bit random values rather than user-chosen secrets,
+// so a fast hash is sufficient.
+func hashRecoveryCode(code string) string {
+	normalised := strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalised))
+	return hex.EncodeToString(sum[:])
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int64, codes []string) error {
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("error deleting recovery codes for user ID %d: %w", userID, err)
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec(
+			"INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashRecoveryCode(code),
+		); err != nil {
+			return fmt.Errorf("error saving recovery code for user ID %d: %w", userID, err)
+		}
+	}
+	return nil
+}
+
+// ReplaceRecoveryCodes discards a user's recovery codes and stores new ones.
+func ReplaceRecoveryCodes(userID int64, codes []string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, userID, codes); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit recovery codes: %w", err)
+	}
+	return nil
+}
+
+// UseRecoveryCode marks a matching unused recovery code as used. It reports
+// whether the code was valid.
+func UseRecoveryCode(userID int64, code string) (bool, error) {
+	res, err := DB.Exec(`
+		UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, fmt.Errorf("error checking recovery code for user ID %d: %w", userID, err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left.
+func CountRecoveryCodes(userID int64) (int, error) {
+	var count int
+	err := DB.QueryRow(
+		"SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID,
+	).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting recovery codes for user ID %d: %w", userID, err)
+	}
+	return count, nil
+}
+
+// IsTwoFactorRequired reports whether the policy requires two-factor
+// authentication for the given role.
+func IsTwoFactorRequired(role string) (bool, error) {
+	var required int
+	err := DB.QueryRow("SELECT required FROM two_factor_policy WHERE role = ? COLLATE NOCASE", role).Scan(&required)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error checking two-factor policy for role %s: %w", role, err)
+	}
+	return required == 1, nil
+}
+
+// GetTwoFactorPolicy returns whether two-factor authentication is required
+// for each role, built-in or custom.
+func GetTwoFactorPolicy() (map[string]bool, error) {
+	rows, err := DB.Query(`
+		SELECT r.name, COALESCE(p.required, 0)
+		FROM roles r
+		LEFT JOIN two_factor_policy p ON p.role = r.name COLLATE NOCASE
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving two-factor policy: %w", err)
+	}
+	defer rows.Close()
+
+	policy := make(map[string]bool)
+	for rows.Next() {
+		var role string
+		var required int
+		if err := rows.Scan(&role, &required); err != nil {
+			return nil, fmt.Errorf("error reading two-factor policy: %w", err)
+		}
+		policy[role] = required == 1
+	}
+	return policy, rows.Err()
+}
+
+// SetTwoFactorRequired changes whether a role must use two-factor
+// authentication. It returns sql.ErrNoRows if there is no such role.
+func SetTwoFactorRequired(role string, required bool) error {
+	requiredInt := 0
+	if required {
+		requiredInt = 1
+	}
+	var name string
+	if err := DB.QueryRow("SELECT name FROM roles WHERE name = ? COLLATE NOCASE", role).Scan(&name); err != nil {
+		return err
+	}
+	_, err := DB.Exec(`
+		INSERT INTO two_factor_policy (role, required) VALUES (?, ?)
+		ON CONFLICT(role) DO UPDATE SET required = excluded.required
+	`, name, requiredInt)
+	if err != nil {
+		return fmt.Errorf("error updating two-factor policy for role %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestTwoFactorPolicyCoversCustomRoles(t *testing.T) {
+	openTestDB(t)
+	roleID, err := CreateRole("Auditor", "Reads the books", DashboardAccountant, []string{PermPaymentsView})
+	if err != nil {
+		t.Fatalf("CreateRole: %v", err)
+	}
+
+	policy, err := GetTwoFactorPolicy()
+	if err != nil {
+		t.Fatalf("GetTwoFactorPolicy: %v", err)
+	}
+	for _, role := range []string{RoleAdmin, "Operator", "Auditor"} {
+		if required, ok := policy[role]; !ok || required {
+			t.Errorf("policy[%s] = %v, %v; want listed and not required", role, required, ok)
+		}
+	}
+
+	if err := SetTwoFactorRequired("auditor", true); err != nil {
+		t.Fatalf("SetTwoFactorRequired: %v", err)
+	}
+	if required, err := IsTwoFactorRequired("Auditor"); err != nil || !required {
+		t.Errorf("IsTwoFactorRequired(Auditor) = %v, %v; want true", required, err)
+	}
+	if policy, _ := GetTwoFactorPolicy(); !policy["Auditor"] {
+		t.Errorf("policy = %v, want Auditor required", policy)
+	}
+
+	if err := SetTwoFactorRequired("Nobody", true); err != sql.ErrNoRows {
+		t.Errorf("SetTwoFactorRequired for an unknown role: error = %v, want sql.ErrNoRows", err)
+	}
+
+	// A role made later under the same name starts without the requirement
+	if err := DeleteRole(roleID); err != nil {
+		t.Fatalf("DeleteRole: %v", err)
+	}
+	if _, err := CreateRole("Auditor", "", DashboardAccountant, nil); err != nil {
+		t.Fatalf("CreateRole: %v", err)
+	}
+	if required, err := IsTwoFactorRequired("Auditor"); err != nil || required {
+		t.Errorf("IsTwoFactorRequired(Auditor) after re-creating = %v, %v; want false", required, err)
+	}
+}
@@ -0,0 +1,577 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"SecureSignIn/utils"
+)
+
+// WaitlistHold is how long a passenger promoted from the waitlist has to
+// confirm the seat held for them before it goes to the next in line.
+var WaitlistHold = utils.GetEnvDuration("WAITLIST_HOLD", 30*time.Minute)
+
+// Waitlist entry statuses. An entry waits until a seat frees up for its
+// segment, is then offered a Held booking, and ends up Booked once
+// confirmed or Expired if the hold runs out or the trip leaves without it.
+const (
+	WaitlistWaiting = "Waiting"
+	WaitlistOffered = "Offered"
+	WaitlistBooked  = "Booked"
+	WaitlistExpired = "Expired"
+	WaitlistRemoved = "Removed"
+)
+
+var (
+	// ErrSeatsAvailable is returned when waitlisting a passenger for a segment that still has free seats
+	ErrSeatsAvailable = errors.New("trip has free seats between these stops")
+	// ErrNotWaiting is returned when removing a waitlist entry that is already booked, expired or removed
+	ErrNotWaiting = errors.New("waitlist entry is no longer waiting")
+	// ErrNoOffer is returned when confirming a waitlist entry that has not been offered a seat
+	ErrNoOffer = errors.New("no seat has been offered to this waitlist entry")
+	// ErrHoldExpired is returned when confirming a waitlist offer or seat hold that has run out or been released
+	ErrHoldExpired = errors.New("the held seat has been released")
+)
+
+// WaitlistEntry is a passenger waiting for a seat on a trip. Boarding and
+// Alighting are the stations of the segment they want and DepartureTime is
+// when the trip leaves the boarding stop. Position is their place in line
+// while waiting: entries with a higher priority go first, then the earliest.
+type WaitlistEntry struct {
+	ID            int64      `json:"id"`
+	TripID        int64      `json:"trip_id"`
+	Passenger     string     `json:"passenger"`
+	PhoneNumber   string     `json:"phone_number"`
+	Boarding      string     `json:"boarding"`
+	Alighting     string     `json:"alighting"`
+	DepartureTime string     `json:"departure_time"`
+	Priority      int        `json:"priority"`
+	Status        string     `json:"status"`
+	Position      int        `json:"position,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	CreatedBy     string     `json:"created_by"`
+	OfferedAt     *time.Time `json:"offered_at"`
+	HoldExpiresAt *time.Time `json:"hold_expires_at"`
+	BookingID     int64      `json:"booking_id,omitempty"`
+	Reference     string     `json:"reference,omitempty"`
+	SeatNumber    string     `json:"seat_number,omitempty"`
+}
+
+// WaitlistOffer is a seat held for a waitlisted passenger: a Held booking
+// that must be confirmed before HoldExpiresAt.
+type WaitlistOffer struct {
+	EntryID       int64     `json:"entry_id"`
+	TripID        int64     `json:"trip_id"`
+	BookingID     int64     `json:"booking_id"`
+	Passenger     string    `json:"passenger"`
+	SeatNumber    string    `json:"seat_number"`
+	HoldExpiresAt time.Time `json:"hold_expires_at"`
+}
+
+// AddToWaitlist puts a passenger on the waitlist of a trip for the segment
+// between the boarding and alighting stations of the request, and returns the
+// new entry's ID and place in line. Seat and status of the request are
+// ignored. It returns ErrSeatsAvailable if the segment can be booked now.
+func AddToWaitlist(b BookingRequest, priority int, createdBy string) (id int64, position int, err error) {
+	if b.TripID == 0 || strings.TrimSpace(b.Passenger) == "" {
+		return 0, 0, fmt.Errorf("trip ID and passenger name are required")
+	}
+	encSocialID, err := EncryptField(b.SocialID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to encrypt social ID: %w", err)
+	}
+	encDOB, err := EncryptField(b.DateOfBirth)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to encrypt date of birth: %w", err)
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	seg, _, err := tripSegment(tx, b.TripID, b.Boarding, b.Alighting)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, 0, fmt.Errorf("trip not found")
+		}
+		return 0, 0, err
+	}
+	if _, err := reserveSeat(tx, b.TripID, seg, ""); err == nil {
+		return 0, 0, ErrSeatsAvailable
+	} else if !errors.Is(err, ErrTripFull) {
+		return 0, 0, err
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO waitlist (trip_id, passenger, social_id, phone_number, date_of_birth, boarding_stop, alighting_stop,
+			priority, status, created_at, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, b.TripID, strings.TrimSpace(b.Passenger), encSocialID, b.PhoneNumber, encDOB, seg.From, seg.alightingStop(),
+		priority, WaitlistWaiting, sqlTime(time.Now()), createdBy)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to add to waitlist: %w", err)
+	}
+	if id, err = res.LastInsertId(); err != nil {
+		return 0, 0, fmt.Errorf("failed to retrieve waitlist entry id: %w", err)
+	}
+	err = tx.QueryRow(`
+		SELECT COUNT(*) FROM waitlist
+		WHERE trip_id = ? AND status = ? AND (priority > ? OR (priority = ? AND id <= ?))
+	`, b.TripID, WaitlistWaiting, priority, priority, id).Scan(&position)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error getting waitlist position: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, fmt.Errorf("failed to add to waitlist: %w", err)
+	}
+	return id, position, nil
+}
+
+// GetWaitlist returns the waitlist of a trip, entries still waiting or on
+// offer first in the order they are served. If tripID is 0 it returns the
+// entries of every trip that are still waiting or on offer, by departure.
+func GetWaitlist(tripID int64) ([]WaitlistEntry, error) {
+	query := `
+		SELECT b.id, b.trip_id, b.passenger, b.phone_number, ` + boardingStationSQL + `, ` + alightingStationSQL + `,
+			` + boardingTimeSQL + `, b.priority, b.status, b.created_at, COALESCE(b.created_by, ''), b.offered_at,
+			b.hold_expires_at, COALESCE(b.booking_id, 0), COALESCE(bk.reference, ''), COALESCE(bk.seat_number, '')
+		FROM waitlist b
+		JOIN trips t ON b.trip_id = t.id
+		LEFT JOIN bookings bk ON b.booking_id = bk.id`
+	var args []interface{}
+	if tripID != 0 {
+		query += " WHERE b.trip_id = ?"
+		args = append(args, tripID)
+	} else {
+		query += " WHERE b.status IN (?, ?)"
+		args = append(args, WaitlistWaiting, WaitlistOffered)
+	}
+	query += `
+		ORDER BY t.departure_time, b.trip_id,
+			CASE b.status WHEN 'Offered' THEN 0 WHEN 'Waiting' THEN 1 ELSE 2 END,
+			b.priority DESC, b.created_at, b.id`
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving waitlist: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []WaitlistEntry{}
+	positions := map[int64]int{}
+	for rows.Next() {
+		var e WaitlistEntry
+		var offeredAt, holdExpiresAt sql.NullTime
+		err := rows.Scan(&e.ID, &e.TripID, &e.Passenger, &e.PhoneNumber, &e.Boarding, &e.Alighting, &e.DepartureTime,
+			&e.Priority, &e.Status, &e.CreatedAt, &e.CreatedBy, &offeredAt, &holdExpiresAt, &e.BookingID, &e.Reference, &e.SeatNumber)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning waitlist entry: %w", err)
+		}
+		if offeredAt.Valid {
+			e.OfferedAt = &offeredAt.Time
+		}
+		if holdExpiresAt.Valid {
+			e.HoldExpiresAt = &holdExpiresAt.Time
+		}
+		if e.Status == WaitlistWaiting {
+			positions[e.TripID]++
+			e.Position = positions[e.TripID]
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// promoteWaitlist offers the seats free on a trip to its waitlist within a
+// write transaction. Waiting entries are served in order, each getting a
+// Held booking that expires after WaitlistHold if a seat is free for its
+// segment; entries that do not fit are passed over for later ones that do.
+// ExpireHolds releases the booking if it is not confirmed in time.
+func promoteWaitlist(tx *sql.Tx, tripID int64, now time.Time) ([]WaitlistOffer, error) {
+	rows, err := tx.Query(`
+		SELECT id, passenger, social_id, phone_number, date_of_birth, boarding_stop, alighting_stop
+		FROM waitlist
+		WHERE trip_id = ? AND status = ?
+		ORDER BY priority DESC, created_at, id
+	`, tripID, WaitlistWaiting)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving waitlist of trip %d: %w", tripID, err)
+	}
+	type waiting struct {
+		id      int64
+		booking BookingRequest
+		seg     Segment
+	}
+	var queue []waiting
+	for rows.Next() {
+		w := waiting{booking: BookingRequest{TripID: tripID, Status: BookingHeld, ActorUsername: "waitlist"}}
+		var boarding int
+		var alighting sql.NullInt64
+		err := rows.Scan(&w.id, &w.booking.Passenger, &w.booking.SocialID, &w.booking.PhoneNumber, &w.booking.DateOfBirth, &boarding, &alighting)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning waitlist entry: %w", err)
+		}
+		w.seg = bookingSegment(boarding, alighting)
+		queue = append(queue, w)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(queue) == 0 {
+		return nil, nil
+	}
+
+	stops, err := getTripStops(tx, tripID)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := tripLocation(tx, tripID)
+	if err != nil {
+		return nil, err
+	}
+	var offers []WaitlistOffer
+	for _, w := range queue {
+		// Skip segments the trip no longer has or has already left
+		if w.seg.From >= w.seg.last(stops) {
+			continue
+		}
+		if departure, err := parseDeparture(stops[w.seg.From].DepartureTime, loc); err != nil || !departure.After(now) {
+			continue
+		}
+		if err := DecryptFields(&w.booking.SocialID, &w.booking.DateOfBirth); err != nil {
+			return nil, fmt.Errorf("failed to decrypt waitlist entry %d: %w", w.id, err)
+		}
+
+		booking, err := insertBooking(tx, w.booking, w.seg, stops)
+		if errors.Is(err, ErrTripFull) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		offer := WaitlistOffer{EntryID: w.id, TripID: tripID, BookingID: booking.ID, Passenger: w.booking.Passenger,
+			SeatNumber: booking.SeatNumber, HoldExpiresAt: now.Add(WaitlistHold)}
+		if _, err := tx.Exec("UPDATE bookings SET hold_expires_at = ? WHERE id = ?", sqlTime(offer.HoldExpiresAt), booking.ID); err != nil {
+			return nil, fmt.Errorf("error setting waitlist hold: %w", err)
+		}
+		_, err = tx.Exec(`
+			UPDATE waitlist SET status = ?, offered_at = ?, hold_expires_at = ?, booking_id = ?
+			WHERE id = ?
+		`, WaitlistOffered, sqlTime(now), sqlTime(offer.HoldExpiresAt), booking.ID, w.id)
+		if err != nil {
+			return nil, fmt.Errorf("error offering seat to waitlist entry %d: %w", w.id, err)
+		}
+		offers = append(offers, offer)
+	}
+	return offers, nil
+}
+
+// offeredEntry is a waitlist entry on offer together with the booking held for it
+type offeredEntry struct {
+	id            int64
+	tripID        int64
+	bookingID     sql.NullInt64
+	bookingStatus sql.NullString
+	holdExpiresAt time.Time
+}
+
+func getOfferedEntry(q queryer, entryID int64) (*offeredEntry, string, error) {
+	e := &offeredEntry{id: entryID}
+	var status string
+	var holdExpiresAt sql.NullTime
+	err := q.QueryRow(`
+		SELECT w.trip_id, w.status, w.booking_id, bk.status, bk.hold_expires_at
+		FROM waitlist w
+		LEFT JOIN bookings bk ON w.booking_id = bk.id
+		WHERE w.id = ?
+	`, entryID).Scan(&e.tripID, &status, &e.bookingID, &e.bookingStatus, &holdExpiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", err
+		}
+		return nil, "", fmt.Errorf("error retrieving waitlist entry %d: %w", entryID, err)
+	}
+	e.holdExpiresAt = holdExpiresAt.Time
+	return e, status, nil
+}
+
+// taken reports whether the booking offered to an entry went ahead
+func (e *offeredEntry) taken() bool {
+	return e.bookingStatus.Valid && e.bookingStatus.String != BookingHeld && !isReleased(e.bookingStatus.String)
+}
+
+// settle ends an entry on offer whose booking is no longer held: Booked if
+// the booking went ahead, Expired if it was cancelled or deleted. held is
+// true if the booking is still Held and nothing was changed.
+func (e *offeredEntry) settle(tx *sql.Tx) (held bool, err error) {
+	if e.bookingStatus.String == BookingHeld {
+		return true, nil
+	}
+	status := WaitlistExpired
+	if e.taken() {
+		status = WaitlistBooked
+	}
+	if _, err := tx.Exec("UPDATE waitlist SET status = ? WHERE id = ?", status, e.id); err != nil {
+		return false, fmt.Errorf("error updating waitlist entry %d: %w", e.id, err)
+	}
+	return false, nil
+}
+
+// release cancels the booking held for an entry on offer with a full refund
+// of anything paid, and gives the entry the given status
+func (e *offeredEntry) release(tx *sql.Tx, status, reason string, cashierID int64, cashierUsername string, now time.Time) error {
+	full := 100
+	_, err := cancelBooking(tx, CancelRequest{
+		BookingID:       e.bookingID.Int64,
+		OverridePercent: &full,
+		Reason:          reason,
+		CashierID:       cashierID,
+		CashierUsername: cashierUsername,
+	}, now)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE waitlist SET status = ? WHERE id = ?", status, e.id); err != nil {
+		return fmt.Errorf("error updating waitlist entry %d: %w", e.id, err)
+	}
+	return nil
+}
+
+// ConfirmWaitlistOffer confirms the booking held for a waitlist entry and
+// returns its ID. It returns sql.ErrNoRows if there is no such entry,
+// ErrHoldExpired if its hold has run out or the booking has been cancelled,
+// and ErrNoOffer if the entry is not on offer for any other reason.
+func ConfirmWaitlistOffer(entryID, actorID int64, actorUsername string) (int64, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	e, status, err := getOfferedEntry(tx, entryID)
+	if err != nil {
+		return 0, err
+	}
+	switch status {
+	case WaitlistOffered:
+	case WaitlistExpired:
+		return 0, ErrHoldExpired
+	default:
+		return 0, ErrNoOffer
+	}
+	held, err := e.settle(tx)
+	if err != nil {
+		return 0, err
+	}
+	if !held {
+		if err := tx.Commit(); err != nil {
+			return 0, fmt.Errorf("error updating waitlist entry %d: %w", entryID, err)
+		}
+		// A booking confirmed directly has still been taken up
+		if e.taken() {
+			return e.bookingID.Int64, nil
+		}
+		return 0, ErrHoldExpired
+	}
+	if !time.Now().Before(e.holdExpiresAt) {
+		return 0, ErrHoldExpired
+	}
+
+	if _, err := setBookingStatus(tx, e.bookingID.Int64, BookingConfirmed, actorID, actorUsername, "Waitlist offer confirmed", time.Now()); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE waitlist SET status = ? WHERE id = ?", WaitlistBooked, entryID); err != nil {
+		return 0, fmt.Errorf("error updating waitlist entry %d: %w", entryID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("error confirming waitlist offer: %w", err)
+	}
+	return e.bookingID.Int64, nil
+}
+
+// RemoveFromWaitlist takes a passenger off a trip's waitlist. If a seat was
+// on offer to them its booking is cancelled and the seat offered to the next
+// in line; released is the cancelled booking's ID, or 0. It returns
+// sql.ErrNoRows if there is no such entry and ErrNotWaiting if it has already
+// been booked, expired or removed.
+func RemoveFromWaitlist(entryID, cashierID int64, cashierUsername string) (released int64, offers []WaitlistOffer, err error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	e, status, err := getOfferedEntry(tx, entryID)
+	if err != nil {
+		return 0, nil, err
+	}
+	now := time.Now()
+	switch status {
+	case WaitlistWaiting:
+		if _, err := tx.Exec("UPDATE waitlist SET status = ? WHERE id = ?", WaitlistRemoved, entryID); err != nil {
+			return 0, nil, fmt.Errorf("error removing waitlist entry %d: %w", entryID, err)
+		}
+	case WaitlistOffered:
+		held, err := e.settle(tx)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !held {
+			if err := tx.Commit(); err != nil {
+				return 0, nil, fmt.Errorf("error updating waitlist entry %d: %w", entryID, err)
+			}
+			return 0, nil, ErrNotWaiting
+		}
+		if err := e.release(tx, WaitlistRemoved, "Waitlist offer withdrawn", cashierID, cashierUsername, now); err != nil {
+			return 0, nil, err
+		}
+		released = e.bookingID.Int64
+		if offers, err = promoteWaitlist(tx, e.tripID, now); err != nil {
+			return 0, nil, err
+		}
+	default:
+		return 0, nil, ErrNotWaiting
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, nil, fmt.Errorf("error removing waitlist entry %d: %w", entryID, err)
+	}
+	return released, offers, nil
+}
+
+// ExpireWaitlist ends the waitlist entries whose time is up: entries whose
+// offered booking was confirmed, cancelled or deleted directly are settled,
+// with any seat freed offered to the next in line, and passengers still
+// waiting when their trip leaves the boarding stop are expired. Offers past
+// their hold are released by ExpireHolds. The changes are recorded in the
+// audit log as made by the system. It returns the new offers made.
+func ExpireWaitlist() (offers []WaitlistOffer, err error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	rows, err := tx.Query("SELECT id FROM waitlist WHERE status = ?", WaitlistOffered)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving waitlist offers: %w", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning waitlist offer: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var changes []systemChange
+	freed := map[int64]bool{}
+	for _, id := range ids {
+		e, _, err := getOfferedEntry(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		change, err := updateChange(tx, AuditWaitlist, id)
+		if err != nil {
+			return nil, err
+		}
+		held, err := e.settle(tx)
+		if err != nil {
+			return nil, err
+		}
+		if !held {
+			changes = append(changes, change)
+			freed[e.tripID] = true
+		}
+	}
+	for tripID := range freed {
+		promoted, err := promoteWaitlist(tx, tripID, now)
+		if err != nil {
+			return nil, err
+		}
+		offers = append(offers, promoted...)
+	}
+
+	nowSQL, nowArgs, err := stationNowSQL(tx, "t.origin", now)
+	if err != nil {
+		return nil, err
+	}
+	departed := `b.status = ?
+		  AND EXISTS (SELECT 1 FROM trips t WHERE t.id = b.trip_id AND ` + boardingTimeSQL + ` <= ` + nowSQL + `)`
+	rows, err = tx.Query("SELECT b.id FROM waitlist b WHERE "+departed, append([]interface{}{WaitlistWaiting}, nowArgs...)...)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving waitlist entries of departed trips: %w", err)
+	}
+	ids = ids[:0]
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("error scanning waitlist entry: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		change, err := updateChange(tx, AuditWaitlist, id)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	_, err = tx.Exec("UPDATE waitlist AS b SET status = ? WHERE "+departed, append([]interface{}{WaitlistExpired, WaitlistWaiting}, nowArgs...)...)
+	if err != nil {
+		return nil, fmt.Errorf("error expiring waitlist entries: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("error expiring waitlist: %w", err)
+	}
+	auditSystemChanges(append(changes, offerChanges(offers)...))
+	return offers, nil
+}
+
+// ScheduleWaitlistCheck runs ExpireWaitlist now and then at the given interval
+func ScheduleWaitlistCheck(interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	check := func() {
+		offers, err := ExpireWaitlist()
+		if err != nil {
+			log.Printf("Warning: Failed to check waitlist: %v", err)
+			return
+		}
+		for _, o := range offers {
+			log.Printf("Offered seat %s on trip %d to waitlisted passenger %s (booking %d, hold until %s)",
+				o.SeatNumber, o.TripID, o.Passenger, o.BookingID, o.HoldExpiresAt.Format(departureLayouts[0]))
+		}
+	}
+	check()
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			check()
+		}
+	}()
+
+	log.Printf("Waitlist check scheduled every %s", interval)
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+// addTestWaitlist waitlists a passenger for a segment of a trip; empty
+// stations mean the whole trip
+func addTestWaitlist(t *testing.T, tripID int64, n, priority int, boarding, alighting string) int64 {
+	t.Helper()
+	b := testBooking(tripID, n)
+	b.Boarding, b.Alighting = boarding, alighting
+	id, _, err := AddToWaitlist(b, priority, "test")
+	if err != nil {
+		t.Fatalf("AddToWaitlist: %v", err)
+	}
+	return id
+}
+
+func waitlistStatus(t *testing.T, entryID int64) string {
+	t.Helper()
+	var status string
+	if err := DB.QueryRow("SELECT status FROM waitlist WHERE id = ?", entryID).Scan(&status); err != nil {
+		t.Fatalf("reading waitlist status: %v", err)
+	}
+	return status
+}
+
+// offeredTo checks that exactly one seat was offered, to the given entry, and
+// returns the held booking
+func offeredTo(t *testing.T, offers []WaitlistOffer, entryID int64) int64 {
+	t.Helper()
+	if len(offers) != 1 || offers[0].EntryID != entryID {
+		t.Fatalf("offers = %+v, want one to entry %d", offers, entryID)
+	}
+	if got := bookingStatus(t, offers[0].BookingID); got != BookingHeld {
+		t.Errorf("offered booking is %s, want Held", got)
+	}
+	if got := waitlistStatus(t, entryID); got != WaitlistOffered {
+		t.Errorf("entry %d is %s, want Offered", entryID, got)
+	}
+	return offers[0].BookingID
+}
+
+// TestWaitlistPromotionOrder frees the only seat of a trip three times and
+// checks it goes to the highest priority first, then to the earliest entry
+func TestWaitlistPromotionOrder(t *testing.T) {
+	openTestDB(t)
+	tripID := addTestTrip(t, 1)
+	booked := addTestBooking(t, tripID, 1)
+
+	first := addTestWaitlist(t, tripID, 2, 0, "", "")
+	urgent := addTestWaitlist(t, tripID, 3, 5, "", "")
+	second := addTestWaitlist(t, tripID, 4, 0, "", "")
+
+	_, offers, err := CancelBooking(CancelRequest{BookingID: booked, CashierUsername: "test"})
+	if err != nil {
+		t.Fatalf("CancelBooking: %v", err)
+	}
+	held := offeredTo(t, offers, urgent)
+	if got := waitlistStatus(t, first); got != WaitlistWaiting {
+		t.Errorf("earlier entry is %s, want still Waiting", got)
+	}
+
+	offers, err = ReleaseHold(held, 0, "test")
+	if err != nil {
+		t.Fatalf("ReleaseHold: %v", err)
+	}
+	held = offeredTo(t, offers, first)
+
+	offers, err = ReleaseHold(held, 0, "test")
+	if err != nil {
+		t.Fatalf("ReleaseHold: %v", err)
+	}
+	offeredTo(t, offers, second)
+}
+
+// TestWaitlistPromotionSkipsSegmentsThatDoNotFit frees the second leg of a
+// trip and checks that the passenger waiting for the whole trip is passed
+// over for the one waiting for that leg alone
+func TestWaitlistPromotionSkipsSegmentsThatDoNotFit(t *testing.T) {
+	openTestDB(t)
+	tripID := addTestTripVia(t, 1, "THR", "QOM", "IFN")
+
+	firstLeg := testBooking(tripID, 1)
+	firstLeg.Boarding, firstLeg.Alighting = "THR", "QOM"
+	if _, err := AddBooking(firstLeg); err != nil {
+		t.Fatalf("AddBooking: %v", err)
+	}
+	secondLeg := testBooking(tripID, 2)
+	secondLeg.Boarding, secondLeg.Alighting = "QOM", "IFN"
+	booked, err := AddBooking(secondLeg)
+	if err != nil {
+		t.Fatalf("AddBooking: %v", err)
+	}
+
+	wholeTrip := addTestWaitlist(t, tripID, 3, 5, "", "")
+	fromQom := addTestWaitlist(t, tripID, 4, 0, "QOM", "IFN")
+
+	_, offers, err := CancelBooking(CancelRequest{BookingID: booked.ID, CashierUsername: "test"})
+	if err != nil {
+		t.Fatalf("CancelBooking: %v", err)
+	}
+	offeredTo(t, offers, fromQom)
+	if got := waitlistStatus(t, wholeTrip); got != WaitlistWaiting {
+		t.Errorf("entry for the whole trip is %s, want still Waiting", got)
+	}
+}
+
+// TestFreedSeatsGoToTheWaitlistFirst checks that a seat freed by cancelling
+// or deleting a booking is held for the waitlist before anyone else can book it
+func TestFreedSeatsGoToTheWaitlistFirst(t *testing.T) {
+	tests := []struct {
+		name string
+		free func(t *testing.T, bookingID int64) []WaitlistOffer
+	}{
+		{"cancel", func(t *testing.T, id int64) []WaitlistOffer {
+			_, offers, err := CancelBooking(CancelRequest{BookingID: id, CashierUsername: "test"})
+			if err != nil {
+				t.Fatalf("CancelBooking: %v", err)
+			}
+			return offers
+		}},
+		{"delete", func(t *testing.T, id int64) []WaitlistOffer {
+			offers, err := DeleteBooking(id)
+			if err != nil {
+				t.Fatalf("DeleteBooking: %v", err)
+			}
+			return offers
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDB(t)
+			tripID := addTestTrip(t, 1)
+			booked := addTestBooking(t, tripID, 1)
+			entry := addTestWaitlist(t, tripID, 2, 0, "", "")
+
+			offeredTo(t, tt.free(t, booked), entry)
+			if _, err := AddBooking(testBooking(tripID, 3)); !errors.Is(err, ErrTripFull) {
+				t.Errorf("booking the freed seat: error = %v, want ErrTripFull", err)
+			}
+		})
+	}
+}
+
+func TestDeleteBookingWithPaymentsIsRefused(t *testing.T) {
+	openTestDB(t)
+	tripID := addTestTrip(t, 1)
+	booked := addTestBooking(t, tripID, 1)
+	entry := addTestWaitlist(t, tripID, 2, 0, "", "")
+	if _, err := RecordPayment(booked, 1000, PaymentCash, 0, "test", ""); err != nil {
+		t.Fatalf("RecordPayment: %v", err)
+	}
+
+	if _, err := DeleteBooking(booked); !errors.Is(err, ErrBookingHasPayments) {
+		t.Fatalf("DeleteBooking error = %v, want ErrBookingHasPayments", err)
+	}
+	if got := waitlistStatus(t, entry); got != WaitlistWaiting {
+		t.Errorf("entry is %s, want still Waiting", got)
+	}
+}
@@ -97,8 +97,11 @@ create_db_setup_scripts() {
 # Set paths
 APP_CONFIG_DIR="$HOME/.config/secure-sign-in-app"
 USER_HOME_DIR="$HOME/.securesignin"
-DB_PATH="$USER_HOME_DIR/securesignin.db"
-KEY_PATH="$USER_HOME_DIR/encryption.key"
+DB_PATH="${SQLITE_DB_PATH:-$USER_HOME_DIR/securesignin.db}"
+export ENCRYPTION_KEY_PATH="${ENCRYPTION_KEY_PATH:-$USER_HOME_DIR/encryption.key}"
+KEY_PATH="$ENCRYPTION_KEY_PATH"
+# The app generates the ticket signing key on first start
+export TICKET_KEY_PATH="${TICKET_KEY_PATH:-$USER_HOME_DIR/ticket.key}"
 
 # Create all necessary directories
 echo "Creating application directories..."
@@ -112,14 +115,21 @@ chmod 755 "$APP_CONFIG_DIR"
 chmod 755 "$USER_HOME_DIR"
 chmod 755 "$APP_CONFIG_DIR/backups"
 
-# Check for existing encryption key
+# Create the encryption key for a new database. An existing database needs
+# the key its data was encrypted with, so a missing key is never replaced.
 if [ ! -f "$KEY_PATH" ]; then
-  echo "No encryption key found, creating placeholder (app will generate the proper key)"
-  dd if=/dev/urandom bs=1 count=32 of="$KEY_PATH" 2>/dev/null
-  chmod 600 "$KEY_PATH"
+  if [ -f "$DB_PATH" ]; then
+    echo "Warning: No encryption key at $KEY_PATH for the database at $DB_PATH."
+    echo "Restore the key from a backup, or set ENCRYPTION_KEY_PATH to where it is."
+  else
+    echo "No encryption key found, creating one at $KEY_PATH"
+    (umask 077 && head -c 32 /dev/urandom > "$KEY_PATH")
+  fi
 fi
 
 echo "Database setup complete. Your database will be stored at: $DB_PATH"
+echo "Encryption key: $KEY_PATH (back it up with the database)"
+echo "Ticket signing key: $TICKET_KEY_PATH (back it up with the database)"
 EOF
   chmod +x ../scripts/linux-db-setup.sh
   
@@ -133,8 +143,11 @@ echo === Secure Sign In Database Setup ===
 :: Set paths
 set "APP_CONFIG_DIR=%USERPROFILE%\.config\secure-sign-in-app"
 set "USER_HOME_DIR=%USERPROFILE%\.securesignin"
-set "DB_PATH=%USER_HOME_DIR%\securesignin.db"
-set "KEY_PATH=%USER_HOME_DIR%\encryption.key"
+if defined SQLITE_DB_PATH (set "DB_PATH=%SQLITE_DB_PATH%") else (set "DB_PATH=%USER_HOME_DIR%\securesignin.db")
+if not defined ENCRYPTION_KEY_PATH set "ENCRYPTION_KEY_PATH=%USER_HOME_DIR%\encryption.key"
+set "KEY_PATH=%ENCRYPTION_KEY_PATH%"
+:: The app generates the ticket signing key on first start
+if not defined TICKET_KEY_PATH set "TICKET_KEY_PATH=%USER_HOME_DIR%\ticket.key"
 
 :: Create all necessary directories
 echo Creating application directories...
@@ -142,17 +155,26 @@ if not exist "%APP_CONFIG_DIR%" mkdir "%APP_CONFIG_DIR%"
 if not exist "%USER_HOME_DIR%" mkdir "%USER_HOME_DIR%"
 if not exist "%APP_CONFIG_DIR%\backups" mkdir "%APP_CONFIG_DIR%\backups"
 
-:: Check for existing encryption key
+:: Create the encryption key for a new database: 32 random bytes, as the app
+:: reads it. An existing database needs the key its data was encrypted with,
+:: so a missing key is never replaced.
 if not exist "%KEY_PATH%" (
-  echo No encryption key found, creating placeholder for app to use
-  certutil -f -encodehex NUL "%KEY_PATH%" 32 >nul 2>&1
-  if errorlevel 1 (
-    echo Failed to create key file. Please run as administrator.
-    exit /b 1
+  if exist "%DB_PATH%" (
+    echo Warning: No encryption key at %KEY_PATH% for the database at %DB_PATH%.
+    echo Restore the key from a backup, or set ENCRYPTION_KEY_PATH to where it is.
+  ) else (
+    echo No encryption key found, creating one at %KEY_PATH%
+    powershell -NoProfile -Command "$key = New-Object byte[] 32; [Security.Cryptography.RandomNumberGenerator]::Create().GetBytes($key); [IO.File]::WriteAllBytes($env:KEY_PATH, $key)" >nul 2>&1
+    if errorlevel 1 (
+      echo Failed to create key file. Please run as administrator.
+      exit /b 1
+    )
   )
 )
 
 echo Database setup complete. Your database will be stored at: %DB_PATH%
+echo Encryption key: %KEY_PATH% (back it up with the database)
+echo Ticket signing key: %TICKET_KEY_PATH% (back it up with the database)
 EOF
   
   # Create modified launch scripts
@@ -160,8 +182,10 @@ EOF
 #!/bin/bash
 # Run script for Secure Sign In application
 
-# Set correct database path
+# Set correct database and key paths
 export SQLITE_DB_PATH="$HOME/.securesignin/securesignin.db"
+export ENCRYPTION_KEY_PATH="${ENCRYPTION_KEY_PATH:-$HOME/.securesignin/encryption.key}"
+export TICKET_KEY_PATH="${TICKET_KEY_PATH:-$HOME/.securesignin/ticket.key}"
 
 # Run database setup script if it exists
 if [ -f "./scripts/linux-db-setup.sh" ]; then
@@ -185,8 +209,10 @@ EOF
 @echo off
 :: Run script for Secure Sign In application
 
-:: Set correct database path
+:: Set correct database and key paths
 set "SQLITE_DB_PATH=%USERPROFILE%\.securesignin\securesignin.db"
+if not defined ENCRYPTION_KEY_PATH set "ENCRYPTION_KEY_PATH=%USERPROFILE%\.securesignin\encryption.key"
+if not defined TICKET_KEY_PATH set "TICKET_KEY_PATH=%USERPROFILE%\.securesignin\ticket.key"
 
 :: Run database setup script if it exists
 if exist ".\scripts\windows-db-setup.bat" (
@@ -2,9 +2,9 @@ package main
 
 import (
 	"SecureSignIn/db"
+	"SecureSignIn/mailer"
 	"crypto/rand"
 	"database/sql"
-	"encoding/hex"
 	"fmt"
 	"html/template"
 	"log"
@@ -14,7 +14,6 @@ import (
 	"runtime/debug"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -128,77 +127,6 @@ type PageData struct {
 	SSN string
 }
 
-// --- Password Reset Token Store (In-Memory - Demo Only) ---
-type ResetTokenInfo struct {
-	UserID int
-	Expiry time.Time
-}
-
-var (
-	resetTokens = make(map[string]ResetTokenInfo)
-	tokenMutex  sync.RWMutex
-)
-
-const resetTokenValidity = 15 * time.Minute // Token valid for 15 minutes
-
-// generateResetToken creates a secure random token.
-func generateResetToken() (string, error) {
-	b := make([]byte, 16) // 128 bits
-	_, err := rand.Read(b)
-	if err != nil {
-		return "", err
-	}
-	return hex.EncodeToString(b), nil
-}
-
-// storeResetToken stores a token for a user.
-func storeResetToken(userID int) (string, error) {
-	token, err := generateResetToken()
-	if err != nil {
-		return "", fmt.Errorf("failed to generate reset token: %w", err)
-	}
-	tokenMutex.Lock()
-	defer tokenMutex.Unlock()
-	resetTokens[token] = ResetTokenInfo{
-		UserID: userID,
-		Expiry: time.Now().Add(resetTokenValidity),
-	}
-	log.Printf("Stored reset token for user ID %d (expires %v)", userID, resetTokens[token].Expiry)
-	return token, nil
-}
-
-// validateResetToken checks if a token is valid and returns the user ID.
-func validateResetToken(token string) (int, bool) {
-	tokenMutex.RLock()
-	defer tokenMutex.RUnlock()
-	info, exists := resetTokens[token]
-	valid := exists && !time.Now().After(info.Expiry)
-
-	if exists && !valid { // Token expired, remove it
-		tokenMutex.Lock()
-		delete(resetTokens, token)
-		tokenMutex.Unlock()
-		log.Printf("Reset token %s expired and removed.", token)
-	}
-
-	if valid {
-		log.Printf("Validated reset token %s for user ID %d.", token, info.UserID)
-	} else {
-		log.Printf("Reset token %s invalid or not found.", token)
-	}
-	return info.UserID, valid
-}
-
-// invalidateResetToken removes a token from the store.
-func invalidateResetToken(token string) {
-	tokenMutex.Lock()
-	defer tokenMutex.Unlock()
-	delete(resetTokens, token)
-	log.Printf("Invalidated reset token %s.", token)
-}
-
-// --- End Token Store ---
-
 // RegistrationForm represents the registration form data
 type RegistrationForm struct {
 	Username         string `form:"username"`
@@ -529,12 +457,7 @@ func forgotHandler(c echo.Context) error {
 
 		// If reset code is not provided, generate and send one
 		if resetCode == "" {
-			code := generateVerificationCode()
-			expiresAt := time.Now().Add(15 * time.Minute)
-
-			log.Printf("Debug - Generating new reset code '%s' for user ID %d", code, userID)
-
-			err = db.StoreResetCode(userID, code, expiresAt)
+			code, _, err := db.IssuePasswordReset(userID, false)
 			if err != nil {
 				log.Printf("Error storing reset code: %v", err)
 				return renderTemplate(c, "forgot.html", PageData{
@@ -545,19 +468,25 @@ func forgotHandler(c echo.Context) error {
 				})
 			}
 
-			// TODO: Send email with reset code
-			// For now, we'll just show it on screen for testing
+			if err := mailer.SendPasswordReset(storedEmail, username, code, "", db.ResetTokenTTL); err != nil {
+				log.Printf("Error sending reset code to user ID %d: %v", userID, err)
+				return renderTemplate(c, "forgot.html", PageData{
+					Title:      "Forgot Password",
+					Error:      "We could not send the reset email. Please try again later.",
+					ActivePage: "forgot",
+					Email:      email,
+				})
+			}
 			return renderTemplate(c, "forgot.html", PageData{
 				Title:      "Forgot Password",
-				Success:    fmt.Sprintf("Reset code sent to your email: %s (Code: %s)", email, code),
+				Success:    fmt.Sprintf("A reset code has been sent to %s", email),
 				ActivePage: "forgot",
 				Email:      email,
 			})
 		}
 
 		// Verify reset code and update password
-		log.Printf("Debug - Validating reset code '%s'", resetCode)
-		userID, err = db.ValidateResetCode(resetCode)
+		tokenID, err := db.VerifyResetCode(userID, resetCode)
 		if err != nil {
 			log.Printf("Debug - Reset code validation failed: %v", err)
 			return renderTemplate(c, "forgot.html", PageData{
@@ -592,21 +521,18 @@ func forgotHandler(c echo.Context) error {
 			})
 		}
 
-		// Hash new password
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
-		if err != nil {
-			log.Printf("Error hashing password: %v", err)
+		// Mark reset code as used and update password
+		if err := db.ConsumeResetToken(tokenID); err != nil {
+			log.Printf("Error using reset code: %v", err)
 			return renderTemplate(c, "forgot.html", PageData{
 				Title:      "Forgot Password",
-				Error:      "An error occurred. Please try again.",
+				Error:      "Invalid or expired reset code",
 				ActivePage: "forgot",
 				Email:      email,
-				Success:    "true", // Keep showing the reset code form
 			})
 		}
 
-		// Update password and mark reset code as used
-		err = db.UpdateUserPassword(int(userID), string(hashedPassword))
+		err = db.SetUserPassword(userID, newPassword)
 		if err != nil {
 			log.Printf("Error updating password: %v", err)
 			return renderTemplate(c, "forgot.html", PageData{
@@ -618,12 +544,6 @@ func forgotHandler(c echo.Context) error {
 			})
 		}
 
-		err = db.MarkResetCodeUsed(resetCode)
-		if err != nil {
-			log.Printf("Error marking reset code as used: %v", err)
-			// Non-critical error, continue
-		}
-
 		return c.Redirect(http.StatusSeeOther, "/login?success=Password reset successful. Please log in with your new password.")
 	}
 
@@ -635,73 +555,6 @@ func forgotHandler(c echo.Context) error {
 	})
 }
 
-// Show Reset Password Form handler
-func showResetFormHandler(c echo.Context) error {
-	token := c.Param("token")
-	userID, valid := validateResetToken(token)
-
-	if !valid {
-		log.Printf("Invalid or expired reset token presented: %s", token)
-		return c.Redirect(http.StatusSeeOther, "/forgot?error=Invalid or expired reset link.")
-	}
-
-	log.Printf("Showing password reset form for valid token %s (User ID: %d)", token, userID)
-	data := PageData{
-		Title:      "Reset Password",
-		ActivePage: "reset",
-		ResetToken: token,
-	}
-	return renderTemplate(c, "reset_password.html", data)
-}
-
-// Handle Reset Password Submission handler
-func handleResetPasswordHandler(c echo.Context) error {
-	token := c.Param("token")
-	newPassword := c.FormValue("password")
-	confirmPassword := c.FormValue("confirm_password")
-
-	userID, valid := validateResetToken(token)
-	if !valid {
-		log.Printf("Password reset attempt with invalid/expired token: %s", token)
-		return c.Redirect(http.StatusSeeOther, "/forgot?error=Invalid or expired reset link.")
-	}
-
-	if newPassword == "" || newPassword != confirmPassword {
-		log.Printf("Password reset failed for token %s: Passwords do not match or are empty.", token)
-		data := PageData{
-			Title:      "Reset Password",
-			Error:      "Passwords do not match or are empty.",
-			ResetToken: token,
-		}
-		return renderTemplate(c, "reset_password.html", data)
-	}
-	if len(newPassword) < 8 {
-		data := PageData{
-			Title:      "Reset Password",
-			Error:      "Password must be at least 8 characters long.",
-			ResetToken: token,
-		}
-		return renderTemplate(c, "reset_password.html", data)
-	}
-
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
-	if err != nil {
-		log.Printf("Error hashing new password for user ID %d: %v", userID, err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "Error processing password reset.")
-	}
-
-	err = db.UpdateUserPassword(userID, string(hashedPassword))
-	if err != nil {
-		log.Printf("Error updating password in DB for user ID %d: %v", userID, err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update password.")
-	}
-
-	invalidateResetToken(token)
-
-	log.Printf("Password successfully reset for user ID %d using token %s", userID, token)
-	return c.Redirect(http.StatusSeeOther, "/login?success=Password successfully reset. Please log in.")
-}
-
 // Health Check handler
 func healthCheckHandler(c echo.Context) error {
 	if err := db.DB.Ping(); err != nil {
@@ -1122,24 +975,8 @@ func securityQuestionResetHandler(c echo.Context) error {
 				})
 			}
 
-			// Hash new password
-			hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
-			if err != nil {
-				log.Printf("Error hashing password: %v", err)
-				return renderTemplate(c, "security_reset.html", PageData{
-					Title:            "Reset Password",
-					Error:            "An error occurred. Please try again.",
-					ActivePage:       "forgot",
-					Username:         username,
-					SecurityQuestion: question,
-					QuestionID:       questionIDInt,
-					UserID:           userIDInt,
-					HasSecurityQ:     true,
-				})
-			}
-
 			// Update password
-			err = db.UpdateUserPassword(int(userIDInt), string(hashedPassword))
+			err = db.SetUserPassword(userIDInt, newPassword)
 			if err != nil {
 				log.Printf("Error updating password: %v", err)
 				return renderTemplate(c, "security_reset.html", PageData{
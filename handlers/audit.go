@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"log"
+
+	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+)
+
+// Audit actions
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditDelete = "delete"
+
+	// AuditPasswordChange marks a password being set, which changes nothing
+	// the audit snapshot shows apart from the time of the change
+	AuditPasswordChange = "password_change"
+)
+
+// Audit records a data-changing action in the audit log, attributing it to the
+// logged in user (if any), the client IP and the request ID. before and after
+// are the entity's state around the change; pass nil for a side where the
+// entity did not exist. Failing to write the entry is logged but never fails
+// the request, since the change itself has already been made.
+func Audit(c echo.Context, action, entityType string, entityID int64, before, after interface{}) {
+	entry := db.AuditEntry{
+		ActorID:       GetLoggedInUserID(c),
+		ActorUsername: GetLoggedInUsername(c),
+		Action:        action,
+		EntityType:    entityType,
+		EntityID:      entityID,
+		IPAddress:     c.RealIP(),
+		RequestID:     c.Response().Header().Get(echo.HeaderXRequestID),
+	}
+	if err := db.RecordAudit(entry, before, after); err != nil {
+		log.Printf("Error writing audit entry for %s %s %d: %v", action, entityType, entityID, err)
+	}
+}
+
+// AuditSnapshot returns the audited state of an entity, or nil if it cannot be read
+func AuditSnapshot(entityType string, entityID int64) map[string]interface{} {
+	snapshot, err := db.Snapshot(entityType, entityID)
+	if err != nil {
+		log.Printf("Error taking audit snapshot: %v", err)
+	}
+	return snapshot
+}
@@ -2,7 +2,9 @@ package auth
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"strings"
 	"time"
@@ -11,6 +13,7 @@ import (
 	"golang.org/x/crypto/bcrypt"
 
 	"SecureSignIn/db"
+	"SecureSignIn/handlers"
 	"SecureSignIn/handlers/templates"
 	"SecureSignIn/models"
 )
@@ -107,65 +110,144 @@ func BasicAuthHandler(c echo.Context) error {
 		return templates.RenderTemplate(c, "login.html", data)
 	}
 
+	// Refuse to check the password while the account is locked out
+	lockedUntil, err := db.GetLockedUntil(userID)
+	if err != nil {
+		log.Printf("Error checking lockout for user ID %d: %v", userID, err)
+	} else if !lockedUntil.IsZero() {
+		log.Printf("Login refused for locked account: %s from %s", storedUsername, c.RealIP())
+		if err := db.LogLoginAttempt(userID, c.RealIP(), false); err != nil {
+			log.Printf("Warning: Failed to log login attempt for user ID %d: %v", userID, err)
+		}
+		data := models.PageData{
+			Title:      "Login",
+			Error:      lockoutMessage(lockedUntil),
+			Username:   usernameOrEmail, // Preserve the input
+			ActivePage: "login",
+		}
+		return templates.RenderTemplate(c, "login.html", data)
+	}
+
 	// Compare password
 	err = bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(password))
 	if err != nil {
 		// Log failed login attempt before returning error
 		log.Printf("Login failed for user: %s (Invalid Password) from %s", usernameOrEmail, c.RealIP())
+		errorMsg := "Invalid username/email or password"
+		lockedUntil, err := db.RecordFailedLogin(userID, c.RealIP())
+		if err != nil {
+			log.Printf("Warning: Failed to record failed login for user ID %d: %v", userID, err)
+		} else if !lockedUntil.IsZero() {
+			log.Printf("Account %s locked until %s after repeated failed logins", storedUsername, lockedUntil.Format(time.RFC3339))
+			errorMsg = lockoutMessage(lockedUntil)
+		}
 		data := models.PageData{
 			Title:      "Login",
-			Error:      "Invalid username/email or password",
+			Error:      errorMsg,
 			Username:   usernameOrEmail, // Preserve the input
 			ActivePage: "login",
 		}
 		return templates.RenderTemplate(c, "login.html", data)
 	}
 
-	log.Printf("User %s (ID: %d) logged in successfully from %s", storedUsername, userID, c.RealIP())
+	// Ask for the second factor before starting a real session
+	_, twoFactorEnabled, err := db.GetTwoFactorSecret(userID)
+	if err != nil {
+		log.Printf("Error checking two-factor status for user ID %d: %v", userID, err)
+		data := models.PageData{
+			Title:      "Login",
+			Error:      "An error occurred while signing you in. Please try again.",
+			Username:   usernameOrEmail, // Preserve the input
+			ActivePage: "login",
+		}
+		return templates.RenderTemplate(c, "login.html", data)
+	}
+	if twoFactorEnabled {
+		token, err := db.CreatePendingSession(userID, c.RealIP(), c.Request().UserAgent())
+		if err != nil {
+			log.Printf("Error creating pending session for user ID %d: %v", userID, err)
+			data := models.PageData{
+				Title:      "Login",
+				Error:      "An error occurred while signing you in. Please try again.",
+				Username:   usernameOrEmail, // Preserve the input
+				ActivePage: "login",
+			}
+			return templates.RenderTemplate(c, "login.html", data)
+		}
+		log.Printf("User %s (ID: %d) passed password check, awaiting two-factor code", storedUsername, userID)
+		handlers.SetPendingSessionCookie(c, token, time.Now().Add(db.PendingTwoFactorTTL))
+		return c.Redirect(http.StatusSeeOther, "/login/2fa")
+	}
+
+	return completeLogin(c, userID, storedUsername, usernameOrEmail)
+}
+
+// completeLogin records a successful login, starts the user's session and
+// sends them to the dashboard.
+func completeLogin(c echo.Context, userID int64, username, formUsername string) error {
+	log.Printf("User %s (ID: %d) logged in successfully from %s", username, userID, c.RealIP())
 	// Log successful login attempt
 	if err := db.LogLoginAttempt(userID, c.RealIP(), true); err != nil {
 		log.Printf("Warning: Failed to log successful login attempt for user ID %d: %v", userID, err)
 		// Continue with login even if logging fails
 	}
+	if err := db.ResetLoginFailures(userID); err != nil {
+		log.Printf("Warning: Failed to reset login failures for user ID %d: %v", userID, err)
+	}
 
-	// Set cookie to maintain session
-	cookie := new(http.Cookie)
-	cookie.Name = "username"
-	cookie.Value = storedUsername
-	cookie.Expires = time.Now().Add(24 * time.Hour) // Cookie expires in 24 hours
-	cookie.Path = "/"
-	c.SetCookie(cookie)
+	// Start a server-side session and hand the browser only its opaque token
+	token, err := db.CreateSession(userID, c.RealIP(), c.Request().UserAgent())
+	if err != nil {
+		log.Printf("Error creating session for user ID %d: %v", userID, err)
+		data := models.PageData{
+			Title:      "Login",
+			Error:      "An error occurred while signing you in. Please try again.",
+			Username:   formUsername, // Preserve the input
+			ActivePage: "login",
+		}
+		return templates.RenderTemplate(c, "login.html", data)
+	}
+	handlers.SetSessionCookie(c, token, time.Now().Add(db.SessionTTL))
 
-	// Set role cookie
-	roleCookie := new(http.Cookie)
-	roleCookie.Name = "user_role"
-	roleCookie.Value = storedRole
-	roleCookie.Expires = time.Now().Add(24 * time.Hour) // Cookie expires in 24 hours
-	roleCookie.Path = "/"
-	c.SetCookie(roleCookie)
+	return c.Redirect(http.StatusSeeOther, "/dashboard?success=Successfully logged in&user="+username)
+}
 
-	return c.Redirect(http.StatusSeeOther, "/dashboard?success=Successfully logged in&user="+storedUsername)
+// lockoutMessage tells a locked out user how long to wait before trying again
+func lockoutMessage(lockedUntil time.Time) string {
+	minutes := int(math.Ceil(time.Until(lockedUntil).Minutes()))
+	if minutes < 1 {
+		minutes = 1
+	}
+	return fmt.Sprintf("Too many failed login attempts. This account is locked for %d more minute(s).", minutes)
 }
 
 // LogoutHandler - Process logout
 func LogoutHandler(c echo.Context) error {
+	// End the server-side session so the token cannot be reused
+	if cookie, err := c.Cookie(handlers.SessionCookieName); err == nil && cookie.Value != "" {
+		if err := db.DeleteSession(cookie.Value); err != nil {
+			log.Printf("Warning: Failed to delete session on logout: %v", err)
+		}
+	}
 	log.Printf("User logged out.")
 
-	// Clear the username cookie to end the session
-	cookie := new(http.Cookie)
-	cookie.Name = "username"
-	cookie.Value = ""
-	cookie.Expires = time.Now().Add(-1 * time.Hour) // Set expiration in the past to delete the cookie
-	cookie.Path = "/"
-	c.SetCookie(cookie)
-
-	// Clear the role cookie
-	roleCookie := new(http.Cookie)
-	roleCookie.Name = "user_role"
-	roleCookie.Value = ""
-	roleCookie.Expires = time.Now().Add(-1 * time.Hour) // Set expiration in the past to delete the cookie
-	roleCookie.Path = "/"
-	c.SetCookie(roleCookie)
+	// Clear the session cookie
+	handlers.ClearSessionCookie(c)
 
 	return c.Redirect(http.StatusSeeOther, "/login?success=Successfully logged out.")
-} 
\ No newline at end of file
+}
+
+// LogoutEverywhereHandler - End every session of the logged in user, on all devices
+func LogoutEverywhereHandler(c echo.Context) error {
+	userID := handlers.GetLoggedInUserID(c)
+	count, err := db.DeleteUserSessions(userID)
+	if err != nil {
+		log.Printf("Error ending all sessions for user ID %d: %v", userID, err)
+		return c.Redirect(http.StatusSeeOther, "/dashboard?error=Failed to log out of all sessions. Please try again.")
+	}
+	log.Printf("User %s logged out everywhere (%d sessions ended).", handlers.GetLoggedInUsername(c), count)
+
+	handlers.ClearSessionCookie(c)
+
+	return c.Redirect(http.StatusSeeOther, "/login?success=Successfully logged out of all sessions.")
+}
@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+
+	"SecureSignIn/db"
+	"SecureSignIn/handlers"
+	"SecureSignIn/handlers/templates"
+	"SecureSignIn/models"
+	"SecureSignIn/utils"
+)
+
+// ChangePasswordHandler - Change the logged in user's password, also used
+// when the password policy forces a change at login
+func ChangePasswordHandler(c echo.Context) error {
+	userID := handlers.GetLoggedInUserID(c)
+	username := handlers.GetLoggedInUsername(c)
+
+	data := models.PageData{
+		Title:                "Change Password",
+		ActivePage:           "change_password",
+		IsLoggedIn:           true,
+		Username:             username,
+		UserRole:             handlers.GetLoggedInUserRole(c),
+		Error:                c.QueryParam("error"),
+		PasswordRequirements: utils.PasswordRules.Describe(),
+	}
+
+	if c.Request().Method != "POST" {
+		return templates.RenderTemplate(c, "change_password.html", data)
+	}
+
+	data.Error = ""
+	currentPassword := c.FormValue("current_password")
+	newPassword := c.FormValue("new_password")
+	confirmPassword := c.FormValue("confirm_password")
+
+	var storedID int64
+	var storedUsername, storedHash string
+	row, _ := db.GetUserByID(int(userID))
+	if err := row.Scan(&storedID, &storedUsername, &storedHash); err != nil {
+		log.Printf("Error retrieving user ID %d for password change: %v", userID, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error retrieving user information")
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(currentPassword)) != nil {
+		log.Printf("Password change for user %s rejected: wrong current password", username)
+		data.Error = "Your current password is incorrect"
+		return templates.RenderTemplate(c, "change_password.html", data)
+	}
+	if newPassword != confirmPassword {
+		data.Error = "New passwords do not match"
+		return templates.RenderTemplate(c, "change_password.html", data)
+	}
+
+	before := handlers.AuditSnapshot(db.AuditUser, userID)
+	if err := db.SetUserPassword(userID, newPassword); err != nil {
+		data.Error = passwordPolicyMessage(err)
+		if data.Error == "" {
+			log.Printf("Error changing password for user ID %d: %v", userID, err)
+			data.Error = "An error occurred changing your password. Please try again."
+		}
+		return templates.RenderTemplate(c, "change_password.html", data)
+	}
+
+	handlers.Audit(c, handlers.AuditPasswordChange, db.AuditUser, userID, before, handlers.AuditSnapshot(db.AuditUser, userID))
+	log.Printf("User %s changed their password", username)
+	return c.Redirect(http.StatusSeeOther, "/dashboard?success=Your password has been changed.")
+}
+
+// passwordPolicyMessage returns the reason a new password was rejected by the
+// password policy, or "" if err is some other failure
+func passwordPolicyMessage(err error) string {
+	var policyErr *db.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		return policyErr.Message
+	}
+	return ""
+}
@@ -5,29 +5,38 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/labstack/echo/v4"
 	"golang.org/x/crypto/bcrypt"
 
 	"SecureSignIn/db"
+	"SecureSignIn/handlers"
 	"SecureSignIn/handlers/templates"
-	"SecureSignIn/handlers/tokens"
+	"SecureSignIn/mailer"
 	"SecureSignIn/models"
 )
 
+// resetLinkURL builds the reset link sent alongside the code. Links are only
+// issued when APP_BASE_URL is set, since the request's Host header can't be
+// trusted to build them.
+func resetLinkURL(token string) string {
+	return strings.TrimRight(os.Getenv("APP_BASE_URL"), "/") + "/reset/" + token
+}
+
 // ForgotHandler - Render/Process forgot password form
 func ForgotHandler(c echo.Context) error {
 	if c.Request().Method == "POST" {
 		email := strings.TrimSpace(c.FormValue("email"))
-		resetCode := c.FormValue("resetCode")
+		// Codes are lowercase hex, but the form upper-cases what is typed
+		resetCode := strings.ToLower(strings.TrimSpace(c.FormValue("resetCode")))
 		newPassword := c.FormValue("newPassword")
 		confirmPassword := c.FormValue("confirmPassword")
 
-		log.Printf("Debug - Forgot password POST: email=%s, resetCode=%s, newPassword length=%d",
-			email, resetCode, len(newPassword))
+		log.Printf("Debug - Forgot password POST: email=%s, resetCode provided=%v, newPassword length=%d",
+			email, resetCode != "", len(newPassword))
 
 		// Validate email
 		if email == "" {
@@ -51,18 +60,9 @@ func ForgotHandler(c echo.Context) error {
 		}
 
 		var userID int64
-		var username string
-		var storedEmail string
-		err = row.Scan(&userID, &username, &storedEmail)
-		if err != nil {
-			if err == sql.ErrNoRows {
-				return templates.RenderTemplate(c, "forgot.html", models.PageData{
-					Title:      "Forgot Password",
-					Error:      "No account found with this email address",
-					ActivePage: "forgot",
-					Email:      email,
-				})
-			}
+		var username, storedDOB, storedSSN, storedPassword, storedEmail, storedRole string
+		err = row.Scan(&userID, &username, &storedDOB, &storedSSN, &storedPassword, &storedEmail, &storedRole)
+		if err != nil && err != sql.ErrNoRows {
 			log.Printf("Error scanning user data: %v", err)
 			return templates.RenderTemplate(c, "forgot.html", models.PageData{
 				Title:      "Forgot Password",
@@ -71,15 +71,25 @@ func ForgotHandler(c echo.Context) error {
 				Email:      email,
 			})
 		}
+		accountExists := err == nil
 
 		// If reset code is not provided, generate and send one
 		if resetCode == "" {
-			code := tokens.GenerateVerificationCode()
-			expiresAt := time.Now().Add(15 * time.Minute)
-
-			log.Printf("Debug - Generating new reset code '%s' for user ID %d", code, userID)
+			// Respond the same way whether or not the address is registered so
+			// the form cannot be used to discover accounts
+			sentMessage := fmt.Sprintf("If an account exists for %s, a reset code has been sent to it. The code expires in %d minutes.",
+				email, int(db.ResetTokenTTL.Minutes()))
+			if !accountExists {
+				log.Printf("Password reset requested for unknown email %s", email)
+				return templates.RenderTemplate(c, "forgot.html", models.PageData{
+					Title:      "Forgot Password",
+					Success:    sentMessage,
+					ActivePage: "forgot",
+					Email:      email,
+				})
+			}
 
-			err = db.StoreResetCode(userID, code, expiresAt)
+			code, link, err := db.IssuePasswordReset(userID, os.Getenv("APP_BASE_URL") != "")
 			if err != nil {
 				log.Printf("Error storing reset code: %v", err)
 				return templates.RenderTemplate(c, "forgot.html", models.PageData{
@@ -90,19 +100,35 @@ func ForgotHandler(c echo.Context) error {
 				})
 			}
 
-			// TODO: Send email with reset code
-			// For now, we'll just show it on screen for testing
+			resetURL := ""
+			if link != "" {
+				resetURL = resetLinkURL(link)
+			}
+			if err := mailer.SendPasswordReset(storedEmail, username, code, resetURL, db.ResetTokenTTL); err != nil {
+				log.Printf("Error sending reset code to user ID %d: %v", userID, err)
+				return templates.RenderTemplate(c, "forgot.html", models.PageData{
+					Title:      "Forgot Password",
+					Error:      "We could not send the reset email. Please try again later.",
+					ActivePage: "forgot",
+					Email:      email,
+				})
+			}
+			log.Printf("Sent password reset code to user ID %d", userID)
+
 			return templates.RenderTemplate(c, "forgot.html", models.PageData{
 				Title:      "Forgot Password",
-				Success:    fmt.Sprintf("Reset code sent to your email: %s (Code: %s)", email, code),
+				Success:    sentMessage,
 				ActivePage: "forgot",
 				Email:      email,
 			})
 		}
 
 		// Verify reset code and update password
-		log.Printf("Debug - Validating reset code '%s'", resetCode)
-		userID, err = db.ValidateResetCode(resetCode)
+		var tokenID int64
+		err = db.ErrInvalidResetToken
+		if accountExists {
+			tokenID, err = db.VerifyResetCode(userID, resetCode)
+		}
 		if err != nil {
 			log.Printf("Debug - Reset code validation failed: %v", err)
 			return templates.RenderTemplate(c, "forgot.html", models.PageData{
@@ -127,54 +153,55 @@ func ForgotHandler(c echo.Context) error {
 			})
 		}
 
-		if len(newPassword) < 8 {
+		// Check the password policy before using up the code, so a rejected
+		// password can be corrected with the same code
+		if err := db.CheckNewPassword(userID, newPassword); err != nil {
+			message := passwordPolicyMessage(err)
+			if message == "" {
+				log.Printf("Error checking new password: %v", err)
+				message = "An error occurred. Please try again."
+			}
 			return templates.RenderTemplate(c, "forgot.html", models.PageData{
 				Title:      "Forgot Password",
-				Error:      "Password must be at least 8 characters long",
+				Error:      message,
 				ActivePage: "forgot",
 				Email:      email,
 				Success:    "true", // Keep showing the reset code form
 			})
 		}
 
-		// Hash new password
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
-		if err != nil {
-			log.Printf("Error hashing password: %v", err)
+		// Use up the reset code before changing the password so it works only once
+		if err := db.ConsumeResetToken(tokenID); err != nil {
+			log.Printf("Error using reset code for user ID %d: %v", userID, err)
 			return templates.RenderTemplate(c, "forgot.html", models.PageData{
 				Title:      "Forgot Password",
-				Error:      "An error occurred. Please try again.",
+				Error:      "Invalid or expired reset code",
 				ActivePage: "forgot",
 				Email:      email,
 				Success:    "true", // Keep showing the reset code form
 			})
 		}
 
-		// Update password and mark reset code as used
-		err = db.UpdateUserPassword(int(userID), string(hashedPassword))
+		before := handlers.AuditSnapshot(db.AuditUser, userID)
+		err = db.SetUserPassword(userID, newPassword)
 		if err != nil {
 			log.Printf("Error updating password: %v", err)
 			return templates.RenderTemplate(c, "forgot.html", models.PageData{
 				Title:      "Forgot Password",
-				Error:      "An error occurred updating password. Please try again.",
+				Error:      "An error occurred updating password. Please request a new reset code.",
 				ActivePage: "forgot",
 				Email:      email,
-				Success:    "true", // Keep showing the reset code form
 			})
 		}
 
-		err = db.MarkResetCodeUsed(resetCode)
-		if err != nil {
-			log.Printf("Error marking reset code as used: %v", err)
-			// Non-critical error, continue
-		}
-
+		handlers.Audit(c, handlers.AuditPasswordChange, db.AuditUser, userID, before, handlers.AuditSnapshot(db.AuditUser, userID))
 		return c.Redirect(http.StatusSeeOther, "/login?success=Password reset successful. Please log in with your new password.")
 	}
 
 	// GET request - show form
 	return templates.RenderTemplate(c, "forgot.html", models.PageData{
 		Title:      "Forgot Password",
+		Error:      c.QueryParam("error"),
 		ActivePage: "forgot",
 		Email:      "", // Initialize Email field to empty string
 	})
@@ -183,14 +210,16 @@ func ForgotHandler(c echo.Context) error {
 // ShowResetFormHandler - Show reset password form
 func ShowResetFormHandler(c echo.Context) error {
 	token := c.Param("token")
-	userID, valid := tokens.ValidateResetToken(token)
-
-	if !valid {
-		log.Printf("Invalid or expired reset token presented: %s", token)
+	userID, _, err := db.LookupResetLink(token)
+	if err != nil {
+		if err != db.ErrInvalidResetToken {
+			log.Printf("Error looking up reset link: %v", err)
+		}
+		log.Printf("Invalid or expired reset link presented from %s", c.RealIP())
 		return c.Redirect(http.StatusSeeOther, "/forgot?error=Invalid or expired reset link.")
 	}
 
-	log.Printf("Showing password reset form for valid token %s (User ID: %d)", token, userID)
+	log.Printf("Showing password reset form for reset link (User ID: %d)", userID)
 	data := models.PageData{
 		Title:      "Reset Password",
 		ActivePage: "reset",
@@ -205,14 +234,17 @@ func HandleResetPasswordHandler(c echo.Context) error {
 	newPassword := c.FormValue("password")
 	confirmPassword := c.FormValue("confirm_password")
 
-	userID, valid := tokens.ValidateResetToken(token)
-	if !valid {
-		log.Printf("Password reset attempt with invalid/expired token: %s", token)
+	userID, tokenID, err := db.LookupResetLink(token)
+	if err != nil {
+		if err != db.ErrInvalidResetToken {
+			log.Printf("Error looking up reset link: %v", err)
+		}
+		log.Printf("Password reset attempt with invalid/expired reset link from %s", c.RealIP())
 		return c.Redirect(http.StatusSeeOther, "/forgot?error=Invalid or expired reset link.")
 	}
 
 	if newPassword == "" || newPassword != confirmPassword {
-		log.Printf("Password reset failed for token %s: Passwords do not match or are empty.", token)
+		log.Printf("Password reset failed for user ID %d: Passwords do not match or are empty.", userID)
 		data := models.PageData{
 			Title:      "Reset Password",
 			Error:      "Passwords do not match or are empty.",
@@ -220,30 +252,35 @@ func HandleResetPasswordHandler(c echo.Context) error {
 		}
 		return templates.RenderTemplate(c, "reset_password.html", data)
 	}
-	if len(newPassword) < 8 {
+	if err := db.CheckNewPassword(userID, newPassword); err != nil {
+		message := passwordPolicyMessage(err)
+		if message == "" {
+			log.Printf("Error checking new password for user ID %d: %v", userID, err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error processing password reset.")
+		}
 		data := models.PageData{
 			Title:      "Reset Password",
-			Error:      "Password must be at least 8 characters long.",
+			Error:      message,
 			ResetToken: token,
 		}
 		return templates.RenderTemplate(c, "reset_password.html", data)
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
-	if err != nil {
-		log.Printf("Error hashing new password for user ID %d: %v", userID, err)
-		return echo.NewHTTPError(http.StatusInternalServerError, "Error processing password reset.")
+	// Use up the link before changing the password so it works only once
+	if err := db.ConsumeResetToken(tokenID); err != nil {
+		log.Printf("Error using reset link for user ID %d: %v", userID, err)
+		return c.Redirect(http.StatusSeeOther, "/forgot?error=Invalid or expired reset link.")
 	}
 
-	err = db.UpdateUserPassword(userID, string(hashedPassword))
+	before := handlers.AuditSnapshot(db.AuditUser, userID)
+	err = db.SetUserPassword(userID, newPassword)
 	if err != nil {
 		log.Printf("Error updating password in DB for user ID %d: %v", userID, err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to update password.")
 	}
 
-	tokens.InvalidateResetToken(token)
-
-	log.Printf("Password successfully reset for user ID %d using token %s", userID, token)
+	handlers.Audit(c, handlers.AuditPasswordChange, db.AuditUser, userID, before, handlers.AuditSnapshot(db.AuditUser, userID))
+	log.Printf("Password successfully reset for user ID %d using a reset link", userID)
 	return c.Redirect(http.StatusSeeOther, "/login?success=Password successfully reset. Please log in.")
 }
 
@@ -393,19 +430,6 @@ func SecurityQuestionResetHandler(c echo.Context) error {
 				})
 			}
 
-			if len(newPassword) < 8 {
-				return templates.RenderTemplate(c, "security_reset.html", models.PageData{
-					Title:            "Reset Password",
-					Error:            "Password must be at least 8 characters long",
-					ActivePage:       "forgot",
-					Username:         username,
-					SecurityQuestion: question,
-					QuestionID:       questionIDInt,
-					UserID:           userIDInt,
-					HasSecurityQ:     true,
-				})
-			}
-
 			// Verify security answer
 			err = bcrypt.CompareHashAndPassword([]byte(answerHash), []byte(strings.ToLower(strings.TrimSpace(answer))))
 			if err != nil {
@@ -422,29 +446,19 @@ func SecurityQuestionResetHandler(c echo.Context) error {
 				})
 			}
 
-			// Hash new password
-			hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
-			if err != nil {
-				log.Printf("Error hashing password: %v", err)
-				return templates.RenderTemplate(c, "security_reset.html", models.PageData{
-					Title:            "Reset Password",
-					Error:            "An error occurred. Please try again.",
-					ActivePage:       "forgot",
-					Username:         username,
-					SecurityQuestion: question,
-					QuestionID:       questionIDInt,
-					UserID:           userIDInt,
-					HasSecurityQ:     true,
-				})
-			}
-
-			// Update password
-			err = db.UpdateUserPassword(int(userIDInt), string(hashedPassword))
+			// Update password. The policy is only checked once the answer is
+			// verified, so the history check can't be used to test guessed passwords.
+			before := handlers.AuditSnapshot(db.AuditUser, userIDInt)
+			err = db.SetUserPassword(userIDInt, newPassword)
 			if err != nil {
-				log.Printf("Error updating password: %v", err)
+				message := passwordPolicyMessage(err)
+				if message == "" {
+					log.Printf("Error updating password: %v", err)
+					message = "An error occurred updating password. Please try again."
+				}
 				return templates.RenderTemplate(c, "security_reset.html", models.PageData{
 					Title:            "Reset Password",
-					Error:            "An error occurred updating password. Please try again.",
+					Error:            message,
 					ActivePage:       "forgot",
 					Username:         username,
 					SecurityQuestion: question,
@@ -454,6 +468,7 @@ func SecurityQuestionResetHandler(c echo.Context) error {
 				})
 			}
 
+			handlers.Audit(c, handlers.AuditPasswordChange, db.AuditUser, userIDInt, before, handlers.AuditSnapshot(db.AuditUser, userIDInt))
 			log.Printf("Password successfully reset for user ID %d using security question", userIDInt)
 			return c.Redirect(http.StatusSeeOther, "/login?success=Password reset successful. Please log in with your new password.")
 		}
@@ -475,14 +490,14 @@ func SecurityQuestionResetHandler(c echo.Context) error {
 
 // SetupSecurityQuestionHandler - Manage security questions
 func SetupSecurityQuestionHandler(c echo.Context) error {
-	// Check if user is logged in using cookie
-	cookie, err := c.Cookie("username")
-	if err != nil || cookie.Value == "" {
+	// Check if user is logged in using the session identity
+	loggedInUsername := handlers.GetLoggedInUsername(c)
+	if loggedInUsername == "" {
 		return c.Redirect(http.StatusSeeOther, "/login?error=You must be logged in to set up security questions")
 	}
 
-	// Get user information using the username from cookie
-	userRow, err := db.GetUserByUsername(cookie.Value)
+	// Get user information using the username from the session
+	userRow, err := db.GetUserByUsername(loggedInUsername)
 	if err != nil {
 		log.Printf("Error getting user by username: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, "Error retrieving user information")
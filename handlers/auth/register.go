@@ -9,8 +9,9 @@ import (
 	"golang.org/x/crypto/bcrypt"
 
 	"SecureSignIn/db"
+	"SecureSignIn/handlers"
 	"SecureSignIn/handlers/templates"
-	"SecureSignIn/handlers/utils"
+	"SecureSignIn/utils"
 	"SecureSignIn/models"
 )
 
@@ -169,6 +170,19 @@ func BasicRegisterHandler(c echo.Context) error {
 		})
 	}
 
+	if ok, msg := utils.PasswordRules.Validate(password, username); !ok {
+		log.Printf("ERROR: Password rejected by policy: %s", msg)
+		return templates.RenderTemplate(c, "register.html", models.PageData{
+			Title:      "Register",
+			Error:      msg,
+			ActivePage: "register",
+			Username:   username,
+			Email:      email,
+			DOB:        dob,
+			SSN:        ssn,
+		})
+	}
+
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -222,6 +236,7 @@ func BasicRegisterHandler(c echo.Context) error {
 		// But log the error
 	}
 
+	handlers.Audit(c, handlers.AuditCreate, db.AuditUser, userID, nil, handlers.AuditSnapshot(db.AuditUser, userID))
 	log.Printf("SUCCESS: User registered with ID: %d", userID)
 	return c.Redirect(http.StatusSeeOther, "/login?success=Registration successful! Please log in.")
 } 
\ No newline at end of file
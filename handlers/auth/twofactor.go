@@ -0,0 +1,332 @@
+package auth
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"html/template"
+	"image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+
+	"SecureSignIn/db"
+	"SecureSignIn/handlers"
+	"SecureSignIn/handlers/templates"
+	"SecureSignIn/models"
+	"SecureSignIn/utils"
+)
+
+// totpIssuer is the name authenticator apps show next to the account
+const totpIssuer = "SecureSignIn"
+
+// recoveryCodeCount is how many recovery codes are issued at a time
+const recoveryCodeCount = 10
+
+// totpPeriod is how many seconds each authenticator code is valid for
+const totpPeriod = 30
+
+// TwoFactorLoginHandler - Second login step, verifies the authenticator or recovery code
+func TwoFactorLoginHandler(c echo.Context) error {
+	cookie, err := c.Cookie(handlers.PendingSessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	session, err := db.GetPendingSession(cookie.Value)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error loading pending session: %v", err)
+		}
+		handlers.ClearPendingSessionCookie(c)
+		return c.Redirect(http.StatusSeeOther, "/login?error=Your sign-in has expired. Please enter your password again.")
+	}
+
+	if c.Request().Method != "POST" {
+		return templates.RenderTemplate(c, "login_2fa.html", models.PageData{
+			Title:      "Two-Factor Authentication",
+			ActivePage: "login",
+			Username:   session.Username,
+		})
+	}
+
+	// A lockout triggered from another browser also ends this attempt
+	lockedUntil, err := db.GetLockedUntil(session.UserID)
+	if err != nil {
+		log.Printf("Error checking lockout for user ID %d: %v", session.UserID, err)
+	} else if !lockedUntil.IsZero() {
+		return abandonTwoFactorLogin(c, session, lockoutMessage(lockedUntil))
+	}
+
+	code := strings.TrimSpace(c.FormValue("code"))
+	valid, usedRecoveryCode, err := verifySecondFactor(session.UserID, code)
+	if err != nil {
+		log.Printf("Error verifying two-factor code for user ID %d: %v", session.UserID, err)
+		return templates.RenderTemplate(c, "login_2fa.html", models.PageData{
+			Title:      "Two-Factor Authentication",
+			Error:      "An error occurred while checking your code. Please try again.",
+			ActivePage: "login",
+			Username:   session.Username,
+		})
+	}
+	if !valid {
+		log.Printf("Two-factor check failed for user %s from %s", session.Username, c.RealIP())
+		lockedUntil, err := db.RecordFailedLogin(session.UserID, c.RealIP())
+		if err != nil {
+			log.Printf("Warning: Failed to record failed login for user ID %d: %v", session.UserID, err)
+		} else if !lockedUntil.IsZero() {
+			log.Printf("Account %s locked until %s after repeated failed logins", session.Username, lockedUntil.Format(time.RFC3339))
+			return abandonTwoFactorLogin(c, session, lockoutMessage(lockedUntil))
+		}
+		return templates.RenderTemplate(c, "login_2fa.html", models.PageData{
+			Title:      "Two-Factor Authentication",
+			Error:      "Invalid authentication code",
+			ActivePage: "login",
+			Username:   session.Username,
+		})
+	}
+	if usedRecoveryCode {
+		log.Printf("User %s signed in with a recovery code", session.Username)
+	}
+
+	// The pending session has served its purpose; completeLogin issues a fresh one
+	if err := db.DeleteSession(session.Token); err != nil {
+		log.Printf("Warning: Failed to delete pending session: %v", err)
+	}
+	handlers.ClearPendingSessionCookie(c)
+	return completeLogin(c, session.UserID, session.Username, session.Username)
+}
+
+// abandonTwoFactorLogin ends a pending two-factor login and returns the user to the login page
+func abandonTwoFactorLogin(c echo.Context, session *db.Session, message string) error {
+	if err := db.DeleteSession(session.Token); err != nil {
+		log.Printf("Warning: Failed to delete pending session: %v", err)
+	}
+	handlers.ClearPendingSessionCookie(c)
+	return templates.RenderTemplate(c, "login.html", models.PageData{
+		Title:      "Login",
+		Error:      message,
+		Username:   session.Username,
+		ActivePage: "login",
+	})
+}
+
+// verifySecondFactor checks a code against the user's authenticator secret,
+// falling back to their unused recovery codes. It reports whether the code
+// was accepted and whether a recovery code was consumed.
+func verifySecondFactor(userID int64, code string) (bool, bool, error) {
+	if code == "" {
+		return false, false, nil
+	}
+	secret, enabled, err := db.GetTwoFactorSecret(userID)
+	if err != nil {
+		return false, false, err
+	}
+	if !enabled {
+		return false, false, nil
+	}
+	valid, err := validateTOTP(userID, code, secret, time.Now())
+	if err != nil || valid {
+		return valid, false, err
+	}
+	used, err := db.UseRecoveryCode(userID, code)
+	if err != nil {
+		return false, false, err
+	}
+	return used, used, nil
+}
+
+// validateTOTP checks an authenticator code against a secret at the time now,
+// allowing for a time step of clock drift either way as totp.Validate does. A
+// code is only accepted once: its time step must be later than the last one
+// accepted for the user, so a code seen over someone's shoulder cannot be replayed.
+func validateTOTP(userID int64, code, secret string, now time.Time) (bool, error) {
+	for _, skew := range []int64{0, -1, 1} {
+		at := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		ok, err := totp.ValidateCustom(code, secret, at, totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err == nil && ok {
+			return db.UseTOTPStep(userID, at.Unix()/totpPeriod)
+		}
+	}
+	return false, nil
+}
+
+// codeAccepted is validateTOTP for the setup page, where an error checking
+// the code is logged and the code refused
+func codeAccepted(userID int64, code, secret string) bool {
+	valid, err := validateTOTP(userID, code, secret, time.Now())
+	if err != nil {
+		log.Printf("Error checking two-factor code for user ID %d: %v", userID, err)
+	}
+	return valid
+}
+
+// SetupTwoFactorHandler - Enroll in, manage or turn off two-factor authentication
+func SetupTwoFactorHandler(c echo.Context) error {
+	userID := handlers.GetLoggedInUserID(c)
+	username := handlers.GetLoggedInUsername(c)
+
+	required, err := db.IsTwoFactorRequired(handlers.GetLoggedInUserRole(c))
+	if err != nil {
+		log.Printf("Error checking two-factor policy: %v", err)
+	}
+
+	data := models.PageData{
+		Title:             "Two-Factor Authentication",
+		ActivePage:        "setup_2fa",
+		IsLoggedIn:        true,
+		Username:          username,
+		UserRole:          handlers.GetLoggedInUserRole(c),
+		TwoFactorRequired: required,
+		Error:             c.QueryParam("error"),
+	}
+
+	secret, enabled, err := db.GetTwoFactorSecret(userID)
+	if err != nil {
+		log.Printf("Error loading two-factor settings for user ID %d: %v", userID, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error loading two-factor settings")
+	}
+
+	if c.Request().Method == "POST" {
+		data.Error = ""
+		code := strings.TrimSpace(c.FormValue("code"))
+		action := c.FormValue("action")
+
+		switch {
+		case action == "enable" && !enabled:
+			if secret == "" || !codeAccepted(userID, code, secret) {
+				data.Error = "The code did not match. Check the time on your device and try again."
+				break
+			}
+			before := handlers.AuditSnapshot(db.AuditUser, userID)
+			codes, err := utils.GenerateRecoveryCodes(recoveryCodeCount)
+			if err == nil {
+				err = db.EnableTwoFactor(userID, codes)
+			}
+			if err != nil {
+				log.Printf("Error enabling two-factor for user ID %d: %v", userID, err)
+				data.Error = "An error occurred enabling two-factor authentication. Please try again."
+				break
+			}
+			handlers.Audit(c, handlers.AuditUpdate, db.AuditUser, userID, before, handlers.AuditSnapshot(db.AuditUser, userID))
+			log.Printf("User %s enabled two-factor authentication", username)
+			enabled = true
+			data.RecoveryCodes = codes
+			data.Success = "Two-factor authentication is now enabled. Save your recovery codes somewhere safe."
+
+		case action == "regenerate" && enabled:
+			if !codeAccepted(userID, code, secret) {
+				data.Error = "Invalid authentication code"
+				break
+			}
+			codes, err := utils.GenerateRecoveryCodes(recoveryCodeCount)
+			if err == nil {
+				err = db.ReplaceRecoveryCodes(userID, codes)
+			}
+			if err != nil {
+				log.Printf("Error regenerating recovery codes for user ID %d: %v", userID, err)
+				data.Error = "An error occurred generating recovery codes. Please try again."
+				break
+			}
+			log.Printf("User %s regenerated two-factor recovery codes", username)
+			data.RecoveryCodes = codes
+			data.Success = "New recovery codes generated. Your previous codes no longer work."
+
+		case action == "disable" && enabled:
+			if required {
+				data.Error = "Your role requires two-factor authentication, so it cannot be turned off."
+				break
+			}
+			if !codeAccepted(userID, code, secret) {
+				data.Error = "Invalid authentication code"
+				break
+			}
+			before := handlers.AuditSnapshot(db.AuditUser, userID)
+			if err := db.DisableTwoFactor(userID); err != nil {
+				log.Printf("Error disabling two-factor for user ID %d: %v", userID, err)
+				data.Error = "An error occurred turning off two-factor authentication. Please try again."
+				break
+			}
+			handlers.Audit(c, handlers.AuditUpdate, db.AuditUser, userID, before, handlers.AuditSnapshot(db.AuditUser, userID))
+			log.Printf("User %s disabled two-factor authentication", username)
+			enabled = false
+			secret = ""
+			data.Success = "Two-factor authentication has been turned off."
+
+		default:
+			data.Error = "Invalid request. Please try again."
+		}
+	}
+
+	data.TwoFactorEnabled = enabled
+	if enabled {
+		data.RecoveryCodesLeft, err = db.CountRecoveryCodes(userID)
+		if err != nil {
+			log.Printf("Error counting recovery codes for user ID %d: %v", userID, err)
+		}
+		return templates.RenderTemplate(c, "setup_2fa.html", data)
+	}
+
+	// Not enrolled yet: show the secret to scan, keeping the same one across reloads
+	var key *otp.Key
+	if secret == "" {
+		key, err = totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: username})
+		if err == nil {
+			err = db.SetPendingTwoFactorSecret(userID, key.Secret())
+		}
+	} else {
+		key, err = keyFromSecret(username, secret)
+	}
+	if err != nil {
+		log.Printf("Error preparing two-factor enrollment for user ID %d: %v", userID, err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error preparing two-factor enrollment")
+	}
+
+	data.TwoFactorSecret = key.Secret()
+	data.TwoFactorURI = template.URL(key.URL())
+	if qr, err := qrDataURI(key); err != nil {
+		log.Printf("Error rendering two-factor QR code: %v", err)
+	} else {
+		data.TwoFactorQR = qr
+	}
+	return templates.RenderTemplate(c, "setup_2fa.html", data)
+}
+
+// keyFromSecret rebuilds the otpauth key for an existing secret
+func keyFromSecret(username, secret string) (*otp.Key, error) {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", "6")
+	params.Set("period", "30")
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + username,
+		RawQuery: params.Encode(),
+	}
+	return otp.NewKeyFromURL(u.String())
+}
+
+// qrDataURI renders the enrollment QR code as an inline PNG
+func qrDataURI(key *otp.Key) (template.URL, error) {
+	img, err := key.Image(200, 200)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
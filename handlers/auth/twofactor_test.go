@@ -0,0 +1,148 @@
+package auth
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+
+	"SecureSignIn/db"
+	"SecureSignIn/utils"
+)
+
+// openTestDB opens a fresh database in a temporary directory, with its own
+// encryption and ticket keys
+func openTestDB(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("SQLITE_DB_PATH", filepath.Join(dir, "test.db"))
+	t.Setenv("ENCRYPTION_KEY_PATH", filepath.Join(dir, "encryption.key"))
+	t.Setenv("TICKET_KEY_PATH", filepath.Join(dir, "ticket.key"))
+	if err := db.InitializeDB(); err != nil {
+		t.Fatalf("InitializeDB: %v", err)
+	}
+	t.Cleanup(func() { db.DB.Close() })
+}
+
+// addTestUser adds an operator and returns their ID
+func addTestUser(t *testing.T, username string) int64 {
+	t.Helper()
+	hash, err := utils.HashPassword("Correct-Horse-42")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	id, err := db.AddUser(username, hash, "1990-01-01", "1234567890", username+"@example.com", "Operator")
+	if err != nil {
+		t.Fatalf("AddUser: %v", err)
+	}
+	return id
+}
+
+// enrollTwoFactor turns on two-factor authentication for a user and returns
+// their secret and recovery codes
+func enrollTwoFactor(t *testing.T, userID int64) (string, []string) {
+	t.Helper()
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: "test"})
+	if err != nil {
+		t.Fatalf("totp.Generate: %v", err)
+	}
+	codes, err := utils.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes: %v", err)
+	}
+	if err := db.SetPendingTwoFactorSecret(userID, key.Secret()); err != nil {
+		t.Fatalf("SetPendingTwoFactorSecret: %v", err)
+	}
+	if err := db.EnableTwoFactor(userID, codes); err != nil {
+		t.Fatalf("EnableTwoFactor: %v", err)
+	}
+	return key.Secret(), codes
+}
+
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	t.Helper()
+	code, err := totp.GenerateCodeCustom(secret, at, totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1})
+	if err != nil {
+		t.Fatalf("GenerateCodeCustom: %v", err)
+	}
+	return code
+}
+
+func TestTOTPCodesWorkOnce(t *testing.T) {
+	openTestDB(t)
+	userID := addTestUser(t, "alice")
+	secret, _ := enrollTwoFactor(t, userID)
+
+	// The start of a time step, so every check below stays within it
+	now := time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)
+	step := time.Duration(totpPeriod) * time.Second
+	tests := []struct {
+		name string
+		code string
+		at   time.Time
+		want bool
+	}{
+		{"current code", totpCode(t, secret, now), now, true},
+		{"same code again", totpCode(t, secret, now), now, false},
+		{"same code later in its step", totpCode(t, secret, now), now.Add(step - time.Second), false},
+		{"previous step's code, within drift", totpCode(t, secret, now.Add(-step)), now, false},
+		{"wrong code", "000000", now.Add(step), false},
+		{"next step's code", totpCode(t, secret, now.Add(step)), now.Add(step), true},
+		{"code from two steps ahead, beyond drift", totpCode(t, secret, now.Add(3*step)), now.Add(step), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "wrong code" && tt.code == totpCode(t, secret, tt.at) {
+				t.Skip("000000 happens to be the current code")
+			}
+			got, err := validateTOTP(userID, tt.code, secret, tt.at)
+			if err != nil {
+				t.Fatalf("validateTOTP: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("validateTOTP = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecoveryCodesWorkOnce(t *testing.T) {
+	openTestDB(t)
+	userID := addTestUser(t, "bob")
+	_, codes := enrollTwoFactor(t, userID)
+
+	accepted, usedRecovery, err := verifySecondFactor(userID, codes[0])
+	if err != nil || !accepted || !usedRecovery {
+		t.Fatalf("first use = %v, %v, %v; want accepted as a recovery code", accepted, usedRecovery, err)
+	}
+	if accepted, _, err := verifySecondFactor(userID, codes[0]); err != nil || accepted {
+		t.Errorf("second use = %v, %v; want refused", accepted, err)
+	}
+
+	// Codes are accepted however they are typed
+	retyped := strings.ToUpper(strings.ReplaceAll(codes[1], "-", " "))
+	if accepted, _, err := verifySecondFactor(userID, retyped); err != nil || !accepted {
+		t.Errorf("retyped code = %v, %v; want accepted", accepted, err)
+	}
+	if left, err := db.CountRecoveryCodes(userID); err != nil || left != recoveryCodeCount-2 {
+		t.Errorf("%d recovery codes left (%v), want %d", left, err, recoveryCodeCount-2)
+	}
+
+	// New codes replace the old ones, used or not
+	fresh, err := utils.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes: %v", err)
+	}
+	if err := db.ReplaceRecoveryCodes(userID, fresh); err != nil {
+		t.Fatalf("ReplaceRecoveryCodes: %v", err)
+	}
+	if accepted, _, _ := verifySecondFactor(userID, codes[2]); accepted {
+		t.Error("a replaced recovery code was accepted")
+	}
+	if accepted, _, _ := verifySecondFactor(userID, fresh[0]); !accepted {
+		t.Error("a new recovery code was refused")
+	}
+}
@@ -2,10 +2,34 @@ package handlers
 
 import (
 	"database/sql"
+	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
 
+// SessionCookieName is the cookie that carries the opaque session token
+const SessionCookieName = "session_id"
+
+// PendingSessionCookieName is the cookie that carries the token of a login
+// waiting for its two-factor code
+const PendingSessionCookieName = "pending_2fa"
+
+// CSRFCookieName is the cookie that carries the CSRF token of a visitor who
+// has no session yet
+const CSRFCookieName = "csrf_token"
+
+// CSRFFieldName is the form field, and CSRFHeaderName the request header,
+// that carry the CSRF token of a state-changing request
+const (
+	CSRFFieldName  = "csrf_token"
+	CSRFHeaderName = "X-CSRF-Token"
+)
+
+// CSRFTokenLoaderKey holds the function the CSRF middleware leaves on the
+// context of safe requests to look up the caller's token when it is needed
+const CSRFTokenLoaderKey = "csrf_token_loader"
+
 // PageData struct for template rendering
 type PageData struct {
 	Title            string
@@ -74,11 +98,73 @@ func RowsToMap(rows *sql.Rows) ([]map[string]interface{}, error) {
 	return results, nil
 }
 
-// Helper function to get logged in username
+// SetSessionCookie stores the session token in an HTTP-only cookie
+func SetSessionCookie(c echo.Context, token string, expires time.Time) {
+	setTokenCookie(c, SessionCookieName, token, expires)
+}
+
+// ClearSessionCookie removes the session cookie from the browser
+func ClearSessionCookie(c echo.Context) {
+	setTokenCookie(c, SessionCookieName, "", time.Now().Add(-1*time.Hour)) // Set expiration in the past to delete the cookie
+}
+
+// SetPendingSessionCookie stores the token of a login awaiting two-factor verification
+func SetPendingSessionCookie(c echo.Context, token string, expires time.Time) {
+	setTokenCookie(c, PendingSessionCookieName, token, expires)
+}
+
+// ClearPendingSessionCookie removes the pending two-factor login cookie
+func ClearPendingSessionCookie(c echo.Context) {
+	setTokenCookie(c, PendingSessionCookieName, "", time.Now().Add(-1*time.Hour))
+}
+
+// SetCSRFCookie stores the CSRF token of a visitor who is not logged in. It
+// lasts until the browser is closed.
+func SetCSRFCookie(c echo.Context, token string) {
+	setTokenCookie(c, CSRFCookieName, token, time.Time{})
+}
+
+func setTokenCookie(c echo.Context, name, token string, expires time.Time) {
+	cookie := new(http.Cookie)
+	cookie.Name = name
+	cookie.Value = token
+	cookie.Expires = expires
+	cookie.Path = "/"
+	cookie.HttpOnly = true
+	cookie.SameSite = http.SameSiteLaxMode
+	c.SetCookie(cookie)
+}
+
+// Helper function to get logged in username (set on the context by the session middleware)
 func GetLoggedInUsername(c echo.Context) string {
-	cookie, err := c.Cookie("username")
-	if err != nil || cookie.Value == "" {
+	username, _ := c.Get("username").(string)
+	return username
+}
+
+// GetLoggedInUserID returns the ID of the logged in user, or 0 if there is none
+func GetLoggedInUserID(c echo.Context) int64 {
+	userID, _ := c.Get("user_id").(int64)
+	return userID
+}
+
+// GetLoggedInUserRole returns the role of the logged in user as loaded from the database
+func GetLoggedInUserRole(c echo.Context) string {
+	role, _ := c.Get("user_role").(string)
+	return role
+}
+
+// GetCSRFToken returns the CSRF token forms and scripts on the current page
+// must send back (set on the context by the CSRF middleware, or looked up
+// the first time it is asked for)
+func GetCSRFToken(c echo.Context) string {
+	if token, ok := c.Get("csrf_token").(string); ok {
+		return token
+	}
+	load, ok := c.Get(CSRFTokenLoaderKey).(func() string)
+	if !ok {
 		return ""
 	}
-	return cookie.Value
-} 
\ No newline at end of file
+	token := load()
+	c.Set("csrf_token", token)
+	return token
+}
@@ -2,18 +2,22 @@ package dashboard
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 	"github.com/xuri/excelize/v2"
 	"golang.org/x/crypto/bcrypt"
 
 	"SecureSignIn/db"
+	"SecureSignIn/handlers"
 	"SecureSignIn/handlers/templates"
 	"SecureSignIn/models"
 	"SecureSignIn/utils"
@@ -21,22 +25,13 @@ import (
 
 // AdminDashboardHandler - Handler for admin dashboard
 func AdminDashboardHandler(c echo.Context) error {
-	// Make sure user is logged in and has admin role
-	usernameCookie, err := c.Cookie("username")
-	if err != nil || usernameCookie.Value == "" {
+	// Make sure user is logged in
+	username := handlers.GetLoggedInUsername(c)
+	if username == "" {
 		log.Printf("Admin dashboard access attempted without valid session")
 		return c.Redirect(http.StatusSeeOther, "/login?error=You must be logged in to access this page")
 	}
 
-	username := usernameCookie.Value
-	
-	// Check role
-	roleCookie, err := c.Cookie("user_role")
-	if err != nil || roleCookie.Value != "Admin" {
-		log.Printf("Admin dashboard access attempted by non-admin user: %s", username)
-		return c.Redirect(http.StatusSeeOther, "/dashboard?error=You do not have permission to access the admin dashboard")
-	}
-
 	log.Printf("Admin dashboard accessed by user: %s", username)
 
 	// Prepare page data
@@ -45,7 +40,7 @@ func AdminDashboardHandler(c echo.Context) error {
 		ActivePage:   "admin",
 		IsLoggedIn:   true,
 		Username:     username,
-		UserRole:     "Admin",
+		UserRole:     handlers.GetLoggedInUserRole(c),
 		Success:      c.QueryParam("success"),
 		Error:        c.QueryParam("error"),
 	}
@@ -55,68 +50,13 @@ func AdminDashboardHandler(c echo.Context) error {
 
 // AdminUsersHandler - Handler for admin user management
 func AdminUsersHandler(c echo.Context) error {
-	// Make sure user is logged in and has admin role
-	usernameCookie, err := c.Cookie("username")
-	if err != nil || usernameCookie.Value == "" {
+	// Make sure user is logged in
+	username := handlers.GetLoggedInUsername(c)
+	if username == "" {
 		log.Printf("Admin users page access attempted without valid session")
 		return c.Redirect(http.StatusSeeOther, "/login?error=You must be logged in to access this page")
 	}
 
-	username := usernameCookie.Value
-	
-	// Check role
-	roleCookie, err := c.Cookie("user_role")
-	if err != nil || roleCookie.Value != "Admin" {
-		log.Printf("Admin users page access attempted by non-admin user: %s", username)
-		return c.Redirect(http.StatusSeeOther, "/dashboard?error=You do not have permission to access the admin users page")
-	}
-
-	// Fetch all users
-	allUsers, err := db.GetAllUsers()
-	if err != nil {
-		log.Printf("Error getting all users: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve users"})
-	}
-	defer allUsers.Close()
-
-	// Convert rows to array of maps
-	var users []map[string]interface{}
-	for allUsers.Next() {
-		var id int64
-		var usernameStr, email, passwordHash, createdAt, dateOfBirth, socialSecurity, role string
-		if err := allUsers.Scan(&id, &usernameStr, &email, &passwordHash, &createdAt, &dateOfBirth, &socialSecurity, &role); err != nil {
-			log.Printf("Error scanning user row: %v", err)
-			continue
-		}
-		users = append(users, map[string]interface{}{ 
-			"id": id,
-			"username": usernameStr,
-			"email": email,
-			"created_at": createdAt,
-			"role": role,
-		})
-	}
-
-	return c.JSON(http.StatusOK, users)
-}
-
-// ManagerUsersHandler - Handler for manager user management
-func ManagerUsersHandler(c echo.Context) error {
-	// Make sure user is logged in and has manager role
-	usernameCookie, err := c.Cookie("username")
-	if err != nil || usernameCookie.Value == "" {
-		log.Printf("Manager users page access attempted without valid session")
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "You must be logged in to access this page"})
-	}
-	username := usernameCookie.Value
-
-	// Check role
-	roleCookie, err := c.Cookie("user_role")
-	if err != nil || (roleCookie.Value != "Manager" && roleCookie.Value != "Admin") {
-		log.Printf("Manager users page access attempted by non-manager user: %s", username)
-		return c.JSON(http.StatusForbidden, map[string]string{"error": "You do not have permission to access the manager users page"})
-	}
-
 	// Fetch all users
 	allUsers, err := db.GetAllUsers()
 	if err != nil {
@@ -130,7 +70,8 @@ func ManagerUsersHandler(c echo.Context) error {
 	for allUsers.Next() {
 		var id int64
 		var usernameStr, email, passwordHash, createdAt, dateOfBirth, socialSecurity, role string
-		if err := allUsers.Scan(&id, &usernameStr, &email, &passwordHash, &createdAt, &dateOfBirth, &socialSecurity, &role); err != nil {
+		var lockedUntil sql.NullString
+		if err := allUsers.Scan(&id, &usernameStr, &email, &passwordHash, &createdAt, &dateOfBirth, &socialSecurity, &role, &lockedUntil); err != nil {
 			log.Printf("Error scanning user row: %v", err)
 			continue
 		}
@@ -140,6 +81,7 @@ func ManagerUsersHandler(c echo.Context) error {
 			"email": email,
 			"created_at": createdAt,
 			"role": role,
+			"locked_until": lockedUntil.String,
 		})
 	}
 
@@ -148,23 +90,14 @@ func ManagerUsersHandler(c echo.Context) error {
 
 // AdminCreateUserHandler - Handler for creating new users
 func AdminCreateUserHandler(c echo.Context) error {
-	// Make sure user is logged in and has admin role
-	usernameCookie, err := c.Cookie("username")
-	if err != nil || usernameCookie.Value == "" {
+	// Make sure user is logged in
+	username := handlers.GetLoggedInUsername(c)
+	if username == "" {
 		log.Printf("Admin create user attempted without valid session")
 		return c.JSON(http.StatusUnauthorized, map[string]string{
 			"error": "You must be logged in to perform this action",
 		})
 	}
-	
-	// Check role
-	roleCookie, err := c.Cookie("user_role")
-	if err != nil || roleCookie.Value != "Admin" {
-		log.Printf("Admin create user attempted by non-admin user: %s", usernameCookie.Value)
-		return c.JSON(http.StatusForbidden, map[string]string{
-			"error": "You do not have permission to perform this action",
-		})
-	}
 
 	// Parse JSON request
 	var req struct {
@@ -191,14 +124,19 @@ func AdminCreateUserHandler(c echo.Context) error {
 	if ok, msg := utils.IsValidUsername(req.Username); !ok {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
 	}
-	if ok, msg := utils.IsValidPassword(req.Password); !ok {
+	if ok, msg := utils.PasswordRules.Validate(req.Password, req.Username); !ok {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
 	}
 
-	// Check valid role
-	if req.Role != "Operator" && req.Role != "Manager" && req.Role != "Accountant" && req.Role != "Admin" {
-		req.Role = "Operator" // Default to Operator if invalid role
+	// Check the role exists and is one the logged in user may hand out
+	if req.Role == "" {
+		req.Role = "Operator"
 	}
+	role, status, msg := grantableRole(c, req.Role)
+	if status != 0 {
+		return c.JSON(status, map[string]string{"error": msg})
+	}
+	req.Role = role
 
 	// Create user
 	// Hash the password
@@ -219,7 +157,8 @@ func AdminCreateUserHandler(c echo.Context) error {
 		})
 	}
 	
-	log.Printf("User created successfully by admin. ID: %d, Username: %s, Role: %s", userID, req.Username, req.Role)
+	handlers.Audit(c, handlers.AuditCreate, db.AuditUser, userID, nil, handlers.AuditSnapshot(db.AuditUser, userID))
+	log.Printf("User created successfully by %s. ID: %d, Username: %s, Role: %s", username, userID, req.Username, req.Role)
 	
 	return c.JSON(http.StatusOK, map[string]interface{}{
 		"message": "User created successfully",
@@ -227,71 +166,6 @@ func AdminCreateUserHandler(c echo.Context) error {
 	})
 }
 
-// ManagerCreateUserHandler - Handler for creating new users by manager (cannot assign Admin role)
-func ManagerCreateUserHandler(c echo.Context) error {
-	// Make sure user is logged in and has manager role
-	usernameCookie, err := c.Cookie("username")
-	if err != nil || usernameCookie.Value == "" {
-		log.Printf("Manager create user attempted without valid session")
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "You must be logged in to perform this action"})
-	}
-	// Check role
-	roleCookie, err := c.Cookie("user_role")
-	if err != nil || (roleCookie.Value != "Manager" && roleCookie.Value != "Admin") {
-		log.Printf("Manager create user attempted by non-manager user: %s", usernameCookie.Value)
-		return c.JSON(http.StatusForbidden, map[string]string{"error": "You do not have permission to perform this action"})
-	}
-
-	// Parse JSON request
-	var req struct {
-		Username string `json:"username"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
-		Role     string `json:"role"`
-	}
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request format"})
-	}
-
-	// Basic validation
-	if req.Username == "" || req.Email == "" || req.Password == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Username, email, and password are required"})
-	}
-
-	// Validate username and password format
-	if ok, msg := utils.IsValidUsername(req.Username); !ok {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
-	}
-	if ok, msg := utils.IsValidPassword(req.Password); !ok {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
-	}
-
-	// Restrict role: cannot assign Admin
-	switch req.Role {
-	case "Operator", "Manager", "Accountant":
-	// allowed
-	default:
-		req.Role = "Operator"
-	}
-
-	// Hash the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-	if err != nil {
-		log.Printf("Error hashing password: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create user"})
-	}
-
-	// Add user to database
-	userID, err := db.AddUser(req.Username, string(hashedPassword), "", "", req.Email, req.Role)
-	if err != nil {
-		log.Printf("Error creating user by manager: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create user"})
-	}
-
-	log.Printf("User created successfully by manager. ID: %d, Username: %s, Role: %s", userID, req.Username, req.Role)
-	return c.JSON(http.StatusOK, map[string]interface{}{"message": "User created successfully", "user_id": userID})
-}
-
 // AdminUpdateUserHandler - Handler for updating a user's role
 func AdminUpdateUserHandler(c echo.Context) error {
 	// Ensure request body contains id and role
@@ -302,42 +176,23 @@ func AdminUpdateUserHandler(c echo.Context) error {
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
-	// Validate role
-	switch req.Role {
-	case "Operator", "Manager", "Accountant", "Admin":
-	default:
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid role"})
-	}
-	// Update role in database
-	if err := db.UpdateUserRole(req.ID, req.Role); err != nil {
-		log.Printf("Error updating role for user %d: %v", req.ID, err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update user role"})
-	}
-	return c.JSON(http.StatusOK, map[string]string{"message": "Role updated successfully"})
-}
-
-// ManagerUpdateUserHandler - Handler for updating a user's role by manager (cannot assign Admin role)
-func ManagerUpdateUserHandler(c echo.Context) error {
-	// Ensure request body contains id and role
-	var req struct {
-		ID   int64  `json:"id"`
-		Role string `json:"role"`
-	}
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	// Validate role: both the user's current role and the new one must be
+	// roles the logged in user could grant
+	if status, msg := manageableUser(c, req.ID); status != 0 {
+		return c.JSON(status, map[string]string{"error": msg})
 	}
-	// Restrict role: cannot assign Admin
-	switch req.Role {
-	case "Operator", "Manager", "Accountant":
-	// allowed
-	default:
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid role"})
+	role, status, msg := grantableRole(c, req.Role)
+	if status != 0 {
+		return c.JSON(status, map[string]string{"error": msg})
 	}
+	req.Role = role
 	// Update role in database
+	before := handlers.AuditSnapshot(db.AuditUser, req.ID)
 	if err := db.UpdateUserRole(req.ID, req.Role); err != nil {
-		log.Printf("Error updating role for user %d by manager: %v", req.ID, err)
+		log.Printf("Error updating role for user %d: %v", req.ID, err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update user role"})
 	}
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditUser, req.ID, before, handlers.AuditSnapshot(db.AuditUser, req.ID))
 	return c.JSON(http.StatusOK, map[string]string{"message": "Role updated successfully"})
 }
 
@@ -348,13 +203,41 @@ func AdminDeleteUserHandler(c echo.Context) error {
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
 	}
+	if status, msg := manageableUser(c, userID); status != 0 {
+		return c.JSON(status, map[string]string{"error": msg})
+	}
+	before := handlers.AuditSnapshot(db.AuditUser, userID)
 	if err := db.DeleteUser(userID); err != nil {
 		log.Printf("Error deleting user %d: %v", userID, err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete user"})
 	}
+	handlers.Audit(c, handlers.AuditDelete, db.AuditUser, userID, before, nil)
 	return c.JSON(http.StatusOK, map[string]string{"message": "User deleted successfully"})
 }
 
+// AdminUnlockUserHandler - Handler for lifting a user's login lockout
+func AdminUnlockUserHandler(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+	if status, msg := manageableUser(c, userID); status != 0 {
+		return c.JSON(status, map[string]string{"error": msg})
+	}
+	before := handlers.AuditSnapshot(db.AuditUser, userID)
+	found, err := db.UnlockUser(userID)
+	if err != nil {
+		log.Printf("Error unlocking user %d: %v", userID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to unlock user"})
+	}
+	if !found {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+	}
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditUser, userID, before, handlers.AuditSnapshot(db.AuditUser, userID))
+	log.Printf("User ID %d unlocked by %s", userID, handlers.GetLoggedInUsername(c))
+	return c.JSON(http.StatusOK, map[string]string{"message": "User unlocked successfully"})
+}
+
 // AdminUpdatePasswordHandler - Handler for updating a user's password
 func AdminUpdatePasswordHandler(c echo.Context) error {
 	// Ensure request body contains id and password
@@ -366,29 +249,25 @@ func AdminUpdatePasswordHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
 	
-	// Validate password
-	if len(req.Password) < 6 {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Password must be at least 6 characters"})
+	if status, msg := manageableUser(c, req.ID); status != 0 {
+		return c.JSON(status, map[string]string{"error": msg})
 	}
-	
-	// Validate password format
-	if ok, msg := utils.IsValidPassword(req.Password); !ok {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
-	}
-	
-	// Hash the new password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-	if err != nil {
-		log.Printf("Error hashing password: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update password"})
-	}
-	
-	// Update password in database
-	if err := db.UpdateUserPassword(int(req.ID), string(hashedPassword)); err != nil {
+
+	// Validate against the password policy and update the password in the database
+	before := handlers.AuditSnapshot(db.AuditUser, req.ID)
+	if err := db.SetUserPassword(req.ID, req.Password); err != nil {
+		var policyErr *db.PasswordPolicyError
+		if errors.As(err, &policyErr) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": policyErr.Message})
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "User not found"})
+		}
 		log.Printf("Error updating password for user %d: %v", req.ID, err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update password"})
 	}
 	
+	handlers.Audit(c, handlers.AuditPasswordChange, db.AuditUser, req.ID, before, handlers.AuditSnapshot(db.AuditUser, req.ID))
 	log.Printf("Password updated successfully for user ID: %d", req.ID)
 	return c.JSON(http.StatusOK, map[string]string{"message": "Password updated successfully"})
 }
@@ -404,6 +283,10 @@ func AdminUpdateUsernameHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
 	
+	if status, msg := manageableUser(c, req.ID); status != 0 {
+		return c.JSON(status, map[string]string{"error": msg})
+	}
+
 	// Validate username
 	if len(req.Username) < 3 {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Username must be at least 3 characters"})
@@ -415,41 +298,45 @@ func AdminUpdateUsernameHandler(c echo.Context) error {
 	}
 	
 	// Update username in database
+	before := handlers.AuditSnapshot(db.AuditUser, req.ID)
 	if err := db.UpdateUsername(req.ID, req.Username); err != nil {
 		log.Printf("Error updating username for user %d: %v", req.ID, err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 	}
 	
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditUser, req.ID, before, handlers.AuditSnapshot(db.AuditUser, req.ID))
 	log.Printf("Username updated successfully for user ID: %d to '%s'", req.ID, req.Username)
 	return c.JSON(http.StatusOK, map[string]string{"message": "Username updated successfully"})
 }
 
 // --- Vehicle Management Handlers ---
 
+// vehicleSeatLayout builds the seat layout sent with a vehicle. An omitted
+// aisle position puts the aisle in the middle of the row.
+func vehicleSeatLayout(capacity, columns int, aisleAfter *int, letters string) (db.SeatLayout, error) {
+	aisle := -1
+	if aisleAfter != nil {
+		aisle = *aisleAfter
+	}
+	return db.NewSeatLayout(capacity, columns, aisle, letters)
+}
+
 // AdminVehiclesHandler - Handler for getting all vehicles
 func AdminVehiclesHandler(c echo.Context) error {
-	// Make sure user is logged in and has admin role
-	usernameCookie, err := c.Cookie("username")
-	if err != nil || usernameCookie.Value == "" {
+	// Make sure user is logged in
+	username := handlers.GetLoggedInUsername(c)
+	if username == "" {
 		log.Printf("Admin vehicles page access attempted without valid session")
 		return c.JSON(http.StatusUnauthorized, map[string]string{
 			"error": "You must be logged in to access this page",
 		})
 	}
-	
-	// Check role: allow Admin and Manager
-	roleCookie, err := c.Cookie("user_role")
-	if err != nil || (roleCookie.Value != "Admin" && roleCookie.Value != "Manager") {
-		log.Printf("Admin vehicles page access attempted by unauthorized user: %s", usernameCookie.Value)
-		return c.JSON(http.StatusForbidden, map[string]string{
-			"error": "You do not have permission to access the vehicles page",
-		})
-	}
 
 	// Fetch vehicles (optionally filter by departure and arrival times)
 	dep := c.QueryParam("departure")
 	arr := c.QueryParam("arrival")
 	var allVehicles *sql.Rows
+	var err error
 	if dep != "" && arr != "" {
 		allVehicles, err = db.GetAvailableVehicles(dep, arr)
 	} else {
@@ -469,9 +356,12 @@ func AdminVehiclesHandler(c echo.Context) error {
 		var id int64
 		var vehicleNumber, vehicleType, status, lastMaintenance, nextMaintenance, createdAt, notes string
 		var capacity int
+		var seatColumns, aisleAfter sql.NullInt64
+		var seatLetters sql.NullString
 		
 		if err := allVehicles.Scan(&id, &vehicleNumber, &vehicleType, &capacity, &status, 
-								 &lastMaintenance, &nextMaintenance, &createdAt, &notes); err != nil {
+								 &lastMaintenance, &nextMaintenance, &createdAt, &notes,
+								 &seatColumns, &aisleAfter, &seatLetters); err != nil {
 			log.Printf("Error scanning vehicle row: %v", err)
 			continue
 		}
@@ -486,6 +376,7 @@ func AdminVehiclesHandler(c echo.Context) error {
 			"next_maintenance":    nextMaintenance,
 			"created_at":          createdAt,
 			"notes":               notes,
+			"seat_layout":         db.SeatLayoutFromColumns(capacity, seatColumns, aisleAfter, seatLetters),
 		})
 	}
 
@@ -494,23 +385,14 @@ func AdminVehiclesHandler(c echo.Context) error {
 
 // AdminCreateVehicleHandler - Handler for creating a new vehicle
 func AdminCreateVehicleHandler(c echo.Context) error {
-	// Make sure user is logged in and has admin role
-	usernameCookie, err := c.Cookie("username")
-	if err != nil || usernameCookie.Value == "" {
+	// Make sure user is logged in
+	username := handlers.GetLoggedInUsername(c)
+	if username == "" {
 		log.Printf("Admin create vehicle attempted without valid session")
 		return c.JSON(http.StatusUnauthorized, map[string]string{
 			"error": "You must be logged in to perform this action",
 		})
 	}
-	
-	// Check role: allow Admin and Manager
-	roleCookie, err := c.Cookie("user_role")
-	if err != nil || (roleCookie.Value != "Admin" && roleCookie.Value != "Manager") {
-		log.Printf("Vehicle creation attempted by unauthorized user: %s", usernameCookie.Value)
-		return c.JSON(http.StatusForbidden, map[string]string{
-			"error": "You do not have permission to perform this action",
-		})
-	}
 
 	// Parse JSON request
 	var req struct {
@@ -521,6 +403,9 @@ func AdminCreateVehicleHandler(c echo.Context) error {
 		LastMaintenance  string `json:"last_maintenance"`
 		NextMaintenance  string `json:"next_maintenance"`
 		Notes            string `json:"notes"`
+		SeatColumns      int    `json:"seat_columns"`
+		AisleAfter       *int   `json:"aisle_after"`
+		SeatLetters      string `json:"seat_letters"`
 	}
 	
 	if err := c.Bind(&req); err != nil {
@@ -541,8 +426,13 @@ func AdminCreateVehicleHandler(c echo.Context) error {
 		req.Status = "Active"
 	}
 
+	layout, err := vehicleSeatLayout(req.Capacity, req.SeatColumns, req.AisleAfter, req.SeatLetters)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
 	// Add vehicle to database
-	vehicleID, err := db.AddVehicle(req.VehicleNumber, req.Type, req.Capacity, req.Status, 
+	vehicleID, err := db.AddVehicle(req.VehicleNumber, req.Type, layout, req.Status, 
 								  req.LastMaintenance, req.NextMaintenance, req.Notes)
 	if err != nil {
 		log.Printf("Error creating vehicle: %v", err)
@@ -551,6 +441,7 @@ func AdminCreateVehicleHandler(c echo.Context) error {
 		})
 	}
 	
+	handlers.Audit(c, handlers.AuditCreate, db.AuditVehicle, vehicleID, nil, handlers.AuditSnapshot(db.AuditVehicle, vehicleID))
 	log.Printf("Vehicle created successfully by admin. ID: %d, Vehicle Number: %s", vehicleID, req.VehicleNumber)
 	
 	return c.JSON(http.StatusOK, map[string]interface{}{
@@ -571,6 +462,9 @@ func AdminUpdateVehicleHandler(c echo.Context) error {
 		LastMaintenance  string `json:"last_maintenance"`
 		NextMaintenance  string `json:"next_maintenance"`
 		Notes            string `json:"notes"`
+		SeatColumns      int    `json:"seat_columns"`
+		AisleAfter       *int   `json:"aisle_after"`
+		SeatLetters      string `json:"seat_letters"`
 	}
 	
 	if err := c.Bind(&req); err != nil {
@@ -592,14 +486,21 @@ func AdminUpdateVehicleHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Cannot modify vehicle assigned to trips with active bookings"})
 	}
 
+	layout, err := vehicleSeatLayout(req.Capacity, req.SeatColumns, req.AisleAfter, req.SeatLetters)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
 	// Update vehicle in database
-	err = db.UpdateVehicle(req.ID, req.VehicleNumber, req.Type, req.Capacity, 
+	before := handlers.AuditSnapshot(db.AuditVehicle, req.ID)
+	err = db.UpdateVehicle(req.ID, req.VehicleNumber, req.Type, layout, 
 						  req.Status, req.LastMaintenance, req.NextMaintenance, req.Notes)
 	if err != nil {
 		log.Printf("Error updating vehicle %d: %v", req.ID, err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 	}
 	
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditVehicle, req.ID, before, handlers.AuditSnapshot(db.AuditVehicle, req.ID))
 	log.Printf("Vehicle updated successfully. ID: %d, Vehicle Number: %s", req.ID, req.VehicleNumber)
 	return c.JSON(http.StatusOK, map[string]string{"message": "Vehicle updated successfully"})
 }
@@ -622,10 +523,12 @@ func AdminDeleteVehicleHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Cannot delete vehicle assigned to trips with active bookings"})
 	}
 	
+	before := handlers.AuditSnapshot(db.AuditVehicle, vehicleID)
 	if err := db.DeleteVehicle(vehicleID); err != nil {
 		log.Printf("Error deleting vehicle %d: %v", vehicleID, err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete vehicle"})
 	}
+	handlers.Audit(c, handlers.AuditDelete, db.AuditVehicle, vehicleID, before, nil)
 	
 	log.Printf("Vehicle deleted successfully. ID: %d", vehicleID)
 	return c.JSON(http.StatusOK, map[string]string{"message": "Vehicle deleted successfully"})
@@ -633,15 +536,10 @@ func AdminDeleteVehicleHandler(c echo.Context) error {
 
 // AdminGetVehicleByIDHandler handles retrieving a specific vehicle by ID
 func AdminGetVehicleByIDHandler(c echo.Context) error {
-	// Ensure admin or manager role
-	username, err := c.Cookie("username")
-	if err != nil || username.Value == "" {
+	// Ensure logged in
+	if handlers.GetLoggedInUsername(c) == "" {
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "You must be logged in"})
 	}
-	r, err := c.Cookie("user_role")
-	if err != nil || (r.Value != "Admin" && r.Value != "Manager") {
-		return c.JSON(http.StatusForbidden, map[string]string{"error": "Permission denied"})
-	}
 
 	// Get the vehicle ID from the URL parameter
 	id := c.Param("id")
@@ -670,7 +568,10 @@ func AdminGetVehicleByIDHandler(c echo.Context) error {
 		NextMaintenanceDate string `json:"next_maintenance_date"`
 		CreatedAt          string `json:"created_at"`
 		Notes              string `json:"notes"`
+		SeatLayout         db.SeatLayout `json:"seat_layout"`
 	}
+	var seatColumns, aisleAfter sql.NullInt64
+	var seatLetters sql.NullString
 
 	err = row.Scan(
 		&vehicle.ID,
@@ -682,6 +583,9 @@ func AdminGetVehicleByIDHandler(c echo.Context) error {
 		&vehicle.NextMaintenanceDate,
 		&vehicle.CreatedAt,
 		&vehicle.Notes,
+		&seatColumns,
+		&aisleAfter,
+		&seatLetters,
 	)
 	
 	if err != nil {
@@ -694,6 +598,8 @@ func AdminGetVehicleByIDHandler(c echo.Context) error {
 		})
 	}
 
+	vehicle.SeatLayout = db.SeatLayoutFromColumns(vehicle.Capacity, seatColumns, aisleAfter, seatLetters)
+
 	return c.JSON(http.StatusOK, vehicle)
 }
 
@@ -701,16 +607,11 @@ func AdminGetVehicleByIDHandler(c echo.Context) error {
 
 // AdminTripsHandler - Handler for listing all trips
 func AdminTripsHandler(c echo.Context) error {
-	// Ensure admin
-	usernameCookie, err := c.Cookie("username")
-	if err != nil || usernameCookie.Value == "" {
+	// Ensure logged in
+	username := handlers.GetLoggedInUsername(c)
+	if username == "" {
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "You must be logged in"})
 	}
-	// Check role: allow Admin and Manager
-	roleCookie, err := c.Cookie("user_role")
-	if err != nil || (roleCookie.Value != "Admin" && roleCookie.Value != "Manager") {
-		return c.JSON(http.StatusForbidden, map[string]string{"error": "Permission denied"})
-	}
 
 	rows, err := db.GetAllTrips()
 	if err != nil {
@@ -721,9 +622,9 @@ func AdminTripsHandler(c echo.Context) error {
 
 	var trips []map[string]interface{}
 	for rows.Next() {
-		var id, vehicleID int64
-		var origin, destination, departure, arrival, createdAt, vehicleNumber string
-		if err := rows.Scan(&id, &origin, &destination, &vehicleID, &departure, &arrival, &createdAt, &vehicleNumber); err != nil {
+		var id, vehicleID, routeID int64
+		var origin, destination, departure, arrival, createdAt, vehicleNumber, routeName string
+		if err := rows.Scan(&id, &origin, &destination, &vehicleID, &departure, &arrival, &createdAt, &vehicleNumber, &routeID, &routeName); err != nil {
 			log.Printf("Error scanning trip: %v", err)
 			continue
 		}
@@ -736,6 +637,8 @@ func AdminTripsHandler(c echo.Context) error {
 			"departure_time": departure,
 			"arrival_time": arrival,
 			"created_at": createdAt,
+			"route_id": routeID,
+			"route_name": routeName,
 		})
 	}
 	return c.JSON(http.StatusOK, trips)
@@ -743,18 +646,14 @@ func AdminTripsHandler(c echo.Context) error {
 
 // AdminCreateTripHandler - Handler to create a new trip
 func AdminCreateTripHandler(c echo.Context) error {
-	// Ensure admin
-	usernameCookie, err := c.Cookie("username")
-	if err != nil || usernameCookie.Value == "" {
+	// Ensure logged in
+	username := handlers.GetLoggedInUsername(c)
+	if username == "" {
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "You must be logged in"})
 	}
-	// Check role: allow Admin and Manager
-	roleCookie, err := c.Cookie("user_role")
-	if err != nil || (roleCookie.Value != "Admin" && roleCookie.Value != "Manager") {
-		return c.JSON(http.StatusForbidden, map[string]string{"error": "Permission denied"})
-	}
 
 	var req struct {
+		RouteID     int64  `json:"route_id"`
 		Origin      string `json:"origin"`
 		Destination string `json:"destination"`
 		VehicleID   int64  `json:"vehicle_id"`
@@ -764,20 +663,22 @@ func AdminCreateTripHandler(c echo.Context) error {
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
-	if req.Origin == "" || req.Destination == "" || req.VehicleID == 0 || req.Departure == "" || req.Arrival == "" {
+	if (req.RouteID == 0 && (req.Origin == "" || req.Destination == "")) || req.VehicleID == 0 || req.Departure == "" || req.Arrival == "" {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "All fields are required"})
 	}
 	
-	// Validate origin and destination are not the same
-	if req.Origin == req.Destination {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Origin and destination cannot be the same city"})
+	// Trips run on a route between stations; origin and destination pick the direct route
+	route, err := db.ResolveRoute(req.RouteID, req.Origin, req.Destination)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": routeError(err)})
 	}
 	
-	id, err := db.AddTrip(req.Origin, req.Destination, req.VehicleID, req.Departure, req.Arrival)
+	id, err := db.AddTrip(route.ID, req.VehicleID, req.Departure, req.Arrival)
 	if err != nil {
 		log.Printf("Error creating trip: %v", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 	}
+	handlers.Audit(c, handlers.AuditCreate, db.AuditTrip, id, nil, handlers.AuditSnapshot(db.AuditTrip, id))
 	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Trip created", "trip_id": id})
 }
 
@@ -785,6 +686,7 @@ func AdminCreateTripHandler(c echo.Context) error {
 func AdminUpdateTripHandler(c echo.Context) error {
 	var req struct {
 		ID          int64  `json:"id"`
+		RouteID     int64  `json:"route_id"`
 		Origin      string `json:"origin"`
 		Destination string `json:"destination"`
 		VehicleID   int64  `json:"vehicle_id"`
@@ -798,10 +700,11 @@ func AdminUpdateTripHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Trip ID required"})
 	}
 	
-	// Validate origin and destination are not the same
-	if req.Origin == req.Destination {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Origin and destination cannot be the same city"})
+	route, err := db.ResolveRoute(req.RouteID, req.Origin, req.Destination)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": routeError(err)})
 	}
+	req.Origin, req.Destination = route.Origin, route.Destination
 	
 	// Check if trip has active bookings
 	bookingCount, err := db.GetTripBookingsCount(req.ID)
@@ -838,10 +741,28 @@ func AdminUpdateTripHandler(c echo.Context) error {
 	if !available {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Selected vehicle is not available for the new schedule"})
 	}
-	if err := db.UpdateTrip(req.ID, req.Origin, req.Destination, req.VehicleID, req.Departure, req.Arrival); err != nil {
+
+	// Every booked seat must exist on the vehicle the trip moves to
+	if bookingCount > 0 {
+		missing, err := db.MissingSeatsOnVehicle(req.ID, req.VehicleID)
+		if err != nil {
+			log.Printf("Error checking booked seats against vehicle %d: %v", req.VehicleID, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Error checking booked seats"})
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Seats %s are booked but do not exist on the selected vehicle", strings.Join(missing, ", "))})
+		}
+	}
+	before := handlers.AuditSnapshot(db.AuditTrip, req.ID)
+	if err := db.UpdateTrip(req.ID, route.ID, req.VehicleID, req.Departure, req.Arrival); err != nil {
+		if errors.Is(err, db.ErrStopsBooked) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Passengers board or alight at intermediate stops of this trip, so it cannot move to another route"})
+		}
 		log.Printf("Error updating trip: %v", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 	}
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditTrip, req.ID, before, handlers.AuditSnapshot(db.AuditTrip, req.ID))
 	return c.JSON(http.StatusOK, map[string]string{"message": "Trip updated"})
 }
 
@@ -863,10 +784,15 @@ func AdminDeleteTripHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Cannot delete trip with active bookings"})
 	}
 	
+	before := handlers.AuditSnapshot(db.AuditTrip, id)
 	if err := db.DeleteTrip(id); err != nil {
+		if errors.Is(err, db.ErrTripHasPayments) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Cannot delete a trip whose bookings have payments. Cancel the bookings first."})
+		}
 		log.Printf("Error deleting trip: %v", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Delete failed"})
 	}
+	handlers.Audit(c, handlers.AuditDelete, db.AuditTrip, id, before, nil)
 	
 	return c.JSON(http.StatusOK, map[string]string{"message": "Trip deleted"})
 }
@@ -874,22 +800,19 @@ func AdminDeleteTripHandler(c echo.Context) error {
 // --- Booking Management Handlers ---
 // AdminBookingsHandler - Handler for listing all bookings
 func AdminBookingsHandler(c echo.Context) error {
-	// Ensure admin
-	username, err := c.Cookie("username")
-	if err != nil || username.Value == "" {
+	// Ensure logged in
+	if handlers.GetLoggedInUsername(c) == "" {
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "You must be logged in"})
 	}
-	// Check role: allow Admin and Manager
-	r, err := c.Cookie("user_role")
-	if err != nil || (r.Value != "Admin" && r.Value != "Manager") {
-		return c.JSON(http.StatusForbidden, map[string]string{"error": "Permission denied"})
-	}
 
 	// Get filter parameters
 	filter := make(map[string]string)
 	if p := c.QueryParam("passenger"); p != "" {
 		filter["passenger"] = p
 	}
+	if r := c.QueryParam("reference"); r != "" {
+		filter["reference"] = r
+	}
 	if o := c.QueryParam("origin"); o != "" {
 		filter["origin"] = o
 	}
@@ -933,11 +856,24 @@ func AdminBookingsHandler(c echo.Context) error {
 	var bookings []map[string]interface{}
 	for rows.Next() {
 		var id, tripID int64
-		var passenger, socialID, phoneNumber, dateOfBirth, bookingDate, status, origin, destination, departureTime string
-		if err := rows.Scan(&id, &tripID, &passenger, &socialID, &phoneNumber, &dateOfBirth, &bookingDate, &status, &origin, &destination, &departureTime); err != nil {
+		var passenger, socialID, phoneNumber, dateOfBirth, bookingDate, status, origin, destination, departureTime, seatNumber, fareCategory, reference, boarding, alighting string
+		var price sql.NullInt64
+		var paid int64
+		var holdExpiresAt sql.NullTime
+		var passengerID sql.NullInt64
+		if err := rows.Scan(&id, &tripID, &passenger, &socialID, &phoneNumber, &dateOfBirth, &bookingDate, &status, &origin, &destination, &departureTime, &seatNumber, &price, &fareCategory, &paid, &reference, &boarding, &alighting, &holdExpiresAt, &passengerID); err != nil {
 			log.Printf("Error scanning booking: %v", err)
 			continue
 		}
+		if err := db.DecryptFields(&socialID, &dateOfBirth); err != nil {
+			log.Printf("Error decrypting booking %d: %v", id, err)
+			continue
+		}
+		// Only seat holds still held have an expiry
+		var holdExpires interface{}
+		if status == db.BookingHeld && holdExpiresAt.Valid {
+			holdExpires = holdExpiresAt.Time
+		}
 		bookings = append(bookings, map[string]interface{}{
 			"id": id,
 			"trip_id": tripID,
@@ -950,6 +886,15 @@ func AdminBookingsHandler(c echo.Context) error {
 			"origin": origin,
 			"destination": destination,
 			"departure_time": departureTime,
+			"seat_number": seatNumber,
+			"price_cents": nullInt(price),
+			"fare_category": fareCategory,
+			"paid_cents": paid,
+			"reference": reference,
+			"boarding": boarding,
+			"alighting": alighting,
+			"hold_expires_at": holdExpires,
+			"passenger_id": nullInt(passengerID),
 		})
 	}
 	// Paginate results
@@ -968,25 +913,12 @@ func AdminBookingsHandler(c echo.Context) error {
 
 // AdminCreateBookingHandler - Handler to create a new booking
 func AdminCreateBookingHandler(c echo.Context) error {
-	// Ensure admin
-	username, err := c.Cookie("username")
-	if err != nil || username.Value == "" {
+	// Ensure logged in
+	if handlers.GetLoggedInUsername(c) == "" {
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "You must be logged in"})
 	}
-	// Check role: allow Admin and Manager
-	r, err := c.Cookie("user_role")
-	if err != nil || (r.Value != "Admin" && r.Value != "Manager") {
-		return c.JSON(http.StatusForbidden, map[string]string{"error": "Permission denied"})
-	}
 
-	var req struct {
-		TripID      int64  `json:"trip_id"`
-		Passenger   string `json:"passenger"`
-		SocialID    string `json:"social_id"`
-		PhoneNumber string `json:"phone_number"`
-		DateOfBirth string `json:"date_of_birth"`
-		Status      string `json:"status"`
-	}
+	var req db.BookingRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
 	}
@@ -994,30 +926,45 @@ func AdminCreateBookingHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Trip, passenger name, and status are required"})
 	}
 	
-	// Check if the trip has available seats
-	isAvailable, err := db.CheckTripAvailability(req.TripID)
-	if err != nil {
-		log.Printf("Error checking trip availability: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("Failed to check trip availability: %v", err)})
-	}
+	req.ActorID = handlers.GetLoggedInUserID(c)
+	req.ActorUsername = handlers.GetLoggedInUsername(c)
 	
-	if !isAvailable {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Trip is fully booked. No seats available."})
-	}
-	
-	id, err := db.AddBooking(req.TripID, req.Passenger, req.SocialID, req.PhoneNumber, req.DateOfBirth, req.Status)
-	if err != nil {
+	// Book the chosen seat between the chosen stops, or a free one if none was chosen
+	booking, err := db.AddBooking(req)
+	if message, ok := segmentError(err); ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": message})
+	}
+	var transitionErr *db.BookingTransitionError
+	switch {
+	case errors.Is(err, db.ErrInvalidStatus):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid booking status"})
+	case errors.As(err, &transitionErr):
+		return c.JSON(http.StatusConflict, map[string]string{"error": "New bookings must be Confirmed. Use Hold Seat to keep a seat for a while."})
+	case errors.Is(err, db.ErrTripFull):
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{"error": "Trip is fully booked between these stops. No seats available.", "waitlist": true})
+	case errors.Is(err, db.ErrInvalidSeat):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Seat %s does not exist on this trip's vehicle", db.NormalizeSeatLabel(req.SeatNumber))})
+	case errors.Is(err, db.ErrSeatTaken):
+		return c.JSON(http.StatusConflict, map[string]string{"error": fmt.Sprintf("Seat %s is already taken. Please choose another seat.", db.NormalizeSeatLabel(req.SeatNumber))})
+	case err != nil:
 		log.Printf("Error creating booking: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create booking"})
 	}
-	return c.JSON(http.StatusOK, map[string]interface{}{ "message": "Booking created", "booking_id": id })
+	handlers.Audit(c, handlers.AuditCreate, db.AuditBooking, booking.ID, nil, handlers.AuditSnapshot(db.AuditBooking, booking.ID))
+	return c.JSON(http.StatusOK, map[string]interface{}{ "message": "Booking created", "booking_id": booking.ID, "reference": booking.Reference, "seat_number": booking.SeatNumber, "fare": booking.Fare })
 }
 
-// AdminUpdateBookingStatusHandler - Handler to update booking status
+// AdminUpdateBookingStatusHandler - Handler to update booking status. Cancelling
+// a booking refunds it under the cancellation rules unless the user may
+// override the refund and gives a reason. Changes the booking state machine
+// does not allow are refused with 409 Conflict.
 func AdminUpdateBookingStatusHandler(c echo.Context) error {
 	var req struct {
-		ID     int64  `json:"id"`
-		Status string `json:"status"`
+		ID                    int64  `json:"id"`
+		Status                string `json:"status"`
+		Reason                string `json:"reason"`
+		OverrideRefundPercent *int   `json:"override_refund_percent"`
+		OverrideReason        string `json:"override_reason"`
 	}
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
@@ -1025,26 +972,49 @@ func AdminUpdateBookingStatusHandler(c echo.Context) error {
 	if req.ID == 0 || req.Status == "" {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID and status required"})
 	}
+	if !db.IsValidBookingStatus(req.Status) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid booking status"})
+	}
 	
 	// Get current booking status before updating
 	var currentStatus string
 	var tripID int64
 	err := db.DB.QueryRow("SELECT status, trip_id FROM bookings WHERE id = ?", req.ID).Scan(&currentStatus, &tripID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Booking not found"})
+	}
 	if err != nil {
 		log.Printf("Error retrieving current booking status: %v", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve booking information"})
 	}
 	
-	// Update the booking status
-	if err := db.UpdateBookingStatus(req.ID, req.Status); err != nil {
+	before := handlers.AuditSnapshot(db.AuditBooking, req.ID)
+	response := map[string]interface{}{"message": "Booking status updated"}
+	if req.Status == db.BookingCancelled {
+		cancellation, offers, errResponse := cancelBooking(c, req.ID, req.OverrideRefundPercent, strings.TrimSpace(req.OverrideReason))
+		if cancellation == nil {
+			return errResponse
+		}
+		response["message"] = "Booking cancelled"
+		response["cancellation"] = cancellation
+		response["promoted"] = offers
+	} else if err := db.UpdateBookingStatus(req.ID, req.Status, handlers.GetLoggedInUserID(c), handlers.GetLoggedInUsername(c), strings.TrimSpace(req.Reason)); err != nil {
+		var transitionErr *db.BookingTransitionError
+		switch {
+		case errors.Is(err, db.ErrTripFull):
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Trip is fully booked. The booking cannot be reinstated."})
+		case errors.As(err, &transitionErr):
+			return c.JSON(http.StatusConflict, map[string]string{"error": transitionErr.Error()})
+		}
 		log.Printf("Error updating booking status: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update booking status"})
 	}
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditBooking, req.ID, before, handlers.AuditSnapshot(db.AuditBooking, req.ID))
 	
 	// Special processing for status changes related to capacity
 	// If booking was not cancelled before but is now, or vice versa
-	if (currentStatus != "Cancelled" && req.Status == "Cancelled") || 
-	   (currentStatus == "Cancelled" && req.Status != "Cancelled") {
+	if (currentStatus != db.BookingCancelled && req.Status == db.BookingCancelled) || 
+	   (currentStatus == db.BookingCancelled && req.Status != db.BookingRefunded) {
 		// Log the capacity change
 		capacity, err := db.GetTripVehicleCapacity(tripID)
 		if err != nil {
@@ -1060,7 +1030,22 @@ func AdminUpdateBookingStatusHandler(c echo.Context) error {
 			tripID, currentStatus, req.Status, capacity, count)
 	}
 	
-	return c.JSON(http.StatusOK, map[string]string{"message": "Booking status updated"})
+	return c.JSON(http.StatusOK, response)
+}
+
+// AdminBookingStatusHistoryHandler - Handler for the status changes of a booking
+func AdminBookingStatusHistoryHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid booking ID"})
+	}
+
+	history, err := db.GetBookingStatusHistory(id)
+	if err != nil {
+		log.Printf("Error retrieving booking status history: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve status history"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"history": history})
 }
 
 // AdminDeleteBookingHandler - Handler to delete a booking
@@ -1080,13 +1065,22 @@ func AdminDeleteBookingHandler(c echo.Context) error {
 		// Continue with deletion attempt even if this fails
 	}
 	
-	if err := db.DeleteBooking(id); err != nil {
+	before := handlers.AuditSnapshot(db.AuditBooking, id)
+	promoted, err := db.DeleteBooking(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Booking not found"})
+		}
+		if errors.Is(err, db.ErrBookingHasPayments) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Cannot delete a booking that has payments. Cancel it instead."})
+		}
 		log.Printf("Error deleting booking: %v", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Delete failed"})
 	}
+	handlers.Audit(c, handlers.AuditDelete, db.AuditBooking, id, before, nil)
 	
 	// Log capacity change if booking was not cancelled (as cancelled bookings don't affect capacity)
-	if err == nil && status != "Cancelled" && tripID > 0 {
+	if err == nil && status != db.BookingCancelled && status != db.BookingRefunded && tripID > 0 {
 		capacity, err := db.GetTripVehicleCapacity(tripID)
 		if err != nil {
 			log.Printf("Warning: Could not get trip capacity after booking deletion: %v", err)
@@ -1100,11 +1094,16 @@ func AdminDeleteBookingHandler(c echo.Context) error {
 		log.Printf("Trip ID %d: Booking deleted. Current capacity: %d, Active bookings: %d", 
 			tripID, capacity, count)
 	}
+
+	// The freed seat was offered to the first passenger on the waitlist it fits
+	auditOffers(c, promoted)
 	
-	return c.JSON(http.StatusOK, map[string]string{"message": "Booking deleted"})
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Booking deleted", "promoted": promoted})
 }
 
-// AdminTripCapacityHandler - Handler to get trip capacity information
+// AdminTripCapacityHandler - Handler to get trip capacity information. The
+// boarding and alighting query parameters (station names or codes) limit it
+// to part of the trip; the legs of the whole trip are always included.
 func AdminTripCapacityHandler(c echo.Context) error {
 	// Parse trip ID from path parameter
 	idParam := c.Param("id")
@@ -1113,59 +1112,110 @@ func AdminTripCapacityHandler(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid trip ID"})
 	}
 	
-	// Get vehicle capacity for the trip
-	capacity, err := db.GetTripVehicleCapacity(id)
+	// Get seat availability between the stops
+	capacity, err := db.GetTripCapacity(id, c.QueryParam("boarding"), c.QueryParam("alighting"))
 	if err != nil {
-		log.Printf("Error getting trip vehicle capacity: %v", err)
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Trip not found"})
+		}
+		if message, ok := segmentError(err); ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": message})
+		}
+		log.Printf("Error getting trip capacity: %v", err)
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get trip capacity"})
 	}
 	
-	// Get current booking count
-	bookingsCount, err := db.GetTripBookingsCount(id)
+	boarded, awaiting, noShow, err := db.GetTripBoardingCounts(id)
 	if err != nil {
-		log.Printf("Error getting trip bookings count: %v", err)
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get bookings count"})
-	}
-	
-	// Calculate available seats
-	available := capacity - bookingsCount
-	if available < 0 {
-		available = 0 // Safeguard against negative values
+		log.Printf("Error getting trip boarding counts: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get boarding counts"})
 	}
 	
 	// Return capacity information
 	return c.JSON(http.StatusOK, map[string]interface{}{
-		"capacity": capacity,
-		"booked": bookingsCount,
-		"available": available,
-		"is_available": available > 0,
+		"capacity": capacity.Capacity,
+		"boarding": capacity.Boarding,
+		"alighting": capacity.Alighting,
+		"booked": capacity.Booked,
+		"available": capacity.Available,
+		"is_available": capacity.Available > 0,
+		"legs": capacity.Legs,
+		"boarded": boarded,
+		"awaiting_boarding": awaiting,
+		"no_show": noShow,
 	})
 }
 
+// AdminTripSeatsHandler - Handler to get the seat map of a trip, optionally
+// between the boarding and alighting stations given as query parameters
+func AdminTripSeatsHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid trip ID"})
+	}
+
+	seatMap, err := db.GetTripSeatMap(id, c.QueryParam("boarding"), c.QueryParam("alighting"))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Trip not found"})
+		}
+		if message, ok := segmentError(err); ok {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": message})
+		}
+		log.Printf("Error getting seat map for trip %d: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to get seat map"})
+	}
+	return c.JSON(http.StatusOK, seatMap)
+}
+
+// reportColumns lists the columns of each report type, in display order
+var reportColumns = map[string][]string{
+	"booking_summary":      {"date", "bookings"},
+	"route_performance":    {"route", "origin", "destination", "bookings"},
+	"cancellation_summary": {"date", "bookings", "cancellations", "cancellation_rate"},
+	"daily_revenue":        {"date", "payments", "refunds", "net"},
+	"revenue_by_route":     {"origin", "destination", "bookings", "net"},
+	"revenue_by_method":    {"method", "payments", "refunds", "net"},
+	"refunds":              {"time", "booking_id", "passenger", "origin", "destination", "amount", "method", "cashier", "reference"},
+}
+
+// reportData runs a report over a date range. ok is false for an unknown report type.
+func reportData(reportType, from, to string) (columns []string, rows []map[string]interface{}, ok bool, err error) {
+	columns, ok = reportColumns[reportType]
+	if !ok {
+		return nil, nil, false, nil
+	}
+	switch reportType {
+	case "booking_summary":
+		rows, err = db.GetBookingSummary(from, to)
+	case "route_performance":
+		rows, err = db.GetRoutePerformance(from, to)
+	case "cancellation_summary":
+		rows, err = db.GetCancellationSummary(from, to)
+	case "daily_revenue":
+		rows, err = db.GetDailyRevenue(from, to)
+	case "revenue_by_route":
+		rows, err = db.GetRevenueByRoute(from, to)
+	case "revenue_by_method":
+		rows, err = db.GetRevenueByPaymentMethod(from, to)
+	case "refunds":
+		rows, err = db.GetRefunds(from, to)
+	}
+	return columns, rows, true, err
+}
+
 // AdminReportsDataHandler - Handler for getting reports data
 func AdminReportsDataHandler(c echo.Context) error {
-	// Ensure user is logged in; group middleware enforces role
-	if cookie, err := c.Cookie("username"); err != nil || cookie.Value == "" {
+	// Ensure user is logged in; RequirePermission enforces access
+	if handlers.GetLoggedInUsername(c) == "" {
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "You must be logged in"})
 	}
 	// Parse query params
 	reportType := c.QueryParam("report")
 	from := c.QueryParam("from")
 	to := c.QueryParam("to")
-	var columns []string
-	var rowsData []map[string]interface{}
-	var err error
-	switch reportType {
-	case "booking_summary":
-		columns = []string{"date", "bookings"}
-		rowsData, err = db.GetBookingSummary(from, to)
-	case "route_performance":
-		columns = []string{"origin", "destination", "bookings"}
-		rowsData, err = db.GetRoutePerformance(from, to)
-	case "cancellation_summary":
-		columns = []string{"date", "bookings", "cancellations", "cancellation_rate"}
-		rowsData, err = db.GetCancellationSummary(from, to)
-	default:
+	columns, rowsData, ok, err := reportData(reportType, from, to)
+	if !ok {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unknown report type"})
 	}
 	if err != nil {
@@ -1178,28 +1228,16 @@ func AdminReportsDataHandler(c echo.Context) error {
 
 // AdminReportsExportHandler - Handler for exporting reports to XLSX
 func AdminReportsExportHandler(c echo.Context) error {
-	// Ensure user is logged in; group middleware enforces role
-	if cookie, err := c.Cookie("username"); err != nil || cookie.Value == "" {
+	// Ensure user is logged in; RequirePermission enforces access
+	if handlers.GetLoggedInUsername(c) == "" {
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "You must be logged in"})
 	}
 	// Parse params
 	reportType := c.QueryParam("report")
 	from := c.QueryParam("from")
 	to := c.QueryParam("to")
-	var columns []string
-	var rowsData []map[string]interface{}
-	var err error
-	switch reportType {
-	case "booking_summary":
-		columns = []string{"date", "bookings"}
-		rowsData, err = db.GetBookingSummary(from, to)
-	case "route_performance":
-		columns = []string{"origin", "destination", "bookings"}
-		rowsData, err = db.GetRoutePerformance(from, to)
-	case "cancellation_summary":
-		columns = []string{"date", "bookings", "cancellations", "cancellation_rate"}
-		rowsData, err = db.GetCancellationSummary(from, to)
-	default:
+	columns, rowsData, ok, err := reportData(reportType, from, to)
+	if !ok {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unknown report type"})
 	}
 	if err != nil {
@@ -1236,14 +1274,10 @@ func AdminReportsExportHandler(c echo.Context) error {
 
 // AdminBackupHandler - Handler to create a database backup
 func AdminBackupHandler(c echo.Context) error {
-	// Ensure admin
-	if cookie, err := c.Cookie("username"); err != nil || cookie.Value == "" {
+	// Ensure logged in
+	if handlers.GetLoggedInUsername(c) == "" {
 		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "You must be logged in"})
 	}
-	// Check role: allow Admin and Manager
-	if role, err := c.Cookie("user_role"); err != nil || (role.Value != "Admin" && role.Value != "Manager") {
-		return c.JSON(http.StatusForbidden, map[string]string{"error": "Permission denied"})
-	}
 	// Perform backup
 	dbPath := os.Getenv("SQLITE_DB_PATH")
 	backupPath, err := utils.BackupDatabase(dbPath)
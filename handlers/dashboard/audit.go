@@ -0,0 +1,84 @@
+package dashboard
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/xuri/excelize/v2"
+
+	"SecureSignIn/db"
+)
+
+// auditFilter reads the audit log filters from the query string
+func auditFilter(c echo.Context) db.AuditFilter {
+	f := db.AuditFilter{
+		Actor:      c.QueryParam("actor"),
+		Action:     c.QueryParam("action"),
+		EntityType: c.QueryParam("entity_type"),
+		From:       c.QueryParam("from"),
+		To:         c.QueryParam("to"),
+	}
+	if id, err := strconv.ParseInt(c.QueryParam("entity_id"), 10, 64); err == nil && id > 0 {
+		f.EntityID = id
+	}
+	return f
+}
+
+// AdminAuditLogHandler - Handler for listing audit log entries with filters and pagination
+func AdminAuditLogHandler(c echo.Context) error {
+	page := 1
+	pageSize := 25
+	if p, err := strconv.Atoi(c.QueryParam("page")); err == nil && p > 0 {
+		page = p
+	}
+	if ps, err := strconv.Atoi(c.QueryParam("page_size")); err == nil && ps > 0 && ps <= 200 {
+		pageSize = ps
+	}
+
+	entries, total, err := db.GetAuditLog(auditFilter(c), pageSize, (page-1)*pageSize)
+	if err != nil {
+		log.Printf("Error retrieving audit log: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve audit log"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"total": total, "entries": entries})
+}
+
+// AdminAuditExportHandler - Handler for exporting the filtered audit log to XLSX
+func AdminAuditExportHandler(c echo.Context) error {
+	entries, _, err := db.GetAuditLog(auditFilter(c), 0, 0)
+	if err != nil {
+		log.Printf("Error retrieving audit log for export: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to export audit log"})
+	}
+
+	f := excelize.NewFile()
+	sheet := f.GetSheetName(0)
+	columns := []string{"id", "time", "actor", "action", "entity_type", "entity_id", "before", "after", "ip_address", "request_id"}
+	for i, col := range columns {
+		cell, _ := excelize.CoordinatesToCellName(i+1, 1)
+		f.SetCellValue(sheet, cell, col)
+	}
+	for r, e := range entries {
+		values := []interface{}{
+			e.ID, e.CreatedAt.Format("2006-01-02 15:04:05"), e.ActorUsername, e.Action, e.EntityType, e.EntityID,
+			string(e.Before), string(e.After), e.IPAddress, e.RequestID,
+		}
+		for i, v := range values {
+			cell, _ := excelize.CoordinatesToCellName(i+1, r+2)
+			f.SetCellValue(sheet, cell, v)
+		}
+	}
+
+	filename := fmt.Sprintf("audit_log_%s.xlsx", time.Now().Format("20060102_150405"))
+	c.Response().Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+	c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	if err := f.Write(c.Response().Writer); err != nil {
+		log.Printf("Error writing audit log Excel file: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to write Excel file"})
+	}
+	return nil
+}
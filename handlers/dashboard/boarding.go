@@ -0,0 +1,68 @@
+package dashboard
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+	"SecureSignIn/handlers"
+)
+
+// BoardingScanHandler - Handler to board a passenger from the scanned code of
+// their ticket. trip_id is optional and, if set, the ticket must be for that trip.
+func BoardingScanHandler(c echo.Context) error {
+	var req struct {
+		Code   string `json:"code"`
+		TripID int64  `json:"trip_id"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	req.Code = strings.TrimSpace(req.Code)
+	if req.Code == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Ticket code required"})
+	}
+
+	var before interface{}
+	if claims, err := db.VerifyTicket(req.Code); err == nil {
+		before = handlers.AuditSnapshot(db.AuditBooking, claims.BookingID)
+	}
+	pass, err := db.BoardTicket(req.Code, req.TripID, handlers.GetLoggedInUserID(c), handlers.GetLoggedInUsername(c))
+	if err != nil {
+		message, status := boardingError(err)
+		if status == 0 {
+			log.Printf("Error boarding ticket: %v", err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to board passenger"})
+		}
+		return c.JSON(status, map[string]interface{}{"error": message, "booking": pass})
+	}
+
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditBooking, pass.BookingID, before, handlers.AuditSnapshot(db.AuditBooking, pass.BookingID))
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Passenger boarded", "booking": pass})
+}
+
+// boardingError turns a rejected scan into the message shown at the door and
+// its HTTP status, or a status of 0 for unexpected errors
+func boardingError(err error) (string, int) {
+	switch {
+	case errors.Is(err, db.ErrInvalidTicket):
+		return "Ticket is not valid", http.StatusBadRequest
+	case errors.Is(err, db.ErrWrongTrip):
+		return "Ticket is for another trip", http.StatusConflict
+	case errors.Is(err, db.ErrTicketOutdated):
+		return "Ticket has been replaced. Please print a new ticket.", http.StatusConflict
+	case errors.Is(err, db.ErrAlreadyBoarded):
+		return "Passenger has already boarded", http.StatusConflict
+	case errors.Is(err, db.ErrNotBoardable):
+		return "Booking is not confirmed", http.StatusConflict
+	case errors.Is(err, db.ErrBoardingNotOpen):
+		return "Boarding has not opened for this trip yet", http.StatusConflict
+	case errors.Is(err, db.ErrBoardingClosed):
+		return "Boarding has closed for this trip", http.StatusConflict
+	}
+	return "", 0
+}
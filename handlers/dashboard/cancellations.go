@@ -0,0 +1,117 @@
+package dashboard
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+	"SecureSignIn/handlers"
+)
+
+// cancelBooking cancels a booking for the logged in user, who must hold the
+// override permission to replace the refund the rules give, and records the
+// waitlist offers made for the freed seat. On failure it sends the error
+// response and returns a nil cancellation with the result of sending it.
+func cancelBooking(c echo.Context, bookingID int64, overridePercent *int, reason string) (*db.Cancellation, []db.WaitlistOffer, error) {
+	if overridePercent != nil {
+		allowed, err := db.HasPermission(handlers.GetLoggedInUserRole(c), db.PermBookingsOverrideRefund)
+		if err != nil {
+			log.Printf("Error checking refund override permission: %v", err)
+		}
+		if !allowed {
+			return nil, nil, c.JSON(http.StatusForbidden, map[string]string{"error": "You do not have permission to override the refund"})
+		}
+	}
+
+	cancellation, offers, err := db.CancelBooking(db.CancelRequest{
+		BookingID:       bookingID,
+		OverridePercent: overridePercent,
+		Reason:          reason,
+		CashierID:       handlers.GetLoggedInUserID(c),
+		CashierUsername: handlers.GetLoggedInUsername(c),
+	})
+	var transitionErr *db.BookingTransitionError
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, nil, c.JSON(http.StatusNotFound, map[string]string{"error": "Booking not found"})
+	case errors.Is(err, db.ErrOverrideReasonRequired):
+		return nil, nil, c.JSON(http.StatusBadRequest, map[string]string{"error": "A reason is required to override the refund"})
+	case errors.Is(err, db.ErrAlreadyCancelled):
+		return nil, nil, c.JSON(http.StatusConflict, map[string]string{"error": "Booking is already cancelled"})
+	case errors.As(err, &transitionErr):
+		return nil, nil, c.JSON(http.StatusConflict, map[string]string{"error": transitionErr.Error()})
+	case err != nil:
+		log.Printf("Error cancelling booking %d: %v", bookingID, err)
+		return nil, nil, c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to cancel booking"})
+	}
+
+	if cancellation.RefundPaymentID != 0 {
+		handlers.Audit(c, handlers.AuditCreate, db.AuditPayment, cancellation.RefundPaymentID, nil,
+			handlers.AuditSnapshot(db.AuditPayment, cancellation.RefundPaymentID))
+	}
+	auditOffers(c, offers)
+	return cancellation, offers, nil
+}
+
+// AdminCancellationQuoteHandler - Handler for the refund a booking would get if cancelled now
+func AdminCancellationQuoteHandler(c echo.Context) error {
+	bookingID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid booking ID"})
+	}
+
+	quote, err := db.QuoteCancellation(bookingID)
+	switch {
+	case err == sql.ErrNoRows:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Booking not found"})
+	case errors.Is(err, db.ErrAlreadyCancelled):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Booking is already cancelled"})
+	case err != nil:
+		log.Printf("Error quoting cancellation of booking %d: %v", bookingID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to work out the refund"})
+	}
+	return c.JSON(http.StatusOK, quote)
+}
+
+// AdminCancellationRulesHandler - Handler for listing the cancellation rules
+func AdminCancellationRulesHandler(c echo.Context) error {
+	rules, err := db.GetCancellationRules()
+	if err != nil {
+		log.Printf("Error retrieving cancellation rules: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve cancellation rules"})
+	}
+	return c.JSON(http.StatusOK, rules)
+}
+
+// AdminUpdateCancellationRulesHandler - Handler to replace the cancellation rules
+func AdminUpdateCancellationRulesHandler(c echo.Context) error {
+	var req struct {
+		Rules []db.CancellationRule `json:"rules"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	before, err := db.GetCancellationRules()
+	if err != nil {
+		log.Printf("Error retrieving cancellation rules: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update cancellation rules"})
+	}
+	if err := db.SetCancellationRules(req.Rules); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	after, err := db.GetCancellationRules()
+	if err != nil {
+		log.Printf("Error retrieving cancellation rules: %v", err)
+	}
+
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditPolicy, 0,
+		map[string]interface{}{"cancellation_rules": before},
+		map[string]interface{}{"cancellation_rules": after})
+	return c.JSON(http.StatusOK, map[string]string{"message": "Cancellation rules updated"})
+}
@@ -0,0 +1,212 @@
+package dashboard
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+	"SecureSignIn/handlers"
+)
+
+// nullInt returns the value of n, or nil so it is written as JSON null
+func nullInt(n sql.NullInt64) interface{} {
+	if !n.Valid {
+		return nil
+	}
+	return n.Int64
+}
+
+// fareRequest is the body of the create and update fare endpoints
+type fareRequest struct {
+	ID            int64  `json:"id"`
+	Origin        string `json:"origin"`
+	Destination   string `json:"destination"`
+	BaseFareCents int64  `json:"base_fare_cents"`
+	ValidFrom     string `json:"valid_from"`
+	ValidTo       string `json:"valid_to"`
+}
+
+func (req fareRequest) fare() db.Fare {
+	return db.Fare{
+		ID:            req.ID,
+		Origin:        strings.TrimSpace(req.Origin),
+		Destination:   strings.TrimSpace(req.Destination),
+		BaseFareCents: req.BaseFareCents,
+		ValidFrom:     strings.TrimSpace(req.ValidFrom),
+		ValidTo:       strings.TrimSpace(req.ValidTo),
+	}
+}
+
+// AdminFaresHandler - Handler for listing fares, vehicle type multipliers and discounts
+func AdminFaresHandler(c echo.Context) error {
+	fares, err := db.GetFares()
+	if err != nil {
+		log.Printf("Error retrieving fares: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve fares"})
+	}
+	multipliers, err := db.GetVehicleTypeMultipliers()
+	if err != nil {
+		log.Printf("Error retrieving vehicle type multipliers: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve fares"})
+	}
+	discounts, err := db.GetFareDiscounts()
+	if err != nil {
+		log.Printf("Error retrieving fare discounts: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve fares"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"fares":       fares,
+		"multipliers": multipliers,
+		"discounts":   discounts,
+	})
+}
+
+// AdminCreateFareHandler - Handler to add a fare for a route
+func AdminCreateFareHandler(c echo.Context) error {
+	var req fareRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	id, err := db.AddFare(req.fare())
+	if err != nil {
+		if errors.Is(err, db.ErrFareOverlap) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Another fare for this route is in effect during these dates"})
+		}
+		log.Printf("Error creating fare: %v", err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	handlers.Audit(c, handlers.AuditCreate, db.AuditFare, id, nil, handlers.AuditSnapshot(db.AuditFare, id))
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Fare created", "fare_id": id})
+}
+
+// AdminUpdateFareHandler - Handler to change a fare
+func AdminUpdateFareHandler(c echo.Context) error {
+	var req fareRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if req.ID == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Fare ID required"})
+	}
+
+	before := handlers.AuditSnapshot(db.AuditFare, req.ID)
+	if err := db.UpdateFare(req.fare()); err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Fare not found"})
+		case errors.Is(err, db.ErrFareOverlap):
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Another fare for this route is in effect during these dates"})
+		}
+		log.Printf("Error updating fare %d: %v", req.ID, err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditFare, req.ID, before, handlers.AuditSnapshot(db.AuditFare, req.ID))
+	return c.JSON(http.StatusOK, map[string]string{"message": "Fare updated"})
+}
+
+// AdminDeleteFareHandler - Handler to delete a fare
+func AdminDeleteFareHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid fare ID"})
+	}
+
+	before := handlers.AuditSnapshot(db.AuditFare, id)
+	if before == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Fare not found"})
+	}
+	if err := db.DeleteFare(id); err != nil {
+		log.Printf("Error deleting fare %d: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Delete failed"})
+	}
+	handlers.Audit(c, handlers.AuditDelete, db.AuditFare, id, before, nil)
+	return c.JSON(http.StatusOK, map[string]string{"message": "Fare deleted"})
+}
+
+// AdminUpdateFareMultiplierHandler - Handler to set the fare multiplier of a vehicle type
+func AdminUpdateFareMultiplierHandler(c echo.Context) error {
+	var req struct {
+		VehicleType string  `json:"vehicle_type"`
+		Multiplier  float64 `json:"multiplier"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	req.VehicleType = strings.TrimSpace(req.VehicleType)
+
+	multipliers, err := db.GetVehicleTypeMultipliers()
+	if err != nil {
+		log.Printf("Error retrieving vehicle type multipliers: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update multiplier"})
+	}
+	previous, ok := multipliers[req.VehicleType]
+	if !ok {
+		previous = 1
+	}
+	if err := db.SetVehicleTypeMultiplier(req.VehicleType, req.Multiplier); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditPolicy, 0,
+		map[string]interface{}{"vehicle_type": req.VehicleType, "fare_multiplier": previous},
+		map[string]interface{}{"vehicle_type": req.VehicleType, "fare_multiplier": req.Multiplier})
+	return c.JSON(http.StatusOK, map[string]string{"message": "Multiplier updated"})
+}
+
+// AdminUpdateFareDiscountHandler - Handler to change the child or senior discount
+func AdminUpdateFareDiscountHandler(c echo.Context) error {
+	var req db.FareDiscount
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	discounts, err := db.GetFareDiscounts()
+	if err != nil {
+		log.Printf("Error retrieving fare discounts: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update discount"})
+	}
+	var before interface{}
+	for _, d := range discounts {
+		if d.Category == req.Category {
+			before = d
+		}
+	}
+	if err := db.UpdateFareDiscount(req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditPolicy, 0, before, req)
+	return c.JSON(http.StatusOK, map[string]string{"message": "Discount updated"})
+}
+
+// AdminFareQuoteHandler - Handler to price a ticket on a trip for a passenger's
+// date of birth, optionally between the boarding and alighting stations given
+// as query parameters
+func AdminFareQuoteHandler(c echo.Context) error {
+	tripID, err := strconv.ParseInt(c.QueryParam("trip_id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid trip ID"})
+	}
+
+	quote, err := db.QuoteFare(tripID, c.QueryParam("boarding"), c.QueryParam("alighting"), c.QueryParam("date_of_birth"))
+	if message, ok := segmentError(err); ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": message})
+	}
+	switch {
+	case err == sql.ErrNoRows:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Trip not found"})
+	case errors.Is(err, db.ErrNoFare):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "No fare is set between these stops on the travel date"})
+	case err != nil:
+		log.Printf("Error quoting fare for trip %d: %v", tripID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to price ticket"})
+	}
+	return c.JSON(http.StatusOK, quote)
+}
@@ -0,0 +1,112 @@
+package dashboard
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+	"SecureSignIn/handlers"
+)
+
+// holdError turns a seat hold that cannot be confirmed or released into the
+// message shown to staff and its status code. ok is false for any other error.
+func holdError(err error) (message string, status int, ok bool) {
+	switch {
+	case err == sql.ErrNoRows:
+		return "Booking not found", http.StatusNotFound, true
+	case errors.Is(err, db.ErrHoldExpired):
+		return "The hold has run out and the seat has been released", http.StatusConflict, true
+	case errors.Is(err, db.ErrNotHeld):
+		return "This booking is not a seat hold, or has already been confirmed", http.StatusConflict, true
+	}
+	return "", 0, false
+}
+
+// HoldSeatHandler - Handler to hold a seat for a passenger while they find
+// their ID or payment. The seat is kept for minutes, or the default hold if
+// not given, and released if the hold is not confirmed in time.
+func HoldSeatHandler(c echo.Context) error {
+	var req struct {
+		db.BookingRequest
+		Minutes int `json:"minutes"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if req.TripID == 0 || req.Passenger == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Trip and passenger name are required"})
+	}
+	req.ActorID = handlers.GetLoggedInUserID(c)
+	req.ActorUsername = handlers.GetLoggedInUsername(c)
+
+	booking, err := db.HoldSeat(req.BookingRequest, time.Duration(req.Minutes)*time.Minute)
+	if message, ok := segmentError(err); ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": message})
+	}
+	switch {
+	case errors.Is(err, db.ErrHoldTooLong):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("A seat can be held for at most %d minutes", int(db.SeatHoldMax.Minutes()))})
+	case errors.Is(err, db.ErrTripFull):
+		return c.JSON(http.StatusBadRequest, map[string]interface{}{"error": "Trip is fully booked between these stops. No seats available.", "waitlist": true})
+	case errors.Is(err, db.ErrInvalidSeat):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("Seat %s does not exist on this trip's vehicle", db.NormalizeSeatLabel(req.SeatNumber))})
+	case errors.Is(err, db.ErrSeatTaken):
+		return c.JSON(http.StatusConflict, map[string]string{"error": fmt.Sprintf("Seat %s is already taken. Please choose another seat.", db.NormalizeSeatLabel(req.SeatNumber))})
+	case err != nil:
+		log.Printf("Error holding seat: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to hold seat"})
+	}
+	handlers.Audit(c, handlers.AuditCreate, db.AuditBooking, booking.ID, nil, handlers.AuditSnapshot(db.AuditBooking, booking.ID))
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Seat held", "booking_id": booking.ID, "reference": booking.Reference,
+		"seat_number": booking.SeatNumber, "fare": booking.Fare, "hold_expires_at": booking.HoldExpiresAt})
+}
+
+// ConfirmHoldHandler - Handler to confirm a seat hold before it runs out
+func ConfirmHoldHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid booking ID"})
+	}
+
+	before := handlers.AuditSnapshot(db.AuditBooking, id)
+	err = db.ConfirmHold(id, handlers.GetLoggedInUserID(c), handlers.GetLoggedInUsername(c))
+	if message, status, ok := holdError(err); ok {
+		return c.JSON(status, map[string]string{"error": message})
+	}
+	if err != nil {
+		log.Printf("Error confirming seat hold %d: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to confirm booking"})
+	}
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditBooking, id, before, handlers.AuditSnapshot(db.AuditBooking, id))
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Booking confirmed", "booking_id": id})
+}
+
+// ReleaseHoldHandler - Handler to give up a seat hold. The seat is offered
+// to the trip's waitlist.
+func ReleaseHoldHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid booking ID"})
+	}
+
+	before := handlers.AuditSnapshot(db.AuditBooking, id)
+	offers, err := db.ReleaseHold(id, handlers.GetLoggedInUserID(c), handlers.GetLoggedInUsername(c))
+	if message, status, ok := holdError(err); ok {
+		return c.JSON(status, map[string]string{"error": message})
+	}
+	if err != nil {
+		log.Printf("Error releasing seat hold %d: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to release seat"})
+	}
+	log.Printf("Released seat hold %d", id)
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditBooking, id, before, handlers.AuditSnapshot(db.AuditBooking, id))
+	auditOffers(c, offers)
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Seat released", "promoted": offers})
+}
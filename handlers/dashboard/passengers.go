@@ -0,0 +1,74 @@
+package dashboard
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+	"SecureSignIn/handlers"
+)
+
+// SearchPassengersHandler - Handler for looking up passengers by national ID
+// or the start of their phone number, to fill in the booking form
+func SearchPassengersHandler(c echo.Context) error {
+	passengers, err := db.SearchPassengers(c.QueryParam("q"))
+	if err != nil {
+		log.Printf("Error searching passengers: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to search passengers"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"passengers": passengers})
+}
+
+// PassengerHandler - Handler for a passenger's details with their upcoming and past trips
+func PassengerHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid passenger ID"})
+	}
+
+	passenger, err := db.GetPassenger(id)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Passenger not found"})
+	}
+	if err != nil {
+		log.Printf("Error retrieving passenger %d: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve passenger"})
+	}
+	return c.JSON(http.StatusOK, passenger)
+}
+
+// AdminMergePassengersHandler - Handler to merge a duplicate passenger record
+// into another. The duplicate's bookings move to the record kept.
+func AdminMergePassengersHandler(c echo.Context) error {
+	var req struct {
+		KeepID      int64 `json:"keep_id"`
+		DuplicateID int64 `json:"duplicate_id"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if req.KeepID == 0 || req.DuplicateID == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Both passengers are required"})
+	}
+
+	keepBefore := handlers.AuditSnapshot(db.AuditPassenger, req.KeepID)
+	duplicateBefore := handlers.AuditSnapshot(db.AuditPassenger, req.DuplicateID)
+	moved, err := db.MergePassengers(req.KeepID, req.DuplicateID)
+	switch {
+	case err == sql.ErrNoRows:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Passenger not found"})
+	case errors.Is(err, db.ErrSamePassenger):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Choose two different passengers to merge"})
+	case err != nil:
+		log.Printf("Error merging passenger %d into %d: %v", req.DuplicateID, req.KeepID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to merge passengers"})
+	}
+	handlers.Audit(c, handlers.AuditDelete, db.AuditPassenger, req.DuplicateID, duplicateBefore, nil)
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditPassenger, req.KeepID, keepBefore, handlers.AuditSnapshot(db.AuditPassenger, req.KeepID))
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Passengers merged", "passenger_id": req.KeepID, "bookings_moved": moved})
+}
@@ -0,0 +1,127 @@
+package dashboard
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+	"SecureSignIn/handlers"
+)
+
+// paymentRequest is the body of the payment and refund endpoints
+type paymentRequest struct {
+	AmountCents int64  `json:"amount_cents"`
+	Method      string `json:"method"`
+	Reference   string `json:"reference"`
+}
+
+// AdminPaymentsHandler - Handler for listing the payments ledger with filters
+func AdminPaymentsHandler(c echo.Context) error {
+	filter := db.PaymentFilter{
+		Method: c.QueryParam("method"),
+		From:   c.QueryParam("from"),
+		To:     c.QueryParam("to"),
+	}
+	if id, err := strconv.ParseInt(c.QueryParam("booking_id"), 10, 64); err == nil && id > 0 {
+		filter.BookingID = id
+	}
+
+	payments, err := db.GetPayments(filter)
+	if err != nil {
+		log.Printf("Error retrieving payments: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve payments"})
+	}
+	return c.JSON(http.StatusOK, payments)
+}
+
+// AdminBookingPaymentsHandler - Handler for the payments and outstanding balance of a booking
+func AdminBookingPaymentsHandler(c echo.Context) error {
+	bookingID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid booking ID"})
+	}
+
+	balance, err := db.GetBookingBalance(bookingID)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Booking not found"})
+	}
+	if err != nil {
+		log.Printf("Error retrieving balance of booking %d: %v", bookingID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve payments"})
+	}
+	payments, err := db.GetPayments(db.PaymentFilter{BookingID: bookingID})
+	if err != nil {
+		log.Printf("Error retrieving payments of booking %d: %v", bookingID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve payments"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"balance": balance, "payments": payments})
+}
+
+// AdminRecordPaymentHandler - Handler to record a payment taken for a booking
+func AdminRecordPaymentHandler(c echo.Context) error {
+	return recordLedgerEntry(c, false)
+}
+
+// AdminRecordRefundHandler - Handler to record a refund paid out for a booking
+func AdminRecordRefundHandler(c echo.Context) error {
+	return recordLedgerEntry(c, true)
+}
+
+// recordLedgerEntry records a payment or refund for the booking in the URL,
+// with the logged in user as the cashier
+func recordLedgerEntry(c echo.Context, refund bool) error {
+	bookingID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid booking ID"})
+	}
+	var req paymentRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	req.Method = strings.ToLower(strings.TrimSpace(req.Method))
+	req.Reference = strings.TrimSpace(req.Reference)
+	if req.AmountCents <= 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Amount must be greater than zero"})
+	}
+	if len(req.Reference) > 100 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Reference must be at most 100 characters"})
+	}
+
+	record := db.RecordPayment
+	if refund {
+		record = db.RecordRefund
+	}
+	id, err := record(bookingID, req.AmountCents, req.Method, handlers.GetLoggedInUserID(c), handlers.GetLoggedInUsername(c), req.Reference)
+	switch {
+	case err == sql.ErrNoRows:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Booking not found"})
+	case errors.Is(err, db.ErrOverpayment):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Payment is more than the booking's outstanding balance"})
+	case errors.Is(err, db.ErrRefundTooLarge):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Refund is more than was paid for this booking"})
+	case errors.Is(err, db.ErrBookingReleased):
+		return c.JSON(http.StatusConflict, map[string]string{"error": "This booking has been cancelled or refunded and cannot be paid for"})
+	case errors.Is(err, db.ErrInvalidPaymentMethod):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Payment method must be cash, card or transfer"})
+	case err != nil:
+		log.Printf("Error recording payment for booking %d: %v", bookingID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to record payment"})
+	}
+	handlers.Audit(c, handlers.AuditCreate, db.AuditPayment, id, nil, handlers.AuditSnapshot(db.AuditPayment, id))
+
+	balance, err := db.GetBookingBalance(bookingID)
+	if err != nil {
+		log.Printf("Error retrieving balance of booking %d: %v", bookingID, err)
+	}
+	message := "Payment recorded"
+	if refund {
+		message = "Refund recorded"
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": message, "payment_id": id, "balance": balance})
+}
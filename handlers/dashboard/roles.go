@@ -0,0 +1,215 @@
+package dashboard
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+	"SecureSignIn/handlers"
+	"SecureSignIn/utils"
+)
+
+// grantableRole resolves a role name and checks that the logged in user holds
+// every permission of that role, so nobody can hand out more access than they
+// have. It returns the role's canonical name, or an HTTP status and message.
+func grantableRole(c echo.Context, name string) (string, int, string) {
+	role, err := db.GetRoleByName(strings.TrimSpace(name))
+	if err == sql.ErrNoRows {
+		return "", http.StatusBadRequest, "Invalid role"
+	}
+	if err != nil {
+		log.Printf("Error looking up role %s: %v", name, err)
+		return "", http.StatusInternalServerError, "Failed to check role"
+	}
+
+	allowed, err := db.CanGrantRole(handlers.GetLoggedInUserRole(c), role.Name)
+	if err != nil {
+		log.Printf("Error checking whether %s may grant role %s: %v", handlers.GetLoggedInUsername(c), role.Name, err)
+		return "", http.StatusInternalServerError, "Failed to check role"
+	}
+	if !allowed {
+		return "", http.StatusForbidden, "You cannot assign a role with permissions you do not have"
+	}
+	return role.Name, 0, ""
+}
+
+// manageableUser checks that the logged in user could grant the role of the
+// user they are about to change. It returns 0 if they may, or an HTTP status and message.
+func manageableUser(c echo.Context, userID int64) (int, string) {
+	role, err := db.GetUserRole(userID)
+	if err == sql.ErrNoRows {
+		return http.StatusNotFound, "User not found"
+	}
+	if err != nil {
+		log.Printf("Error retrieving role for user %d: %v", userID, err)
+		return http.StatusInternalServerError, "Failed to retrieve user"
+	}
+
+	allowed, err := db.CanGrantRole(handlers.GetLoggedInUserRole(c), role)
+	if err != nil {
+		log.Printf("Error checking whether %s may manage user %d: %v", handlers.GetLoggedInUsername(c), userID, err)
+		return http.StatusInternalServerError, "Failed to check permissions"
+	}
+	if !allowed {
+		return http.StatusForbidden, "You cannot change a user whose role has permissions you do not have"
+	}
+	return 0, ""
+}
+
+// roleRequest is the body of the create and update role endpoints
+type roleRequest struct {
+	ID          int64    `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Dashboard   string   `json:"dashboard"`
+	Permissions []string `json:"permissions"`
+}
+
+// validate checks the dashboard and permissions of a role request
+func (req *roleRequest) validate() string {
+	req.Description = strings.TrimSpace(req.Description)
+	if len(req.Description) > 200 {
+		return "Description must be at most 200 characters"
+	}
+	if req.Dashboard == "" {
+		req.Dashboard = db.DashboardOperator
+	}
+	if !db.IsValidDashboard(req.Dashboard) {
+		return "Invalid dashboard"
+	}
+	for _, perm := range req.Permissions {
+		if !db.IsValidPermission(perm) {
+			return "Unknown permission: " + perm
+		}
+	}
+	return ""
+}
+
+// AdminPermissionsHandler - Handler for listing every permission a role can grant
+func AdminPermissionsHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"permissions": db.Permissions,
+		"dashboards":  db.Dashboards,
+	})
+}
+
+// AdminRolesHandler - Handler for listing roles with their permissions
+func AdminRolesHandler(c echo.Context) error {
+	roles, err := db.GetRoles()
+	if err != nil {
+		log.Printf("Error retrieving roles: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve roles"})
+	}
+	return c.JSON(http.StatusOK, roles)
+}
+
+// AdminAssignableRolesHandler - Handler for listing the roles the logged in user may assign to others
+func AdminAssignableRolesHandler(c echo.Context) error {
+	roles, err := db.GetRoles()
+	if err != nil {
+		log.Printf("Error retrieving roles: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve roles"})
+	}
+
+	actorRole := handlers.GetLoggedInUserRole(c)
+	names := []string{}
+	for _, role := range roles {
+		allowed, err := db.CanGrantRole(actorRole, role.Name)
+		if err != nil {
+			log.Printf("Error checking whether role %s may grant %s: %v", actorRole, role.Name, err)
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve roles"})
+		}
+		if allowed {
+			names = append(names, role.Name)
+		}
+	}
+	return c.JSON(http.StatusOK, names)
+}
+
+// AdminCreateRoleHandler - Handler for creating a custom role
+func AdminCreateRoleHandler(c echo.Context) error {
+	var req roleRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if ok, msg := utils.IsValidRoleName(req.Name); !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+	if msg := req.validate(); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+	if _, err := db.GetRoleByName(req.Name); err == nil {
+		return c.JSON(http.StatusConflict, map[string]string{"error": "A role with this name already exists"})
+	}
+
+	id, err := db.CreateRole(req.Name, req.Description, req.Dashboard, req.Permissions)
+	if err != nil {
+		log.Printf("Error creating role %s: %v", req.Name, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create role"})
+	}
+
+	handlers.Audit(c, handlers.AuditCreate, db.AuditRole, id, nil, handlers.AuditSnapshot(db.AuditRole, id))
+	log.Printf("Role %s created by %s with permissions %v", req.Name, handlers.GetLoggedInUsername(c), req.Permissions)
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Role created successfully", "role_id": id})
+}
+
+// AdminUpdateRoleHandler - Handler for changing a role's description, dashboard and permissions
+func AdminUpdateRoleHandler(c echo.Context) error {
+	var req roleRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if msg := req.validate(); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+
+	before := handlers.AuditSnapshot(db.AuditRole, req.ID)
+	err := db.UpdateRole(req.ID, req.Description, req.Dashboard, req.Permissions)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Role not found"})
+	case errors.Is(err, db.ErrProtectedRole):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "The Admin role always has every permission and cannot be changed"})
+	case err != nil:
+		log.Printf("Error updating role %d: %v", req.ID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update role"})
+	}
+
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditRole, req.ID, before, handlers.AuditSnapshot(db.AuditRole, req.ID))
+	log.Printf("Role ID %d updated by %s with permissions %v", req.ID, handlers.GetLoggedInUsername(c), req.Permissions)
+	return c.JSON(http.StatusOK, map[string]string{"message": "Role updated successfully"})
+}
+
+// AdminDeleteRoleHandler - Handler for deleting a custom role
+func AdminDeleteRoleHandler(c echo.Context) error {
+	roleID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid role ID"})
+	}
+
+	before := handlers.AuditSnapshot(db.AuditRole, roleID)
+	err = db.DeleteRole(roleID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Role not found"})
+	case errors.Is(err, db.ErrProtectedRole):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Built-in roles cannot be deleted"})
+	case errors.Is(err, db.ErrRoleInUse):
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Move the users with this role to another role before deleting it"})
+	case err != nil:
+		log.Printf("Error deleting role %d: %v", roleID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to delete role"})
+	}
+
+	handlers.Audit(c, handlers.AuditDelete, db.AuditRole, roleID, before, nil)
+	log.Printf("Role ID %d deleted by %s", roleID, handlers.GetLoggedInUsername(c))
+	return c.JSON(http.StatusOK, map[string]string{"message": "Role deleted successfully"})
+}
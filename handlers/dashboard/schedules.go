@@ -0,0 +1,155 @@
+package dashboard
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+	"SecureSignIn/handlers"
+)
+
+// scheduleRequest is the body of the create and update schedule endpoints
+type scheduleRequest struct {
+	ID              int64  `json:"id"`
+	RouteID         int64  `json:"route_id"`
+	Origin          string `json:"origin"`
+	Destination     string `json:"destination"`
+	DepartureTime   string `json:"departure_time"`
+	DurationMinutes int    `json:"duration_minutes"`
+	DaysOfWeek      []int  `json:"days_of_week"`
+	ValidFrom       string `json:"valid_from"`
+	ValidTo         string `json:"valid_to"`
+	VehicleID       int64  `json:"vehicle_id"`
+	Active          *bool  `json:"active"`
+}
+
+func (req scheduleRequest) schedule() db.Schedule {
+	return db.Schedule{
+		ID:              req.ID,
+		RouteID:         req.RouteID,
+		Origin:          strings.TrimSpace(req.Origin),
+		Destination:     strings.TrimSpace(req.Destination),
+		DepartureTime:   strings.TrimSpace(req.DepartureTime),
+		DurationMinutes: req.DurationMinutes,
+		DaysOfWeek:      req.DaysOfWeek,
+		ValidFrom:       strings.TrimSpace(req.ValidFrom),
+		ValidTo:         strings.TrimSpace(req.ValidTo),
+		VehicleID:       req.VehicleID,
+		Active:          req.Active == nil || *req.Active,
+	}
+}
+
+// AdminSchedulesHandler - Handler for listing timetables
+func AdminSchedulesHandler(c echo.Context) error {
+	schedules, err := db.GetSchedules()
+	if err != nil {
+		log.Printf("Error retrieving schedules: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve schedules"})
+	}
+	return c.JSON(http.StatusOK, schedules)
+}
+
+// AdminCreateScheduleHandler - Handler to add a timetable entry
+func AdminCreateScheduleHandler(c echo.Context) error {
+	var req scheduleRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	id, err := db.AddSchedule(req.schedule())
+	if err != nil {
+		log.Printf("Error creating schedule: %v", err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	handlers.Audit(c, handlers.AuditCreate, db.AuditSchedule, id, nil, handlers.AuditSnapshot(db.AuditSchedule, id))
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Schedule created", "schedule_id": id})
+}
+
+// AdminUpdateScheduleHandler - Handler to change a timetable entry. Trips it
+// has already generated are not changed.
+func AdminUpdateScheduleHandler(c echo.Context) error {
+	var req scheduleRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if req.ID == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Schedule ID required"})
+	}
+
+	before := handlers.AuditSnapshot(db.AuditSchedule, req.ID)
+	if err := db.UpdateSchedule(req.schedule()); err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Schedule not found"})
+		}
+		log.Printf("Error updating schedule %d: %v", req.ID, err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditSchedule, req.ID, before, handlers.AuditSnapshot(db.AuditSchedule, req.ID))
+	return c.JSON(http.StatusOK, map[string]string{"message": "Schedule updated"})
+}
+
+// AdminDeleteScheduleHandler - Handler to delete a timetable entry. Trips it
+// has already generated are kept.
+func AdminDeleteScheduleHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid schedule ID"})
+	}
+
+	before := handlers.AuditSnapshot(db.AuditSchedule, id)
+	if before == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Schedule not found"})
+	}
+	if err := db.DeleteSchedule(id); err != nil {
+		log.Printf("Error deleting schedule %d: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Delete failed"})
+	}
+	handlers.Audit(c, handlers.AuditDelete, db.AuditSchedule, id, before, nil)
+	return c.JSON(http.StatusOK, map[string]string{"message": "Schedule deleted"})
+}
+
+// AdminGenerateTripsHandler - Handler to generate the trips of all active
+// timetables now rather than waiting for the daily run. days defaults to
+// SCHEDULE_DAYS_AHEAD.
+func AdminGenerateTripsHandler(c echo.Context) error {
+	var req struct {
+		Days int `json:"days"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if req.Days == 0 {
+		req.Days = db.ScheduleDaysAhead
+	}
+	if req.Days < 1 || req.Days > 366 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Days must be between 1 and 366"})
+	}
+
+	report, err := db.GenerateScheduledTrips(req.Days)
+	if report != nil {
+		for _, id := range report.CreatedTripIDs {
+			handlers.Audit(c, handlers.AuditCreate, db.AuditTrip, id, nil, handlers.AuditSnapshot(db.AuditTrip, id))
+		}
+	}
+	if err != nil {
+		log.Printf("Error generating scheduled trips: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate trips"})
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
+// AdminScheduleConflictsHandler - Handler for listing upcoming departures
+// timetables could not generate and why
+func AdminScheduleConflictsHandler(c echo.Context) error {
+	conflicts, err := db.GetScheduleConflicts()
+	if err != nil {
+		log.Printf("Error retrieving schedule conflicts: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve schedule conflicts"})
+	}
+	return c.JSON(http.StatusOK, conflicts)
+}
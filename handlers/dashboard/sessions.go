@@ -0,0 +1,90 @@
+package dashboard
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+)
+
+// currentSessionID returns the ID of the session making the request, if any
+func currentSessionID(c echo.Context) int64 {
+	if session, ok := c.Get("session").(*db.Session); ok {
+		return session.ID
+	}
+	return 0
+}
+
+// AdminUserSessionsHandler - Handler for listing a user's active sessions
+func AdminUserSessionsHandler(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	sessions, err := db.GetUserSessions(userID)
+	if err != nil {
+		log.Printf("Error retrieving sessions for user %d: %v", userID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve sessions"})
+	}
+
+	currentID := currentSessionID(c)
+	result := []map[string]interface{}{}
+	for _, s := range sessions {
+		result = append(result, map[string]interface{}{
+			"id":            s.ID,
+			"ip_address":    s.IPAddress,
+			"user_agent":    s.UserAgent,
+			"created_at":    s.CreatedAt,
+			"last_activity": s.LastSeenAt,
+			"expires_at":    s.ExpiresAt,
+			"current":       s.ID == currentID,
+		})
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+// AdminRevokeUserSessionHandler - Handler for revoking one of a user's sessions
+func AdminRevokeUserSessionHandler(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+	sessionID, err := strconv.ParseInt(c.Param("sid"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid session ID"})
+	}
+
+	revoked, err := db.DeleteUserSession(userID, sessionID)
+	if err != nil {
+		log.Printf("Error revoking session %d for user %d: %v", sessionID, userID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke session"})
+	}
+	if !revoked {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Session not found"})
+	}
+
+	log.Printf("Session %d of user ID %d revoked", sessionID, userID)
+	return c.JSON(http.StatusOK, map[string]string{"message": "Session revoked"})
+}
+
+// AdminRevokeAllUserSessionsHandler - Handler for revoking every session of a user
+func AdminRevokeAllUserSessionsHandler(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid user ID"})
+	}
+
+	count, err := db.DeleteUserSessions(userID)
+	if err != nil {
+		log.Printf("Error revoking sessions for user %d: %v", userID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to revoke sessions"})
+	}
+
+	log.Printf("Revoked %d sessions of user ID %d", count, userID)
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "All sessions revoked", "revoked": count})
+}
@@ -0,0 +1,201 @@
+package dashboard
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+	"SecureSignIn/handlers"
+)
+
+// routeError turns a failure to find the route of a trip or timetable into
+// the message shown to staff
+func routeError(err error) string {
+	switch {
+	case errors.Is(err, db.ErrUnknownStation), errors.Is(err, db.ErrNoRoute), errors.Is(err, db.ErrSameStation):
+		return err.Error()
+	case errors.Is(err, db.ErrRouteInactive):
+		return "Route is no longer active"
+	}
+	log.Printf("Error finding route: %v", err)
+	return "Failed to find route"
+}
+
+// routeRequest is the body of the create and update route endpoints.
+// StationIDs lists the stops in order, origin first.
+type routeRequest struct {
+	ID              int64   `json:"id"`
+	Name            string  `json:"name"`
+	StationIDs      []int64 `json:"station_ids"`
+	DistanceKm      float64 `json:"distance_km"`
+	DurationMinutes int     `json:"duration_minutes"`
+	Active          *bool   `json:"active"`
+}
+
+func (req routeRequest) route() db.Route {
+	return db.Route{
+		ID:              req.ID,
+		Name:            req.Name,
+		DistanceKm:      req.DistanceKm,
+		DurationMinutes: req.DurationMinutes,
+		Active:          req.Active == nil || *req.Active,
+	}
+}
+
+// routeSnapshot returns a route with its stops for the audit log, or nil if it does not exist
+func routeSnapshot(id int64) interface{} {
+	route, err := db.GetRoute(id)
+	if err != nil {
+		return nil
+	}
+	return route
+}
+
+// AdminStationsHandler - Handler for listing stations
+func AdminStationsHandler(c echo.Context) error {
+	stations, err := db.GetStations()
+	if err != nil {
+		log.Printf("Error retrieving stations: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve stations"})
+	}
+	return c.JSON(http.StatusOK, stations)
+}
+
+// AdminCreateStationHandler - Handler to add a station
+func AdminCreateStationHandler(c echo.Context) error {
+	var req db.Station
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	id, err := db.AddStation(req)
+	if err != nil {
+		log.Printf("Error creating station: %v", err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	handlers.Audit(c, handlers.AuditCreate, db.AuditStation, id, nil, handlers.AuditSnapshot(db.AuditStation, id))
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Station created", "station_id": id})
+}
+
+// AdminUpdateStationHandler - Handler to change a station. A new name is
+// carried over to the trips, fares and timetables that use the station.
+func AdminUpdateStationHandler(c echo.Context) error {
+	var req db.Station
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if req.ID == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Station ID required"})
+	}
+
+	before := handlers.AuditSnapshot(db.AuditStation, req.ID)
+	if err := db.UpdateStation(req); err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Station not found"})
+		}
+		log.Printf("Error updating station %d: %v", req.ID, err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditStation, req.ID, before, handlers.AuditSnapshot(db.AuditStation, req.ID))
+	return c.JSON(http.StatusOK, map[string]string{"message": "Station updated"})
+}
+
+// AdminDeleteStationHandler - Handler to delete a station that is not on any route
+func AdminDeleteStationHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid station ID"})
+	}
+
+	before := handlers.AuditSnapshot(db.AuditStation, id)
+	if before == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Station not found"})
+	}
+	if err := db.DeleteStation(id); err != nil {
+		if errors.Is(err, db.ErrStationInUse) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Station is a stop of a route. Remove it from its routes first."})
+		}
+		log.Printf("Error deleting station %d: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Delete failed"})
+	}
+	handlers.Audit(c, handlers.AuditDelete, db.AuditStation, id, before, nil)
+	return c.JSON(http.StatusOK, map[string]string{"message": "Station deleted"})
+}
+
+// AdminRoutesHandler - Handler for listing routes with their stops
+func AdminRoutesHandler(c echo.Context) error {
+	routes, err := db.GetRoutes()
+	if err != nil {
+		log.Printf("Error retrieving routes: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve routes"})
+	}
+	return c.JSON(http.StatusOK, routes)
+}
+
+// AdminCreateRouteHandler - Handler to add a route
+func AdminCreateRouteHandler(c echo.Context) error {
+	var req routeRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	id, err := db.AddRoute(req.route(), req.StationIDs)
+	if err != nil {
+		log.Printf("Error creating route: %v", err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	handlers.Audit(c, handlers.AuditCreate, db.AuditRoute, id, nil, routeSnapshot(id))
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Route created", "route_id": id})
+}
+
+// AdminUpdateRouteHandler - Handler to change a route
+func AdminUpdateRouteHandler(c echo.Context) error {
+	var req routeRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if req.ID == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Route ID required"})
+	}
+
+	before := routeSnapshot(req.ID)
+	if err := db.UpdateRoute(req.route(), req.StationIDs); err != nil {
+		switch {
+		case err == sql.ErrNoRows:
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Route not found"})
+		case errors.Is(err, db.ErrRouteInUse):
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Trips or timetables run on this route, so its origin and destination cannot change"})
+		}
+		log.Printf("Error updating route %d: %v", req.ID, err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditRoute, req.ID, before, routeSnapshot(req.ID))
+	return c.JSON(http.StatusOK, map[string]string{"message": "Route updated"})
+}
+
+// AdminDeleteRouteHandler - Handler to delete a route no trip or timetable runs on
+func AdminDeleteRouteHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid route ID"})
+	}
+
+	before := routeSnapshot(id)
+	if before == nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Route not found"})
+	}
+	if err := db.DeleteRoute(id); err != nil {
+		if errors.Is(err, db.ErrRouteInUse) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "Trips or timetables run on this route. Make it inactive instead."})
+		}
+		log.Printf("Error deleting route %d: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Delete failed"})
+	}
+	handlers.Audit(c, handlers.AuditDelete, db.AuditRoute, id, before, nil)
+	return c.JSON(http.StatusOK, map[string]string{"message": "Route deleted"})
+}
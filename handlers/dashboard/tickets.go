@@ -0,0 +1,125 @@
+package dashboard
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image/png"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
+	"github.com/go-pdf/fpdf"
+	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+)
+
+// ticketQRSize is the width and height of the QR code image in pixels
+const ticketQRSize = 400
+
+// TicketHandler - Handler to download the PDF ticket of a booking. Tickets can
+// be printed again at any time; each print is counted.
+func TicketHandler(c echo.Context) error {
+	bookingID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid booking ID"})
+	}
+
+	ticket, err := db.IssueTicket(bookingID)
+	switch {
+	case err == sql.ErrNoRows:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Booking not found"})
+	case errors.Is(err, db.ErrTicketCancelled):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Cancelled bookings have no ticket"})
+	case err != nil:
+		log.Printf("Error issuing ticket for booking %d: %v", bookingID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to issue ticket"})
+	}
+
+	pdf, err := renderTicket(ticket)
+	if err != nil {
+		log.Printf("Error rendering ticket for booking %d: %v", bookingID, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to generate ticket"})
+	}
+	c.Response().Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"ticket_%s.pdf\"", ticket.Reference))
+	return c.Blob(http.StatusOK, "application/pdf", pdf)
+}
+
+// renderTicket lays out a ticket on an A6 landscape page with the QR code of
+// its signed payload on the right
+func renderTicket(t *db.Ticket) ([]byte, error) {
+	code, err := qr.Encode(t.Payload, qr.M, qr.Auto)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode QR code: %w", err)
+	}
+	code, err = barcode.Scale(code, ticketQRSize, ticketQRSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scale QR code: %w", err)
+	}
+	var qrImage bytes.Buffer
+	if err := png.Encode(&qrImage, code); err != nil {
+		return nil, fmt.Errorf("failed to encode QR image: %w", err)
+	}
+
+	pdf := fpdf.New("L", "mm", "A6", "")
+	pdf.SetTitle("Ticket "+t.Reference, true)
+	pdf.SetMargins(8, 8, 8)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.AddPage()
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.CellFormat(0, 8, "Intercity Portal", "", 1, "L", false, 0, "")
+	pdf.SetFont("Helvetica", "", 9)
+	pdf.CellFormat(0, 5, "Boarding ticket", "", 1, "L", false, 0, "")
+	pdf.Ln(2)
+
+	pdf.SetFont("Helvetica", "B", 20)
+	pdf.CellFormat(80, 10, t.Reference, "", 1, "L", false, 0, "")
+	pdf.Ln(1)
+
+	price := "Not priced"
+	if t.PriceCents != nil {
+		price = fmt.Sprintf("%.2f", float64(*t.PriceCents)/100)
+		if t.FareCategory != "" && t.FareCategory != db.FareAdult {
+			price += " (" + t.FareCategory + ")"
+		}
+	}
+	rows := [][2]string{
+		{"Passenger", t.Passenger},
+		{"From", t.Origin},
+		{"To", t.Destination},
+		{"Departure", strings.Replace(t.DepartureTime, "T", " ", 1)},
+		{"Vehicle", t.VehicleNumber},
+		{"Seat", t.SeatNumber},
+		{"Price", price},
+	}
+	for _, row := range rows {
+		pdf.SetFont("Helvetica", "", 9)
+		pdf.CellFormat(22, 6, row[0], "", 0, "L", false, 0, "")
+		pdf.SetFont("Helvetica", "B", 11)
+		pdf.CellFormat(62, 6, tr(row[1]), "", 1, "L", false, 0, "")
+	}
+
+	pdf.RegisterImageOptionsReader("qr", fpdf.ImageOptions{ImageType: "PNG"}, &qrImage)
+	pdf.ImageOptions("qr", 96, 22, 45, 45, false, fpdf.ImageOptions{ImageType: "PNG"}, 0, "")
+
+	pdf.SetFont("Helvetica", "", 7)
+	footer := "Show this ticket when boarding."
+	if t.Prints > 1 {
+		footer = fmt.Sprintf("Reprint %d. Only the latest print is valid if the seat has changed.", t.Prints-1)
+	}
+	pdf.SetXY(8, 96)
+	pdf.CellFormat(0, 4, footer, "", 0, "L", false, 0, "")
+
+	var out bytes.Buffer
+	if err := pdf.Output(&out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,75 @@
+package dashboard
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+	"SecureSignIn/handlers"
+)
+
+// segmentError turns boarding and alighting stops that do not fit a trip into
+// the message shown to staff. ok is false for any other error.
+func segmentError(err error) (message string, ok bool) {
+	switch {
+	case errors.Is(err, db.ErrUnknownStation), errors.Is(err, db.ErrNotAStop):
+		return err.Error(), true
+	case errors.Is(err, db.ErrInvalidSegment):
+		return "The alighting stop must come after the boarding stop", true
+	}
+	return "", false
+}
+
+// AdminTripStopsHandler - Handler for listing the stops of a trip with their times
+func AdminTripStopsHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid trip ID"})
+	}
+
+	stops, err := db.GetTripStops(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Trip not found"})
+		}
+		log.Printf("Error retrieving stops of trip %d: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve trip stops"})
+	}
+	return c.JSON(http.StatusOK, stops)
+}
+
+// AdminUpdateTripStopsHandler - Handler to set the arrival and departure times
+// of a trip's intermediate stops. The trip's own departure and arrival are
+// changed through the trip update endpoint.
+func AdminUpdateTripStopsHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid trip ID"})
+	}
+	var req struct {
+		Stops []db.TripStop `json:"stops"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	before, err := db.GetTripStops(id)
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Trip not found"})
+	}
+	if err := db.SetTripStopTimes(id, req.Stops); err != nil {
+		if err == sql.ErrNoRows {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "Trip not found"})
+		}
+		log.Printf("Error updating stops of trip %d: %v", id, err)
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	after, _ := db.GetTripStops(id)
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditTrip, id, before, after)
+	return c.JSON(http.StatusOK, map[string]string{"message": "Trip stops updated"})
+}
@@ -0,0 +1,60 @@
+package dashboard
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+	"SecureSignIn/handlers"
+)
+
+// AdminTwoFactorPolicyHandler - Handler for reading which roles must use two-factor authentication
+func AdminTwoFactorPolicyHandler(c echo.Context) error {
+	policy, err := db.GetTwoFactorPolicy()
+	if err != nil {
+		log.Printf("Error retrieving two-factor policy: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve two-factor policy"})
+	}
+	return c.JSON(http.StatusOK, policy)
+}
+
+// AdminUpdateTwoFactorPolicyHandler - Handler for requiring or relaxing two-factor authentication for a role
+func AdminUpdateTwoFactorPolicyHandler(c echo.Context) error {
+	var req struct {
+		Role     string `json:"role"`
+		Required bool   `json:"required"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+
+	r, err := db.GetRoleByName(strings.TrimSpace(req.Role))
+	if err == sql.ErrNoRows {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Unknown role"})
+	}
+	if err != nil {
+		log.Printf("Error retrieving role %s: %v", req.Role, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update two-factor policy"})
+	}
+	role := r.Name
+
+	wasRequired, err := db.IsTwoFactorRequired(role)
+	if err != nil {
+		log.Printf("Error retrieving two-factor policy for role %s: %v", role, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update two-factor policy"})
+	}
+	if err := db.SetTwoFactorRequired(role, req.Required); err != nil {
+		log.Printf("Error updating two-factor policy: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update two-factor policy"})
+	}
+
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditPolicy, 0,
+		map[string]interface{}{"role": role, "two_factor_required": wasRequired},
+		map[string]interface{}{"role": role, "two_factor_required": req.Required})
+	log.Printf("Two-factor authentication for role %s set to required=%v by %s", role, req.Required, handlers.GetLoggedInUsername(c))
+	return c.JSON(http.StatusOK, map[string]string{"message": "Two-factor policy updated"})
+}
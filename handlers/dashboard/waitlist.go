@@ -0,0 +1,137 @@
+package dashboard
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+	"SecureSignIn/handlers"
+)
+
+// auditOffers records the bookings held for waitlisted passengers
+func auditOffers(c echo.Context, offers []db.WaitlistOffer) {
+	for _, o := range offers {
+		log.Printf("Trip ID %d: Offered seat %s to waitlisted passenger %s (booking %d)", o.TripID, o.SeatNumber, o.Passenger, o.BookingID)
+		handlers.Audit(c, handlers.AuditCreate, db.AuditBooking, o.BookingID, nil, handlers.AuditSnapshot(db.AuditBooking, o.BookingID))
+		handlers.Audit(c, handlers.AuditUpdate, db.AuditWaitlist, o.EntryID, nil, handlers.AuditSnapshot(db.AuditWaitlist, o.EntryID))
+	}
+}
+
+// offeredBookingSnapshot returns the audit snapshot of the booking offered to
+// a waitlist entry, given the entry's snapshot, or nil if it has none
+func offeredBookingSnapshot(entry map[string]interface{}) map[string]interface{} {
+	bookingID, ok := entry["booking_id"].(int64)
+	if !ok {
+		return nil
+	}
+	return handlers.AuditSnapshot(db.AuditBooking, bookingID)
+}
+
+// WaitlistHandler - Handler for listing the waitlist of a trip, or of every
+// trip if no trip_id is given
+func WaitlistHandler(c echo.Context) error {
+	var tripID int64
+	if param := c.QueryParam("trip_id"); param != "" {
+		id, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid trip ID"})
+		}
+		tripID = id
+	}
+
+	entries, err := db.GetWaitlist(tripID)
+	if err != nil {
+		log.Printf("Error retrieving waitlist: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to retrieve waitlist"})
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{"entries": entries, "hold_minutes": int(db.WaitlistHold.Minutes())})
+}
+
+// AddToWaitlistHandler - Handler to put a passenger on the waitlist of a full
+// trip. Entries with a higher priority are offered a seat first.
+func AddToWaitlistHandler(c echo.Context) error {
+	var req struct {
+		db.BookingRequest
+		Priority int `json:"priority"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request"})
+	}
+	if req.TripID == 0 || req.Passenger == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Trip and passenger name are required"})
+	}
+
+	id, position, err := db.AddToWaitlist(req.BookingRequest, req.Priority, handlers.GetLoggedInUsername(c))
+	if message, ok := segmentError(err); ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": message})
+	}
+	switch {
+	case errors.Is(err, db.ErrSeatsAvailable):
+		return c.JSON(http.StatusConflict, map[string]string{"error": "Seats are still available between these stops. Book the passenger instead."})
+	case err != nil:
+		log.Printf("Error adding to waitlist: %v", err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+	handlers.Audit(c, handlers.AuditCreate, db.AuditWaitlist, id, nil, handlers.AuditSnapshot(db.AuditWaitlist, id))
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Passenger added to the waitlist", "entry_id": id, "position": position})
+}
+
+// ConfirmWaitlistOfferHandler - Handler to confirm the booking held for a
+// waitlisted passenger before the hold runs out
+func ConfirmWaitlistOfferHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid waitlist entry ID"})
+	}
+
+	before := handlers.AuditSnapshot(db.AuditWaitlist, id)
+	bookingBefore := offeredBookingSnapshot(before)
+	bookingID, err := db.ConfirmWaitlistOffer(id, handlers.GetLoggedInUserID(c), handlers.GetLoggedInUsername(c))
+	switch {
+	case err == sql.ErrNoRows:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Waitlist entry not found"})
+	case errors.Is(err, db.ErrNoOffer):
+		return c.JSON(http.StatusConflict, map[string]string{"error": "No seat has been offered to this passenger"})
+	case errors.Is(err, db.ErrHoldExpired):
+		return c.JSON(http.StatusConflict, map[string]string{"error": "The hold has run out and the seat has been released"})
+	case err != nil:
+		log.Printf("Error confirming waitlist entry %d: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to confirm booking"})
+	}
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditWaitlist, id, before, handlers.AuditSnapshot(db.AuditWaitlist, id))
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditBooking, bookingID, bookingBefore, handlers.AuditSnapshot(db.AuditBooking, bookingID))
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Booking confirmed", "booking_id": bookingID})
+}
+
+// RemoveFromWaitlistHandler - Handler to take a passenger off the waitlist.
+// A seat on offer to them is released and offered to the next in line.
+func RemoveFromWaitlistHandler(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid waitlist entry ID"})
+	}
+
+	before := handlers.AuditSnapshot(db.AuditWaitlist, id)
+	bookingBefore := offeredBookingSnapshot(before)
+	released, offers, err := db.RemoveFromWaitlist(id, handlers.GetLoggedInUserID(c), handlers.GetLoggedInUsername(c))
+	switch {
+	case err == sql.ErrNoRows:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Waitlist entry not found"})
+	case errors.Is(err, db.ErrNotWaiting):
+		return c.JSON(http.StatusConflict, map[string]string{"error": "The passenger is no longer on the waitlist"})
+	case err != nil:
+		log.Printf("Error removing waitlist entry %d: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to remove from waitlist"})
+	}
+	handlers.Audit(c, handlers.AuditUpdate, db.AuditWaitlist, id, before, handlers.AuditSnapshot(db.AuditWaitlist, id))
+	if released != 0 {
+		handlers.Audit(c, handlers.AuditUpdate, db.AuditBooking, released, bookingBefore, handlers.AuditSnapshot(db.AuditBooking, released))
+	}
+	auditOffers(c, offers)
+	return c.JSON(http.StatusOK, map[string]interface{}{"message": "Passenger removed from the waitlist", "promoted": offers})
+}
@@ -1,62 +1,141 @@
 package middleware
 
 import (
+	"database/sql"
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+	"SecureSignIn/handlers"
 )
 
+// sessionTouchInterval limits how often last-seen is written back for a session
+const sessionTouchInterval = time.Minute
+
+// loadSession resolves the session cookie to a live session and places the
+// user's identity on the context. It returns false if there is no valid session.
+func loadSession(c echo.Context) bool {
+	cookie, err := c.Cookie(handlers.SessionCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+
+	session, err := db.GetSession(cookie.Value)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error loading session for %s: %v", c.Path(), err)
+		}
+		handlers.ClearSessionCookie(c)
+		return false
+	}
+
+	if time.Since(session.LastSeenAt) > sessionTouchInterval {
+		if err := db.TouchSession(session.ID); err != nil {
+			log.Printf("Warning: Failed to update session activity: %v", err)
+		}
+	}
+
+	c.Set("session", session)
+	c.Set("user_id", session.UserID)
+	c.Set("username", session.Username)
+	c.Set("user_role", session.Role)
+	return true
+}
+
+// needsTwoFactorEnrollment reports whether the logged in user's role requires
+// two-factor authentication that they have not set up yet.
+func needsTwoFactorEnrollment(c echo.Context) bool {
+	session, ok := c.Get("session").(*db.Session)
+	if !ok || session.TwoFactorEnabled {
+		return false
+	}
+	required, err := db.IsTwoFactorRequired(session.Role)
+	if err != nil {
+		log.Printf("Error checking two-factor policy: %v", err)
+		return false
+	}
+	return required
+}
+
+// requiredAccountSetup returns the page a logged in user has to visit before
+// anything else: changing an expired password or enrolling in two-factor
+// authentication required for their role. It returns "" if there is none.
+func requiredAccountSetup(c echo.Context) string {
+	username := handlers.GetLoggedInUsername(c)
+	if session, ok := c.Get("session").(*db.Session); ok && session.PasswordChangeDue {
+		log.Printf("Access denied: User %s must change their password before accessing %s", username, c.Path())
+		return "/change-password?error=You need to choose a new password before continuing."
+	}
+	if needsTwoFactorEnrollment(c) {
+		log.Printf("Access denied: User %s must set up two-factor authentication before accessing %s", username, c.Path())
+		return "/setup-2fa?error=Your role requires two-factor authentication. Please set it up to continue."
+	}
+	return ""
+}
+
 // RequireLogin middleware checks if the user is logged in
 func RequireLogin(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		cookie, err := c.Cookie("username")
-		if err != nil || cookie.Value == "" {
-			log.Printf("Access denied: No valid session cookie found for %s", c.Path())
+		if !loadSession(c) {
+			log.Printf("Access denied: No valid session found for %s", c.Path())
+			return c.Redirect(http.StatusSeeOther, "/login?error=You must be logged in to access this page")
+		}
+		if target := requiredAccountSetup(c); target != "" {
+			return c.Redirect(http.StatusSeeOther, target)
+		}
+		return next(c)
+	}
+}
+
+// RequireLoginForAccountSetup middleware checks if the user is logged in, but
+// still lets users who have to change their password or enroll in required
+// two-factor authentication through so they can do so
+func RequireLoginForAccountSetup(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !loadSession(c) {
+			log.Printf("Access denied: No valid session found for %s", c.Path())
 			return c.Redirect(http.StatusSeeOther, "/login?error=You must be logged in to access this page")
 		}
 		return next(c)
 	}
 }
 
-// RequireRole middleware checks if the user has the required role
-func RequireRole(roles []string) echo.MiddlewareFunc {
+// RequirePermission middleware checks if the user's role grants a permission.
+// Page requests are redirected to the dashboard, API requests get a JSON error.
+func RequirePermission(permission string) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			// Check if user is logged in
-			usernameCookie, err := c.Cookie("username")
-			if err != nil || usernameCookie.Value == "" {
-				log.Printf("Access denied: No valid session cookie found for %s", c.Path())
+			if !loadSession(c) {
+				log.Printf("Access denied: No valid session found for %s", c.Path())
 				return c.Redirect(http.StatusSeeOther, "/login?error=You must be logged in to access this page")
 			}
-
-			// Check if user has the required role
-			roleCookie, err := c.Cookie("user_role")
-			if err != nil || roleCookie.Value == "" {
-				log.Printf("Access denied: No valid role cookie found for %s (user: %s)", c.Path(), usernameCookie.Value)
-				return c.Redirect(http.StatusSeeOther, "/dashboard?error=You do not have the required permissions")
+			if target := requiredAccountSetup(c); target != "" {
+				return c.Redirect(http.StatusSeeOther, target)
 			}
 
-			// Check if user's role is in the allowed roles
-			hasRequiredRole := false
-			userRole := roleCookie.Value
-			for _, role := range roles {
-				if strings.EqualFold(userRole, role) {
-					hasRequiredRole = true
-					break
-				}
+			// Check if user's role grants the permission
+			username := handlers.GetLoggedInUsername(c)
+			userRole := handlers.GetLoggedInUserRole(c)
+			allowed, err := db.HasPermission(userRole, permission)
+			if err != nil {
+				log.Printf("Error checking permission %s for role %s: %v", permission, userRole, err)
 			}
 
-			if !hasRequiredRole {
-				log.Printf("Access denied: User %s has role %s but needs one of %v for %s", 
-					usernameCookie.Value, userRole, roles, c.Path())
-				return c.Redirect(http.StatusSeeOther, "/dashboard?error=You do not have the required permissions")
+			if !allowed {
+				log.Printf("Access denied: User %s has role %s which lacks %s for %s",
+					username, userRole, permission, c.Path())
+				if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMETextHTML) {
+					return c.Redirect(http.StatusSeeOther, "/dashboard?error=You do not have the required permissions")
+				}
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "You do not have permission to perform this action"})
 			}
 
-			// Set the user role in the context
-			c.Set("user_role", userRole)
 			return next(c)
 		}
 	}
-} 
\ No newline at end of file
+}
@@ -0,0 +1,99 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+	"SecureSignIn/handlers"
+	"SecureSignIn/utils"
+)
+
+// csrfToken returns the CSRF token of the caller: the one stored with their
+// session (or pending two-factor login) if they have one, otherwise the one in
+// their CSRF cookie, which is issued here if missing. loggedIn reports which.
+// A session already loaded by the auth middleware is used without another
+// database lookup.
+func csrfToken(c echo.Context) (token string, loggedIn bool, err error) {
+	if session, ok := c.Get("session").(*db.Session); ok && session.CSRFToken != "" {
+		return session.CSRFToken, true, nil
+	}
+	for _, name := range []string{handlers.SessionCookieName, handlers.PendingSessionCookieName} {
+		cookie, err := c.Cookie(name)
+		if err != nil || cookie.Value == "" {
+			continue
+		}
+		token, err := db.GetSessionCSRFToken(cookie.Value)
+		if err == nil {
+			return token, name == handlers.SessionCookieName, nil
+		}
+		if err != sql.ErrNoRows {
+			return "", false, err
+		}
+	}
+
+	if cookie, err := c.Cookie(handlers.CSRFCookieName); err == nil && len(cookie.Value) == 64 {
+		return cookie.Value, false, nil
+	}
+	token, err = utils.GenerateToken()
+	if err != nil {
+		return "", false, err
+	}
+	handlers.SetCSRFCookie(c, token)
+	return token, false, nil
+}
+
+// CSRF middleware makes the caller's CSRF token available to templates and
+// rejects any POST, PUT, PATCH or DELETE request that does not send it back,
+// either in the csrf_token form field or the X-CSRF-Token header. Pages are
+// sent back to the dashboard or login page, API requests get a JSON error.
+// Static files are passed straight through, and for GET, HEAD and OPTIONS
+// requests the token is only looked up if a page asks for it.
+func CSRF(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if strings.HasPrefix(c.Request().URL.Path, "/static/") {
+			return next(c)
+		}
+
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Set(handlers.CSRFTokenLoaderKey, func() string {
+				token, _, err := csrfToken(c)
+				if err != nil {
+					log.Printf("Error loading CSRF token for %s: %v", c.Path(), err)
+				}
+				return token
+			})
+			return next(c)
+		}
+
+		expected, loggedIn, err := csrfToken(c)
+		if err != nil {
+			log.Printf("Error loading CSRF token for %s: %v", c.Path(), err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "An unexpected error occurred. Please try again later.")
+		}
+		c.Set("csrf_token", expected)
+
+		submitted := c.Request().Header.Get(handlers.CSRFHeaderName)
+		if submitted == "" {
+			submitted = c.FormValue(handlers.CSRFFieldName)
+		}
+		if submitted != "" && subtle.ConstantTimeCompare([]byte(submitted), []byte(expected)) == 1 {
+			return next(c)
+		}
+
+		log.Printf("CSRF check failed for %s %s from %s", c.Request().Method, c.Request().URL.Path, c.RealIP())
+		if strings.Contains(c.Request().Header.Get(echo.HeaderAccept), echo.MIMETextHTML) {
+			if loggedIn {
+				return c.Redirect(http.StatusSeeOther, "/dashboard?error=Your form expired. Please try again.")
+			}
+			return c.Redirect(http.StatusSeeOther, "/login?error=Your form expired. Please try again.")
+		}
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Missing or invalid CSRF token. Reload the page and try again."})
+	}
+}
@@ -0,0 +1,126 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/db"
+	"SecureSignIn/handlers"
+)
+
+// anonymousToken is a well-formed CSRF cookie value
+var anonymousToken = strings.Repeat("a", 64)
+
+// newCSRFServer serves /form behind the CSRF middleware. If sessionToken is
+// set, requests come from a logged-in user whose session carries that token.
+func newCSRFServer(sessionToken string) *echo.Echo {
+	e := echo.New()
+	if sessionToken != "" {
+		e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				c.Set("session", &db.Session{CSRFToken: sessionToken})
+				return next(c)
+			}
+		})
+	}
+	e.Use(CSRF)
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, handlers.GetCSRFToken(c))
+	}
+	e.GET("/form", ok)
+	e.POST("/form", ok)
+	return e
+}
+
+func TestCSRF(t *testing.T) {
+	tests := []struct {
+		name         string
+		session      string
+		cookie       string
+		field        string
+		header       string
+		html         bool
+		wantStatus   int
+		wantLocation string
+	}{
+		{name: "missing token", cookie: anonymousToken, wantStatus: http.StatusForbidden},
+		{name: "missing cookie and token", wantStatus: http.StatusForbidden},
+		{name: "form field", cookie: anonymousToken, field: anonymousToken, wantStatus: http.StatusOK},
+		{name: "header", cookie: anonymousToken, header: anonymousToken, wantStatus: http.StatusOK},
+		{name: "mismatched field", cookie: anonymousToken, field: strings.Repeat("b", 64), wantStatus: http.StatusForbidden},
+		{name: "mismatched header", cookie: anonymousToken, header: strings.Repeat("b", 64), wantStatus: http.StatusForbidden},
+		{name: "header is checked before the field", cookie: anonymousToken, header: "wrong", field: anonymousToken, wantStatus: http.StatusForbidden},
+		{name: "malformed cookie", cookie: "short", field: "short", wantStatus: http.StatusForbidden},
+		{name: "page sent back to login", cookie: anonymousToken, html: true, wantStatus: http.StatusSeeOther, wantLocation: "/login?"},
+		{name: "session token", session: "session-token", header: "session-token", wantStatus: http.StatusOK},
+		{name: "cookie does not stand in for the session", session: "session-token", cookie: anonymousToken, field: anonymousToken, wantStatus: http.StatusForbidden},
+		{name: "session page sent back to dashboard", session: "session-token", html: true, wantStatus: http.StatusSeeOther, wantLocation: "/dashboard?"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newCSRFServer(tt.session)
+			form := url.Values{}
+			if tt.field != "" {
+				form.Set(handlers.CSRFFieldName, tt.field)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/form", strings.NewReader(form.Encode()))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: handlers.CSRFCookieName, Value: tt.cookie})
+			}
+			if tt.header != "" {
+				req.Header.Set(handlers.CSRFHeaderName, tt.header)
+			}
+			if tt.html {
+				req.Header.Set(echo.HeaderAccept, echo.MIMETextHTML)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if location := rec.Header().Get(echo.HeaderLocation); !strings.HasPrefix(location, tt.wantLocation) {
+				t.Errorf("redirected to %q, want %s...", location, tt.wantLocation)
+			}
+		})
+	}
+}
+
+// TestCSRFIssuesAnonymousCookie checks that a visitor without a session gets
+// a token cookie from the first page that asks for one, and that posting it
+// back is accepted
+func TestCSRFIssuesAnonymousCookie(t *testing.T) {
+	e := newCSRFServer("")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/form", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET status = %d", rec.Code)
+	}
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == handlers.CSRFCookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil || len(cookie.Value) != 64 {
+		t.Fatalf("no CSRF cookie issued: %v", rec.Result().Cookies())
+	}
+	if token := rec.Body.String(); token != cookie.Value {
+		t.Errorf("page token %q does not match the cookie %q", token, cookie.Value)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/form", nil)
+	req.AddCookie(cookie)
+	req.Header.Set(handlers.CSRFHeaderName, cookie.Value)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("POST with the issued token: status = %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,86 @@
+package middleware
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	echomw "github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
+
+	"SecureSignIn/handlers/templates"
+	"SecureSignIn/models"
+	"SecureSignIn/utils"
+)
+
+var (
+	authLimiterStore     echomw.RateLimiterStore
+	authLimiterStoreOnce sync.Once
+)
+
+// authRateLimiterStore returns the per-IP store shared by all authentication
+// endpoints, so one client's budget covers login and password reset together.
+// The rate is AUTH_RATE_LIMIT requests per minute with bursts of AUTH_RATE_BURST.
+func authRateLimiterStore() echomw.RateLimiterStore {
+	authLimiterStoreOnce.Do(func() {
+		perMinute := utils.GetEnvInt("AUTH_RATE_LIMIT", 10)
+		burst := utils.GetEnvInt("AUTH_RATE_BURST", 5)
+		authLimiterStore = echomw.NewRateLimiterMemoryStoreWithConfig(echomw.RateLimiterMemoryStoreConfig{
+			Rate:      rate.Limit(float64(perMinute) / 60),
+			Burst:     burst,
+			ExpiresIn: 10 * time.Minute,
+		})
+	})
+	return authLimiterStore
+}
+
+// ClientIPExtractor decides where c.RealIP, and so the rate limits, login
+// history, sessions and audit log, take the client's address from. It is the
+// address that connected, unless that is one of the trusted proxies (IPs or
+// CIDR ranges), in which case the address the proxy gives in X-Forwarded-For
+// is used. Headers sent by anyone else are ignored, so clients cannot pick
+// their own address.
+func ClientIPExtractor(trustedProxies []string) echo.IPExtractor {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, proxy := range trustedProxies {
+		cidr := proxy
+		if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+			cidr += "/32"
+		} else if ip != nil {
+			cidr += "/128"
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Printf("Warning: Ignoring invalid trusted proxy %q", proxy)
+			continue
+		}
+		options = append(options, echo.TrustIPRange(ipNet))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// AuthRateLimit limits how often a single IP may submit an authentication form.
+// Rejected requests re-render the given page with an error.
+func AuthRateLimit(templateName, title, activePage string) echo.MiddlewareFunc {
+	return echomw.RateLimiterWithConfig(echomw.RateLimiterConfig{
+		Store: authRateLimiterStore(),
+		IdentifierExtractor: func(c echo.Context) (string, error) {
+			return c.RealIP(), nil
+		},
+		DenyHandler: func(c echo.Context, identifier string, err error) error {
+			log.Printf("Rate limit exceeded for %s on %s", identifier, c.Path())
+			c.Response().Header().Set(echo.HeaderRetryAfter, "60")
+			return templates.RenderTemplateStatus(c, http.StatusTooManyRequests, templateName, models.PageData{
+				Title:      title,
+				Error:      "Too many attempts from your network. Please wait a minute and try again.",
+				ActivePage: activePage,
+			})
+		},
+	})
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// postAuth submits n logins from remoteAddr, each with a different
+// X-Forwarded-For, and returns how many got past the rate limit
+func postAuth(t *testing.T, e *echo.Echo, remoteAddr string, n int) int {
+	t.Helper()
+	passed := 0
+	for i := 0; i < n; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/auth", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set(echo.HeaderXForwardedFor, "203.0.113."+strconv.Itoa(i+1))
+		req.Header.Set(echo.HeaderXRealIP, "198.51.100."+strconv.Itoa(i+1))
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code == http.StatusOK {
+			passed++
+		}
+	}
+	return passed
+}
+
+func newAuthServer(trustedProxies []string) *echo.Echo {
+	e := echo.New()
+	e.IPExtractor = ClientIPExtractor(trustedProxies)
+	e.POST("/auth", func(c echo.Context) error {
+		return c.String(http.StatusOK, c.RealIP())
+	}, AuthRateLimit("login.html", "Login", "login"))
+	return e
+}
+
+// TestAuthRateLimitIgnoresForwardedFor checks that a client changing its
+// X-Forwarded-For on every attempt still runs into the limit for its address
+func TestAuthRateLimitIgnoresForwardedFor(t *testing.T) {
+	e := newAuthServer(nil)
+	const attempts = 20
+	passed := postAuth(t, e, "192.0.2.10:40000", attempts)
+	if passed == 0 || passed >= attempts {
+		t.Fatalf("%d of %d attempts with changing X-Forwarded-For passed, want the limit to apply", passed, attempts)
+	}
+	if more := postAuth(t, e, "192.0.2.10:40001", 1); more != 0 {
+		t.Errorf("attempt from a limited address passed with a new X-Forwarded-For")
+	}
+}
+
+func TestClientIPExtractor(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies []string
+		remote  string
+		want    string
+	}{
+		{"no proxies", nil, "192.0.2.10:1234", "192.0.2.10"},
+		{"private address is not trusted by default", nil, "10.0.0.5:1234", "10.0.0.5"},
+		{"untrusted sender", []string{"10.0.0.0/8"}, "192.0.2.10:1234", "192.0.2.10"},
+		{"trusted range", []string{"10.0.0.0/8"}, "10.0.0.5:1234", "203.0.113.7"},
+		{"trusted address", []string{"127.0.0.1"}, "127.0.0.1:1234", "203.0.113.7"},
+		{"invalid entry is ignored", []string{"not-an-ip"}, "127.0.0.1:1234", "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+			req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.7")
+			if got := ClientIPExtractor(tt.proxies)(req); got != tt.want {
+				t.Errorf("client IP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
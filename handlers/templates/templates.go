@@ -9,6 +9,9 @@ import (
 	"strings"
 
 	"github.com/labstack/echo/v4"
+
+	"SecureSignIn/handlers"
+	"SecureSignIn/models"
 )
 
 // Template cache
@@ -54,6 +57,11 @@ func InitTemplates() {
 
 // Render a template given a model
 func RenderTemplate(c echo.Context, tmpl string, data interface{}) error {
+	return RenderTemplateStatus(c, http.StatusOK, tmpl, data)
+}
+
+// Render a template given a model, responding with the given status code
+func RenderTemplateStatus(c echo.Context, status int, tmpl string, data interface{}) error {
 	log.Printf("Attempting to render template: %s", tmpl)
 	
 	t, ok := Templates[tmpl]
@@ -62,6 +70,15 @@ func RenderTemplate(c echo.Context, tmpl string, data interface{}) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, fmt.Sprintf("Template %s not found.", tmpl))
 	}
 
+	// Every form and script on the page needs the caller's CSRF token
+	switch d := data.(type) {
+	case models.PageData:
+		d.CSRFToken = handlers.GetCSRFToken(c)
+		data = d
+	case *models.PageData:
+		d.CSRFToken = handlers.GetCSRFToken(c)
+	}
+
 	var buf strings.Builder
 	err := t.ExecuteTemplate(&buf, "base", data)
 	if err != nil {
@@ -69,5 +86,5 @@ func RenderTemplate(c echo.Context, tmpl string, data interface{}) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Error rendering page.")
 	}
 
-	return c.HTML(http.StatusOK, buf.String())
+	return c.HTML(status, buf.String())
 } 
\ No newline at end of file
@@ -0,0 +1,98 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"SecureSignIn/utils"
+)
+
+// Message is a single outgoing email with plain-text and HTML bodies
+type Message struct {
+	To       string
+	Subject  string
+	TextBody string
+	HTMLBody string
+}
+
+// Mailer delivers outgoing email
+type Mailer interface {
+	Send(msg Message) error
+}
+
+var (
+	defaultMailer     Mailer
+	defaultMailerOnce sync.Once
+)
+
+// Default returns the mailer configured through the environment
+func Default() Mailer {
+	defaultMailerOnce.Do(func() {
+		defaultMailer = FromEnv()
+	})
+	return defaultMailer
+}
+
+// SetDefault replaces the mailer returned by Default
+func SetDefault(m Mailer) {
+	defaultMailerOnce.Do(func() {})
+	defaultMailer = m
+}
+
+// FromEnv builds a mailer from MAIL_DRIVER ("smtp", "file" or "log").
+// When MAIL_DRIVER is unset, SMTP is used if SMTP_HOST is set and the log
+// outbox otherwise, so development setups never send real mail by accident.
+func FromEnv() Mailer {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "SecureSignIn <no-reply@localhost>"
+	}
+
+	driver := strings.ToLower(os.Getenv("MAIL_DRIVER"))
+	if driver == "" {
+		driver = "log"
+		if os.Getenv("SMTP_HOST") != "" {
+			driver = "smtp"
+		}
+	}
+
+	switch driver {
+	case "smtp":
+		m := &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     utils.GetEnvInt("SMTP_PORT", 25),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+		if m.Host == "" {
+			m.Host = "localhost"
+		}
+		log.Printf("Mail delivery: SMTP via %s:%d", m.Host, m.Port)
+		return m
+	case "file":
+		dir := os.Getenv("MAIL_OUTBOX_DIR")
+		if dir == "" {
+			dir = "data/outbox"
+		}
+		log.Printf("Mail delivery: writing messages to %s", dir)
+		return &FileMailer{Dir: dir, From: from}
+	default:
+		if driver != "log" {
+			log.Printf("Warning: Unknown MAIL_DRIVER %q, logging messages instead", driver)
+		}
+		log.Printf("Mail delivery: logging messages (development only)")
+		return &LogMailer{From: from}
+	}
+}
+
+// Send delivers a message through the default mailer
+func Send(msg Message) error {
+	if msg.To == "" {
+		return fmt.Errorf("message has no recipient")
+	}
+	return Default().Send(msg)
+}
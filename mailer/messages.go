@@ -0,0 +1,21 @@
+package mailer
+
+import (
+	"fmt"
+	"time"
+)
+
+// SendPasswordReset emails a password reset code to a user, along with a
+// reset link if resetURL is not empty
+func SendPasswordReset(to, username, code, resetURL string, validFor time.Duration) error {
+	msg, err := Render("password_reset", to, "Your SecureSignIn password reset code", map[string]interface{}{
+		"Username":  username,
+		"Code":      code,
+		"ResetURL":  resetURL,
+		"ExpiresIn": fmt.Sprintf("%d minutes", int(validFor.Minutes())),
+	})
+	if err != nil {
+		return err
+	}
+	return Send(msg)
+}
@@ -0,0 +1,59 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileMailer writes each message to Dir as an .eml file instead of sending it.
+// Intended for development and testing.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+// Send writes the message to the outbox directory
+func (m *FileMailer) Send(msg Message) error {
+	if err := os.MkdirAll(m.Dir, 0700); err != nil {
+		return fmt.Errorf("failed to create outbox directory: %w", err)
+	}
+
+	body, err := buildMessage(m.From, msg)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s_%s.eml", time.Now().UTC().Format("20060102_150405.000000000"), sanitizeFileName(msg.To))
+	path := filepath.Join(m.Dir, name)
+	if err := os.WriteFile(path, body, 0600); err != nil {
+		return fmt.Errorf("failed to write message to outbox: %w", err)
+	}
+	log.Printf("Mail to %s written to outbox: %s", msg.To, path)
+	return nil
+}
+
+// LogMailer writes the plain-text body of each message to the application log
+// instead of sending it. Intended for development only.
+type LogMailer struct {
+	From string
+}
+
+// Send logs the message
+func (m *LogMailer) Send(msg Message) error {
+	log.Printf("Mail (not sent) from %s to %s\nSubject: %s\n\n%s", m.From, msg.To, msg.Subject, msg.TextBody)
+	return nil
+}
+
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_', r == '@':
+			return r
+		}
+		return '_'
+	}, s)
+}
@@ -0,0 +1,257 @@
+package mailer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpSession is what a fakeSMTP server was sent
+type smtpSession struct {
+	auth string
+	from string
+	rcpt []string
+	data []byte
+}
+
+// fakeSMTP is a local SMTP stand-in that accepts one session and records it.
+// It offers AUTH PLAIN but not STARTTLS.
+type fakeSMTP struct {
+	host    string
+	port    int
+	session chan smtpSession
+}
+
+func startFakeSMTP(t *testing.T) *fakeSMTP {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	addr := ln.Addr().(*net.TCPAddr)
+	s := &fakeSMTP{host: addr.IP.String(), port: addr.Port, session: make(chan smtpSession, 1)}
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		tp := textproto.NewConn(conn)
+		var got smtpSession
+		tp.PrintfLine("220 localhost ESMTP fake")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			verb := strings.ToUpper(strings.Fields(line + " ")[0])
+			switch verb {
+			case "EHLO", "HELO":
+				tp.PrintfLine("250-localhost")
+				tp.PrintfLine("250-AUTH PLAIN")
+				tp.PrintfLine("250 HELP")
+			case "AUTH":
+				got.auth = strings.TrimPrefix(line, "AUTH PLAIN ")
+				tp.PrintfLine("235 2.7.0 Authentication successful")
+			case "MAIL":
+				got.from = line[strings.Index(line, ":")+1:]
+				tp.PrintfLine("250 OK")
+			case "RCPT":
+				got.rcpt = append(got.rcpt, line[strings.Index(line, ":")+1:])
+				tp.PrintfLine("250 OK")
+			case "DATA":
+				tp.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+				got.data, err = tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				tp.PrintfLine("250 OK")
+			case "QUIT":
+				tp.PrintfLine("221 Bye")
+				s.session <- got
+				return
+			default:
+				tp.PrintfLine("250 OK")
+			}
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) received(t *testing.T) smtpSession {
+	t.Helper()
+	select {
+	case got := <-s.session:
+		return got
+	case <-time.After(10 * time.Second):
+		t.Fatal("fake SMTP server received no message")
+	}
+	return smtpSession{}
+}
+
+// useTemplates points the mailer at the repository's email templates
+func useTemplates(t *testing.T) {
+	t.Helper()
+	previous := TemplatesDir
+	TemplatesDir = filepath.Join("..", "templates", "email")
+	t.Cleanup(func() { TemplatesDir = previous })
+}
+
+// readParts returns the decoded bodies of a multipart message by content type
+func readParts(t *testing.T, msg *mail.Message) map[string]string {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("Content-Type: %v", err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %q, want multipart/alternative", mediaType)
+	}
+	parts := map[string]string{}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading part: %v", err)
+		}
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		body, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatalf("reading %s part: %v", partType, err)
+		}
+		parts[partType] = string(body)
+	}
+	return parts
+}
+
+func TestSMTPMailerSendsPasswordReset(t *testing.T) {
+	useTemplates(t)
+	server := startFakeSMTP(t)
+	SetDefault(&SMTPMailer{
+		Host:     server.host,
+		Port:     server.port,
+		Username: "mailer",
+		Password: "secret",
+		From:     "SecureSignIn <no-reply@example.com>",
+	})
+	t.Cleanup(func() { SetDefault(&LogMailer{}) })
+
+	const code = "482913"
+	if err := SendPasswordReset("Alice <alice@example.com>", "alice", code, "https://example.com/reset?code=482913", 15*time.Minute); err != nil {
+		t.Fatalf("SendPasswordReset: %v", err)
+	}
+	got := server.received(t)
+
+	if got.from != "<no-reply@example.com>" {
+		t.Errorf("MAIL FROM = %q, want <no-reply@example.com>", got.from)
+	}
+	if len(got.rcpt) != 1 || got.rcpt[0] != "<alice@example.com>" {
+		t.Errorf("RCPT TO = %q, want [<alice@example.com>]", got.rcpt)
+	}
+	if credentials, err := base64.StdEncoding.DecodeString(got.auth); err != nil || string(credentials) != "\x00mailer\x00secret" {
+		t.Errorf("AUTH PLAIN credentials = %q, want mailer/secret", credentials)
+	}
+
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(string(got.data))))
+	if err != nil {
+		t.Fatalf("parsing message: %v", err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("decoding subject: %v", err)
+	}
+	headers := map[string]string{
+		"From":         "SecureSignIn <no-reply@example.com>",
+		"To":           "Alice <alice@example.com>",
+		"Subject":      "Your SecureSignIn password reset code",
+		"MIME-Version": "1.0",
+	}
+	for name, want := range headers {
+		value := msg.Header.Get(name)
+		if name == "Subject" {
+			value = subject
+		}
+		if value != want {
+			t.Errorf("%s = %q, want %q", name, value, want)
+		}
+	}
+	if _, err := msg.Header.Date(); err != nil {
+		t.Errorf("Date header: %v", err)
+	}
+
+	parts := readParts(t, msg)
+	for _, partType := range []string{"text/plain", "text/html"} {
+		body, ok := parts[partType]
+		if !ok {
+			t.Errorf("message has no %s part", partType)
+			continue
+		}
+		if !strings.Contains(body, code) {
+			t.Errorf("%s part does not contain the reset code", partType)
+		}
+		if !strings.Contains(body, "alice") {
+			t.Errorf("%s part does not greet the user", partType)
+		}
+	}
+}
+
+func TestSMTPMailerRejectsInvalidRecipient(t *testing.T) {
+	m := &SMTPMailer{Host: "127.0.0.1", Port: 1, From: "no-reply@example.com"}
+	if err := m.Send(Message{To: "not an address", Subject: "Hi", TextBody: "Hi"}); err == nil {
+		t.Error("Send to an invalid address succeeded")
+	}
+}
+
+func TestFileMailerWritesOutbox(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "outbox")
+	m := &FileMailer{Dir: dir, From: "no-reply@example.com"}
+	if err := m.Send(Message{To: "bob@example.com", Subject: "Reset", TextBody: "Your reset code is: 123456", HTMLBody: "<p>123456</p>"}); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("outbox holds %d messages (%v), want 1", len(files), err)
+	}
+	if !strings.HasSuffix(files[0], "_bob@example.com.eml") {
+		t.Errorf("outbox file %s is not named after the recipient", filepath.Base(files[0]))
+	}
+	info, err := os.Stat(files[0])
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("outbox file mode = %o, want 600", perm)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+	msg, err := mail.ReadMessage(f)
+	if err != nil {
+		t.Fatalf("parsing outbox message: %v", err)
+	}
+	if to := msg.Header.Get("To"); to != "bob@example.com" {
+		t.Errorf("To = %q, want bob@example.com", to)
+	}
+	if text := readParts(t, msg)["text/plain"]; !strings.Contains(text, "123456") {
+		t.Errorf("text part %q does not contain the code", text)
+	}
+}
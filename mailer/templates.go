@@ -0,0 +1,74 @@
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"path/filepath"
+	"sync"
+	texttemplate "text/template"
+)
+
+// TemplatesDir holds the email templates. Each message has a NAME.txt
+// plain-text template and an optional NAME.html template.
+var TemplatesDir = filepath.Join("templates", "email")
+
+var (
+	textTemplates = make(map[string]*texttemplate.Template)
+	htmlTemplates = make(map[string]*htmltemplate.Template)
+	templateMutex sync.Mutex
+)
+
+// Render builds a message from the named email templates
+func Render(name, to, subject string, data interface{}) (Message, error) {
+	msg := Message{To: to, Subject: subject}
+
+	textTmpl, htmlTmpl, err := loadTemplates(name)
+	if err != nil {
+		return msg, err
+	}
+
+	var buf bytes.Buffer
+	if err := textTmpl.Execute(&buf, data); err != nil {
+		return msg, fmt.Errorf("error rendering email template %s.txt: %w", name, err)
+	}
+	msg.TextBody = buf.String()
+
+	if htmlTmpl != nil {
+		buf.Reset()
+		if err := htmlTmpl.Execute(&buf, data); err != nil {
+			return msg, fmt.Errorf("error rendering email template %s.html: %w", name, err)
+		}
+		msg.HTMLBody = buf.String()
+	}
+	return msg, nil
+}
+
+// loadTemplates parses a message's templates on first use
+func loadTemplates(name string) (*texttemplate.Template, *htmltemplate.Template, error) {
+	templateMutex.Lock()
+	defer templateMutex.Unlock()
+
+	if t, ok := textTemplates[name]; ok {
+		return t, htmlTemplates[name], nil
+	}
+
+	textPath := filepath.Join(TemplatesDir, name+".txt")
+	textTmpl, err := texttemplate.ParseFiles(textPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading email template %s: %w", textPath, err)
+	}
+
+	htmlPath := filepath.Join(TemplatesDir, name+".html")
+	var htmlTmpl *htmltemplate.Template
+	if matches, _ := filepath.Glob(htmlPath); len(matches) > 0 {
+		htmlTmpl, err = htmltemplate.ParseFiles(htmlPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error loading email template %s: %w", htmlPath, err)
+		}
+	}
+
+	textTemplates[name] = textTmpl
+	htmlTemplates[name] = htmlTmpl
+	return textTmpl, htmlTmpl, nil
+}
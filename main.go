@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"SecureSignIn/db"
+	"SecureSignIn/handlers"
 	"SecureSignIn/routes"
 	"SecureSignIn/utils"
 
@@ -49,12 +50,17 @@ func main() {
 	// Serve static files
 	e.Static("/static", "static")
 
-	// CORS middleware with more detailed configuration
-	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{"*"},
-		AllowMethods: []string{echo.GET, echo.HEAD, echo.PUT, echo.PATCH, echo.POST, echo.DELETE},
-		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept},
-	}))
+	// CORS: only origins on the CORS_ALLOWED_ORIGINS allow-list may call the
+	// API from the browser. With no list, only same-origin requests work.
+	if origins := utils.GetEnvList("CORS_ALLOWED_ORIGINS"); len(origins) > 0 {
+		log.Printf("Allowing cross-origin requests from %v", origins)
+		e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+			AllowOrigins:     origins,
+			AllowMethods:     []string{echo.GET, echo.HEAD, echo.PUT, echo.PATCH, echo.POST, echo.DELETE},
+			AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, handlers.CSRFHeaderName},
+			AllowCredentials: true,
+		}))
+	}
 
 	// Simple test endpoint
 	e.GET("/test", func(c echo.Context) error {
@@ -74,6 +80,21 @@ func main() {
 		log.Println("Admin user check completed successfully")
 	}
 
+	// Purge expired sessions and reset tokens now and every hour
+	db.ScheduleCleanup(time.Hour)
+
+	// Mark passengers who did not board as no-shows once boarding closes
+	db.ScheduleNoShowCheck(5 * time.Minute)
+
+	// Generate trips from the timetables now and every day
+	db.ScheduleTripGeneration(24 * time.Hour)
+
+	// Release waitlist seats whose hold has run out and offer them to the next in line
+	db.ScheduleWaitlistCheck(time.Minute)
+
+	// Release seat holds that have run out
+	db.ScheduleHoldCheck(time.Minute)
+
 	// Set up a database backup on startup and daily backups
 	dbPath := os.Getenv("SQLITE_DB_PATH")
 	if dbPath == "" {
@@ -1,5 +1,7 @@
 package models
 
+import "html/template"
+
 // PageData struct for template rendering
 type PageData struct {
 	Title            string
@@ -23,6 +25,19 @@ type PageData struct {
 	// Fields for registration form data persistence
 	DOB string
 	SSN string
+	// Fields for two-factor authentication setup
+	TwoFactorEnabled  bool
+	TwoFactorRequired bool
+	TwoFactorSecret   string
+	TwoFactorURI      template.URL // otpauth:// URI of the enrollment key
+	TwoFactorQR       template.URL // data: URI of the enrollment QR code
+	RecoveryCodes     []string     // shown once, right after they are generated
+	RecoveryCodesLeft int
+	// Summary of the password policy shown next to new password fields
+	PasswordRequirements string
+	// CSRFToken must be sent back with every form and state-changing request
+	// (filled in when the page is rendered)
+	CSRFToken string
 }
 
 // RegistrationForm represents the registration form data
@@ -3,10 +3,12 @@ package routes
 import (
 	"github.com/labstack/echo/v4"
 
+	"SecureSignIn/db"
 	"SecureSignIn/handlers/auth"
 	"SecureSignIn/handlers/dashboard"
 	"SecureSignIn/handlers/middleware"
 	"SecureSignIn/handlers/templates"
+	"SecureSignIn/utils"
 )
 
 // RegisterRoutes registers all application routes
@@ -14,8 +16,12 @@ func RegisterRoutes(e *echo.Echo) {
 	// Initialize templates
 	templates.InitTemplates()
 	
+	// Client addresses come from the connection, or from proxies on TRUSTED_PROXIES
+	e.IPExtractor = middleware.ClientIPExtractor(utils.GetEnvList("TRUSTED_PROXIES"))
+
 	// Middleware
 	e.Use(middleware.LogAndRecover)
+	e.Use(middleware.CSRF)
 
 	// Static files
 	e.Static("/static", "static")
@@ -26,8 +32,11 @@ func RegisterRoutes(e *echo.Echo) {
 	
 	// Auth routes
 	e.GET("/login", auth.LoginHandler)
-	e.POST("/auth", auth.BasicAuthHandler)
+	e.POST("/auth", auth.BasicAuthHandler, middleware.AuthRateLimit("login.html", "Login", "login"))
+	e.GET("/login/2fa", auth.TwoFactorLoginHandler)
+	e.POST("/login/2fa", auth.TwoFactorLoginHandler, middleware.AuthRateLimit("login_2fa.html", "Two-Factor Authentication", "login"))
 	e.GET("/logout", auth.LogoutHandler)
+	e.POST("/logout/all", middleware.RequireLoginForAccountSetup(auth.LogoutEverywhereHandler))
 	
 	// Registration routes
 	e.GET("/register", auth.RegisterHandler)
@@ -35,120 +44,138 @@ func RegisterRoutes(e *echo.Echo) {
 	
 	// Password reset routes
 	e.GET("/forgot", auth.ForgotHandler)
-	e.POST("/forgot", auth.ForgotHandler)
+	e.POST("/forgot", auth.ForgotHandler, middleware.AuthRateLimit("forgot.html", "Forgot Password", "forgot"))
 	e.GET("/reset/:token", auth.ShowResetFormHandler)
 	e.POST("/reset/:token", auth.HandleResetPasswordHandler)
 	e.GET("/security-reset", auth.SecurityQuestionResetHandler)
-	e.POST("/security-reset", auth.SecurityQuestionResetHandler)
+	e.POST("/security-reset", auth.SecurityQuestionResetHandler, middleware.AuthRateLimit("security_reset.html", "Reset Password", "forgot"))
 	
 	// Authenticated routes (requires login)
 	e.GET("/dashboard", middleware.RequireLogin(dashboard.DashboardHandler))
 	e.GET("/setup-security", middleware.RequireLogin(auth.SetupSecurityQuestionHandler))
 	e.POST("/setup-security", middleware.RequireLogin(auth.SetupSecurityQuestionHandler))
+	e.GET("/setup-2fa", middleware.RequireLoginForAccountSetup(auth.SetupTwoFactorHandler))
+	e.POST("/setup-2fa", middleware.RequireLoginForAccountSetup(auth.SetupTwoFactorHandler))
+	e.GET("/change-password", middleware.RequireLoginForAccountSetup(auth.ChangePasswordHandler))
+	e.POST("/change-password", middleware.RequireLoginForAccountSetup(auth.ChangePasswordHandler))
 	
 	// Trip planning routes - accessible to all authenticated users
 	e.GET("/trip-plan", middleware.RequireLogin(dashboard.TripPlanHandler)) // Trip planning view for next week
 	
-	// Role-specific routes
-	// Operator routes
-	operatorGroup := e.Group("/operator")
-	operatorGroup.Use(middleware.RequireRole([]string{"Operator", "Manager", "Admin"}))
-	operatorGroup.GET("/dashboard", dashboard.DashboardHandler)
-	operatorGroup.GET("/trips", dashboard.OperatorTripsHandler)
-	operatorGroup.POST("/trips/create", dashboard.OperatorCreateTripHandler)
-	operatorGroup.POST("/trips/update", dashboard.OperatorUpdateTripHandler)
-	operatorGroup.DELETE("/trips/:id", dashboard.OperatorDeleteTripHandler)
-	operatorGroup.GET("/trips/:id/capacity", dashboard.OperatorTripCapacityHandler)
-
-	operatorGroup.GET("/bookings", dashboard.OperatorGetBookingsHandler)
-	operatorGroup.POST("/bookings/create", dashboard.OperatorCreateBookingHandler)
-	operatorGroup.POST("/bookings/status", dashboard.AdminUpdateBookingStatusHandler)
-	operatorGroup.DELETE("/bookings/:id", dashboard.OperatorDeleteBookingHandler)
-	
-	// Manager routes
-	managerGroup := e.Group("/manager")
-	managerGroup.Use(middleware.RequireRole([]string{"Manager", "Admin"}))
-
-	// Manager dashboard and user management
-	managerGroup.GET("/dashboard", dashboard.DashboardHandler)
-	managerGroup.GET("/users", dashboard.ManagerUsersHandler)
-	managerGroup.POST("/users/create", dashboard.ManagerCreateUserHandler)
-	managerGroup.POST("/users/update", dashboard.ManagerUpdateUserHandler)
-	managerGroup.DELETE("/users/:id", dashboard.AdminDeleteUserHandler)
-	managerGroup.POST("/users/password", dashboard.AdminUpdatePasswordHandler)
-	managerGroup.POST("/users/username", dashboard.AdminUpdateUsernameHandler)
+	// Management routes. Each route is guarded by the permission it needs, so
+	// the same endpoints serve every role and custom roles work without new routes.
+	perm := middleware.RequirePermission
+	adminGroup := e.Group("/admin")
+	adminGroup.GET("/dashboard", dashboard.AdminDashboardHandler, perm(db.PermRolesManage))
+
+	// User management routes
+	adminGroup.GET("/users", dashboard.AdminUsersHandler, perm(db.PermUsersView))
+	adminGroup.GET("/users/roles", dashboard.AdminAssignableRolesHandler, perm(db.PermUsersView))
+	adminGroup.POST("/users/create", dashboard.AdminCreateUserHandler, perm(db.PermUsersCreate))
+	adminGroup.POST("/users/update", dashboard.AdminUpdateUserHandler, perm(db.PermUsersUpdate))
+	adminGroup.DELETE("/users/:id", dashboard.AdminDeleteUserHandler, perm(db.PermUsersDelete))
+	adminGroup.POST("/users/password", dashboard.AdminUpdatePasswordHandler, perm(db.PermUsersUpdate))
+	adminGroup.POST("/users/username", dashboard.AdminUpdateUsernameHandler, perm(db.PermUsersUpdate))
+	adminGroup.POST("/users/:id/unlock", dashboard.AdminUnlockUserHandler, perm(db.PermUsersUnlock))
+	adminGroup.GET("/users/:id/sessions", dashboard.AdminUserSessionsHandler, perm(db.PermSessionsManage))
+	adminGroup.DELETE("/users/:id/sessions", dashboard.AdminRevokeAllUserSessionsHandler, perm(db.PermSessionsManage))
+	adminGroup.DELETE("/users/:id/sessions/:sid", dashboard.AdminRevokeUserSessionHandler, perm(db.PermSessionsManage))
+
+	// Role and security policy routes
+	adminGroup.GET("/permissions", dashboard.AdminPermissionsHandler, perm(db.PermRolesManage))
+	adminGroup.GET("/roles", dashboard.AdminRolesHandler, perm(db.PermRolesManage))
+	adminGroup.POST("/roles/create", dashboard.AdminCreateRoleHandler, perm(db.PermRolesManage))
+	adminGroup.POST("/roles/update", dashboard.AdminUpdateRoleHandler, perm(db.PermRolesManage))
+	adminGroup.DELETE("/roles/:id", dashboard.AdminDeleteRoleHandler, perm(db.PermRolesManage))
+	adminGroup.GET("/2fa-policy", dashboard.AdminTwoFactorPolicyHandler, perm(db.PermSecurityManage))
+	adminGroup.POST("/2fa-policy", dashboard.AdminUpdateTwoFactorPolicyHandler, perm(db.PermSecurityManage))
 
 	// Vehicle management routes
-	managerGroup.GET("/vehicles", dashboard.AdminVehiclesHandler)
-	managerGroup.GET("/vehicles/:id", dashboard.AdminGetVehicleByIDHandler)
-	managerGroup.POST("/vehicles/create", dashboard.AdminCreateVehicleHandler)
-	managerGroup.POST("/vehicles/update", dashboard.AdminUpdateVehicleHandler)
-	managerGroup.DELETE("/vehicles/:id", dashboard.AdminDeleteVehicleHandler)
+	adminGroup.GET("/vehicles", dashboard.AdminVehiclesHandler, perm(db.PermVehiclesView))
+	adminGroup.GET("/vehicles/:id", dashboard.AdminGetVehicleByIDHandler, perm(db.PermVehiclesView))
+	adminGroup.POST("/vehicles/create", dashboard.AdminCreateVehicleHandler, perm(db.PermVehiclesCreate))
+	adminGroup.POST("/vehicles/update", dashboard.AdminUpdateVehicleHandler, perm(db.PermVehiclesUpdate))
+	adminGroup.DELETE("/vehicles/:id", dashboard.AdminDeleteVehicleHandler, perm(db.PermVehiclesDelete))
 
 	// Trip management routes
-	managerGroup.GET("/trips", dashboard.AdminTripsHandler)
-	managerGroup.POST("/trips/create", dashboard.AdminCreateTripHandler)
-	managerGroup.POST("/trips/update", dashboard.AdminUpdateTripHandler)
-	managerGroup.DELETE("/trips/:id", dashboard.AdminDeleteTripHandler)
-	managerGroup.GET("/trips/:id/capacity", dashboard.AdminTripCapacityHandler)
+	adminGroup.GET("/trips", dashboard.AdminTripsHandler, perm(db.PermTripsView))
+	adminGroup.POST("/trips/create", dashboard.AdminCreateTripHandler, perm(db.PermTripsCreate))
+	adminGroup.POST("/trips/update", dashboard.AdminUpdateTripHandler, perm(db.PermTripsUpdate))
+	adminGroup.DELETE("/trips/:id", dashboard.AdminDeleteTripHandler, perm(db.PermTripsDelete))
+	adminGroup.GET("/trips/:id/capacity", dashboard.AdminTripCapacityHandler, perm(db.PermTripsView))
+	adminGroup.GET("/trips/:id/seats", dashboard.AdminTripSeatsHandler, perm(db.PermTripsView))
+	adminGroup.GET("/trips/:id/stops", dashboard.AdminTripStopsHandler, perm(db.PermTripsView))
+	adminGroup.POST("/trips/:id/stops", dashboard.AdminUpdateTripStopsHandler, perm(db.PermTripsUpdate))
 
-	// Booking management routes
-	managerGroup.GET("/bookings", dashboard.AdminBookingsHandler)
-	managerGroup.POST("/bookings/create", dashboard.AdminCreateBookingHandler)
-	managerGroup.POST("/bookings/status", dashboard.AdminUpdateBookingStatusHandler)
-	managerGroup.DELETE("/bookings/:id", dashboard.AdminDeleteBookingHandler)
+	// Station and route master data
+	adminGroup.GET("/stations", dashboard.AdminStationsHandler, perm(db.PermTripsView))
+	adminGroup.POST("/stations/create", dashboard.AdminCreateStationHandler, perm(db.PermRoutesManage))
+	adminGroup.POST("/stations/update", dashboard.AdminUpdateStationHandler, perm(db.PermRoutesManage))
+	adminGroup.DELETE("/stations/:id", dashboard.AdminDeleteStationHandler, perm(db.PermRoutesManage))
+	adminGroup.GET("/routes", dashboard.AdminRoutesHandler, perm(db.PermTripsView))
+	adminGroup.POST("/routes/create", dashboard.AdminCreateRouteHandler, perm(db.PermRoutesManage))
+	adminGroup.POST("/routes/update", dashboard.AdminUpdateRouteHandler, perm(db.PermRoutesManage))
+	adminGroup.DELETE("/routes/:id", dashboard.AdminDeleteRouteHandler, perm(db.PermRoutesManage))
 
-	// Reports routes
-	managerGroup.GET("/reports/data", dashboard.AdminReportsDataHandler)
-	managerGroup.GET("/reports/export", dashboard.AdminReportsExportHandler)
+	// Timetable routes
+	adminGroup.GET("/schedules", dashboard.AdminSchedulesHandler, perm(db.PermTripsView))
+	adminGroup.GET("/schedules/conflicts", dashboard.AdminScheduleConflictsHandler, perm(db.PermTripsView))
+	adminGroup.POST("/schedules/create", dashboard.AdminCreateScheduleHandler, perm(db.PermSchedulesManage))
+	adminGroup.POST("/schedules/update", dashboard.AdminUpdateScheduleHandler, perm(db.PermSchedulesManage))
+	adminGroup.DELETE("/schedules/:id", dashboard.AdminDeleteScheduleHandler, perm(db.PermSchedulesManage))
+	adminGroup.POST("/schedules/generate", dashboard.AdminGenerateTripsHandler, perm(db.PermSchedulesManage))
 
-	// Backup endpoints
-	managerGroup.POST("/backup", dashboard.AdminBackupHandler)
-	managerGroup.GET("/backup/download", dashboard.AdminBackupDownloadHandler)
-
-	// Accountant routes
-	accountantGroup := e.Group("/accountant")
-	accountantGroup.Use(middleware.RequireRole([]string{"Accountant", "Admin"}))
-	accountantGroup.GET("/dashboard", dashboard.DashboardHandler)
-	accountantGroup.GET("/reports/data", dashboard.AdminReportsDataHandler)
-	accountantGroup.GET("/reports/export", dashboard.AdminReportsExportHandler)
-	
-	// Admin routes
-	adminGroup := e.Group("/admin")
-	adminGroup.Use(middleware.RequireRole([]string{"Admin"}))
-	adminGroup.GET("/dashboard", dashboard.AdminDashboardHandler)
-	adminGroup.GET("/users", dashboard.AdminUsersHandler)
-	adminGroup.POST("/users/create", dashboard.AdminCreateUserHandler)
-	adminGroup.POST("/users/update", dashboard.AdminUpdateUserHandler)
-	adminGroup.DELETE("/users/:id", dashboard.AdminDeleteUserHandler)
-	adminGroup.POST("/users/password", dashboard.AdminUpdatePasswordHandler)
-	adminGroup.POST("/users/username", dashboard.AdminUpdateUsernameHandler)
-	
-	// Vehicle management routes
-	adminGroup.GET("/vehicles", dashboard.AdminVehiclesHandler)
-	adminGroup.GET("/vehicles/:id", dashboard.AdminGetVehicleByIDHandler)
-	adminGroup.POST("/vehicles/create", dashboard.AdminCreateVehicleHandler)
-	adminGroup.POST("/vehicles/update", dashboard.AdminUpdateVehicleHandler)
-	adminGroup.DELETE("/vehicles/:id", dashboard.AdminDeleteVehicleHandler)
-	
-	// Trip management routes
-	adminGroup.GET("/trips", dashboard.AdminTripsHandler)
-	adminGroup.POST("/trips/create", dashboard.AdminCreateTripHandler)
-	adminGroup.POST("/trips/update", dashboard.AdminUpdateTripHandler)
-	adminGroup.DELETE("/trips/:id", dashboard.AdminDeleteTripHandler)
-	adminGroup.GET("/trips/:id/capacity", dashboard.AdminTripCapacityHandler)
-	
 	// Booking management routes
-	adminGroup.GET("/bookings", dashboard.AdminBookingsHandler)
-	adminGroup.POST("/bookings/create", dashboard.AdminCreateBookingHandler)
-	adminGroup.POST("/bookings/status", dashboard.AdminUpdateBookingStatusHandler)
-	adminGroup.DELETE("/bookings/:id", dashboard.AdminDeleteBookingHandler)
-	
+	adminGroup.GET("/bookings", dashboard.AdminBookingsHandler, perm(db.PermBookingsView))
+	adminGroup.POST("/bookings/create", dashboard.AdminCreateBookingHandler, perm(db.PermBookingsCreate))
+	adminGroup.POST("/bookings/status", dashboard.AdminUpdateBookingStatusHandler, perm(db.PermBookingsUpdate))
+	adminGroup.DELETE("/bookings/:id", dashboard.AdminDeleteBookingHandler, perm(db.PermBookingsDelete))
+	adminGroup.GET("/bookings/:id/history", dashboard.AdminBookingStatusHistoryHandler, perm(db.PermBookingsView))
+	adminGroup.POST("/passengers/merge", dashboard.AdminMergePassengersHandler, perm(db.PermPassengersMerge))
+	adminGroup.GET("/bookings/:id/payments", dashboard.AdminBookingPaymentsHandler, perm(db.PermPaymentsView))
+	adminGroup.POST("/bookings/:id/payments", dashboard.AdminRecordPaymentHandler, perm(db.PermPaymentsRecord))
+	adminGroup.POST("/bookings/:id/refunds", dashboard.AdminRecordRefundHandler, perm(db.PermPaymentsRefund))
+	adminGroup.GET("/bookings/:id/cancellation", dashboard.AdminCancellationQuoteHandler, perm(db.PermBookingsUpdate))
+
+	// Payments ledger
+	adminGroup.GET("/payments", dashboard.AdminPaymentsHandler, perm(db.PermPaymentsView))
+
+	// Fare routes
+	adminGroup.GET("/fares", dashboard.AdminFaresHandler, perm(db.PermFaresView))
+	adminGroup.GET("/fares/quote", dashboard.AdminFareQuoteHandler, perm(db.PermFaresView))
+	adminGroup.POST("/fares/create", dashboard.AdminCreateFareHandler, perm(db.PermFaresManage))
+	adminGroup.POST("/fares/update", dashboard.AdminUpdateFareHandler, perm(db.PermFaresManage))
+	adminGroup.DELETE("/fares/:id", dashboard.AdminDeleteFareHandler, perm(db.PermFaresManage))
+	adminGroup.POST("/fares/multipliers", dashboard.AdminUpdateFareMultiplierHandler, perm(db.PermFaresManage))
+	adminGroup.POST("/fares/discounts", dashboard.AdminUpdateFareDiscountHandler, perm(db.PermFaresManage))
+	adminGroup.GET("/fares/cancellation-rules", dashboard.AdminCancellationRulesHandler, perm(db.PermFaresView))
+	adminGroup.POST("/fares/cancellation-rules", dashboard.AdminUpdateCancellationRulesHandler, perm(db.PermFaresManage))
+
 	// Reports routes
-	adminGroup.GET("/reports/data", dashboard.AdminReportsDataHandler)
-	adminGroup.GET("/reports/export", dashboard.AdminReportsExportHandler)
-	
+	adminGroup.GET("/reports/data", dashboard.AdminReportsDataHandler, perm(db.PermReportsView))
+	adminGroup.GET("/reports/export", dashboard.AdminReportsExportHandler, perm(db.PermReportsExport))
+
 	// Backup endpoints
-	adminGroup.POST("/backup", dashboard.AdminBackupHandler)
-	adminGroup.GET("/backup/download", dashboard.AdminBackupDownloadHandler)
+	adminGroup.POST("/backup", dashboard.AdminBackupHandler, perm(db.PermBackupCreate))
+	adminGroup.GET("/backup/download", dashboard.AdminBackupDownloadHandler, perm(db.PermBackupDownload))
+
+	// Audit log
+	adminGroup.GET("/audit", dashboard.AdminAuditLogHandler, perm(db.PermAuditView))
+	adminGroup.GET("/audit/export", dashboard.AdminAuditExportHandler, perm(db.PermAuditView))
+
+	// Tickets are printed at the ticket counter and scanned at the door
+	operatorGroup := e.Group("/operator")
+	operatorGroup.GET("/bookings/:id/ticket", dashboard.TicketHandler, perm(db.PermTicketsPrint))
+	operatorGroup.POST("/boarding", dashboard.BoardingScanHandler, perm(db.PermBoardingScan))
+
+	// Passengers wait at the counter for seats on full trips
+	operatorGroup.GET("/waitlist", dashboard.WaitlistHandler, perm(db.PermBookingsView))
+	operatorGroup.POST("/waitlist", dashboard.AddToWaitlistHandler, perm(db.PermBookingsCreate))
+	operatorGroup.POST("/waitlist/:id/confirm", dashboard.ConfirmWaitlistOfferHandler, perm(db.PermBookingsUpdate))
+	operatorGroup.DELETE("/waitlist/:id", dashboard.RemoveFromWaitlistHandler, perm(db.PermBookingsUpdate))
+	operatorGroup.POST("/holds", dashboard.HoldSeatHandler, perm(db.PermBookingsCreate))
+	operatorGroup.POST("/holds/:id/confirm", dashboard.ConfirmHoldHandler, perm(db.PermBookingsUpdate))
+	operatorGroup.DELETE("/holds/:id", dashboard.ReleaseHoldHandler, perm(db.PermBookingsUpdate))
+	operatorGroup.GET("/passengers", dashboard.SearchPassengersHandler, perm(db.PermBookingsView))
+	operatorGroup.GET("/passengers/:id", dashboard.PassengerHandler, perm(db.PermBookingsView))
 } 
\ No newline at end of file
@@ -6,6 +6,8 @@
 # Set up environment variables
 APP_DIR="$(dirname "$(readlink -f "$0")")"
 export SQLITE_DB_PATH="$HOME/.securesignin/securesignin.db"
+export ENCRYPTION_KEY_PATH="${ENCRYPTION_KEY_PATH:-$HOME/.securesignin/encryption.key}"
+export TICKET_KEY_PATH="${TICKET_KEY_PATH:-$HOME/.securesignin/ticket.key}"
 DATA_DIR="$(dirname "$SQLITE_DB_PATH")"
 
 # Create data directory if it doesn't exist
@@ -19,6 +21,8 @@ fi
 # Run the application
 echo "Starting SecureSignIn from $APP_DIR"
 echo "Using database: $SQLITE_DB_PATH"
+echo "Using encryption key: $ENCRYPTION_KEY_PATH"
+echo "Using ticket signing key: $TICKET_KEY_PATH"
 
 # Kill existing instances if any
 pkill -f securesignin || true
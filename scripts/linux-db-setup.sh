@@ -3,8 +3,11 @@
 # Set paths
 APP_CONFIG_DIR="$HOME/.config/secure-sign-in-app"
 USER_HOME_DIR="$HOME/.securesignin"
-DB_PATH="$USER_HOME_DIR/securesignin.db"
-KEY_PATH="$USER_HOME_DIR/encryption.key"
+DB_PATH="${SQLITE_DB_PATH:-$USER_HOME_DIR/securesignin.db}"
+export ENCRYPTION_KEY_PATH="${ENCRYPTION_KEY_PATH:-$USER_HOME_DIR/encryption.key}"
+KEY_PATH="$ENCRYPTION_KEY_PATH"
+# The app generates the ticket signing key on first start
+export TICKET_KEY_PATH="${TICKET_KEY_PATH:-$USER_HOME_DIR/ticket.key}"
 
 # Create all necessary directories
 echo "Creating application directories..."
@@ -18,11 +21,18 @@ chmod 755 "$APP_CONFIG_DIR"
 chmod 755 "$USER_HOME_DIR"
 chmod 755 "$APP_CONFIG_DIR/backups"
 
-# Check for existing encryption key
+# Create the encryption key for a new database. An existing database needs
+# the key its data was encrypted with, so a missing key is never replaced.
 if [ ! -f "$KEY_PATH" ]; then
-  echo "No encryption key found, creating placeholder (app will generate the proper key)"
-  dd if=/dev/urandom bs=1 count=32 of="$KEY_PATH" 2>/dev/null
-  chmod 600 "$KEY_PATH"
+  if [ -f "$DB_PATH" ]; then
+    echo "Warning: No encryption key at $KEY_PATH for the database at $DB_PATH."
+    echo "Restore the key from a backup, or set ENCRYPTION_KEY_PATH to where it is."
+  else
+    echo "No encryption key found, creating one at $KEY_PATH"
+    (umask 077 && head -c 32 /dev/urandom > "$KEY_PATH")
+  fi
 fi
 
 echo "Database setup complete. Your database will be stored at: $DB_PATH"
+echo "Encryption key: $KEY_PATH (back it up with the database)"
+echo "Ticket signing key: $TICKET_KEY_PATH (back it up with the database)"
@@ -1,8 +1,10 @@
 @echo off
 :: Run script for Secure Sign In application
 
-:: Set correct database path
+:: Set correct database and key paths
 set "SQLITE_DB_PATH=%USERPROFILE%\.securesignin\securesignin.db"
+if not defined ENCRYPTION_KEY_PATH set "ENCRYPTION_KEY_PATH=%USERPROFILE%\.securesignin\encryption.key"
+if not defined TICKET_KEY_PATH set "TICKET_KEY_PATH=%USERPROFILE%\.securesignin\ticket.key"
 
 :: Run database setup script if it exists
 if exist ".\scripts\windows-db-setup.bat" (
@@ -1,8 +1,10 @@
 #!/bin/bash
 # Run script for Secure Sign In application
 
-# Set correct database path
+# Set correct database and key paths
 export SQLITE_DB_PATH="$HOME/.securesignin/securesignin.db"
+export ENCRYPTION_KEY_PATH="${ENCRYPTION_KEY_PATH:-$HOME/.securesignin/encryption.key}"
+export TICKET_KEY_PATH="${TICKET_KEY_PATH:-$HOME/.securesignin/ticket.key}"
 
 # Run database setup script if it exists
 if [ -f "./scripts/linux-db-setup.sh" ]; then
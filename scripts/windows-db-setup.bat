@@ -6,8 +6,11 @@ echo === Secure Sign In Database Setup ===
 :: Set paths
 set "APP_CONFIG_DIR=%USERPROFILE%\.config\secure-sign-in-app"
 set "USER_HOME_DIR=%USERPROFILE%\.securesignin"
-set "DB_PATH=%USER_HOME_DIR%\securesignin.db"
-set "KEY_PATH=%USER_HOME_DIR%\encryption.key"
+if defined SQLITE_DB_PATH (set "DB_PATH=%SQLITE_DB_PATH%") else (set "DB_PATH=%USER_HOME_DIR%\securesignin.db")
+if not defined ENCRYPTION_KEY_PATH set "ENCRYPTION_KEY_PATH=%USER_HOME_DIR%\encryption.key"
+set "KEY_PATH=%ENCRYPTION_KEY_PATH%"
+:: The app generates the ticket signing key on first start
+if not defined TICKET_KEY_PATH set "TICKET_KEY_PATH=%USER_HOME_DIR%\ticket.key"
 
 :: Create all necessary directories
 echo Creating application directories...
@@ -15,14 +18,23 @@ if not exist "%APP_CONFIG_DIR%" mkdir "%APP_CONFIG_DIR%"
 if not exist "%USER_HOME_DIR%" mkdir "%USER_HOME_DIR%"
 if not exist "%APP_CONFIG_DIR%\backups" mkdir "%APP_CONFIG_DIR%\backups"
 
-:: Check for existing encryption key
+:: Create the encryption key for a new database: 32 random bytes, as the app
+:: reads it. An existing database needs the key its data was encrypted with,
+:: so a missing key is never replaced.
 if not exist "%KEY_PATH%" (
-  echo No encryption key found, creating placeholder for app to use
-  certutil -f -encodehex NUL "%KEY_PATH%" 32 >nul 2>&1
-  if errorlevel 1 (
-    echo Failed to create key file. Please run as administrator.
-    exit /b 1
+  if exist "%DB_PATH%" (
+    echo Warning: No encryption key at %KEY_PATH% for the database at %DB_PATH%.
+    echo Restore the key from a backup, or set ENCRYPTION_KEY_PATH to where it is.
+  ) else (
+    echo No encryption key found, creating one at %KEY_PATH%
+    powershell -NoProfile -Command "$key = New-Object byte[] 32; [Security.Cryptography.RandomNumberGenerator]::Create().GetBytes($key); [IO.File]::WriteAllBytes($env:KEY_PATH, $key)" >nul 2>&1
+    if errorlevel 1 (
+      echo Failed to create key file. Please run as administrator.
+      exit /b 1
+    )
   )
 )
 
 echo Database setup complete. Your database will be stored at: %DB_PATH%
+echo Encryption key: %KEY_PATH% (back it up with the database)
+echo Ticket signing key: %TICKET_KEY_PATH% (back it up with the database)
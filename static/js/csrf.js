@@ -0,0 +1,20 @@
+// Sends the page's CSRF token with every state-changing fetch to this site.
+// The token comes from the csrf-token meta tag rendered by the server.
+(function () {
+    const meta = document.querySelector('meta[name="csrf-token"]');
+    if (!meta || !window.fetch) return;
+    const token = meta.content;
+    const originalFetch = window.fetch;
+
+    window.fetch = function (input, init) {
+        const request = input instanceof Request ? input : null;
+        const method = ((init && init.method) || (request && request.method) || 'GET').toUpperCase();
+        const url = new URL(request ? request.url : input, window.location.href);
+        if (['GET', 'HEAD', 'OPTIONS'].includes(method) || url.origin !== window.location.origin) {
+            return originalFetch.call(this, input, init);
+        }
+        const headers = new Headers((init && init.headers) || (request && request.headers) || undefined);
+        headers.set('X-CSRF-Token', token);
+        return originalFetch.call(this, input, Object.assign({}, init, { headers: headers }));
+    };
+})();
@@ -205,6 +205,34 @@ document.addEventListener('DOMContentLoaded', function() {
         return true;
     }
     
+    // Fill role pickers with the roles the logged in user may assign
+    const roleSelects = document.querySelectorAll('select[data-role-options]');
+    if (roleSelects.length > 0) {
+        fetch('/admin/users/roles')
+            .then(function(response) {
+                if (!response.ok) throw new Error(response.statusText);
+                return response.json();
+            })
+            .then(function(roles) {
+                roleSelects.forEach(function(select) {
+                    const current = select.value;
+                    select.innerHTML = '';
+                    roles.forEach(function(role) {
+                        const option = document.createElement('option');
+                        option.value = role;
+                        option.textContent = role;
+                        select.appendChild(option);
+                    });
+                    if (roles.includes(current)) {
+                        select.value = current;
+                    }
+                });
+            })
+            .catch(function(error) {
+                console.error('Error loading roles:', error);
+            });
+    }
+    
     // Auto-hide alerts after 5 seconds
     const alerts = document.querySelectorAll('.alert');
     alerts.forEach(function(alert) {
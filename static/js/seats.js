@@ -0,0 +1,113 @@
+// Seat maps for the booking forms: fills a seat <select> with the free seats
+// of a trip and draws the trip's seat grid, where a free seat can be clicked
+// to choose it. Seats are free between the stops chosen in the optional
+// boarding and alighting <select>s, or for the whole trip.
+(function() {
+    window.loadSeatMap = async function(tripId, selectElem, mapElem, boardingElem, alightingElem) {
+        if (!selectElem) return;
+        selectElem.innerHTML = '<option value="">Assign automatically</option>';
+        if (mapElem) mapElem.innerHTML = '';
+        if (!tripId) return;
+
+        const params = new URLSearchParams();
+        if (boardingElem && boardingElem.value) params.set('boarding', boardingElem.value);
+        if (alightingElem && alightingElem.value) params.set('alighting', alightingElem.value);
+        let seatMap;
+        try {
+            const res = await fetch(`/admin/trips/${tripId}/seats?${params}`);
+            if (!res.ok) return;
+            seatMap = await res.json();
+        } catch (err) {
+            console.error('Error loading seat map:', err);
+            return;
+        }
+
+        (seatMap.seats || []).filter(s => !s.occupied).forEach(s => {
+            const opt = document.createElement('option');
+            opt.value = s.label;
+            opt.textContent = s.label;
+            selectElem.appendChild(opt);
+        });
+        if (!mapElem) return;
+
+        const layout = seatMap.layout;
+        const grid = document.createElement('div');
+        grid.className = 'seat-grid';
+        // One grid column per seat, plus one for the aisle
+        const columns = layout.columns + (layout.aisle_after > 0 ? 1 : 0);
+        grid.style.gridTemplateColumns = `repeat(${columns}, 2.25rem)`;
+
+        (seatMap.seats || []).forEach(s => {
+            const seat = document.createElement('button');
+            seat.type = 'button';
+            seat.className = 'seat ' + (s.occupied ? 'seat-occupied' : 'seat-free');
+            seat.textContent = s.label;
+            seat.title = s.occupied ? `Seat ${s.label} is taken` : `Choose seat ${s.label}`;
+            seat.disabled = s.occupied;
+            // Leave the aisle column empty
+            let column = s.column;
+            if (layout.aisle_after > 0 && s.column > layout.aisle_after) column++;
+            seat.style.gridRow = s.row;
+            seat.style.gridColumn = column;
+            seat.addEventListener('click', () => {
+                selectElem.value = s.label;
+                selectElem.dispatchEvent(new Event('change'));
+            });
+            grid.appendChild(seat);
+        });
+
+        const summary = document.createElement('div');
+        summary.className = 'seat-summary';
+        summary.textContent = `${seatMap.available} of ${layout.capacity} seats free from ${seatMap.boarding} to ${seatMap.alighting}`;
+        mapElem.appendChild(grid);
+        mapElem.appendChild(summary);
+
+        // Highlight the chosen seat
+        const highlight = () => grid.querySelectorAll('.seat').forEach(b => b.classList.toggle('seat-selected', b.textContent === selectElem.value));
+        selectElem.onchange = highlight;
+        highlight();
+    };
+
+    // loadTripStops fills the boarding and alighting <select>s of a booking
+    // form with the stops of a trip, starting at its origin and ending at its
+    // destination
+    window.loadTripStops = async function(tripId, boardingElem, alightingElem) {
+        if (!boardingElem || !alightingElem) return;
+        boardingElem.innerHTML = '';
+        alightingElem.innerHTML = '';
+        if (!tripId) return;
+
+        let stops;
+        try {
+            const res = await fetch(`/admin/trips/${tripId}/stops`);
+            if (!res.ok) return;
+            stops = await res.json();
+        } catch (err) {
+            console.error('Error loading trip stops:', err);
+            return;
+        }
+
+        stops.forEach((s, i) => {
+            const value = s.code || s.name;
+            if (i < stops.length - 1) boardingElem.appendChild(new Option(`${s.name} (${s.departure_time})`, value));
+            if (i > 0) alightingElem.appendChild(new Option(`${s.name} (${s.arrival_time})`, value));
+        });
+        alightingElem.selectedIndex = alightingElem.options.length - 1;
+    };
+
+    // fillSeatLayoutFields loads a vehicle's seat layout into the edit form
+    window.fillSeatLayoutFields = async function(vehicleId, columnsInput, aisleInput) {
+        if (!vehicleId || !columnsInput || !aisleInput) return;
+        try {
+            const res = await fetch(`/admin/vehicles/${vehicleId}`);
+            if (!res.ok) return;
+            const vehicle = await res.json();
+            if (vehicle.seat_layout) {
+                columnsInput.value = vehicle.seat_layout.columns;
+                aisleInput.value = vehicle.seat_layout.aisle_after;
+            }
+        } catch (err) {
+            console.error('Error loading seat layout:', err);
+        }
+    };
+})();
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetEnvInt reads an integer setting from the environment, falling back to def
+// if it is unset or invalid
+func GetEnvInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("Warning: Invalid value %q for %s, using default %d", value, name, def)
+		return def
+	}
+	return n
+}
+
+// GetEnvDuration reads a duration setting (e.g. "15m") from the environment,
+// falling back to def if it is unset or invalid
+func GetEnvDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Printf("Warning: Invalid value %q for %s, using default %s", value, name, def)
+		return def
+	}
+	return d
+}
+
+// GetEnvBool reads a boolean setting (e.g. "true", "0") from the environment,
+// falling back to def if it is unset or invalid
+func GetEnvBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Warning: Invalid value %q for %s, using default %t", value, name, def)
+		return def
+	}
+	return b
+}
+
+// GetEnvList reads a comma-separated list setting from the environment,
+// trimming spaces and dropping empty entries. It returns nil if unset.
+func GetEnvList(name string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
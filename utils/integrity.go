@@ -103,7 +103,7 @@ func RepairDatabaseIfNeeded(dbPath string) error {
 // VerifyTableConsistency checks if all required tables and indexes exist
 func VerifyTableConsistency(db *sql.DB) error {
 	// List of expected tables
-	expectedTables := []string{"users", "login_history"}
+	expectedTables := []string{"users", "login_history", "sessions", "schema_migrations"}
 
 	// Query to check if a table exists
 	checkTableQuery := `
@@ -0,0 +1,165 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// PasswordPolicy describes the rules every new password must meet.
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	History       int           // number of previous passwords that may not be reused
+	MaxAge        time.Duration // passwords older than this must be changed at next login; 0 disables
+	banned        map[string]bool
+}
+
+// PasswordRules is the active password policy, configurable through the environment.
+var PasswordRules = LoadPasswordPolicy()
+
+// LoadPasswordPolicy reads the password policy from the environment. Extra
+// banned passwords can be listed one per line in PASSWORD_BANNED_FILE.
+func LoadPasswordPolicy() PasswordPolicy {
+	p := PasswordPolicy{
+		MinLength:     GetEnvInt("PASSWORD_MIN_LENGTH", 8),
+		RequireUpper:  GetEnvBool("PASSWORD_REQUIRE_UPPER", true),
+		RequireLower:  GetEnvBool("PASSWORD_REQUIRE_LOWER", true),
+		RequireDigit:  GetEnvBool("PASSWORD_REQUIRE_DIGIT", true),
+		RequireSymbol: GetEnvBool("PASSWORD_REQUIRE_SYMBOL", true),
+		History:       GetEnvInt("PASSWORD_HISTORY", 5),
+		MaxAge:        GetEnvDuration("PASSWORD_MAX_AGE", 0),
+		banned:        make(map[string]bool, len(commonPasswords)),
+	}
+	for _, pw := range commonPasswords {
+		p.banned[pw] = true
+	}
+
+	if path := os.Getenv("PASSWORD_BANNED_FILE"); path != "" {
+		n, err := p.loadBannedFile(path)
+		if err != nil {
+			log.Printf("Warning: Failed to load banned passwords from %s: %v", path, err)
+		} else {
+			log.Printf("Loaded %d banned passwords from %s", n, path)
+		}
+	}
+	return p
+}
+
+// loadBannedFile adds the passwords listed one per line in a file to the banned list
+func (p PasswordPolicy) loadBannedFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if pw := strings.ToLower(strings.TrimSpace(scanner.Text())); pw != "" {
+			p.banned[pw] = true
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
+
+// Validate checks a new password against the policy. It returns true if the
+// password is acceptable, and false with a message describing the problem if not.
+// Reuse of previous passwords is checked separately, against the stored history.
+func (p PasswordPolicy) Validate(password, username string) (bool, string) {
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, char := range password {
+		switch {
+		case unicode.IsUpper(char):
+			hasUpper = true
+		case unicode.IsLower(char):
+			hasLower = true
+		case unicode.IsDigit(char):
+			hasDigit = true
+		case unicode.IsPunct(char) || unicode.IsSymbol(char):
+			hasSymbol = true
+		}
+	}
+
+	var missing []string
+	if len([]rune(password)) < p.MinLength {
+		missing = append(missing, fmt.Sprintf("at least %d characters", p.MinLength))
+	}
+	if p.RequireUpper && !hasUpper {
+		missing = append(missing, "at least one uppercase letter")
+	}
+	if p.RequireLower && !hasLower {
+		missing = append(missing, "at least one lowercase letter")
+	}
+	if p.RequireDigit && !hasDigit {
+		missing = append(missing, "at least one number")
+	}
+	if p.RequireSymbol && !hasSymbol {
+		missing = append(missing, "at least one special character")
+	}
+	if len(missing) > 0 {
+		return false, fmt.Sprintf("Password must contain %s.", strings.Join(missing, ", "))
+	}
+
+	lower := strings.ToLower(password)
+	if p.banned[lower] {
+		return false, "This password is too common. Please choose a different one."
+	}
+	if username != "" && strings.Contains(lower, strings.ToLower(username)) {
+		return false, "Password must not contain your username."
+	}
+	return true, ""
+}
+
+// Describe summarises the policy for display next to password fields
+func (p PasswordPolicy) Describe() string {
+	parts := []string{fmt.Sprintf("at least %d characters", p.MinLength)}
+	if p.RequireUpper {
+		parts = append(parts, "an uppercase letter")
+	}
+	if p.RequireLower {
+		parts = append(parts, "a lowercase letter")
+	}
+	if p.RequireDigit {
+		parts = append(parts, "a number")
+	}
+	if p.RequireSymbol {
+		parts = append(parts, "a special character")
+	}
+	desc := "Use " + strings.Join(parts, ", ") + "."
+	if p.History > 0 {
+		desc += fmt.Sprintf(" You can't reuse any of your last %d passwords.", p.History)
+	}
+	return desc
+}
+
+// commonPasswords are rejected regardless of the character class rules. The
+// list covers the most common leaked passwords, including variants that
+// satisfy typical complexity rules. Comparison is case-insensitive.
+var commonPasswords = []string{
+	"123456", "123456789", "12345678", "1234567890", "password", "password1", "password123",
+	"qwerty", "qwerty123", "qwertyuiop", "111111", "123123", "abc123", "1q2w3e4r",
+	"iloveyou", "admin", "admin123", "welcome", "welcome1", "letmein", "monkey", "dragon",
+	"football", "baseball", "sunshine", "princess", "master", "shadow", "superman",
+	"trustno1", "starwars", "whatever", "passw0rd", "p@ssw0rd", "p@ssword", "p@ssword1",
+	"p@ssw0rd1", "p@ssw0rd!", "p@$$w0rd", "password!", "password1!", "password123!",
+	"password@123", "password#1", "passw0rd!", "passw0rd1", "pa$$w0rd", "pa$$word1",
+	"qwerty1!", "qwerty123!", "qwerty@123", "q1w2e3r4!", "1qaz2wsx", "1qaz@wsx", "1qaz!qaz",
+	"zaq12wsx", "zaq1@wsx", "abc123!", "abcd1234!", "abc@1234", "admin1!", "admin123!",
+	"admin@123", "administrator1!", "welcome1!", "welcome123!", "welcome@123", "letmein1!",
+	"changeme", "changeme1!", "changeme123!", "secret1!", "test1234!", "test@123",
+	"iloveyou1!", "sunshine1!", "summer2024!", "summer2025!", "summer2026!", "winter2024!",
+	"winter2025!", "winter2026!", "spring2025!", "spring2026!", "autumn2025!", "autumn2026!",
+	"january2026!", "company123!", "hello123!", "monkey123!", "dragon123!", "football1!",
+	"baseball1!", "superman1!", "batman123!", "master123!", "login123!", "user1234!",
+	"securesignin1!", "intercity1!", "terminal1!",
+}
@@ -1,7 +1,6 @@
 package utils
 
 import (
-	"fmt"
 	"regexp"
 	"strings"
 	"unicode"
@@ -48,50 +47,20 @@ func IsValidUsername(username string) (bool, string) {
 	return true, ""
 }
 
-// IsValidPassword checks if the password meets complexity requirements.
+// IsValidPassword checks if the password meets the configured password policy.
 // It returns true if valid, and false with an error message if not.
 func IsValidPassword(password string) (bool, string) {
-	var (
-		hasMinLen  = len(password) >= 8
-		hasUpper   = false
-		hasLower   = false
-		hasNumber  = false
-		hasSymbol  = false
-		errorMessages []string
-	)
-
-	for _, char := range password {
-		switch {
-		case unicode.IsUpper(char):
-			hasUpper = true
-		case unicode.IsLower(char):
-			hasLower = true
-		case unicode.IsDigit(char):
-			hasNumber = true
-		case unicode.IsPunct(char) || unicode.IsSymbol(char):
-			hasSymbol = true
-		}
-	}
+	return PasswordRules.Validate(password, "")
+}
 
-	if !hasMinLen {
-		errorMessages = append(errorMessages, "at least 8 characters")
-	}
-	if !hasUpper {
-		errorMessages = append(errorMessages, "at least one uppercase letter")
-	}
-	if !hasLower {
-		errorMessages = append(errorMessages, "at least one lowercase letter")
+// IsValidRoleName checks that a role name is 2-30 letters, numbers, spaces,
+// underscores or hyphens and starts with a letter.
+func IsValidRoleName(name string) (bool, string) {
+	if len(name) < 2 || len(name) > 30 {
+		return false, "Role name must be 2-30 characters long."
 	}
-	if !hasNumber {
-		errorMessages = append(errorMessages, "at least one number")
+	if matched, _ := regexp.MatchString("^[A-Za-z][0-9A-Za-z _-]*$", name); !matched {
+		return false, "Role name must start with a letter and can only contain letters, numbers, spaces, underscores (_), or hyphens (-)."
 	}
-	if !hasSymbol {
-		errorMessages = append(errorMessages, "at least one special character")
-	}
-
-	if len(errorMessages) > 0 {
-		return false, fmt.Sprintf("Password must contain %s.", strings.Join(errorMessages, ", "))
-	}
-
 	return true, ""
-} 
\ No newline at end of file
+}